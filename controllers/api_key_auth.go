@@ -0,0 +1,165 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asm-products/firesize/models"
+)
+
+type apiKeyContextKey struct{}
+type bearerTokenContextKey struct{}
+
+// ApiKeyAuth is negroni middleware requiring an API key, in the X-Api-Key
+// header or a key query param for <img> tags, on requests that fetch a
+// source image once any keys are configured. It enforces each key's
+// allowed domains and rate limit, the handler applies its defaults.
+// A bearer token, in the Authorization header or an access_token query
+// param, can be used instead and is held to the limits in its claims
+type ApiKeyAuth struct {
+}
+
+func NewApiKeyAuth() *ApiKeyAuth {
+	return &ApiKeyAuth{}
+}
+
+func (m *ApiKeyAuth) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	source, ok := requestSource(r)
+	if !ok || !(models.ApiKeysRequired() || models.BearerTokensRequired()) {
+		next(w, r)
+		return
+	}
+
+	if token := requestBearerToken(r); token != "" && models.BearerTokensRequired() {
+		bearer, err := models.ParseBearerToken(token)
+		if err != nil {
+			http.Error(w, "Invalid bearer token", http.StatusUnauthorized)
+			return
+		}
+		if source != "" && !bearer.AllowsSource(source) {
+			http.Error(w, "Source not allowed for this token", http.StatusForbidden)
+			return
+		}
+		if !bearer.AllowsArgs(requestArgs(r)) {
+			http.Error(w, "Operation not allowed for this token", http.StatusForbidden)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), bearerTokenContextKey{}, bearer)))
+		return
+	}
+
+	key := r.Header.Get("X-Api-Key")
+	if key == "" {
+		key = r.URL.Query().Get("key")
+	}
+	if !models.ApiKeysRequired() {
+		http.Error(w, "Bearer token required", http.StatusUnauthorized)
+		return
+	}
+	apiKey := models.FindApiKey(key)
+	if apiKey == nil {
+		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+		return
+	}
+	if source != "" && !apiKey.AllowsSource(source) {
+		http.Error(w, "Source not allowed for this API key", http.StatusForbidden)
+		return
+	}
+	if !apiKey.Allow(time.Now()) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+		return
+	}
+
+	next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+}
+
+// requestSource returns the source image url of requests that fetch one,
+// from the path for transforms and /info style endpoints or ?url= for
+// /hash. Uploads, inline data: and local sources count as fetching one,
+// with an empty url as no host restrictions apply
+func requestSource(r *http.Request) (string, bool) {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return "", false
+	}
+	if i := sourceIndex(r.URL.Path); i >= 0 {
+		source := r.URL.Path[i+1:]
+		if strings.HasPrefix(source, "data:") || strings.HasPrefix(source, "local/") {
+			return "", true
+		}
+		return source, true
+	}
+	if r.URL.Path == "/hash" {
+		return r.URL.Query().Get("url"), true
+	}
+	if r.URL.Path == "/process" || r.URL.Query().Get("b64src") != "" {
+		return "", true
+	}
+	return "", false
+}
+
+// requestArgs returns the url segments before the source of requests
+// that fetch one
+func requestArgs(r *http.Request) []string {
+	if r.URL.Path == "/process" {
+		return uploadArgs(r)
+	}
+	i := sourceIndex(r.URL.Path)
+	if i < 0 && r.URL.Query().Get("b64src") != "" {
+		i = len(r.URL.Path)
+	}
+	if i <= 0 {
+		return nil
+	}
+	return strings.Split(strings.Trim(r.URL.Path[:i], "/"), "/")
+}
+
+// sourceIndex is where the source starts in a transform path, at the
+// first /http, /data:, /local/, object storage or (s)ftp segment, or -1 if
+// it has none
+func sourceIndex(path string) int {
+	i := -1
+	for _, prefix := range []string{"/http", "/data:", "/local/", "/s3://", "/gs://", "/azblob://", "/sftp://", "/ftp://"} {
+		if j := strings.Index(path, prefix); j >= 0 && (i < 0 || j < i) {
+			i = j
+		}
+	}
+	return i
+}
+
+// requestBearerToken returns the token from an Authorization: Bearer
+// header or an access_token query param
+func requestBearerToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// requestApiKey is the key ApiKeyAuth authenticated the request with, or
+// nil
+func requestApiKey(r *http.Request) *models.ApiKey {
+	apiKey, _ := r.Context().Value(apiKeyContextKey{}).(*models.ApiKey)
+	return apiKey
+}
+
+// requestIdentity is the name of the API key or the subject of the token
+// ApiKeyAuth authenticated the request with, or ""
+func requestIdentity(r *http.Request) string {
+	if apiKey := requestApiKey(r); apiKey != nil {
+		return apiKey.Name
+	}
+	if bearer := requestBearer(r); bearer != nil {
+		return bearer.Subject
+	}
+	return ""
+}
+
+// requestBearer is the token ApiKeyAuth authenticated the request with,
+// or nil
+func requestBearer(r *http.Request) *models.BearerToken {
+	bearer, _ := r.Context().Value(bearerTokenContextKey{}).(*models.BearerToken)
+	return bearer
+}
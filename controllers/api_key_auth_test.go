@@ -0,0 +1,124 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestApiKeyAuth(t *testing.T) {
+	err := models.LoadApiKeys(`[{"key": "team-a", "allowed_domains": "*.example.com", "rate_limit": 2}]`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer models.LoadApiKeys("", "")
+
+	m := NewApiKeyAuth()
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if requestApiKey(r) == nil && r.URL.Path != "/api/jobs" {
+			t.Fatal("Expected the key on the request context")
+		}
+	}
+	get := func(url string) int {
+		r, _ := http.NewRequest("GET", url, nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, handler)
+		return w.Code
+	}
+
+	cases := []struct {
+		url    string
+		status int
+	}{
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg", http.StatusUnauthorized},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg?key=nope", http.StatusUnauthorized},
+		{"http://firesize.dev/128x/http://img.example.org/cat.jpg?key=team-a", http.StatusForbidden},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg?key=team-a", http.StatusOK},
+		{"http://firesize.dev/hash?url=http://img.example.com/cat.jpg&key=team-a", http.StatusOK},
+		{"http://firesize.dev/info/http://img.example.com/cat.jpg?key=team-a", http.StatusTooManyRequests},
+		{"http://firesize.dev/api/jobs", http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := get(c.url); status != c.status {
+			t.Fatal("Expected ", c.status, " for ", c.url, ", got ", status)
+		}
+	}
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	models.BearerSecret = []byte("shh")
+	defer func() { models.BearerSecret = nil }()
+
+	sign := func(claims map[string]interface{}) string {
+		token := jwt.New(jwt.GetSigningMethod("HS256"))
+		token.Claims = claims
+		signed, _ := token.SignedString(models.BearerSecret)
+		return signed
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	restricted := sign(map[string]interface{}{"exp": exp, "ops": []string{"resize", "format"}, "sources": []string{"*.example.com"}})
+	unrestricted := sign(map[string]interface{}{"exp": exp})
+	expired := sign(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})
+	noExpiry := sign(map[string]interface{}{})
+
+	m := NewApiKeyAuth()
+	get := func(url string, token string) int {
+		r, _ := http.NewRequest("GET", url, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, func(w http.ResponseWriter, r *http.Request) {})
+		return w.Code
+	}
+
+	cases := []struct {
+		url    string
+		token  string
+		status int
+	}{
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg", "", http.StatusUnauthorized},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg", expired, http.StatusUnauthorized},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg", noExpiry, http.StatusUnauthorized},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg", restricted, http.StatusOK},
+		{"http://firesize.dev/128x/png/http://img.example.com/cat.jpg", restricted, http.StatusOK},
+		{"http://firesize.dev/128x/flip/http://img.example.com/cat.jpg", restricted, http.StatusForbidden},
+		{"http://firesize.dev/128x/http://img.example.org/cat.jpg", restricted, http.StatusForbidden},
+		{"http://firesize.dev/128x/flip/http://img.example.org/cat.jpg", unrestricted, http.StatusOK},
+		{"http://firesize.dev/128x/http://img.example.com/cat.jpg?access_token=" + restricted, "", http.StatusOK},
+	}
+	for _, c := range cases {
+		if status := get(c.url, c.token); status != c.status {
+			t.Fatal("Expected ", c.status, " for ", c.url, ", got ", status)
+		}
+	}
+}
+
+func TestRequestSource(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/128x/http://example.com/cat.jpg":            "http://example.com/cat.jpg",
+		"/128x/http://example.com/data:cat.jpg":       "http://example.com/data:cat.jpg",
+		"/128x/data:image/gif;base64,aHR0cA/http/xyz": "",
+		"/128x/?b64src=R0lGODlh":                      "",
+		"/128x/local/products/http.jpg":               "",
+		"/128x/http://example.com/local/cat.jpg":      "http://example.com/local/cat.jpg",
+		"/128x/s3://originals/http/cat.jpg":           "s3://originals/http/cat.jpg",
+		"/128x/gs://originals/cat.jpg":                "gs://originals/cat.jpg",
+		"/128x/azblob://originals/cat.jpg":            "azblob://originals/cat.jpg",
+		"/128x/sftp://files.example.com/cat.jpg":      "sftp://files.example.com/cat.jpg",
+		"/128x/ftp://files.example.com/cat.jpg":       "ftp://files.example.com/cat.jpg",
+	} {
+		r, _ := http.NewRequest("GET", "http://firesize.dev"+path, nil)
+		source, ok := requestSource(r)
+		if !ok || source != expected {
+			t.Fatal("Expected ", expected, " as the source of ", path, ", got ", source)
+		}
+		if args := requestArgs(r); len(args) != 1 || args[0] != "128x" {
+			t.Fatal("Expected 128x as the args of ", path, ", got ", args)
+		}
+	}
+}
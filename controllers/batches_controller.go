@@ -0,0 +1,78 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/technoweenie/grohl"
+	"github.com/whatupdave/mux"
+)
+
+type BatchesController struct {
+}
+
+func (c *BatchesController) Init(r *mux.Router) {
+	r.HandleFunc("/api/batches", c.Create).Methods("POST")
+}
+
+type BatchParams struct {
+	Url      string     `json:"url"`
+	Variants [][]string `json:"variants"`
+	Archive  string     `json:"archive"`
+}
+
+// Create generates every variant of one source image and streams them
+// back as a single zip or tar archive
+func (c *BatchesController) Create(rw http.ResponseWriter, r *http.Request) {
+	w := &trackingResponseWriter{ResponseWriter: rw}
+
+	account := models.FindAccountByJwt(r.Header.Get("Authorization"))
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var p BatchParams
+	err := decoder.Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Url == "" || len(p.Variants) == 0 {
+		http.Error(w, "Missing url or variants", http.StatusBadRequest)
+		return
+	}
+	for _, variant := range p.Variants {
+		if op := models.DisabledOperation(variant, account.Subdomain); op != "" {
+			http.Error(w, "Operation "+op+" is not enabled", http.StatusForbidden)
+			return
+		}
+	}
+	if p.Archive == "" {
+		p.Archive = "zip"
+	}
+	contentType, ok := models.ArchiveFormats[p.Archive]
+	if !ok {
+		http.Error(w, "Unknown archive format", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="variants.`+p.Archive+`"`)
+
+	err = models.WriteBatchArchive(w, p.Archive, p.Url, p.Variants)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error":    err.Error(),
+			"url":      p.Url,
+			"variants": p.Variants,
+		})
+		// once the archive has started streaming all we can do is stop
+		if w.size == 0 {
+			w.Header().Del("Content-Disposition")
+			http.Error(w, "Could not process batch", http.StatusUnprocessableEntity)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/whatupdave/mux"
+)
+
+type CachePurgesController struct {
+}
+
+func (c *CachePurgesController) Init(r *mux.Router) {
+	r.HandleFunc("/api/admin/cache_purges", c.Create).Methods("POST")
+}
+
+// Create drops cached derivatives by key, source url, prefix or pattern
+// from every cache, for when an origin image is replaced or taken down
+func (c *CachePurgesController) Create(w http.ResponseWriter, r *http.Request) {
+	if !models.AdminAuthorized(r.Header.Get("Authorization")) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var p models.CachePurge
+	err := decoder.Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := models.PurgeCache(r.Context(), &p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := http.StatusOK
+	if len(result.Errors) > 0 {
+		status = http.StatusBadGateway
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Cors is negroni middleware adding CORS headers for the configured
+// origins so canvas based front ends can read processed pixels cross
+// origin. Origins may be *, exact origins or globs like
+// https://*.example.com. Preflight requests are answered here, before
+// they reach authentication
+type Cors struct {
+	origins []string
+	methods string
+	headers string
+	maxAge  int
+}
+
+var defaultCorsMethods = "GET, HEAD"
+var defaultCorsHeaders = "Authorization, X-Api-Key"
+
+func NewCors(origins string, methods string, headers string, maxAge int) *Cors {
+	m := &Cors{methods: defaultCorsMethods, headers: defaultCorsHeaders, maxAge: maxAge}
+	for _, origin := range strings.Split(origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			m.origins = append(m.origins, origin)
+		}
+	}
+	if methods != "" {
+		m.methods = methods
+	}
+	if headers != "" {
+		m.headers = headers
+	}
+	return m
+}
+
+func (m *Cors) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	if len(m.origins) == 0 {
+		next(w, r)
+		return
+	}
+
+	// responses differ by origin unless every origin gets the same one
+	origin := r.Header.Get("Origin")
+	allowed := m.allowOrigin(origin)
+	if allowed != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+	if origin == "" || allowed == "" {
+		next(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", allowed)
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, X-Firesize-Cache")
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", m.methods)
+		w.Header().Set("Access-Control-Allow-Headers", m.headers)
+		if m.maxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(m.maxAge))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	next(w, r)
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin,
+// or "" if it isn't allowed
+func (m *Cors) allowOrigin(origin string) string {
+	for _, allowed := range m.origins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin == "" {
+			continue
+		}
+		if matched, _ := path.Match(allowed, origin); matched || strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCors(t *testing.T) {
+	m := NewCors("https://app.example.com, https://*.preview.example.com", "", "", 600)
+	handled := false
+	handler := func(w http.ResponseWriter, r *http.Request) { handled = true }
+	request := func(method string, origin string) *httptest.ResponseRecorder {
+		handled = false
+		r, _ := http.NewRequest(method, "http://firesize.dev/128x/http://img.example.com/cat.jpg", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, handler)
+		return w
+	}
+
+	w := request("GET", "https://app.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" || !handled {
+		t.Fatal("Expected an allowed origin to be echoed back")
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Fatal("Expected responses to vary by origin")
+	}
+
+	w = request("GET", "https://pr-12.preview.example.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://pr-12.preview.example.com" {
+		t.Fatal("Expected a glob to allow matching origins")
+	}
+
+	w = request("GET", "https://evil.com")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" || !handled {
+		t.Fatal("Expected other origins to get no CORS headers")
+	}
+
+	w = request("OPTIONS", "https://app.example.com")
+	if w.Code != http.StatusNoContent || handled {
+		t.Fatal("Expected preflights to be answered without the handler, got ", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Methods") != "GET, HEAD" || w.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fatal("Expected preflight headers, got ", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "http://firesize.dev/", nil)
+	r.Header.Set("Origin", "https://anywhere.com")
+	NewCors("*", "", "", 0).ServeHTTP(w, r, handler)
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" || w.Header().Get("Vary") != "" {
+		t.Fatal("Expected * to allow every origin without varying")
+	}
+}
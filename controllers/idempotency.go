@@ -0,0 +1,219 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Idempotency is negroni middleware that makes retried POST requests
+// carrying the same Idempotency-Key header replay the original response
+// instead of running again. Failed (5xx) responses aren't kept so they can
+// be retried, and neither are requests or responses too large to hold in
+// memory, like uploads and images, which run again when retried
+type Idempotency struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	bytes   int
+}
+
+// How large a request body is hashed and a response body kept, and how
+// many responses and bytes are kept in all
+var (
+	idempotencyMaxBody     = 64 * 1024
+	idempotencyMaxResponse = 256 * 1024
+	idempotencyMaxEntries  = 10000
+	idempotencyMaxBytes    = 64 << 20
+)
+
+type idempotentResponse struct {
+	bodyHash [32]byte
+	done     bool
+	status   int
+	header   http.Header
+	body     []byte
+	expires  time.Time
+}
+
+func NewIdempotency(ttl time.Duration) *Idempotency {
+	m := &Idempotency{ttl: ttl, entries: map[string]*idempotentResponse{}}
+	every := ttl / 10
+	if every > time.Minute {
+		every = time.Minute
+	}
+	go func() {
+		for range time.Tick(every) {
+			m.sweep()
+		}
+	}()
+	return m
+}
+
+func (m *Idempotency) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	idempotencyKey := r.Header.Get("Idempotency-Key")
+	if r.Method != "POST" || idempotencyKey == "" {
+		next(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(idempotencyMaxBody)+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > idempotencyMaxBody {
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		next(w, r)
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	bodyHash := sha256.Sum256(body)
+
+	// keys are scoped to the endpoint and credentials they were sent with
+	key := fmt.Sprintf("%s %s %x %s", r.Method, r.URL.Path,
+		sha256.Sum256([]byte(r.Header.Get("Authorization"))), idempotencyKey)
+
+	m.mu.Lock()
+	entry, ok := m.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		ok = false
+	}
+	if !ok && len(m.entries) >= idempotencyMaxEntries {
+		m.sweepLocked()
+	}
+	full := !ok && len(m.entries) >= idempotencyMaxEntries
+	if !ok && !full {
+		entry = &idempotentResponse{bodyHash: bodyHash, expires: time.Now().Add(m.ttl)}
+		m.replace(key, entry)
+	}
+	m.mu.Unlock()
+
+	if full {
+		next(w, r)
+		return
+	}
+
+	if ok {
+		switch {
+		case entry.bodyHash != bodyHash:
+			http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		case !entry.done:
+			http.Error(w, "A request with this Idempotency-Key is in progress", http.StatusConflict)
+		default:
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+		}
+		return
+	}
+
+	// the entry is dropped unless the response is kept, even if next
+	// panics, so retries aren't refused as in progress until it expires
+	kept := false
+	defer func() {
+		if !kept {
+			m.mu.Lock()
+			if m.entries[key] == entry {
+				m.replace(key, nil)
+			}
+			m.mu.Unlock()
+		}
+	}()
+
+	rec := &recordingResponseWriter{ResponseWriter: w, max: idempotencyMaxResponse}
+	next(rec, r)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 500 || rec.overflowed || m.entries[key] != entry {
+		return
+	}
+	if m.bytes+rec.body.Len() > idempotencyMaxBytes {
+		m.sweepLocked()
+		if m.bytes+rec.body.Len() > idempotencyMaxBytes {
+			return
+		}
+	}
+	kept = true
+	entry.done = true
+	entry.status = rec.status
+	entry.header = w.Header()
+	entry.body = rec.body.Bytes()
+	m.bytes += len(entry.body)
+}
+
+// replace sets the entry for key, or removes it when entry is nil,
+// keeping count of the bytes held. m.mu must be held
+func (m *Idempotency) replace(key string, entry *idempotentResponse) {
+	if old, ok := m.entries[key]; ok {
+		m.bytes -= len(old.body)
+		delete(m.entries, key)
+	}
+	if entry != nil {
+		m.entries[key] = entry
+		m.bytes += len(entry.body)
+	}
+}
+
+func (m *Idempotency) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sweepLocked()
+}
+
+func (m *Idempotency) sweepLocked() {
+	now := time.Now()
+	for key, entry := range m.entries {
+		if now.After(entry.expires) {
+			m.replace(key, nil)
+		}
+	}
+}
+
+// readCloser reads from Reader and closes Closer
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// recordingResponseWriter keeps a copy of everything written through it,
+// up to max bytes
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status     int
+	body       bytes.Buffer
+	max        int
+	overflowed bool
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflowed && w.body.Len()+len(b) <= w.max {
+		w.body.Write(b)
+	} else {
+		w.overflowed = true
+		w.body.Reset()
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyReplaysResponses(t *testing.T) {
+	m := NewIdempotency(time.Hour)
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "created %d", calls)
+	}
+
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://firesize.dev/api/things", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, handler)
+		return w
+	}
+
+	first := post("abc", "{}")
+	second := post("abc", "{}")
+	if calls != 1 {
+		t.Fatal("Expected the handler to run once, ran ", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != "created 1" {
+		t.Fatal("Expected the first response to be replayed, got ", second.Code, second.Body.String())
+	}
+	if first.Header().Get("Idempotent-Replayed") != "" || second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("Expected only the replay to be marked")
+	}
+
+	if w := post("abc", `{"different":true}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatal("Expected reusing a key with another body to fail, got ", w.Code)
+	}
+
+	post("def", "{}")
+	if calls != 2 {
+		t.Fatal("Expected a new key to run the handler again")
+	}
+}
+
+func TestIdempotencyLimits(t *testing.T) {
+	m := NewIdempotency(time.Hour)
+	calls := 0
+	response := "ok"
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) == "panic" {
+			panic("handler failed")
+		}
+		fmt.Fprint(w, response)
+	}
+	post := func(key string, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://firesize.dev/process", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", key)
+		w := httptest.NewRecorder()
+		func() {
+			defer func() { recover() }()
+			m.ServeHTTP(w, r, handler)
+		}()
+		return w
+	}
+
+	// a panic doesn't leave the key in progress
+	post("panics", "panic")
+	if w := post("panics", "panic"); w.Code == http.StatusConflict || calls != 2 {
+		t.Fatal("Expected a retry after a panic to run again, got ", w.Code)
+	}
+
+	// large uploads pass through whole without being kept
+	upload := strings.Repeat("x", idempotencyMaxBody+1)
+	calls = 0
+	post("upload", upload)
+	post("upload", upload)
+	if calls != 2 || len(m.entries) != 0 {
+		t.Fatal("Expected large requests to run every time, ran ", calls)
+	}
+
+	// large responses aren't kept
+	response = strings.Repeat("x", idempotencyMaxResponse+1)
+	calls = 0
+	if w := post("image", "{}"); w.Body.Len() != len(response) {
+		t.Fatal("Expected the whole response to be sent, got ", w.Body.Len())
+	}
+	post("image", "{}")
+	if calls != 2 || len(m.entries) != 0 {
+		t.Fatal("Expected large responses to run every time, ran ", calls)
+	}
+
+	// once full, new keys aren't kept until expired ones are swept
+	defer func(max int) { idempotencyMaxEntries = max }(idempotencyMaxEntries)
+	idempotencyMaxEntries = 1
+	response = "ok"
+	post("first", "{}")
+	calls = 0
+	post("second", "{}")
+	post("second", "{}")
+	if calls != 2 || len(m.entries) != 1 {
+		t.Fatal("Expected keys past the limit not to be kept")
+	}
+	m.entries[fmt.Sprintf("POST /process %x first", sha256.Sum256(nil))].expires = time.Now()
+	post("third", "{}")
+	if len(m.entries) != 1 || m.bytes != 2 {
+		t.Fatal("Expected expired keys to make room, got ", len(m.entries), m.bytes)
+	}
+}
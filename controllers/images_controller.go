@@ -1,8 +1,17 @@
 package controllers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/asm-products/firesize/models"
 	"github.com/technoweenie/grohl"
@@ -12,32 +21,435 @@ import (
 type ImagesController struct {
 }
 
+// statusClientClosedRequest is reported for requests abandoned by the
+// client before a response could be sent, as nginx does
+const statusClientClosedRequest = 499
+
 func (c *ImagesController) Init(r *mux.Router) {
-	r.HandleFunc("/{args:.*?}http{path:.*}", c.Get)
+	r.HandleFunc("/cas/{name:[0-9a-f]{64}\\.[a-z0-9]+}", c.Content)
+	r.HandleFunc("/info/http{path:.*}", signedSource(c.Info)).Methods("GET")
+	r.HandleFunc("/palette/http{path:.*}", signedSource(c.Palette)).Methods("GET")
+	r.HandleFunc("/blurhash/http{path:.*}", signedSource(c.BlurHash)).Methods("GET")
+	r.HandleFunc("/icons/http{path:.*}", signedSource(c.Icons)).Methods("GET")
+	r.HandleFunc("/hash", signedSource(c.Hash)).Methods("GET")
+	r.HandleFunc("/process", c.Upload).Methods("POST")
+	get := signedSource(c.Get)
+	r.HandleFunc("/{args:.*?}data:{data:.*}", get).MatcherFunc(sourceFirst("data:"))
+	r.HandleFunc("/{args:.*?}local/{local:.*}", get).MatcherFunc(sourceFirst("local/"))
+	r.HandleFunc("/{args:.*?}s3://{s3:.*}", get).MatcherFunc(sourceFirst("s3://"))
+	r.HandleFunc("/{args:.*?}gs://{gs:.*}", get).MatcherFunc(sourceFirst("gs://"))
+	r.HandleFunc("/{args:.*?}azblob://{azblob:.*}", get).MatcherFunc(sourceFirst("azblob://"))
+	r.HandleFunc("/{args:.*?}sftp://{sftp:.*}", get).MatcherFunc(sourceFirst("sftp://"))
+	r.HandleFunc("/{args:.*?}ftp://{ftp:.*}", get).MatcherFunc(sourceFirst("ftp://"))
+	r.HandleFunc("/{args:.*?}http{path:.*}", get)
+	r.HandleFunc("/{args:.*}", get).Queries("b64src", "")
 }
 
-// TODO: Pass through requests without an account subdomain
-func (c *ImagesController) Get(w http.ResponseWriter, r *http.Request) {
+// signedSource wraps every route that fetches a source by url, so none of
+// them can be used unsigned while a signing key is set. Transforms carry
+// their signature in the args, which it removes, the rest an s= query
+// param. Uploads need an authenticated request instead
+func signedSource(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if models.SigningRequired() {
+			vars := mux.Vars(r)
+			var err error
+			if args, ok := vars["args"]; ok {
+				vars["args"], err = models.VerifySignedArgs(args, transformSource(r))
+			} else {
+				err = models.VerifySignedQuery(r.URL.Path, r.URL.Query())
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// sourceFirst matches transforms whose source starts with prefix, so
+// inline data:, local and object storage sources, which may well include
+// "http", aren't taken for http ones and vice versa
+func sourceFirst(prefix string) mux.MatcherFunc {
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		i := sourceIndex(r.URL.Path)
+		return i >= 0 && strings.HasPrefix(r.URL.Path[i+1:], prefix)
+	}
+}
+
+// Info describes a source image as JSON without producing an image
+func (c *ImagesController) Info(w http.ResponseWriter, r *http.Request) {
+	url := "http" + mux.Vars(r)["path"]
+
+	info, err := models.FetchImageInfo(url)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error": err.Error(),
+			"url":   url,
+		})
+		http.Error(w, "Could not identify image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.Header().Set("X-Firesize-Width", strconv.Itoa(info.Width))
+	w.Header().Set("X-Firesize-Height", strconv.Itoa(info.Height))
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(info)
+}
+
+// Palette returns the dominant color and a small palette of the source
+// image, handy as a placeholder background while the image loads
+func (c *ImagesController) Palette(w http.ResponseWriter, r *http.Request) {
+	url := "http" + mux.Vars(r)["path"]
+
+	colors := 5
+	if n, err := strconv.Atoi(r.URL.Query().Get("colors")); err == nil && n > 0 && n <= 16 {
+		colors = n
+	}
+
+	palette, err := models.FetchImagePalette(url, colors)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error": err.Error(),
+			"url":   url,
+		})
+		http.Error(w, "Could not extract palette", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(palette)
+}
+
+// BlurHash returns a https://blurha.sh placeholder for the source image.
+// ?x= and ?y= set the number of components, 4 by 3 by default
+func (c *ImagesController) BlurHash(w http.ResponseWriter, r *http.Request) {
+	url := "http" + mux.Vars(r)["path"]
+
+	x, y := 4, 3
+	if n, err := strconv.Atoi(r.URL.Query().Get("x")); err == nil && n >= 1 && n <= 9 {
+		x = n
+	}
+	if n, err := strconv.Atoi(r.URL.Query().Get("y")); err == nil && n >= 1 && n <= 9 {
+		y = n
+	}
+
+	hash, err := models.FetchBlurHash(url, x, y)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error": err.Error(),
+			"url":   url,
+		})
+		http.Error(w, "Could not encode image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, Response{"blurhash": hash})
+}
+
+// Icons returns a zip of the web app icon set generated from the source
+// image along with the html to reference them
+func (c *ImagesController) Icons(w http.ResponseWriter, r *http.Request) {
+	// icons are too small to carry the watermark, so they're only for
+	// callers who'd be served clean images anyway
+	if models.WatermarkFile != "" && !authenticated(r) {
+		http.Error(w, "icons need a signed or authenticated request", http.StatusForbidden)
+		return
+	}
+	url := "http" + mux.Vars(r)["path"]
+
+	var bundle bytes.Buffer
+	err := models.WriteIconBundle(&bundle, url)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error": err.Error(),
+			"url":   url,
+		})
+		http.Error(w, "Could not generate icons", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="icons.zip"`)
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.WriteHeader(http.StatusOK)
+	bundle.WriteTo(w)
+}
+
+// Hash returns perceptual hashes of the image at ?url= so near identical
+// uploads can be found by comparing hamming distances
+func (c *ImagesController) Hash(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		http.Error(w, "Missing url", http.StatusBadRequest)
+		return
+	}
+
+	hashes, err := models.FetchImageHashes(url)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error": err.Error(),
+			"url":   url,
+		})
+		http.Error(w, "Could not hash image", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(hashes)
+}
+
+// Content serves a stored result by the hash of its contents. These urls
+// never change what they point at so can be cached forever
+func (c *ImagesController) Content(w http.ResponseWriter, r *http.Request) {
+	if models.Contents == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	path := models.Contents.ObjectPath(mux.Vars(r)["name"])
+	if _, err := os.Stat(path); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+strings.SplitN(mux.Vars(r)["name"], ".", 2)[0]+`"`)
+	http.ServeFile(w, r, path)
+}
+
+// Upload processes the image in the request body with the args in ?args=
+// or an X-Firesize-Args header, written as in transform urls, for images
+// that can't be fetched from a url. multipart/form-data bodies send the
+// image in a file field and can give args as form fields instead
+func (c *ImagesController) Upload(w http.ResponseWriter, r *http.Request) {
+	if models.SigningRequired() && requestApiKey(r) == nil && requestBearer(r) == nil {
+		http.Error(w, "uploads need an authenticated request", http.StatusForbidden)
+		return
+	}
+
+	body, contentType := io.Reader(r.Body), r.Header.Get("Content-Type")
+	if isMultipartUpload(r) {
+		err := parseUploadForm(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Upload is too large", http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Missing file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		body, contentType = file, header.Header.Get("Content-Type")
+	}
+
 	subdomain := strings.Split(r.Host, ".")[0]
-	models.CreateImageRequestForSubdomain(subdomain, r.RequestURI)
+	processArgs := requestProcessArgs(w, r, uploadArgs(r), "", subdomain)
+	if processArgs == nil {
+		return
+	}
+	if !processArgs.HasOperations() {
+		http.Error(w, "Nothing to do", http.StatusBadRequest)
+		return
+	}
 
-	vars := mux.Vars(r)
+	err := new(models.IMagick).ProcessUpload(w, r, body, contentType, processArgs)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"error":  err.Error(),
+			"upload": true,
+		})
+		var statusErr *models.StatusError
+		if errors.As(err, &statusErr) {
+			writeStatusError(w, statusErr)
+		} else if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			writeDeadlineExceeded(w)
+		} else if !errors.Is(err, context.Canceled) {
+			http.Error(w, "Processing failed", http.StatusInternalServerError)
+		}
+	}
+}
+
+// uploadFormFields are the form fields multipart uploads can give args
+// in, besides args itself, and the url segment each one stands for
+var uploadFormFields = map[string]string{
+	"width":   "w_",
+	"height":  "h_",
+	"format":  "",
+	"quality": "q_",
+	"fit":     "fit_",
+	"gravity": "g_",
+}
+
+// uploadFormMemory is how much of a multipart upload is held in memory,
+// the rest is spooled to disk
+const uploadFormMemory = 1 << 20
+
+// uploadFormOverhead allows for the form fields and part headers of a
+// multipart upload on top of the file
+const uploadFormOverhead = 64 * 1024
+
+// uploadArgs returns the args of an upload as url segments
+func uploadArgs(r *http.Request) []string {
+	args := r.URL.Query().Get("args")
+	if args == "" {
+		args = r.Header.Get("X-Firesize-Args")
+	}
+	if args != "" || !isMultipartUpload(r) || parseUploadForm(r) != nil {
+		return strings.Split(strings.Trim(args, "/"), "/")
+	}
+
+	form := r.MultipartForm.Value
+	var segments []string
+	if values := form["args"]; len(values) > 0 {
+		segments = strings.Split(strings.Trim(values[0], "/"), "/")
+	}
+	for field, prefix := range uploadFormFields {
+		if values := form[field]; len(values) > 0 && values[0] != "" {
+			segments = append(segments, prefix+values[0])
+		}
+	}
+	return segments
+}
+
+func isMultipartUpload(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+}
+
+// parseUploadForm reads a multipart upload, only once however many times
+// it's called, so ApiKeyAuth can check its args before the handler runs
+func parseUploadForm(r *http.Request) error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	if models.MaxSourceBytes > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, models.MaxSourceBytes+uploadFormOverhead)
+	}
+	return r.ParseMultipartForm(uploadFormMemory)
+}
 
+// transformSource returns the source url of a transform request
+func transformSource(r *http.Request) string {
+	vars := mux.Vars(r)
 	url := "http" + vars["path"]
-	args := strings.Split(vars["args"], "/")
-	processArgs := models.NewProcessArgs(args, url)
+	if data, ok := vars["data"]; ok {
+		url = "data:" + data
+	} else if local, ok := vars["local"]; ok {
+		url = models.LocalSourceUrl(local)
+	} else if object, ok := vars["s3"]; ok {
+		url = "s3://" + object
+	} else if object, ok := vars["gs"]; ok {
+		url = "gs://" + object
+	} else if blob, ok := vars["azblob"]; ok {
+		url = "azblob://" + blob
+	} else if file, ok := vars["sftp"]; ok {
+		url = "sftp://" + file
+	} else if file, ok := vars["ftp"]; ok {
+		url = "ftp://" + file
+	} else if _, ok := vars["path"]; !ok {
+		url = models.DataUriFromBase64(r.URL.Query().Get("b64src"))
+	}
+	return url
+}
+
+// TODO: Pass through requests without an account subdomain
+func (c *ImagesController) Get(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	w := &trackingResponseWriter{ResponseWriter: rw}
 
+	vars := mux.Vars(r)
+	url := transformSource(r)
+
+	subdomain := strings.Split(r.Host, ".")[0]
+	models.CreateImageRequestForSubdomain(subdomain, r.RequestURI)
+
+	args := strings.Split(vars["args"], "/")
+	processArgs := requestProcessArgs(w, r, args, url, subdomain)
+	if processArgs == nil {
+		return
+	}
 	processor := &models.IMagick{}
+	sendTimingTrailer := trackServerTiming(w, processArgs, start)
 
-	w.Header().Set("Cache-Control", "public, max-age=864000")
+	w.Header().Set("Cache-Control", models.CacheControl)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Add("Vary", "Save-Data")
+	if len(models.RegionPresets) > 0 {
+		w.Header().Add("Vary", models.RegionHeader)
+	}
+	w.Header().Set("Accept-CH", models.AcceptClientHints)
+	if models.WatermarkFile != "" {
+		w.Header().Add("Vary", "Authorization, X-Api-Key")
+	}
+	if processArgs.AutoWidth {
+		w.Header().Add("Vary", models.VaryClientHints)
+	}
+	models.SetSurrogateKeyHeaders(w.Header(), models.SurrogateKeys(subdomain, vars["args"], url))
 
 	err := processor.Process(w, r, processArgs)
+	err = models.ServeOverLimit(w, r, processArgs, err)
+	if err == nil {
+		sendTimingTrailer()
+	}
+
+	status := w.status
+	var statusErr *models.StatusError
+	isStatusErr := errors.As(err, &statusErr)
+	if isStatusErr {
+		status = statusErr.Status
+	} else if errors.Is(err, context.Canceled) {
+		status = statusClientClosedRequest
+	} else if err != nil && errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		status = http.StatusGatewayTimeout
+	} else if err != nil {
+		status = http.StatusInternalServerError
+	}
+	models.PublishTransformEvent(&models.TransformEvent{
+		Account:     subdomain,
+		Source:      url,
+		Ops:         args,
+		Bytes:       w.size,
+		DurationMs:  int64(time.Since(start) / time.Millisecond),
+		CacheStatus: w.Header().Get("X-Firesize-Cache"),
+		Status:      status,
+		CompletedAt: time.Now(),
+	})
+
 	if err != nil {
 		grohl.Log(grohl.Data{
 			"error": err.Error(),
 			"parts": args,
 			"url":   url,
 		})
+		if isStatusErr {
+			writeStatusError(w, statusErr)
+			return
+		}
+		if status == statusClientClosedRequest {
+			// nobody is left to send a response to
+			return
+		}
+		if status == http.StatusGatewayTimeout {
+			writeDeadlineExceeded(w)
+			return
+		}
 		panic("processing failed")
 	}
 
@@ -47,3 +459,111 @@ func (c *ImagesController) Get(w http.ResponseWriter, r *http.Request) {
 		"headers": r.Header,
 	})
 }
+
+// requestProcessArgs builds the args for processing a request, applying
+// its headers and the defaults of its API key. It returns nil once it has
+// responded to requests for operations they can't use
+func requestProcessArgs(w http.ResponseWriter, r *http.Request, args []string, url string, subdomain string) *models.ProcessArgs {
+	tenants := []string{subdomain}
+	if apiKey := requestApiKey(r); apiKey != nil {
+		tenants = append(tenants, apiKey.Name)
+	}
+	if op := models.DisabledOperation(args, tenants...); op != "" {
+		http.Error(w, "Operation "+op+" is not enabled", http.StatusForbidden)
+		return nil
+	}
+
+	processArgs := models.NewProcessArgs(args, url)
+	if len(processArgs.Raw) > 0 {
+		// raw flags are only for callers the server knows about
+		if !authenticated(r) {
+			http.Error(w, "raw flags need a signed or authenticated request", http.StatusForbidden)
+			return nil
+		}
+		if err := processArgs.CheckRaw(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+	}
+	if err := processArgs.CheckWasmFilter(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if err := processArgs.CheckEnlarge(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	if processArgs.Push {
+		// pushed objects are kept, so only known callers may make them
+		if models.PushStore == nil {
+			http.Error(w, "No push store configured", http.StatusNotImplemented)
+			return nil
+		}
+		if !authenticated(r) {
+			http.Error(w, "push needs a signed or authenticated request", http.StatusForbidden)
+			return nil
+		}
+		if err := processArgs.CheckPush(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		// the host is the client's to pick, so names are only ever scoped
+		// to who the request was authenticated as
+		processArgs.Account = requestIdentity(r)
+		if processArgs.PushName != "" && processArgs.Account == "" {
+			http.Error(w, "push names need an API key or bearer token", http.StatusForbidden)
+			return nil
+		}
+	}
+	processArgs.ApplyWatermarkPolicy(authenticated(r))
+	processArgs.ApplyRegionPreset(r.Header)
+	processArgs.ApplyClientHints(r.Header)
+	processArgs.ApplySaveData(r.Header)
+	if apiKey := requestApiKey(r); apiKey != nil {
+		apiKey.ApplyDefaults(processArgs)
+	}
+	if processArgs.Encoding == "" {
+		accept := r.Header.Get("Accept")
+		if strings.Contains(accept, "application/json") {
+			processArgs.Encoding = "base64"
+		} else if strings.Contains(accept, "multipart/mixed") {
+			processArgs.Encoding = "multipart"
+		}
+	}
+	processArgs.Context = r.Context()
+	return processArgs
+}
+
+// authenticated is true for requests the server knows the caller of: ones
+// with a valid signature, API key or bearer token
+func authenticated(r *http.Request) bool {
+	return models.SigningRequired() || requestApiKey(r) != nil || requestBearer(r) != nil
+}
+
+// writeDeadlineExceeded reports a request that ran out of the time its
+// caller gave it
+func writeDeadlineExceeded(w http.ResponseWriter) {
+	w.Header().Del("Surrogate-Control")
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+}
+
+// writeStatusError reports a processing failure, as JSON when it has a
+// code clients can act on
+func writeStatusError(w http.ResponseWriter, statusErr *models.StatusError) {
+	// leave errors to Cache-Control rather than the CDN keeping them
+	w.Header().Del("Surrogate-Control")
+	if statusErr.Code == "" {
+		http.Error(w, statusErr.Message, statusErr.Status)
+		return
+	}
+
+	body := Response{"error": statusErr.Code, "message": statusErr.Message}
+	for name, value := range statusErr.Details {
+		body[name] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(statusErr.Status)
+	fmt.Fprint(w, body)
+}
@@ -1,8 +1,13 @@
 package controllers
 
 import (
+	"bytes"
+	"context"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -47,3 +52,154 @@ func TestRecordingImageRequests(t *testing.T) {
 		t.Fatal("Incorrect image request count. Expected: 1, Received: ", count)
 	}
 }
+
+func TestUploadRefusesDocuments(t *testing.T) {
+	router := mux.NewRouter()
+	new(ImagesController).Init(router)
+
+	body := strings.NewReader("<!DOCTYPE html><html><body>Not found</body></html>")
+	request, _ := http.NewRequest("POST", "http://testing.firesize.dev/process?args=128x", body)
+	request.Header.Set("Content-Type", "text/html")
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "html_source") {
+		t.Fatal("Expected html uploads to be refused, got ", recorder.Code, recorder.Body.String())
+	}
+
+	request, _ = http.NewRequest("POST", "http://testing.firesize.dev/process", strings.NewReader("GIF89a"))
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatal("Expected uploads without args to be refused, got ", recorder.Code)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	router := mux.NewRouter()
+	new(ImagesController).Init(router)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("width", "128")
+	form.WriteField("format", "png")
+	file, _ := form.CreateFormFile("file", "page.html")
+	file.Write([]byte("<!DOCTYPE html><html><body>Not found</body></html>"))
+	form.Close()
+
+	request, _ := http.NewRequest("POST", "http://testing.firesize.dev/process", bytes.NewReader(body.Bytes()))
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	args := uploadArgs(request)
+	sort.Strings(args)
+	if strings.Join(args, "/") != "png/w_128" {
+		t.Fatal("Expected args from the form fields, got ", args)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnprocessableEntity || !strings.Contains(recorder.Body.String(), "html_source") {
+		t.Fatal("Expected the uploaded file to be checked, got ", recorder.Code, recorder.Body.String())
+	}
+
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	form.WriteField("args", "128x")
+	form.Close()
+	request, _ = http.NewRequest("POST", "http://testing.firesize.dev/process", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest || recorder.Body.String() != "Missing file\n" {
+		t.Fatal("Expected uploads without a file to be refused, got ", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestSourceRoutesNeedSignatures(t *testing.T) {
+	models.SigningKey = "secret"
+	defer func() { models.SigningKey = "" }()
+	router := mux.NewRouter()
+	router.SkipClean(true)
+	new(ImagesController).Init(router)
+
+	for _, path := range []string{
+		"/128x/http://example.com/cat.jpg",
+		"/info/http://example.com/cat.jpg",
+		"/palette/http://example.com/cat.jpg",
+		"/blurhash/http://example.com/cat.jpg",
+		"/icons/http://example.com/cat.jpg",
+		"/hash?url=http://example.com/cat.jpg",
+		"/info/http://example.com/cat.jpg?s=" + models.SignPath("/info/http://example.com/dog.jpg"),
+	} {
+		request, _ := http.NewRequest("GET", "http://testing.firesize.dev"+path, nil)
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusForbidden {
+			t.Fatal("Expected unsigned ", path, " to be refused, got ", recorder.Code)
+		}
+	}
+
+	request, _ := http.NewRequest("GET", "http://testing.firesize.dev/hash?s="+models.SignPath("/hash"), nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusBadRequest {
+		t.Fatal("Expected a signed request to get through, got ", recorder.Code)
+	}
+}
+
+func TestIconsNeedAuthenticationWithWatermarks(t *testing.T) {
+	models.WatermarkFile = "watermark.png"
+	defer func() { models.WatermarkFile = "" }()
+	router := mux.NewRouter()
+	router.SkipClean(true)
+	new(ImagesController).Init(router)
+
+	request, _ := http.NewRequest("GET", "http://testing.firesize.dev/icons/http://example.com/logo.png", nil)
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatal("Expected unauthenticated icons to be refused, got ", recorder.Code)
+	}
+}
+
+type discardPusher struct{}
+
+func (discardPusher) Push(ctx context.Context, name string, format string, data []byte) error {
+	return nil
+}
+
+func TestPushNeedsStoreAndAuthentication(t *testing.T) {
+	request, _ := http.NewRequest("GET", "http://testing.firesize.dev/push/128x/http://example.com/cat.jpg", nil)
+	args := []string{"push", "128x"}
+	recorder := httptest.NewRecorder()
+	if requestProcessArgs(recorder, request, args, "http://example.com/cat.jpg", "testing") != nil || recorder.Code != http.StatusNotImplemented {
+		t.Fatal("Expected pushes without a push store to be refused, got ", recorder.Code)
+	}
+
+	models.PushStore = discardPusher{}
+	defer func() { models.PushStore = nil }()
+	recorder = httptest.NewRecorder()
+	if requestProcessArgs(recorder, request, args, "http://example.com/cat.jpg", "testing") != nil || recorder.Code != http.StatusForbidden {
+		t.Fatal("Expected unauthenticated pushes to be refused, got ", recorder.Code)
+	}
+}
+
+func TestPushNamesAreScopedToTheAuthenticatedAccount(t *testing.T) {
+	models.PushStore = discardPusher{}
+	defer func() { models.PushStore = nil }()
+	models.SigningKey = "secret"
+	defer func() { models.SigningKey = "" }()
+
+	// signed, but with no account to put its own names under
+	request, _ := http.NewRequest("GET", "http://other.firesize.dev/push_dGh1bWJz/128x/http://example.com/cat.jpg", nil)
+	args := []string{"push_dGh1bWJz", "128x"}
+	recorder := httptest.NewRecorder()
+	if requestProcessArgs(recorder, request, args, "http://example.com/cat.jpg", "other") != nil || recorder.Code != http.StatusForbidden {
+		t.Fatal("Expected push names without an account to be refused, got ", recorder.Code)
+	}
+
+	// the account is the key's, whatever the host says
+	request = request.WithContext(context.WithValue(request.Context(), apiKeyContextKey{}, &models.ApiKey{Name: "acme"}))
+	processArgs := requestProcessArgs(httptest.NewRecorder(), request, args, "http://example.com/cat.jpg", "other")
+	if processArgs == nil || processArgs.Account != "acme" {
+		t.Fatal("Expected pushes to be made for the key's account, got ", processArgs)
+	}
+}
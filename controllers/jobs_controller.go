@@ -0,0 +1,174 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/whatupdave/mux"
+)
+
+type JobsController struct {
+}
+
+func (c *JobsController) Init(r *mux.Router) {
+	r.HandleFunc("/api/jobs", c.Create).Methods("POST")
+	r.HandleFunc("/api/jobs/{id}", c.Show).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/events", c.Events).Methods("GET")
+	r.HandleFunc("/api/jobs/{id}/result", c.Result).Methods("GET")
+}
+
+// Long enough to be useful, short enough to stay under router timeouts
+var maxJobWait = 25 * time.Second
+
+type JobParams struct {
+	Url  string   `json:"url"`
+	Args []string `json:"args"`
+}
+
+// Create queues a job and returns straight away, the client then follows
+// progress through Show or Events
+func (c *JobsController) Create(w http.ResponseWriter, r *http.Request) {
+	account := models.FindAccountByJwt(r.Header.Get("Authorization"))
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var p JobParams
+	err := decoder.Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p.Url == "" {
+		http.Error(w, "Missing url", http.StatusBadRequest)
+		return
+	}
+	if op := models.DisabledOperation(p.Args, account.Subdomain); op != "" {
+		http.Error(w, "Operation "+op+" is not enabled", http.StatusForbidden)
+		return
+	}
+
+	job := models.StartJob(account.Id, p.Url, p.Args)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/jobs/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, Response{"job": job})
+}
+
+// Show returns the job. With ?wait=10s it blocks until the job finishes
+// or the wait runs out, whichever comes first
+func (c *JobsController) Show(w http.ResponseWriter, r *http.Request) {
+	job := findAccountJob(w, r)
+	if job == nil {
+		return
+	}
+
+	if wait := r.URL.Query().Get("wait"); wait != "" {
+		timeout, err := time.ParseDuration(wait)
+		if err != nil {
+			http.Error(w, "Invalid wait: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if timeout > maxJobWait {
+			timeout = maxJobWait
+		}
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-job.Done():
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, Response{"job": job})
+}
+
+// Events streams progress as server-sent events until the job finishes.
+// EventSource can't set headers so the token may be passed as ?token=
+func (c *JobsController) Events(w http.ResponseWriter, r *http.Request) {
+	job := findAccountJob(w, r)
+	if job == nil {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusNotImplemented)
+		return
+	}
+
+	events, unsubscribe := job.Subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	writeEvent(w, "progress", job.Snapshot())
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			writeEvent(w, "progress", event)
+			flusher.Flush()
+		case <-job.Done():
+			writeEvent(w, "done", job.Snapshot())
+			flusher.Flush()
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Result serves the processed image once the job has completed
+func (c *JobsController) Result(w http.ResponseWriter, r *http.Request) {
+	job := findAccountJob(w, r)
+	if job == nil {
+		return
+	}
+
+	switch job.Snapshot().State {
+	case models.JobCompleted:
+		http.ServeFile(w, r, job.ResultPath)
+	case models.JobFailed:
+		http.Error(w, "Job failed", http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, "Job not finished", http.StatusConflict)
+	}
+}
+
+func findAccountJob(w http.ResponseWriter, r *http.Request) *models.Job {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	account := models.FindAccountByJwt(token)
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusUnauthorized)
+		return nil
+	}
+
+	job := models.FindJob(mux.Vars(r)["id"])
+	if job == nil || job.AccountId != account.Id {
+		http.NotFound(w, r)
+		return nil
+	}
+	return job
+}
+
+func writeEvent(w http.ResponseWriter, name string, event models.JobEvent) {
+	data, _ := json.Marshal(event)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/whatupdave/mux"
+)
+
+type ManifestsController struct {
+}
+
+func (c *ManifestsController) Init(r *mux.Router) {
+	r.HandleFunc("/api/manifests", c.Create).Methods("POST")
+}
+
+// Create generates the images listed in a static site build manifest and
+// returns a manifest of their urls and hashes
+func (c *ManifestsController) Create(w http.ResponseWriter, r *http.Request) {
+	account := models.FindAccountByJwt(r.Header.Get("Authorization"))
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var manifest models.BuildManifest
+	err := decoder.Decode(&manifest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, preset := range manifest.Presets {
+		if op := models.DisabledOperation(preset, account.Subdomain); op != "" {
+			http.Error(w, "Operation "+op+" is not enabled", http.StatusForbidden)
+			return
+		}
+	}
+
+	outputs := models.ProcessManifest(&manifest)
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, Response{"outputs": outputs})
+}
@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/whatupdave/mux"
+)
+
+type PurgesController struct {
+}
+
+func (c *PurgesController) Init(r *mux.Router) {
+	r.HandleFunc("/api/purges", c.Create).Methods("POST")
+}
+
+type PurgeParams struct {
+	Urls []string `json:"urls"`
+	All  bool     `json:"all"`
+}
+
+// Create purges the CDN copies of every derivative of the given source
+// urls served for the account, or of everything served for the account
+// when all is set. Other accounts' copies of the same sources are kept
+func (c *PurgesController) Create(w http.ResponseWriter, r *http.Request) {
+	authHeader := r.Header.Get("Authorization")
+
+	account := models.FindAccountByJwt(authHeader)
+	if account == nil {
+		http.Error(w, "Account not found", http.StatusUnauthorized)
+		return
+	}
+
+	if models.Purger == nil {
+		http.Error(w, "No CDN configured", http.StatusNotImplemented)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var p PurgeParams
+	err := decoder.Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	keys := make([]string, 0, len(p.Urls))
+	if p.All {
+		keys = append(keys, models.AccountKey(account.Subdomain))
+	} else {
+		for _, url := range p.Urls {
+			keys = append(keys, models.AccountSourceKey(account.Subdomain, url))
+		}
+	}
+	if len(keys) == 0 {
+		http.Error(w, "Nothing to purge", http.StatusBadRequest)
+		return
+	}
+
+	err = models.Purger.PurgeKeys(keys)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprint(w, Response{"purged": keys})
+}
@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RequestDeadline is negroni middleware holding requests to the deadline
+// their caller sets, in an X-Request-Deadline header or a gRPC style
+// Grpc-Timeout one, clamped to max. Every step, download and delegate
+// runs under the request's context so they all stop by then, and requests
+// arriving past it are turned away with a 504 straight away
+type RequestDeadline struct {
+	max time.Duration
+}
+
+func NewRequestDeadline(max time.Duration) *RequestDeadline {
+	return &RequestDeadline{max: max}
+}
+
+func (m *RequestDeadline) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	now := time.Now()
+	deadline, ok, err := requestDeadline(r.Header, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !ok {
+		next(w, r)
+		return
+	}
+	if m.max > 0 && deadline.After(now.Add(m.max)) {
+		deadline = now.Add(m.max)
+	}
+	if !deadline.After(now) {
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "Request deadline exceeded", http.StatusGatewayTimeout)
+		return
+	}
+
+	ctx, cancel := context.WithDeadline(r.Context(), deadline)
+	defer cancel()
+	next(w, r.WithContext(ctx))
+}
+
+// grpcTimeoutUnits are the units of a Grpc-Timeout header
+// https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-HTTP2.md
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// requestDeadline reads X-Request-Deadline, an RFC 3339 time or unix
+// milliseconds, or failing that Grpc-Timeout, a duration from now
+func requestDeadline(h http.Header, now time.Time) (time.Time, bool, error) {
+	if value := strings.TrimSpace(h.Get("X-Request-Deadline")); value != "" {
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(0, ms*int64(time.Millisecond)), true, nil
+		}
+		deadline, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return time.Time{}, false, errors.New("invalid X-Request-Deadline")
+		}
+		return deadline, true, nil
+	}
+
+	if value := strings.TrimSpace(h.Get("Grpc-Timeout")); value != "" {
+		unit, ok := grpcTimeoutUnits[value[len(value)-1]]
+		amount, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		if !ok || err != nil || amount < 0 || len(value) > 9 {
+			return time.Time{}, false, errors.New("invalid Grpc-Timeout")
+		}
+		return now.Add(time.Duration(amount) * unit), true, nil
+	}
+	return time.Time{}, false, nil
+}
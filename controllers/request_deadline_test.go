@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRequestDeadline(t *testing.T) {
+	m := NewRequestDeadline(30 * time.Second)
+	var remaining time.Duration
+	var hasDeadline bool
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		var deadline time.Time
+		deadline, hasDeadline = r.Context().Deadline()
+		remaining = time.Until(deadline)
+	}
+	request := func(name string, value string) *httptest.ResponseRecorder {
+		hasDeadline = false
+		r, _ := http.NewRequest("GET", "http://firesize.dev/128x/http://example.com/cat.jpg", nil)
+		if name != "" {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, handler)
+		return w
+	}
+
+	request("", "")
+	if hasDeadline {
+		t.Fatal("Expected no deadline without a header")
+	}
+
+	request("Grpc-Timeout", "500m")
+	if !hasDeadline || remaining > 500*time.Millisecond || remaining < 400*time.Millisecond {
+		t.Fatal("Expected a 500ms deadline, got ", remaining)
+	}
+
+	request("X-Request-Deadline", time.Now().Add(2*time.Second).Format(time.RFC3339Nano))
+	if !hasDeadline || remaining > 2*time.Second || remaining < time.Second {
+		t.Fatal("Expected a 2s deadline, got ", remaining)
+	}
+
+	request("X-Request-Deadline", strconv.FormatInt(time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond), 10))
+	if !hasDeadline || remaining > 30*time.Second {
+		t.Fatal("Expected the deadline clamped to 30s, got ", remaining)
+	}
+
+	w := request("X-Request-Deadline", time.Now().Add(-time.Second).Format(time.RFC3339))
+	if hasDeadline || w.Code != http.StatusGatewayTimeout {
+		t.Fatal("Expected a 504 for a deadline already past, got ", w.Code)
+	}
+
+	w = request("Grpc-Timeout", "soon")
+	if hasDeadline || w.Code != http.StatusBadRequest {
+		t.Fatal("Expected a 400 for a malformed timeout, got ", w.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/asm-products/firesize/models"
+)
+
+// trackingResponseWriter remembers the status and number of bytes written
+// so they can be reported once the response is complete
+type trackingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+
+	// beforeHeader runs once, just before the header is sent
+	beforeHeader func(http.Header)
+}
+
+func (w *trackingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.sendingHeader()
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+		w.sendingHeader()
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *trackingResponseWriter) sendingHeader() {
+	if w.beforeHeader != nil {
+		w.beforeHeader(w.Header())
+	}
+}
+
+// trackServerTiming reports the steps args has been through so far in a
+// Server-Timing header when the header is sent. The returned func repeats
+// them in a trailer once the body is done, along with the total including
+// the time spent streaming it, as streamed responses send their header
+// before the work behind them is over. Trailers only reach clients of
+// chunked or HTTP/2 responses
+func trackServerTiming(w *trackingResponseWriter, args *models.ProcessArgs, start time.Time) func() {
+	args.Timings = &models.Timings{}
+	w.beforeHeader = func(h http.Header) {
+		h.Set("Server-Timing", args.Timings.ServerTiming(time.Since(start), h.Get("X-Firesize-Cache")))
+	}
+	return func() {
+		if w.status == 0 {
+			return
+		}
+		w.Header().Set(http.TrailerPrefix+"Server-Timing",
+			args.Timings.ServerTiming(time.Since(start), w.Header().Get("X-Firesize-Cache")))
+	}
+}
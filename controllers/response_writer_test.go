@@ -0,0 +1,44 @@
+package controllers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asm-products/firesize/models"
+)
+
+func TestServerTimingTrailer(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w := &trackingResponseWriter{ResponseWriter: rw}
+		args := &models.ProcessArgs{}
+		sendTimingTrailer := trackServerTiming(w, args, time.Now())
+
+		w.Header().Set("X-Firesize-Cache", "miss")
+		args.Timings.Record("download", 5*time.Millisecond)
+		// large enough, without a Content-Length, to be sent chunked
+		w.Write(bytes.Repeat([]byte("x"), 8192))
+		args.Timings.Record("convert", 40*time.Millisecond)
+		sendTimingTrailer()
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	header := resp.Header.Get("Server-Timing")
+	if !strings.HasPrefix(header, "download;dur=5.0, total;dur=") || !strings.HasSuffix(header, ", cache;desc=miss") {
+		t.Fatal("Expected the steps so far in the Server-Timing header, got ", header)
+	}
+	ioutil.ReadAll(resp.Body)
+	trailer := resp.Trailer.Get("Server-Timing")
+	if !strings.HasPrefix(trailer, "download;dur=5.0, convert;dur=40.0, total;dur=") {
+		t.Fatal("Expected every step in the Server-Timing trailer, got ", trailer)
+	}
+}
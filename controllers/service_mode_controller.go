@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/asm-products/firesize/models"
+	"github.com/whatupdave/mux"
+)
+
+type ServiceModeController struct {
+}
+
+func (c *ServiceModeController) Init(r *mux.Router) {
+	r.HandleFunc("/api/admin/service_mode", c.Show).Methods("GET")
+	r.HandleFunc("/api/admin/service_mode", c.Update).Methods("PUT")
+}
+
+type ServiceModeParams struct {
+	Mode    string `json:"mode"`
+	Message string `json:"message"`
+}
+
+func (c *ServiceModeController) Show(w http.ResponseWriter, r *http.Request) {
+	if !models.AdminAuthorized(r.Header.Get("Authorization")) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(models.CurrentServiceMode())
+}
+
+// Update switches the service into normal, proxy-only or maintenance
+// mode without a deploy
+func (c *ServiceModeController) Update(w http.ResponseWriter, r *http.Request) {
+	if !models.AdminAuthorized(r.Header.Get("Authorization")) {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var p ServiceModeParams
+	err := decoder.Decode(&p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mode, err := models.SetServiceMode(p.Mode, p.Message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(mode)
+}
@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/asm-products/firesize/models"
+)
+
+// ServiceModeGuard is negroni middleware enforcing the service mode. In
+// maintenance mode requests that would fetch or process a source get a
+// static 503. In proxy-only mode transforms are passed through by the
+// processor, so only endpoints that can't work without delegates are
+// turned away
+type ServiceModeGuard struct {
+}
+
+// maintenanceRetryAfter is the Retry-After sent with 503s, in seconds
+var maintenanceRetryAfter = "120"
+
+var defaultMaintenanceMessage = "Down for maintenance, please try again shortly"
+
+func NewServiceModeGuard() *ServiceModeGuard {
+	return &ServiceModeGuard{}
+}
+
+func (m *ServiceModeGuard) ServeHTTP(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	mode := models.CurrentServiceMode()
+	_, fetchesSource := requestSource(r)
+	switch {
+	case mode.Maintenance() && (fetchesSource || needsDelegates(r)):
+	case mode.ProxyOnly() && needsDelegates(r):
+	default:
+		next(w, r)
+		return
+	}
+
+	message := mode.Message
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	w.Header().Set("Retry-After", maintenanceRetryAfter)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Firesize-Mode", mode.Mode)
+	http.Error(w, message, http.StatusServiceUnavailable)
+}
+
+// needsDelegates is true for requests that can only be answered by
+// running delegates, as opposed to transforms which can fall back to
+// passing the source through
+func needsDelegates(r *http.Request) bool {
+	for _, prefix := range []string{"/info/", "/palette/", "/blurhash/", "/icons/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	switch r.URL.Path {
+	case "/hash":
+		return true
+	case "/api/jobs", "/api/batches", "/api/manifests", "/process":
+		return r.Method == "POST"
+	}
+	return false
+}
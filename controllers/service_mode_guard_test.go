@@ -0,0 +1,87 @@
+package controllers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/asm-products/firesize/models"
+)
+
+func TestServiceModeGuard(t *testing.T) {
+	defer models.SetServiceMode(models.ModeNormal, "")
+	m := NewServiceModeGuard()
+	handled := false
+	handler := func(w http.ResponseWriter, r *http.Request) { handled = true }
+	request := func(method string, path string) *httptest.ResponseRecorder {
+		handled = false
+		r, _ := http.NewRequest(method, "http://firesize.dev"+path, nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, r, handler)
+		return w
+	}
+
+	request("GET", "/info/http://img.example.com/cat.jpg")
+	if !handled {
+		t.Fatal("Expected requests through in normal mode")
+	}
+
+	models.SetServiceMode(models.ModeProxyOnly, "")
+	request("GET", "/128x/http://img.example.com/cat.jpg")
+	if !handled {
+		t.Fatal("Expected transforms through in proxy-only mode")
+	}
+	w := request("GET", "/info/http://img.example.com/cat.jpg")
+	if handled || w.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected info to be unavailable in proxy-only mode, got ", w.Code)
+	}
+	w = request("POST", "/api/jobs")
+	if handled || w.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected jobs to be unavailable in proxy-only mode, got ", w.Code)
+	}
+	request("GET", "/api/jobs/1")
+	if !handled {
+		t.Fatal("Expected existing jobs to stay readable in proxy-only mode")
+	}
+
+	models.SetServiceMode(models.ModeMaintenance, "Back soon")
+	w = request("GET", "/128x/http://img.example.com/cat.jpg")
+	if handled || w.Code != http.StatusServiceUnavailable || w.Body.String() != "Back soon\n" {
+		t.Fatal("Expected the maintenance response, got ", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("X-Firesize-Mode") != "maintenance" {
+		t.Fatal("Expected maintenance headers, got ", w.Header())
+	}
+	request("PUT", "/api/admin/service_mode")
+	if !handled {
+		t.Fatal("Expected the admin endpoint through in maintenance mode")
+	}
+}
+
+func TestServiceModeController(t *testing.T) {
+	defer models.SetServiceMode(models.ModeNormal, "")
+	models.AdminToken = "s3cret"
+	defer func() { models.AdminToken = "" }()
+	c := &ServiceModeController{}
+	update := func(auth string, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("PUT", "http://firesize.dev/api/admin/service_mode", strings.NewReader(body))
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		c.Update(w, r)
+		return w
+	}
+
+	w := update("Bearer wrong", `{"mode":"proxy-only"}`)
+	if w.Code != http.StatusUnauthorized || models.CurrentServiceMode().ProxyOnly() {
+		t.Fatal("Expected a wrong token to be rejected, got ", w.Code)
+	}
+	w = update("Bearer s3cret", `{"mode":"sideways"}`)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatal("Expected an unknown mode to be rejected, got ", w.Code)
+	}
+	w = update("Bearer s3cret", `{"mode":"proxy-only"}`)
+	if w.Code != http.StatusOK || !models.CurrentServiceMode().ProxyOnly() {
+		t.Fatal("Expected proxy-only mode, got ", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE api_keys (
+  key             text      PRIMARY KEY,
+  name            text      NOT NULL DEFAULT '',
+  allowed_domains text      NOT NULL DEFAULT '',
+  default_quality text      NOT NULL DEFAULT '',
+  rate_limit      integer   NOT NULL DEFAULT 0
+);
+
+-- +goose Down
+DROP TABLE api_keys;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE service_modes (
+  id         integer   PRIMARY KEY,
+  mode       text      NOT NULL DEFAULT 'normal',
+  message    text      NOT NULL DEFAULT '',
+  updated_at timestamp NOT NULL DEFAULT now()
+);
+
+-- +goose Down
+DROP TABLE service_modes;
@@ -0,0 +1,215 @@
+// Package loadgen generates mixed image traffic against a firesize
+// instance and reports latency percentiles, for capacity planning
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config describes the traffic to generate. AnimatedRatio is the share of
+// requests for AnimatedSources, the rest are for StaticSources
+type Config struct {
+	Target          string
+	Duration        time.Duration
+	Concurrency     int
+	StaticSources   []string
+	AnimatedSources []string
+	AnimatedRatio   float64
+	ApiKey          string
+
+	// Sign turns a transform path into the path to request, e.g. adding
+	// a signature. Nil requests paths as is
+	Sign func(args []string, source string) string
+}
+
+var widths = []int{64, 128, 320, 640, 1024, 1600}
+var staticFormats = []string{"", "jpg", "jpg", "png"}
+var animatedFormats = []string{"", "gif", "mp4", "mp4"}
+var extras = []string{"", "", "g_center", "fit_cover", "q_70", "strip"}
+
+// Request is one generated request
+type Request struct {
+	Path     string
+	Animated bool
+}
+
+// NextRequest picks a random transform of a random source
+func (c *Config) NextRequest(rnd *rand.Rand) Request {
+	animated := len(c.AnimatedSources) > 0 &&
+		(len(c.StaticSources) == 0 || rnd.Float64() < c.AnimatedRatio)
+
+	sources, formats := c.StaticSources, staticFormats
+	if animated {
+		sources, formats = c.AnimatedSources, animatedFormats
+	}
+	source := sources[rnd.Intn(len(sources))]
+
+	width := widths[rnd.Intn(len(widths))]
+	args := []string{strconv.Itoa(width) + "x"}
+	if rnd.Intn(2) == 0 {
+		args[0] += strconv.Itoa(width * 3 / 4)
+	}
+	for _, arg := range []string{extras[rnd.Intn(len(extras))], formats[rnd.Intn(len(formats))]} {
+		if arg != "" {
+			args = append(args, arg)
+		}
+	}
+
+	path := "/" + strings.Join(args, "/") + "/" + source
+	if c.Sign != nil {
+		path = c.Sign(args, source)
+	}
+	return Request{Path: path, Animated: animated}
+}
+
+// Result is the outcome of one request
+type Result struct {
+	Request  Request
+	Status   int
+	Bytes    int64
+	Duration time.Duration
+	Err      error
+}
+
+// Run generates traffic for the configured duration and returns every
+// result
+func Run(c *Config) []Result {
+	client := &http.Client{Timeout: time.Minute}
+	deadline := time.Now().Add(c.Duration)
+
+	var mu sync.Mutex
+	results := []Result{}
+	var wg sync.WaitGroup
+	for i := 0; i < c.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				result := c.do(client, c.NextRequest(rnd))
+				mu.Lock()
+				results = append(results, result)
+				mu.Unlock()
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	return results
+}
+
+func (c *Config) do(client *http.Client, request Request) Result {
+	result := Result{Request: request}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(c.Target, "/")+request.Path, nil)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if c.ApiKey != "" {
+		req.Header.Set("X-Api-Key", c.ApiKey)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		result.Err = err
+		result.Duration = time.Since(start)
+		return result
+	}
+	result.Bytes, result.Err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	result.Duration = time.Since(start)
+	result.Status = resp.StatusCode
+	return result
+}
+
+// Summary is the latency distribution of a set of results
+type Summary struct {
+	Requests int
+	Errors   int
+	Statuses map[int]int
+	Bytes    int64
+	P50      time.Duration
+	P90      time.Duration
+	P99      time.Duration
+	Max      time.Duration
+}
+
+// Summarize works out percentiles over results. Transport errors and non
+// 2xx responses count as errors
+func Summarize(results []Result) Summary {
+	summary := Summary{Requests: len(results), Statuses: map[int]int{}}
+	durations := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		durations = append(durations, r.Duration)
+		summary.Bytes += r.Bytes
+		if r.Err != nil {
+			summary.Errors++
+			continue
+		}
+		summary.Statuses[r.Status]++
+		if r.Status < 200 || r.Status > 299 {
+			summary.Errors++
+		}
+	}
+	if len(durations) == 0 {
+		return summary
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	summary.P50 = percentile(durations, 0.50)
+	summary.P90 = percentile(durations, 0.90)
+	summary.P99 = percentile(durations, 0.99)
+	summary.Max = durations[len(durations)-1]
+	return summary
+}
+
+// percentile uses the nearest rank of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Report writes the summary of results, overall and split by static and
+// animated sources
+func Report(w io.Writer, results []Result, elapsed time.Duration) {
+	static, animated := []Result{}, []Result{}
+	for _, r := range results {
+		if r.Request.Animated {
+			animated = append(animated, r)
+		} else {
+			static = append(static, r)
+		}
+	}
+
+	fmt.Fprintf(w, "%-9s %8s %7s %9s %9s %9s %9s\n", "", "requests", "errors", "p50", "p90", "p99", "max")
+	for _, group := range []struct {
+		name    string
+		results []Result
+	}{{"all", results}, {"static", static}, {"animated", animated}} {
+		s := Summarize(group.results)
+		fmt.Fprintf(w, "%-9s %8d %7d %9s %9s %9s %9s\n", group.name, s.Requests, s.Errors,
+			round(s.P50), round(s.P90), round(s.P99), round(s.Max))
+	}
+
+	s := Summarize(results)
+	fmt.Fprintf(w, "\n%.1f req/s, %d bytes, statuses %v\n", float64(s.Requests)/elapsed.Seconds(), s.Bytes, s.Statuses)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,48 @@
+package loadgen
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSummarizePercentiles(t *testing.T) {
+	results := []Result{}
+	for i := 1; i <= 100; i++ {
+		results = append(results, Result{Status: 200, Duration: time.Duration(i) * time.Millisecond})
+	}
+	results[0].Status = 500
+	results[1].Err = errors.New("reset")
+
+	s := Summarize(results)
+	assert.Equal(t, 100, s.Requests)
+	assert.Equal(t, 2, s.Errors)
+	assert.Equal(t, 50*time.Millisecond, s.P50)
+	assert.Equal(t, 90*time.Millisecond, s.P90)
+	assert.Equal(t, 99*time.Millisecond, s.P99)
+	assert.Equal(t, 100*time.Millisecond, s.Max)
+}
+
+func TestNextRequestMixesSources(t *testing.T) {
+	c := &Config{
+		StaticSources:   []string{"http://example.com/cat.jpg"},
+		AnimatedSources: []string{"http://example.com/cat.gif"},
+		AnimatedRatio:   0.25,
+	}
+	rnd := rand.New(rand.NewSource(1))
+	animated := 0
+	for i := 0; i < 1000; i++ {
+		r := c.NextRequest(rnd)
+		if r.Animated {
+			animated++
+			assert.T(t, strings.HasSuffix(r.Path, "/http://example.com/cat.gif"))
+		} else {
+			assert.T(t, !strings.Contains(r.Path, "mp4"))
+		}
+	}
+	assert.T(t, animated > 200 && animated < 300)
+}
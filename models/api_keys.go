@@ -0,0 +1,193 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ApiKey lets a team use firesize with its own settings. AllowedDomains
+// is a comma separated list of source host globs or /regexps/, as in
+// SOURCE_ALLOWLIST, DefaultQuality applies when a request doesn't set q_
+// and RateLimit is requests per minute. Empty or 0 means no restriction
+type ApiKey struct {
+	Key            string `db:"key" json:"key"`
+	Name           string `db:"name" json:"name"`
+	AllowedDomains string `db:"allowed_domains" json:"allowed_domains"`
+	DefaultQuality string `db:"default_quality" json:"default_quality"`
+	RateLimit      int    `db:"rate_limit" json:"rate_limit"`
+
+	allowedSources []HostPattern `db:"-"`
+}
+
+// ApiKeys are the keys loaded from API_KEYS or API_KEYS_FILE.
+// ApiKeysFromDb also looks keys up in the api_keys table. Image requests
+// need a key when either is set
+var ApiKeys = map[string]*ApiKey{}
+var ApiKeysFromDb bool
+
+// apiKeyCacheTtl is how long keys read from the database are trusted, and
+// apiKeyMissTtl how long keys it doesn't have are remembered as unknown
+var apiKeyCacheTtl = time.Minute
+var apiKeyMissTtl = 10 * time.Second
+
+// apiKeyCacheMax caps the keys remembered, as anyone can present new ones
+var apiKeyCacheMax = 10000
+
+var apiKeyCache = struct {
+	sync.Mutex
+	byKey map[string]cachedApiKey
+}{byKey: map[string]cachedApiKey{}}
+
+type cachedApiKey struct {
+	key     *ApiKey
+	expires time.Time
+}
+
+// ApiKeysRequired is true when any key source is configured
+func ApiKeysRequired() bool {
+	return len(ApiKeys) > 0 || ApiKeysFromDb
+}
+
+// LoadApiKeys reads a JSON array of keys, either inline or from the file
+// at path when inline is empty
+func LoadApiKeys(inline string, path string) error {
+	data := []byte(inline)
+	if inline == "" && path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		ApiKeys = map[string]*ApiKey{}
+		return nil
+	}
+
+	keys := []*ApiKey{}
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+	ApiKeys = map[string]*ApiKey{}
+	for _, key := range keys {
+		key.allowedSources = ParseHostPatterns(key.AllowedDomains)
+		ApiKeys[key.Key] = key
+	}
+	return nil
+}
+
+// FindApiKey returns the key, or nil if it isn't known
+func FindApiKey(key string) *ApiKey {
+	if key == "" {
+		return nil
+	}
+	if apiKey, ok := ApiKeys[key]; ok {
+		return apiKey
+	}
+	if !ApiKeysFromDb || Dbm == nil {
+		return nil
+	}
+
+	apiKeyCache.Lock()
+	cached, ok := apiKeyCache.byKey[key]
+	apiKeyCache.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.key
+	}
+
+	var apiKey *ApiKey
+	keys, err := Dbm.Select(ApiKey{}, `select * from api_keys where key = $1 limit 1`, key)
+	if err != nil {
+		panic(err)
+	}
+	if len(keys) > 0 {
+		apiKey = keys[0].(*ApiKey)
+		apiKey.allowedSources = ParseHostPatterns(apiKey.AllowedDomains)
+	}
+
+	cacheApiKey(key, apiKey)
+	return apiKey
+}
+
+// cacheApiKey remembers what the database had for key, nil if nothing.
+// When the cache is full expired keys are swept, then others dropped
+func cacheApiKey(key string, apiKey *ApiKey) {
+	now := time.Now()
+	ttl := apiKeyCacheTtl
+	if apiKey == nil {
+		ttl = apiKeyMissTtl
+	}
+
+	apiKeyCache.Lock()
+	defer apiKeyCache.Unlock()
+	if _, ok := apiKeyCache.byKey[key]; !ok && len(apiKeyCache.byKey) >= apiKeyCacheMax {
+		for k, cached := range apiKeyCache.byKey {
+			if !now.Before(cached.expires) {
+				delete(apiKeyCache.byKey, k)
+			}
+		}
+		for k := range apiKeyCache.byKey {
+			if len(apiKeyCache.byKey) < apiKeyCacheMax {
+				break
+			}
+			delete(apiKeyCache.byKey, k)
+		}
+	}
+	apiKeyCache.byKey[key] = cachedApiKey{key: apiKey, expires: now.Add(ttl)}
+}
+
+// AllowsSource is true if the key may fetch source
+func (k *ApiKey) AllowsSource(source string) bool {
+	if k.AllowedDomains == "" {
+		return true
+	}
+	patterns := k.allowedSources
+	if patterns == nil {
+		patterns = ParseHostPatterns(k.AllowedDomains)
+	}
+	return matchSourceHost(source, patterns)
+}
+
+// ApplyDefaults fills in the key's settings the request left unset
+func (k *ApiKey) ApplyDefaults(p *ProcessArgs) {
+	if p.Quality == "" && k.DefaultQuality != "" {
+		if _, err := strconv.Atoi(k.DefaultQuality); err == nil {
+			p.Quality = k.DefaultQuality
+		}
+	}
+}
+
+var rateWindows = struct {
+	sync.Mutex
+	byKey map[string]*rateWindow
+}{byKey: map[string]*rateWindow{}}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// Allow counts a request against the key's per minute limit, returning
+// false once it is used up
+func (k *ApiKey) Allow(now time.Time) bool {
+	if k.RateLimit <= 0 {
+		return true
+	}
+
+	rateWindows.Lock()
+	defer rateWindows.Unlock()
+	window, ok := rateWindows.byKey[k.Key]
+	if !ok || now.Sub(window.start) >= time.Minute {
+		window = &rateWindow{start: now}
+		rateWindows.byKey[k.Key] = window
+	}
+	if window.count >= k.RateLimit {
+		return false
+	}
+	window.count++
+	return true
+}
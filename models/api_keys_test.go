@@ -0,0 +1,64 @@
+package models
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestApiKeyApplyDefaults(t *testing.T) {
+	key := &ApiKey{Key: "k", DefaultQuality: "70"}
+
+	args := NewProcessArgs([]string{"128x"}, imgUrl)
+	key.ApplyDefaults(args)
+	assert.Equal(t, "70", args.Quality)
+
+	args = NewProcessArgs([]string{"128x", "q_90"}, imgUrl)
+	key.ApplyDefaults(args)
+	assert.Equal(t, "90", args.Quality)
+}
+
+func TestApiKeyAllowsSource(t *testing.T) {
+	key := &ApiKey{Key: "k", AllowedDomains: "*.example.com, /^cdn\\d\\.net$/"}
+	assert.T(t, key.AllowsSource("http://img.example.com/cat.jpg"))
+	assert.T(t, key.AllowsSource("https://cdn1.net/cat.jpg"))
+	assert.T(t, !key.AllowsSource("http://example.org/cat.jpg"))
+	assert.T(t, (&ApiKey{Key: "open"}).AllowsSource("http://example.org/cat.jpg"))
+}
+
+func TestApiKeyRateLimit(t *testing.T) {
+	key := &ApiKey{Key: "rate-limited", RateLimit: 2}
+	now := time.Now()
+	assert.T(t, key.Allow(now))
+	assert.T(t, key.Allow(now))
+	assert.T(t, !key.Allow(now.Add(59*time.Second)))
+	assert.T(t, key.Allow(now.Add(time.Minute)))
+}
+
+func TestApiKeyCacheIsBounded(t *testing.T) {
+	defer func(previous int) { apiKeyCacheMax = previous }(apiKeyCacheMax)
+	apiKeyCacheMax = 3
+	apiKeyCache.byKey = map[string]cachedApiKey{}
+	defer func() { apiKeyCache.byKey = map[string]cachedApiKey{} }()
+
+	known := &ApiKey{Key: "known", Name: "acme"}
+	cacheApiKey("known", known)
+	cacheApiKey("unknown", nil)
+	assert.T(t, apiKeyCache.byKey["unknown"].expires.Before(apiKeyCache.byKey["known"].expires))
+
+	// expired keys are swept before anything else is dropped
+	apiKeyCache.byKey["expired"] = cachedApiKey{expires: time.Now().Add(-time.Second)}
+	cacheApiKey("random-1", nil)
+	_, ok := apiKeyCache.byKey["expired"]
+	assert.T(t, !ok)
+	assert.Equal(t, 3, len(apiKeyCache.byKey))
+
+	for i := 2; i < 100; i++ {
+		cacheApiKey("random-"+strconv.Itoa(i), nil)
+	}
+	assert.Equal(t, 3, len(apiKeyCache.byKey))
+	_, ok = apiKeyCache.byKey["random-99"]
+	assert.T(t, ok)
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestAzblobSources(t *testing.T) {
+	key := []byte("azure account key")
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("GIF89a"))
+	}))
+	defer server.Close()
+
+	endpoint, containers := AzblobSourceEndpoint, AzblobSourceContainers
+	defer func() { AzblobSourceEndpoint, AzblobSourceContainers = endpoint, containers }()
+	defer InitAzblobSources("", "", "")
+	AzblobSourceEndpoint = server.URL + "/devstoreaccount1"
+	AzblobSourceContainers = BucketAllowlist(ParseHostPatterns("originals"))
+	assert.Equal(t, nil, InitAzblobSources("devstoreaccount1", base64.StdEncoding.EncodeToString(key), ""))
+
+	header := http.Header{}
+	header.Set("Range", "bytes=100-")
+	resp, err := fetchSource(context.Background(), "azblob://originals/products/cat 1.jpg", header)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "/devstoreaccount1/originals/products/cat%201.jpg", got.URL.EscapedPath())
+
+	stringToSign := "GET\n\n\n\n\n\n\n\n\n\n\nbytes=100-\n" +
+		"x-ms-date:" + got.Header.Get("X-Ms-Date") + "\n" +
+		"x-ms-version:" + azblobVersion + "\n" +
+		"/devstoreaccount1/devstoreaccount1/originals/products/cat%201.jpg"
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stringToSign))
+	assert.Equal(t, "SharedKey devstoreaccount1:"+base64.StdEncoding.EncodeToString(mac.Sum(nil)), got.Header.Get("Authorization"))
+
+	// SAS tokens go in the query instead
+	assert.Equal(t, nil, InitAzblobSources("devstoreaccount1", "", "?sv=2021-08-06&sig=abc%2B"))
+	resp, err = fetchSource(context.Background(), "azblob://originals/cat.jpg", nil)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "", got.Header.Get("Authorization"))
+	assert.Equal(t, "abc+", got.URL.Query().Get("sig"))
+	assert.T(t, strings.Contains(got.URL.RawQuery, "sv=2021-08-06"))
+
+	// other containers the account can read are refused
+	got = nil
+	_, err = fetchSource(context.Background(), "azblob://results/cat.jpg", nil)
+	assert.Equal(t, 403, err.(*StatusError).Status)
+	assert.T(t, got == nil)
+}
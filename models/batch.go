@@ -0,0 +1,136 @@
+package models
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ArchiveFormats are the archives batches can be returned as
+var ArchiveFormats = map[string]string{
+	"zip": "application/zip",
+	"tar": "application/x-tar",
+}
+
+type archiveWriter interface {
+	Add(name string, filePath string) error
+	Close() error
+}
+
+type zipArchive struct {
+	*zip.Writer
+}
+
+func (a zipArchive) Add(name string, filePath string) error {
+	return addZipFile(a.Writer, name, filePath)
+}
+
+type tarArchive struct {
+	*tar.Writer
+}
+
+func (a tarArchive) Add(name string, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = a.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(a.Writer, f)
+	return err
+}
+
+// WriteBatchArchive downloads url once and streams each variant into a
+// zip or tar archive as it is processed. Members are named after their
+// args, see batchMemberName
+func WriteBatchArchive(w io.Writer, format string, url string, variants [][]string) error {
+	var archive archiveWriter
+	switch format {
+	case "zip":
+		archive = zipArchive{zip.NewWriter(w)}
+	case "tar":
+		archive = tarArchive{tar.NewWriter(w)}
+	default:
+		return fmt.Errorf("unknown archive format %q", format)
+	}
+
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	source, err := downloadRemote(tempDir, "", &ProcessArgs{Url: url})
+	if err != nil {
+		return err
+	}
+
+	for i, urlArgs := range variants {
+		// every variant gets its own workspace as steps reuse file names
+		variantDir := filepath.Join(tempDir, fmt.Sprintf("%d", i))
+		err = os.Mkdir(variantDir, 0755)
+		if err != nil {
+			return err
+		}
+
+		filePath, err := processVariant(variantDir, source, url, urlArgs)
+		if err != nil {
+			return err
+		}
+
+		err = archive.Add(batchMemberName(urlArgs, filePath), filePath)
+		if err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+// processVariant runs everything but the download over an already
+// downloaded source
+func processVariant(tempDir string, source string, url string, urlArgs []string) (string, error) {
+	args := NewProcessArgs(urlArgs, url)
+	args.Priority = PriorityBatch
+	if !args.HasOperations() {
+		return source, nil
+	}
+	return runPipeline(defaultPipeline[1:], tempDir, source, args)
+}
+
+// batchMemberName names a variant after its args so consumers can find
+// results without a manifest, e.g. 500x300_jpg.jpg
+func batchMemberName(urlArgs []string, filePath string) string {
+	parts := []string{}
+	for _, arg := range urlArgs {
+		if arg != "" {
+			parts = append(parts, strings.Map(func(r rune) rune {
+				if strings.ContainsRune(`/\:*?"<>|`, r) {
+					return '-'
+				}
+				return r
+			}, arg))
+		}
+	}
+	name := strings.Join(parts, "_")
+	if name == "" {
+		name = "original"
+	}
+	return name + filepath.Ext(filePath)
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestBatchMemberName(t *testing.T) {
+	assert.Equal(t, "500x300_g_center.jpg", batchMemberName([]string{"500x300", "", "g_center"}, "/tmp/out.jpg"))
+	assert.Equal(t, "100x100-_png.png", batchMemberName([]string{"100x100>", "png"}, "/tmp/out.png"))
+	assert.Equal(t, "original.gif", batchMemberName(nil, "/tmp/download.gif"))
+}
+
+func TestTarArchiveAdd(t *testing.T) {
+	tempDir, _ := ioutil.TempDir("", "batch")
+	defer os.RemoveAll(tempDir)
+	filePath := filepath.Join(tempDir, "out.png")
+	ioutil.WriteFile(filePath, []byte("png!"), 0644)
+
+	var buf bytes.Buffer
+	archive := tarArchive{tar.NewWriter(&buf)}
+	assert.Equal(t, nil, archive.Add("500x_png.png", filePath))
+	assert.Equal(t, nil, archive.Close())
+
+	r := tar.NewReader(&buf)
+	header, err := r.Next()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "500x_png.png", header.Name)
+	contents, _ := ioutil.ReadAll(r)
+	assert.Equal(t, "png!", string(contents))
+}
@@ -0,0 +1,196 @@
+package models
+
+import (
+	"crypto/rsa"
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// BearerSecret verifies HS256 bearer tokens and BearerPublicKey RS256
+// ones. Image requests need a token, or an API key, when either is set
+var BearerSecret []byte
+var BearerPublicKey *rsa.PublicKey
+
+var ErrInvalidBearerToken = errors.New("invalid bearer token")
+
+// BearerToken holds the restrictions a token's claims put on the
+// requests it authenticates. ops lists the operations the token may use,
+// sources the host globs or /regexps/ it may fetch from. Missing claims
+// mean no restriction
+type BearerToken struct {
+	Subject    string
+	Operations []string
+	Sources    []HostPattern
+
+	restrictsSources bool
+}
+
+// BearerTokensRequired is true when a key to verify tokens is configured
+func BearerTokensRequired() bool {
+	return len(BearerSecret) > 0 || BearerPublicKey != nil
+}
+
+// LoadBearerPublicKey reads a PEM encoded RSA public key, either inline or
+// from the file at path when inline is empty
+func LoadBearerPublicKey(inline string, path string) error {
+	data := []byte(inline)
+	if inline == "" && path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		BearerPublicKey = nil
+		return nil
+	}
+
+	key, err := jwt.ParseRSAPublicKeyFromPEM(data)
+	if err != nil {
+		return err
+	}
+	BearerPublicKey = key
+	return nil
+}
+
+// ParseBearerToken verifies a token's signature and expiry. Tokens must
+// expire, and only the algorithms with a configured key are accepted so
+// an RS256 public key can't be used as an HS256 secret
+func ParseBearerToken(tokenString string) (*BearerToken, error) {
+	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.Alg() {
+		case "HS256":
+			if len(BearerSecret) > 0 {
+				return BearerSecret, nil
+			}
+		case "RS256":
+			if BearerPublicKey != nil {
+				return BearerPublicKey, nil
+			}
+		}
+		return nil, ErrInvalidBearerToken
+	})
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidBearerToken
+	}
+	if _, ok := token.Claims["exp"].(float64); !ok {
+		return nil, ErrInvalidBearerToken
+	}
+
+	bearer := &BearerToken{}
+	bearer.Subject, _ = token.Claims["sub"].(string)
+	if ops, ok := token.Claims["ops"]; ok {
+		bearer.Operations = claimStrings(ops)
+		if bearer.Operations == nil {
+			bearer.Operations = []string{}
+		}
+	}
+	if sources, ok := token.Claims["sources"]; ok {
+		bearer.Sources = ParseHostPatterns(strings.Join(claimStrings(sources), ","))
+		bearer.restrictsSources = true
+	}
+	return bearer, nil
+}
+
+// claimStrings reads a claim holding a list of strings, or a single comma
+// separated one
+func claimStrings(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Split(claim, ",")
+	case []interface{}:
+		values := []string{}
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// AllowsSource is true if the token may fetch source
+func (t *BearerToken) AllowsSource(source string) bool {
+	if !t.restrictsSources {
+		return true
+	}
+	return matchSourceHost(source, t.Sources)
+}
+
+// AllowsArgs is true if every operation in urlArgs is one the token may
+// use. Segments that aren't operations, like signatures, are ignored
+func (t *BearerToken) AllowsArgs(urlArgs []string) bool {
+	if t.Operations == nil {
+		return true
+	}
+	for _, arg := range urlArgs {
+		op := Operation(arg)
+		if op == "" {
+			continue
+		}
+		allowed := false
+		for _, allowedOp := range t.Operations {
+			if strings.TrimSpace(allowedOp) == op {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+var operations = []struct {
+	name string
+	rgx  *regexp.Regexp
+}{
+	{"resize", dimensionsRgx},
+	{"resize", autoWidthRgx},
+	{"resize", widthRgx},
+	{"resize", heightRgx},
+	{"gravity", gravityRgx},
+	{"fit", fitRgx},
+	{"bg", backgroundRgx},
+	{"quality", qualityRgx},
+	{"strip", stripRgx},
+	{"keepmeta", keepMetaRgx},
+	{"radius", radiusRgx},
+	{"mask", maskRgx},
+	{"lqip", lqipRgx},
+	{"encoding", encodingRgx},
+	{"frame", frameRgx},
+	{"format", formatRgx},
+	{"noorient", noAutoOrientRgx},
+	{"pixelate", pixelateRgx},
+	{"redeye", redEyeRgx},
+	{"enlarge", enlargeRgx},
+	{"trim", trimRgx},
+	{"flip", flipRgx},
+	{"flop", flopRgx},
+	{"filter", filterRgx},
+	{"daltonize", daltonizeRgx},
+	{"wasm", wasmFilterRgx},
+	{"adjust", adjustmentRgx},
+	{"raw", rawRgx},
+	{"push", pushRgx},
+	{"version", versionRgx},
+}
+
+// Operation names the operation a url segment asks for, as used in token
+// ops claims, or "" if it isn't one
+func Operation(arg string) string {
+	for _, op := range operations {
+		if op.rgx.MatchString(arg) {
+			return op.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestBearerTokenRS256(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	publicPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	assert.Equal(t, nil, LoadBearerPublicKey(string(publicPem), ""))
+	defer LoadBearerPublicKey("", "")
+
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+	token.Claims["sub"] = "browser-1"
+	token.Claims["ops"] = "resize,quality"
+	signed, _ := token.SignedString(private)
+
+	bearer, err := ParseBearerToken(signed)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "browser-1", bearer.Subject)
+	assert.Equal(t, true, bearer.AllowsArgs([]string{"s_abc", "128x", "q_80"}))
+	assert.Equal(t, false, bearer.AllowsArgs([]string{"128x", "filter_sepia"}))
+	assert.Equal(t, false, bearer.AllowsArgs([]string{"128x", "push"}))
+	assert.Equal(t, false, bearer.AllowsArgs([]string{"128x", "push_e2hhc2h9"}))
+	assert.Equal(t, false, bearer.AllowsArgs([]string{"128x", "v_2"}))
+	assert.Equal(t, true, bearer.AllowsSource("http://anywhere.com/cat.jpg"))
+
+	// the public key must not verify HS256 tokens signed with it
+	forged := jwt.New(jwt.GetSigningMethod("HS256"))
+	forged.Claims["exp"] = time.Now().Add(time.Minute).Unix()
+	forgedSigned, _ := forged.SignedString(publicPem)
+	_, err = ParseBearerToken(forgedSigned)
+	assert.Equal(t, ErrInvalidBearerToken, err)
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// blurHashSamples caps how many pixels are sampled along each axis. A
+// BlurHash only captures a handful of frequencies so sampling every pixel
+// of a large image buys nothing
+const blurHashSamples = 64
+
+// BlurHash encodes img as a https://blurha.sh placeholder string with
+// xComponents by yComponents frequencies
+func BlurHash(img image.Image, xComponents int, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	stepX := int(math.Max(1, float64(width)/blurHashSamples))
+	stepY := int(math.Max(1, float64(height)/blurHashSamples))
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			var factor [3]float64
+			samples := 0
+			for y := 0; y < height; y += stepY {
+				for x := 0; x < width; x += stepX {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					factor[0] += basis * srgbToLinear(r>>8)
+					factor[1] += basis * srgbToLinear(g>>8)
+					factor[2] += basis * srgbToLinear(b>>8)
+					samples++
+				}
+			}
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			scale := normalisation / float64(samples)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+		for _, f := range ac {
+			actualMaximum = math.Max(actualMaximum, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encode83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	hash.WriteString(encode83(linearToSrgb(dc[0])<<16+linearToSrgb(dc[1])<<8+linearToSrgb(dc[2]), 4))
+	for _, f := range ac {
+		hash.WriteString(encode83(
+			quantiseAc(f[0], maximumValue)*19*19+quantiseAc(f[1], maximumValue)*19+quantiseAc(f[2], maximumValue), 2))
+	}
+	return hash.String()
+}
+
+func encode83(value int, length int) string {
+	b := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		b[i] = base83Chars[value%83]
+		value /= 83
+	}
+	return string(b)
+}
+
+func quantiseAc(value float64, maximumValue float64) int {
+	v := value / maximumValue
+	signPow := math.Copysign(math.Pow(math.Abs(v), 0.5), v)
+	return int(math.Max(0, math.Min(18, math.Floor(signPow*9+9.5))))
+}
+
+func srgbToLinear(value uint32) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// contentStoreFormat is the layout version of the content store, kept in
+// <dir>/FORMAT. Stores without one were written before it was versioned
+// and are format 1, whose index entries may lack their source
+const contentStoreFormat = 2
+
+// resultCacheFormat is the version remote cache entries are written with.
+// Entries without one are format 1, which carry no checksum
+const resultCacheFormat = 2
+
+// objectNameRgx matches the object names content store index entries
+// point at
+var objectNameRgx = regexp.MustCompile(`^[0-9a-f]{64}\.[a-z0-9]{1,8}$`)
+
+// migrateContentStore brings the store at dir up to contentStoreFormat
+// before it's used. Older stores have their index checked, dropping
+// entries that are malformed, lack their source or point at missing
+// objects, and objects no entry could name. A store written by a newer
+// version can't be trusted to mean the same thing so its contents are
+// discarded. Leftovers of writes interrupted by the last shutdown are
+// removed too.
+//
+// Processes sharing the store hold a shared lock on <dir>/LOCK while they
+// use it, which is returned to be kept open. Only the first to start, the
+// one that can lock it exclusively, migrates or clears out leftovers, as
+// the others' writes may be in progress
+func migrateContentStore(dir string) (*os.File, error) {
+	lock, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(lock, true, false); err != nil {
+		// wait out a migration by whoever has it, then share the store
+		// as long as it's on this version's format
+		if err = lockFile(lock, false, true); err == nil {
+			var format int
+			format, err = readContentStoreFormat(dir)
+			if err == nil && format != contentStoreFormat {
+				err = fmt.Errorf("content store is format %d and in use by another process", format)
+			}
+		}
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+		return lock, nil
+	}
+
+	if err = migrateLockedContentStore(dir); err == nil {
+		err = lockFile(lock, false, true)
+	}
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	return lock, nil
+}
+
+func migrateLockedContentStore(dir string) error {
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	format, err := readContentStoreFormat(dir)
+	if err != nil {
+		return err
+	}
+	if format == contentStoreFormat {
+		return nil
+	}
+
+	data := grohl.Data{"action": "migrate-contents", "from": format, "to": contentStoreFormat}
+	if format > contentStoreFormat {
+		for _, sub := range []string{"objects", "index"} {
+			if err := os.RemoveAll(filepath.Join(dir, sub)); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+				return err
+			}
+		}
+		data["discarded"] = true
+	} else {
+		data["dropped_entries"], data["dropped_objects"] = validateContentStore(dir)
+	}
+
+	formatPath := filepath.Join(dir, "FORMAT")
+	if err := ioutil.WriteFile(formatPath, []byte(strconv.Itoa(contentStoreFormat)+"\n"), 0644); err != nil {
+		return err
+	}
+	grohl.Log(data)
+	return nil
+}
+
+// readContentStoreFormat is the format of the store at dir, 1 for stores
+// without a FORMAT
+func readContentStoreFormat(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "FORMAT"))
+	if os.IsNotExist(err) {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	format, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("content store format %q isn't a number", strings.TrimSpace(string(b)))
+	}
+	return format, nil
+}
+
+// validateContentStore removes the index entries and objects in dir that
+// can't be served, or can't be purged by source as they don't name it,
+// returning how many of each it removed
+func validateContentStore(dir string) (entries int, objects int) {
+	store := &ContentStore{dir: dir}
+	indexDir := filepath.Join(dir, "index")
+	infos, _ := ioutil.ReadDir(indexDir)
+	for _, info := range infos {
+		path := filepath.Join(indexDir, info.Name())
+		name, source, err := readIndexEntry(path)
+		if err == nil && source != "" && objectNameRgx.MatchString(name) {
+			if _, err = os.Stat(store.ObjectPath(name)); err == nil {
+				continue
+			}
+		}
+		if os.RemoveAll(path) == nil {
+			entries++
+		}
+	}
+
+	filepath.Walk(filepath.Join(dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && !objectNameRgx.MatchString(info.Name()) {
+			if os.Remove(path) == nil {
+				objects++
+			}
+		}
+		return nil
+	})
+	return entries, objects
+}
+
+// checkCachedResult is why a result read back from the remote cache can't
+// be served, nil if it can. Entries from a newer version are left alone
+// for the instances that wrote them, as during a rolling deploy
+func checkCachedResult(result *CachedResult) error {
+	if result.Version > resultCacheFormat {
+		return fmt.Errorf("cached result format %d is newer than %d", result.Version, resultCacheFormat)
+	}
+	if !resultFormatRgx.MatchString(result.Format) {
+		return fmt.Errorf("cached result has invalid format %q", result.Format)
+	}
+	if result.Sha256 != "" && result.Sha256 != dataSha256(result.Data) {
+		return errCorruptResult
+	}
+	return nil
+}
+
+var errCorruptResult = errors.New("cached result doesn't match its checksum")
+
+func dataSha256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// CachePurge picks the cached derivatives to drop, by transform key, by
+// source url, or by sources starting with Prefix or matching Pattern, a
+// glob where * matches anything, slashes included
+type CachePurge struct {
+	Keys    []string `json:"keys"`
+	Urls    []string `json:"urls"`
+	Prefix  string   `json:"prefix"`
+	Pattern string   `json:"pattern"`
+}
+
+// CachePurgeResult lists what was purged. Failures to purge the remote
+// cache or CDN don't stop the rest, they're collected in Errors
+type CachePurgeResult struct {
+	Keys    []string `json:"keys"`
+	Sources []string `json:"sources"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// PurgeCache drops the derivatives picked by p from every configured cache:
+// the memory cache, the content store, the remote cache and the CDN.
+// Sources are matched against what this instance has indexed and the
+// remote cache's own index, so results stored by any instance are dropped
+// from it and can't be fetched back. Other instances' memory caches and
+// content stores only drop them when purged themselves
+func PurgeCache(ctx context.Context, p *CachePurge) (*CachePurgeResult, error) {
+	match, err := p.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	purged := map[string]string{}
+	if Memory != nil {
+		for key, source := range Memory.Purge(match) {
+			purged[key] = source
+		}
+	}
+	if Contents != nil {
+		for key, source := range Contents.Purge(match) {
+			purged[key] = source
+		}
+	}
+	for _, key := range p.Keys {
+		if _, ok := purged[key]; !ok {
+			purged[key] = ""
+		}
+	}
+
+	result := &CachePurgeResult{Keys: []string{}, Sources: []string{}}
+	if RemoteCache != nil {
+		matchSource := func(source string) bool { return match("", source) }
+		for _, prefix := range p.sourcePrefixes() {
+			remote, err := RemoteCache.PurgeSources(ctx, prefix, matchSource)
+			for key, source := range remote {
+				if purged[key] == "" {
+					purged[key] = source
+				}
+			}
+			if err != nil {
+				result.Errors = append(result.Errors, "remote cache: "+err.Error())
+			}
+		}
+	}
+	sources := map[string]bool{}
+	for _, url := range p.Urls {
+		sources[normalizeSourceUrl(url)] = true
+	}
+	for key, source := range purged {
+		result.Keys = append(result.Keys, key)
+		if source != "" {
+			sources[source] = true
+		}
+	}
+	for source := range sources {
+		result.Sources = append(result.Sources, source)
+	}
+	sort.Strings(result.Keys)
+	sort.Strings(result.Sources)
+
+	if RemoteCache != nil {
+		for _, key := range result.Keys {
+			ctx, cancel := context.WithTimeout(ctx, remoteCacheTimeout)
+			err := RemoteCache.Delete(ctx, key)
+			cancel()
+			if err != nil {
+				result.Errors = append(result.Errors, "remote cache: "+err.Error())
+			}
+		}
+	}
+	if Purger != nil && len(result.Sources) > 0 {
+		keys := make([]string, len(result.Sources))
+		for i, source := range result.Sources {
+			keys[i] = SourceKey(source)
+		}
+		if err := Purger.PurgeKeys(keys); err != nil {
+			result.Errors = append(result.Errors, "cdn: "+err.Error())
+		}
+	}
+
+	grohl.Counter(1.0, "cache.purged", len(result.Keys))
+	grohl.Log(grohl.Data{
+		"action":  "purge-cache",
+		"keys":    len(result.Keys),
+		"sources": len(result.Sources),
+		"errors":  len(result.Errors),
+	})
+	return result, nil
+}
+
+// sourcePrefixes are the prefixes every source p picks starts with, one
+// for each url and for the prefix or the start of the pattern
+func (p *CachePurge) sourcePrefixes() []string {
+	prefixes := []string{}
+	for _, url := range p.Urls {
+		prefixes = append(prefixes, normalizeSourceUrl(url))
+	}
+	if p.Prefix != "" {
+		prefixes = append(prefixes, p.Prefix)
+	}
+	if p.Pattern != "" {
+		prefixes = append(prefixes, strings.SplitN(p.Pattern, "*", 2)[0])
+	}
+	return prefixes
+}
+
+// matcher is true for the cache entries p picks, given each one's key and
+// normalized source url
+func (p *CachePurge) matcher() (func(key string, source string) bool, error) {
+	keys := map[string]bool{}
+	for _, key := range p.Keys {
+		keys[key] = true
+	}
+	urls := map[string]bool{}
+	for _, url := range p.Urls {
+		urls[normalizeSourceUrl(url)] = true
+	}
+	var pattern *regexp.Regexp
+	if p.Pattern != "" {
+		parts := strings.Split(p.Pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		pattern = regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+	}
+	if len(keys) == 0 && len(urls) == 0 && p.Prefix == "" && pattern == nil {
+		return nil, errors.New("nothing to purge")
+	}
+
+	return func(key string, source string) bool {
+		if keys[key] {
+			return true
+		}
+		if source == "" {
+			return false
+		}
+		return urls[source] ||
+			(p.Prefix != "" && strings.HasPrefix(source, p.Prefix)) ||
+			(pattern != nil && pattern.MatchString(source))
+	}, nil
+}
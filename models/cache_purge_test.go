@@ -0,0 +1,88 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPurgeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+	Memory = NewMemoryCache(1024, 1024)
+	defer func() { Memory = nil }()
+	remote := &staticResultCache{}
+	RemoteCache = remote
+	defer func() { RemoteCache = nil }()
+
+	cat := filepath.Join(dir, "cat.png")
+	ioutil.WriteFile(cat, []byte("not really a cat"), 0644)
+	dog := filepath.Join(dir, "dog.png")
+	ioutil.WriteFile(dog, []byte("not really a dog"), 0644)
+	catName, _ := Contents.Put("cat-128", "http://example.com/pets/cat.jpg", cat, "png")
+	Contents.Put("dog-128", "http://example.com/pets/dog.jpg", dog, "png")
+	Memory.PutFile("cat-128", "http://example.com/pets/cat.jpg", cat, "", time.Time{})
+
+	result, err := PurgeCache(context.Background(), &CachePurge{Pattern: "http://example.com/*/cat.*"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"cat-128"}, result.Keys)
+	assert.Equal(t, []string{"http://example.com/pets/cat.jpg"}, result.Sources)
+	assert.Equal(t, []string{"cat-128"}, remote.deleted)
+
+	_, ok := Contents.Lookup("cat-128")
+	assert.T(t, !ok)
+	_, err = os.Stat(Contents.ObjectPath(catName))
+	assert.T(t, os.IsNotExist(err))
+	_, ok = Memory.Get("cat-128")
+	assert.T(t, !ok)
+	_, ok = Contents.Lookup("dog-128")
+	assert.T(t, ok)
+
+	result, err = PurgeCache(context.Background(), &CachePurge{Keys: []string{"dog-128", "elsewhere"}})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"dog-128", "elsewhere"}, result.Keys)
+	_, ok = Contents.Lookup("dog-128")
+	assert.T(t, !ok)
+
+	_, err = PurgeCache(context.Background(), &CachePurge{})
+	assert.NotEqual(t, nil, err)
+}
+
+func TestPurgeCacheReachesRemoteResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := indexedResultCache{}
+	RemoteCache = remote
+	defer func() { RemoteCache = nil }()
+
+	// stored by another instance, so not in this one's index
+	data := []byte("not really a cat")
+	cat := &CachedResult{Format: "png", Data: data, Version: resultCacheFormat, Sha256: dataSha256(data), Source: "http://example.com/pets/cat.jpg"}
+	remote.Put(context.Background(), "cat-512", cat)
+	dog := *cat
+	dog.Source = "http://example.com/pets/dog.jpg"
+	remote.Put(context.Background(), "dog-512", &dog)
+
+	result, err := PurgeCache(context.Background(), &CachePurge{Pattern: "http://example.com/*/cat.*"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{"cat-512"}, result.Keys)
+	assert.Equal(t, []string{"http://example.com/pets/cat.jpg"}, result.Sources)
+	_, ok := fetchRemoteResult(context.Background(), dir, "cat-512")
+	assert.T(t, !ok)
+	_, ok = fetchRemoteResult(context.Background(), dir, "dog-512")
+	assert.T(t, ok)
+}
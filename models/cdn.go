@@ -0,0 +1,146 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// CdnPurger invalidates everything a CDN has cached under the given
+// surrogate keys
+type CdnPurger interface {
+	PurgeKeys(keys []string) error
+}
+
+// Purger is nil unless a CDN provider has been configured
+var Purger CdnPurger
+
+var cdnClient = &http.Client{Timeout: 10 * time.Second}
+
+// SurrogateControl is how long the CDN may keep processed images. It can
+// be much longer than Cache-Control as the CDN's copies can be purged by
+// surrogate key, browsers' can't
+var SurrogateControl = "max-age=31536000"
+
+// InitCdn configures purging for the CDN sitting in front of firesize.
+// provider is either "fastly" (id is the service id) or "cloudflare" (id is
+// the zone id)
+func InitCdn(provider string, token string, id string) {
+	switch provider {
+	case "fastly":
+		Purger = &fastlyPurger{apiKey: token, serviceId: id}
+	case "cloudflare":
+		Purger = &cloudflarePurger{apiToken: token, zoneId: id}
+	case "":
+		Purger = nil
+	default:
+		panic("unknown CDN provider " + provider)
+	}
+}
+
+// SourceKey is the surrogate key shared by every derivative of url. The
+// url is normalized first so every spelling of it is purged together
+func SourceKey(url string) string {
+	return "src-" + shortHash(normalizeSourceUrl(url))
+}
+
+// AccountKey is the surrogate key shared by every image served for an account
+func AccountKey(subdomain string) string {
+	return "acct-" + subdomain
+}
+
+// AccountSourceKey is the surrogate key shared by every derivative of url
+// served for one account, so an account can purge its own copies of a
+// source without touching other accounts'
+func AccountSourceKey(subdomain string, url string) string {
+	return "acct-src-" + shortHash(subdomain+" "+normalizeSourceUrl(url))
+}
+
+// PresetKey is the surrogate key shared by every image processed with the
+// same set of url args
+func PresetKey(urlArgs string) string {
+	return "preset-" + shortHash(strings.Trim(urlArgs, "/"))
+}
+
+// SurrogateKeys returns the keys a processed image should be tagged with
+func SurrogateKeys(subdomain string, urlArgs string, url string) []string {
+	return []string{SourceKey(url), AccountKey(subdomain), AccountSourceKey(subdomain, url), PresetKey(urlArgs)}
+}
+
+// SetSurrogateKeyHeaders tags the response for both Fastly (Surrogate-Key)
+// and Cloudflare (Cache-Tag), and sets Surrogate-Control for CDNs that
+// honor it
+func SetSurrogateKeyHeaders(h http.Header, keys []string) {
+	h.Set("Surrogate-Key", strings.Join(keys, " "))
+	h.Set("Cache-Tag", strings.Join(keys, ","))
+	if SurrogateControl != "" {
+		h.Set("Surrogate-Control", SurrogateControl)
+	}
+}
+
+func shortHash(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))[:16]
+}
+
+type fastlyPurger struct {
+	apiKey    string
+	serviceId string
+}
+
+// https://docs.fastly.com/api/purge#purge_db35b293f8a724717fcf25628d713583
+func (p *fastlyPurger) PurgeKeys(keys []string) error {
+	url := fmt.Sprintf("https://api.fastly.com/service/%s/purge", p.serviceId)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", p.apiKey)
+	req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	return doPurge("fastly", req, keys)
+}
+
+type cloudflarePurger struct {
+	apiToken string
+	zoneId   string
+}
+
+// https://api.cloudflare.com/#zone-purge-files-by-cache-tags-or-host
+func (p *cloudflarePurger) PurgeKeys(keys []string) error {
+	body, err := json.Marshal(map[string][]string{"tags": keys})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("https://api.cloudflare.com/client/v4/zones/%s/purge_cache", p.zoneId)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.apiToken)
+	req.Header.Set("Content-Type", "application/json")
+	return doPurge("cloudflare", req, keys)
+}
+
+func doPurge(provider string, req *http.Request, keys []string) error {
+	resp, err := cdnClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	grohl.Log(grohl.Data{
+		"cdn":    provider,
+		"purge":  keys,
+		"status": resp.StatusCode,
+	})
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s purge failed with status %d", provider, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func Test_SourceKeyNormalizesUrl(t *testing.T) {
+	assert.Equal(t, SourceKey("http://example.com/cat.jpg"), SourceKey("HTTP://Example.com:80/cat.jpg"))
+	assert.NotEqual(t, SourceKey("http://example.com/cat.jpg"), SourceKey("http://example.com/dog.jpg"))
+}
+
+func Test_AccountSourceKeyIsPerAccount(t *testing.T) {
+	assert.Equal(t, AccountSourceKey("acme", "http://example.com/cat.jpg"), AccountSourceKey("acme", "HTTP://Example.com:80/cat.jpg"))
+	assert.NotEqual(t, AccountSourceKey("acme", "http://example.com/cat.jpg"), AccountSourceKey("other", "http://example.com/cat.jpg"))
+	assert.NotEqual(t, AccountSourceKey("acme", "http://example.com/cat.jpg"), SourceKey("http://example.com/cat.jpg"))
+}
+
+func Test_SetSurrogateKeyHeaders(t *testing.T) {
+	h := http.Header{}
+	SetSurrogateKeyHeaders(h, []string{"src-a", "acct-b"})
+	assert.Equal(t, "src-a acct-b", h.Get("Surrogate-Key"))
+	assert.Equal(t, "src-a,acct-b", h.Get("Cache-Tag"))
+	assert.Equal(t, SurrogateControl, h.Get("Surrogate-Control"))
+
+	defer func(previous string) { SurrogateControl = previous }(SurrogateControl)
+	SurrogateControl = ""
+	h = http.Header{}
+	SetSurrogateKeyHeaders(h, []string{"src-a"})
+	assert.Equal(t, "", h.Get("Surrogate-Control"))
+}
@@ -0,0 +1,56 @@
+package models
+
+import (
+	"context"
+	"os/exec"
+
+	"github.com/technoweenie/grohl"
+)
+
+// Priority classes. Requests waiting on a response are interactive, jobs,
+// batches and manifests are batch
+const (
+	PriorityInteractive = "interactive"
+	PriorityBatch       = "batch"
+)
+
+// CgroupLimit is written as is to memory.max and cpu.max of the transient
+// cgroup for each delegate process, e.g. "512M" and "50000 100000". Empty
+// values are left unlimited
+type CgroupLimit struct {
+	MemoryMax string
+	CpuMax    string
+}
+
+// CgroupRoot is a cgroup v2 directory firesize may create children in,
+// e.g. /sys/fs/cgroup/firesize. Delegates aren't placed in cgroups unless
+// it's set, and it's only supported on Linux
+var CgroupRoot string
+
+// CgroupLimits are the caps for each priority class
+var CgroupLimits = map[string]CgroupLimit{}
+
+// runLimited runs a heavy delegate process in a transient cgroup capped
+// for its priority class. If the cgroup can't be set up the process runs
+// without one rather than failing the request
+func runLimited(ctx context.Context, cmd *exec.Cmd, priority string) error {
+	if priority == "" {
+		priority = PriorityInteractive
+	}
+	limit, ok := CgroupLimits[priority]
+	if CgroupRoot == "" || !ok {
+		return runCommand(ctx, cmd)
+	}
+
+	release, err := placeInCgroup(cmd, priority, limit)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"cgroup":   CgroupRoot,
+			"priority": priority,
+			"failure":  err,
+		})
+		return runCommand(ctx, cmd)
+	}
+	defer release()
+	return runCommand(ctx, cmd)
+}
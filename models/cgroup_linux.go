@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+var cgroupSeq int64
+
+// InitCgroups enables the memory and cpu controllers for children of
+// CgroupRoot
+func InitCgroups() error {
+	if CgroupRoot == "" {
+		return nil
+	}
+	return ioutil.WriteFile(filepath.Join(CgroupRoot, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+}
+
+// placeInCgroup creates a transient cgroup with limit and has cmd start
+// inside it, so the limits apply from its first instruction. The returned
+// func removes the cgroup once cmd has exited
+func placeInCgroup(cmd *exec.Cmd, priority string, limit CgroupLimit) (func(), error) {
+	dir := filepath.Join(CgroupRoot, fmt.Sprintf("%s-%d-%d", priority, os.Getpid(), atomic.AddInt64(&cgroupSeq, 1)))
+	err := os.Mkdir(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	for file, value := range map[string]string{"memory.max": limit.MemoryMax, "cpu.max": limit.CpuMax} {
+		if value == "" {
+			continue
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+		if err != nil {
+			os.Remove(dir)
+			return nil, err
+		}
+	}
+
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		os.Remove(dir)
+		return nil, err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+
+	return func() {
+		syscall.Close(fd)
+		os.Remove(dir)
+	}, nil
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPlaceInCgroupWritesLimits(t *testing.T) {
+	root, _ := ioutil.TempDir("", "cgroup")
+	defer os.RemoveAll(root)
+	defer func() { CgroupRoot = "" }()
+	CgroupRoot = root
+
+	cmd := exec.Command("true")
+	release, err := placeInCgroup(cmd, PriorityBatch, CgroupLimit{MemoryMax: "512M"})
+	assert.Equal(t, nil, err)
+	defer release()
+
+	dirs, _ := filepath.Glob(filepath.Join(root, "batch-*"))
+	assert.Equal(t, 1, len(dirs))
+	memory, _ := ioutil.ReadFile(filepath.Join(dirs[0], "memory.max"))
+	assert.Equal(t, "512M", string(memory))
+	_, err = os.Stat(filepath.Join(dirs[0], "cpu.max"))
+	assert.T(t, os.IsNotExist(err))
+	assert.T(t, cmd.SysProcAttr.UseCgroupFD)
+}
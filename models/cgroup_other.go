@@ -0,0 +1,21 @@
+//go:build !linux
+
+package models
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errCgroupsUnsupported = errors.New("cgroups are only supported on linux")
+
+func InitCgroups() error {
+	if CgroupRoot == "" {
+		return nil
+	}
+	return errCgroupsUnsupported
+}
+
+func placeInCgroup(cmd *exec.Cmd, priority string, limit CgroupLimit) (func(), error) {
+	return nil, errCgroupsUnsupported
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ClientHintBuckets are the widths automatic sizing rounds up to. Keeping
+// them coarse means browsers with slightly different viewports still share
+// cached derivatives
+var ClientHintBuckets = []int{160, 320, 480, 640, 800, 1024, 1280, 1600, 1920, 2560}
+
+// AcceptClientHints asks browsers to send the hints used by w_auto
+const AcceptClientHints = "DPR, Width, Viewport-Width, Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width"
+
+// VaryClientHints lists the request headers a w_auto response depends on
+const VaryClientHints = "DPR, Width, Viewport-Width, Sec-CH-DPR, Sec-CH-Width, Sec-CH-Viewport-Width"
+
+// ApplyClientHints picks the output width for w_auto requests from the
+// Width, Viewport-Width and DPR hints. Without any hints the width is left
+// unset and the image keeps its original size
+func (p *ProcessArgs) ApplyClientHints(h http.Header) {
+	if !p.AutoWidth {
+		return
+	}
+
+	width := clientHintWidth(h)
+	if width <= 0 {
+		return
+	}
+	p.Width = roundToBucket(width, ClientHintBuckets)
+}
+
+func clientHintWidth(h http.Header) float64 {
+	// Width is already in physical pixels
+	if width := clientHint(h, "Width"); width > 0 {
+		return width
+	}
+
+	viewportWidth := clientHint(h, "Viewport-Width")
+	if viewportWidth <= 0 {
+		return 0
+	}
+	dpr := clientHint(h, "DPR")
+	if dpr <= 0 {
+		dpr = 1
+	}
+	return viewportWidth * dpr
+}
+
+func clientHint(h http.Header, name string) float64 {
+	value := h.Get("Sec-CH-" + name)
+	if value == "" {
+		value = h.Get(name)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// roundToBucket returns the smallest bucket that fits width, or the largest
+// bucket if none do
+func roundToBucket(width float64, buckets []int) int {
+	if len(buckets) == 0 {
+		return int(math.Ceil(width))
+	}
+	i := sort.Search(len(buckets), func(i int) bool {
+		return float64(buckets[i]) >= width
+	})
+	if i == len(buckets) {
+		i--
+	}
+	return buckets[i]
+}
+
+// SaveDataQuality is the highest quality served to clients sending
+// Save-Data: on
+var SaveDataQuality = 50
+
+// SaveDataScale shrinks the requested dimensions for clients sending
+// Save-Data: on. 1 leaves them alone
+var SaveDataScale = 1.0
+
+// ApplySaveData lowers quality and dimensions for clients on metered
+// connections that send Save-Data: on
+func (p *ProcessArgs) ApplySaveData(h http.Header) {
+	if !strings.EqualFold(strings.TrimSpace(h.Get("Save-Data")), "on") {
+		return
+	}
+
+	quality, err := strconv.Atoi(p.Quality)
+	if err != nil || quality > SaveDataQuality {
+		p.Quality = strconv.Itoa(SaveDataQuality)
+	}
+
+	if SaveDataScale > 0 && SaveDataScale < 1 {
+		p.Width = scaleDimension(p.Width, SaveDataScale)
+		p.Height = scaleDimension(p.Height, SaveDataScale)
+	}
+}
+
+func scaleDimension(dimension int, scale float64) int {
+	if dimension <= 0 {
+		return dimension
+	}
+	return int(math.Max(1, math.Floor(float64(dimension)*scale)))
+}
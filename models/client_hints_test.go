@@ -0,0 +1,52 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestClientHintsPickBucketedWidth(t *testing.T) {
+	args := NewProcessArgs([]string{"w_auto"}, imgUrl)
+	assert.T(t, args.AutoWidth)
+
+	args.ApplyClientHints(http.Header{"Width": {"700"}})
+	assert.Equal(t, 800, args.Width)
+
+	args.ApplyClientHints(http.Header{"Viewport-Width": {"412"}, "Dpr": {"2.625"}})
+	assert.Equal(t, 1280, args.Width)
+
+	args.ApplyClientHints(http.Header{"Sec-Ch-Width": {"9000"}})
+	assert.Equal(t, 2560, args.Width)
+}
+
+func TestClientHintsIgnoredWithoutAutoWidth(t *testing.T) {
+	args := NewProcessArgs([]string{"128x"}, imgUrl)
+	args.ApplyClientHints(http.Header{"Width": {"700"}})
+	assert.Equal(t, 128, args.Width)
+
+	args = NewProcessArgs([]string{"w_auto"}, imgUrl)
+	args.ApplyClientHints(http.Header{})
+	assert.Equal(t, 0, args.Width)
+}
+
+func TestSaveDataLowersQualityAndDimensions(t *testing.T) {
+	SaveDataScale = 0.5
+	defer func() { SaveDataScale = 1 }()
+
+	args := NewProcessArgs([]string{"300x201", "q_90"}, imgUrl)
+	args.ApplySaveData(http.Header{"Save-Data": {"on"}})
+	assert.Equal(t, "50", args.Quality)
+	assert.Equal(t, 150, args.Width)
+	assert.Equal(t, 100, args.Height)
+
+	args = NewProcessArgs([]string{"q_30"}, imgUrl)
+	args.ApplySaveData(http.Header{"Save-Data": {"on"}})
+	assert.Equal(t, "30", args.Quality)
+
+	args = NewProcessArgs([]string{"300x"}, imgUrl)
+	args.ApplySaveData(http.Header{})
+	assert.Equal(t, "", args.Quality)
+	assert.Equal(t, 300, args.Width)
+}
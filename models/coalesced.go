@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/technoweenie/grohl"
+)
+
+// coalescedKey indexes the coalesced frames of a gif in the content store
+// by the sha256 of the source's contents, so every size variant of it
+// shares them and a changed source never picks up stale frames
+func coalescedKey(sourceHash string) string {
+	return "coalesced-" + sourceHash
+}
+
+// cachedCoalesce coalesces an animated gif, reusing frames coalesced for
+// an earlier request for the same source when the content store has them.
+// Coalescing dominates the time spent on animated gifs, so without a store
+// every variant pays for it again
+func cachedCoalesce(ctx context.Context, tempDir string, inFile string, source string) (string, error) {
+	if Contents == nil {
+		return coalesceAnimatedGif(ctx, tempDir, inFile)
+	}
+	sourceHash, err := fileSha256(inFile)
+	if err != nil {
+		return coalesceAnimatedGif(ctx, tempDir, inFile)
+	}
+	key := coalescedKey(sourceHash)
+
+	outFile := filepath.Join(tempDir, "temp")
+	if name, ok := Contents.Lookup(key); ok {
+		// later steps may write over their input, so work on a copy
+		if err = copyFile(Contents.ObjectPath(name), outFile); err == nil {
+			grohl.Counter(1.0, "coalesce.cache.hit", 1)
+			return outFile, nil
+		}
+	}
+	grohl.Counter(1.0, "coalesce.cache.miss", 1)
+
+	outFile, err = coalesceAnimatedGif(ctx, tempDir, inFile)
+	if err != nil {
+		return outFile, err
+	}
+	if _, err := Contents.Put(key, source, outFile, "gif"); err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "coalesce-cache-put",
+			"failure": err,
+		})
+	}
+	return outFile, nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
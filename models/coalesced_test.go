@@ -0,0 +1,38 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCachedCoalesceReusesStoredFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+
+	source := filepath.Join(dir, "in")
+	ioutil.WriteFile(source, []byte("GIF89a not really animated"), 0644)
+	frames := filepath.Join(dir, "frames.gif")
+	ioutil.WriteFile(frames, []byte("coalesced frames"), 0644)
+	sourceHash, _ := fileSha256(source)
+	_, err = Contents.Put(coalescedKey(sourceHash), imgUrl, frames, "gif")
+	assert.Equal(t, nil, err)
+
+	tempDir := filepath.Join(dir, "work")
+	os.Mkdir(tempDir, 0755)
+	outFile, err := cachedCoalesce(context.Background(), tempDir, source, imgUrl)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(tempDir, "temp"), outFile)
+	data, _ := ioutil.ReadFile(outFile)
+	assert.Equal(t, "coalesced frames", string(data))
+}
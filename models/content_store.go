@@ -0,0 +1,311 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// ContentStore keeps processed images on disk addressed by the sha256 of
+// their contents, with an index from transform key to content so
+// equivalent requests share a single stored object
+//
+//	<dir>/objects/<hash[0:2]>/<hash>.<format>
+//	<dir>/index/<key>               contains "<hash>.<format>\n<source url>"
+//	<dir>/FORMAT                    the layout version, see migrateContentStore
+//	<dir>/LOCK                      locked by every process using the store
+//
+// Objects' modification times record when they were last used, so once
+// the store grows past maxBytes the least recently used are evicted
+type ContentStore struct {
+	dir      string
+	maxBytes int64
+	lock     *os.File
+
+	mu       sync.Mutex
+	size     int64
+	evicting bool
+}
+
+// Contents is nil unless a content store directory has been configured
+var Contents *ContentStore
+
+// ContentStoreMaxBytes caps the size of the objects in the content store,
+// 0 for no limit. Eviction brings it down to contentStoreLowWater of that
+var ContentStoreMaxBytes int64
+
+const contentStoreLowWater = 0.9
+
+func InitContentStore(dir string) {
+	if Contents != nil {
+		Contents.lock.Close()
+	}
+	if dir == "" {
+		Contents = nil
+		return
+	}
+	for _, sub := range []string{"objects", "index", "tmp"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	lock, err := migrateContentStore(dir)
+	if err != nil {
+		panic(err)
+	}
+	Contents = &ContentStore{dir: dir, maxBytes: ContentStoreMaxBytes, lock: lock}
+	Contents.size = dirSize(filepath.Join(dir, "objects"))
+}
+
+// Lookup returns the stored object name for a transform key
+func (s *ContentStore) Lookup(key string) (name string, ok bool) {
+	name, _, err := readIndexEntry(filepath.Join(s.dir, "index", key))
+	if err != nil {
+		return "", false
+	}
+	now := time.Now()
+	if err := os.Chtimes(s.ObjectPath(name), now, now); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// Modified is when the result indexed under key was stored, the index
+// entry isn't touched by lookups so it keeps that time
+func (s *ContentStore) Modified(key string) time.Time {
+	info, err := os.Stat(filepath.Join(s.dir, "index", key))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// ObjectPath is the location on disk of a stored object name as returned
+// by Lookup and Put
+func (s *ContentStore) ObjectPath(name string) string {
+	if len(name) < 2 {
+		return filepath.Join(s.dir, "objects", name)
+	}
+	return filepath.Join(s.dir, "objects", name[:2], filepath.Base(name))
+}
+
+// Put stores the file at filePath and indexes it under key, returning the
+// object name "<hash>.<format>". source is the url it was made from, kept
+// so its derivatives can be found again when it's purged
+func (s *ContentStore) Put(key string, source string, filePath string, format string) (string, error) {
+	hash, err := fileSha256(filePath)
+	if err != nil {
+		return "", err
+	}
+	name := hash + "." + format
+
+	objectPath := s.ObjectPath(name)
+	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+		err = os.MkdirAll(filepath.Dir(objectPath), 0755)
+		if err != nil {
+			return "", err
+		}
+		err = s.writeAtomically(objectPath, func(w io.Writer) error {
+			in, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer in.Close()
+			_, err = io.Copy(w, in)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+		if info, err := os.Stat(objectPath); err == nil {
+			s.added(info.Size())
+		}
+	}
+
+	err = s.writeAtomically(filepath.Join(s.dir, "index", key), func(w io.Writer) error {
+		_, err := io.WriteString(w, name+"\n"+normalizeSourceUrl(source))
+		return err
+	})
+	return name, err
+}
+
+// readIndexEntry reads the object name and source url an index entry
+// points at. Entries written before sources were kept only have the name
+func readIndexEntry(path string) (name string, source string, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.SplitN(strings.TrimSpace(string(b)), "\n", 2)
+	if len(lines) == 2 {
+		source = lines[1]
+	}
+	return lines[0], source, nil
+}
+
+// Purge removes the index entries for which match is true, returning the
+// source url of each removed key, along with the objects no remaining
+// entry points at
+func (s *ContentStore) Purge(match func(key string, source string) bool) map[string]string {
+	indexDir := filepath.Join(s.dir, "index")
+	entries, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		return nil
+	}
+	purged := map[string]string{}
+	orphaned := map[string]bool{}
+	kept := map[string]bool{}
+	for _, entry := range entries {
+		path := filepath.Join(indexDir, entry.Name())
+		name, source, err := readIndexEntry(path)
+		if err != nil {
+			continue
+		}
+		if !match(entry.Name(), source) {
+			kept[name] = true
+		} else if os.Remove(path) == nil {
+			purged[entry.Name()] = source
+			orphaned[name] = true
+		}
+	}
+
+	var reclaimed int64
+	for name := range orphaned {
+		if kept[name] {
+			continue
+		}
+		objectPath := s.ObjectPath(name)
+		if info, err := os.Stat(objectPath); err == nil && os.Remove(objectPath) == nil {
+			reclaimed += info.Size()
+		}
+	}
+	s.mu.Lock()
+	s.size -= reclaimed
+	s.mu.Unlock()
+	return purged
+}
+
+// added counts a new object towards the size of the store, starting an
+// eviction in the background if that takes it over the limit
+func (s *ContentStore) added(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.size += size
+	if s.maxBytes > 0 && s.size > s.maxBytes && !s.evicting {
+		s.evicting = true
+		go s.evict()
+	}
+}
+
+type storedObject struct {
+	path string
+	size int64
+	used time.Time
+}
+
+// evict removes the least recently used objects until the store is under
+// its low water mark, then the index entries pointing at them
+func (s *ContentStore) evict() {
+	objects := []storedObject{}
+	var total int64
+	filepath.Walk(filepath.Join(s.dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			objects = append(objects, storedObject{path: path, size: info.Size(), used: info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(objects, func(i, k int) bool {
+		return objects[i].used.Before(objects[k].used)
+	})
+
+	target := int64(float64(s.maxBytes) * contentStoreLowWater)
+	evicted := map[string]bool{}
+	var reclaimed int64
+	for _, object := range objects {
+		if total-reclaimed <= target {
+			break
+		}
+		if os.Remove(object.path) == nil {
+			evicted[filepath.Base(object.path)] = true
+			reclaimed += object.size
+		}
+	}
+	s.removeIndexEntries(evicted)
+
+	s.mu.Lock()
+	s.size = total - reclaimed
+	s.evicting = false
+	s.mu.Unlock()
+
+	grohl.Counter(1.0, "content_store.evicted_bytes", int(reclaimed))
+	grohl.Log(grohl.Data{
+		"action":    "evict-contents",
+		"objects":   len(evicted),
+		"reclaimed": reclaimed,
+		"size":      total - reclaimed,
+	})
+}
+
+// removeIndexEntries deletes the keys indexing any of the evicted objects
+func (s *ContentStore) removeIndexEntries(evicted map[string]bool) {
+	if len(evicted) == 0 {
+		return
+	}
+	indexDir := filepath.Join(s.dir, "index")
+	entries, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(indexDir, entry.Name())
+		name, _, err := readIndexEntry(path)
+		if err == nil && evicted[name] {
+			os.Remove(path)
+		}
+	}
+}
+
+// writeAtomically writes to a temporary file and renames it into place so
+// concurrent readers never see a partial object
+func (s *ContentStore) writeAtomically(path string, write func(io.Writer) error) error {
+	tmp, err := ioutil.TempFile(filepath.Join(s.dir, "tmp"), "put")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	err = write(tmp)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func fileSha256(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestContentStoreDeduplicatesIdenticalResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+
+	result := filepath.Join(dir, "out.png")
+	ioutil.WriteFile(result, []byte("not really a png"), 0644)
+
+	first, err := Contents.Put("key1", imgUrl, result, "png")
+	assert.Equal(t, nil, err)
+	second, err := Contents.Put("key2", imgUrl, result, "png")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, first, second)
+	assert.Equal(t, "e90137d39de304eefbbe788bc535c7e82f27abbf8069505fbbd8a9dcdc4f2024.png", first)
+
+	name, ok := Contents.Lookup("key2")
+	assert.T(t, ok)
+	assert.Equal(t, first, name)
+
+	_, ok = Contents.Lookup("missing")
+	assert.T(t, !ok)
+}
+
+func TestCacheKeyDependsOnArgs(t *testing.T) {
+	a := NewProcessArgs([]string{"128x"}, imgUrl)
+	b := NewProcessArgs([]string{"128x"}, imgUrl)
+	c := NewProcessArgs([]string{"64x"}, imgUrl)
+	assert.Equal(t, a.CacheKey(), b.CacheKey())
+	assert.NotEqual(t, a.CacheKey(), c.CacheKey())
+}
+
+func TestCacheKeyNormalizesSourceUrl(t *testing.T) {
+	key := NewProcessArgs([]string{"128x"}, "http://example.com/cat.jpg").CacheKey()
+	for _, source := range []string{"HTTP://Example.COM/cat.jpg", "http://example.com:80/cat.jpg", "http://example.com/cat.jpg#top"} {
+		assert.Equal(t, key, NewProcessArgs([]string{"128x"}, source).CacheKey())
+	}
+	assert.NotEqual(t, key, NewProcessArgs([]string{"128x"}, "http://example.com/Cat.jpg").CacheKey())
+	assert.NotEqual(t, key, NewProcessArgs([]string{"128x"}, "https://example.com/cat.jpg").CacheKey())
+}
+
+func TestContentStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func() { ContentStoreMaxBytes = 0 }()
+	ContentStoreMaxBytes = 250
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+
+	put := func(key string, contents string, used time.Time) {
+		result := filepath.Join(dir, key)
+		ioutil.WriteFile(result, []byte(contents), 0644)
+		name, err := Contents.Put(key, imgUrl, result, "png")
+		assert.Equal(t, nil, err)
+		os.Chtimes(Contents.ObjectPath(name), used, used)
+	}
+	now := time.Now()
+	put("old", strings.Repeat("a", 100), now.Add(-time.Hour))
+	put("used", strings.Repeat("b", 100), now.Add(-2*time.Hour))
+	_, ok := Contents.Lookup("used")
+	assert.T(t, ok)
+
+	// the third object takes the store over its limit
+	put("new", strings.Repeat("c", 100), now)
+	for i := 0; i < 100; i++ {
+		Contents.mu.Lock()
+		evicting := Contents.evicting
+		Contents.mu.Unlock()
+		if !evicting {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, ok = Contents.Lookup("old")
+	assert.T(t, !ok)
+	_, err = os.Stat(filepath.Join(dir, "store", "index", "old"))
+	assert.T(t, os.IsNotExist(err))
+	for _, key := range []string{"used", "new"} {
+		_, ok = Contents.Lookup(key)
+		assert.T(t, ok)
+	}
+	assert.Equal(t, int64(200), Contents.size)
+}
+
+func TestContentStoreMigratesUnversionedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "store")
+
+	InitContentStore(store)
+	result := filepath.Join(dir, "out.png")
+	ioutil.WriteFile(result, []byte("not really a png"), 0644)
+	name, err := Contents.Put("good", imgUrl, result, "png")
+	assert.Equal(t, nil, err)
+	InitContentStore("")
+
+	// a store from before FORMAT, with an entry whose object is gone, a
+	// malformed entry and a leftover partial write
+	os.Remove(filepath.Join(store, "FORMAT"))
+	ioutil.WriteFile(filepath.Join(store, "index", "missing"), []byte(strings.Repeat("0", 64)+".png"), 0644)
+	ioutil.WriteFile(filepath.Join(store, "index", "malformed"), []byte("../../etc/passwd"), 0644)
+	ioutil.WriteFile(filepath.Join(store, "index", "sourceless"), []byte(name), 0644)
+	ioutil.WriteFile(filepath.Join(store, "objects", "put123"), []byte("partial"), 0644)
+	ioutil.WriteFile(filepath.Join(store, "tmp", "put456"), []byte("partial"), 0644)
+
+	InitContentStore(store)
+	defer InitContentStore("")
+	found, ok := Contents.Lookup("good")
+	assert.T(t, ok)
+	assert.Equal(t, name, found)
+	for _, path := range []string{"index/missing", "index/malformed", "index/sourceless", "objects/put123", "tmp/put456"} {
+		_, err = os.Stat(filepath.Join(store, path))
+		assert.T(t, os.IsNotExist(err))
+	}
+	format, _ := ioutil.ReadFile(filepath.Join(store, "FORMAT"))
+	assert.Equal(t, "2\n", string(format))
+}
+
+func TestContentStoreKeepsWritesOfOtherProcesses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "store")
+
+	InitContentStore(store)
+	defer InitContentStore("")
+	partial := filepath.Join(store, "tmp", "put123")
+	ioutil.WriteFile(partial, []byte("partial"), 0644)
+
+	// another process starting on the store while this one uses it
+	lock, err := migrateContentStore(store)
+	assert.Equal(t, nil, err)
+	_, err = os.Stat(partial)
+	assert.Equal(t, nil, err)
+
+	// which can't share it on another format
+	lock.Close()
+	ioutil.WriteFile(filepath.Join(store, "FORMAT"), []byte("1\n"), 0644)
+	_, err = migrateContentStore(store)
+	assert.Equal(t, "content store is format 1 and in use by another process", err.Error())
+}
+
+func TestContentStoreDiscardsNewerFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := filepath.Join(dir, "store")
+
+	InitContentStore(store)
+	result := filepath.Join(dir, "out.png")
+	ioutil.WriteFile(result, []byte("not really a png"), 0644)
+	_, err = Contents.Put("key", imgUrl, result, "png")
+	assert.Equal(t, nil, err)
+	InitContentStore("")
+
+	ioutil.WriteFile(filepath.Join(store, "FORMAT"), []byte("99\n"), 0644)
+	InitContentStore(store)
+	defer InitContentStore("")
+	_, ok := Contents.Lookup("key")
+	assert.T(t, !ok)
+	assert.Equal(t, int64(0), Contents.size)
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// daltonizeRgx matches daltonize_{type}, correcting the image for people
+// with a color vision deficiency, and simulate_{type}, previewing how they
+// see it
+var daltonizeRgx = regexp.MustCompile(`^(daltonize|simulate)_(protanopia|deuteranopia|tritanopia)$`)
+
+type colorMatrix [3][3]float64
+
+// cvdSimulations are the linear RGB matrices of each deficiency at full
+// severity, from Machado, Oliveira and Fernandes (2009)
+var cvdSimulations = map[string]colorMatrix{
+	"protanopia": {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+	"deuteranopia": {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	"tritanopia": {
+		{1.255528, -0.076749, -0.178779},
+		{-0.078411, 0.930809, 0.147602},
+		{0.004733, 0.691367, 0.303900},
+	},
+}
+
+// daltonizeShift moves the color information a deficiency loses into the
+// channels that are still seen
+var daltonizeShift = colorMatrix{
+	{0, 0, 0},
+	{0.7, 1, 0},
+	{0.7, 0, 1},
+}
+
+// daltonizeMatrix corrects for the deficiency simulated by sim, adding the
+// difference between the original and what's seen back shifted to other
+// channels: I + shift * (I - sim)
+func daltonizeMatrix(sim colorMatrix) colorMatrix {
+	var m colorMatrix
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				lost := -sim[k][j]
+				if k == j {
+					lost++
+				}
+				m[i][j] += daltonizeShift[i][k] * lost
+			}
+			if i == j {
+				m[i][j]++
+			}
+		}
+	}
+	return m
+}
+
+func (m colorMatrix) String() string {
+	values := []string{}
+	for _, row := range m {
+		for _, v := range row {
+			values = append(values, fmt.Sprintf("%.6f", v))
+		}
+	}
+	return strings.Join(values, " ")
+}
+
+// daltonizeArgs apply the requested correction or simulation in linear
+// RGB, where the matrices are defined
+func (p *ProcessArgs) daltonizeArgs() []string {
+	if p.Daltonize == "" {
+		return nil
+	}
+	parts := strings.SplitN(p.Daltonize, "_", 2)
+	m := cvdSimulations[parts[1]]
+	if parts[0] == "daltonize" {
+		m = daltonizeMatrix(m)
+	}
+	return []string{"-colorspace", "RGB", "-color-matrix", m.String(), "-colorspace", "sRGB"}
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isDataUri is true for sources given inline as a data: uri rather than
+// fetched from an origin
+func isDataUri(source string) bool {
+	return strings.HasPrefix(source, "data:")
+}
+
+// DataUriFromBase64 is the data: uri of a base64 encoded image, as given
+// in a b64src param
+func DataUriFromBase64(b64src string) string {
+	return "data:;base64," + b64src
+}
+
+// decodeDataUri writes the contents of a data: uri, base64 or percent
+// encoded, to inFile returning its media type and size
+// https://www.rfc-editor.org/rfc/rfc2397
+func decodeDataUri(source string, inFile string) (string, int64, error) {
+	comma := strings.IndexByte(source, ',')
+	if !isDataUri(source) || comma < 0 {
+		return "", 0, statusErrorf(http.StatusBadRequest, "invalid data uri")
+	}
+	mediaType, encoded := source[len("data:"):comma], source[comma+1:]
+
+	var data []byte
+	var err error
+	if strings.HasSuffix(mediaType, ";base64") {
+		mediaType = strings.TrimSuffix(mediaType, ";base64")
+		data, err = decodeBase64(encoded)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(encoded)
+		data = []byte(unescaped)
+	}
+	if err != nil {
+		return "", 0, statusErrorf(http.StatusBadRequest, "invalid data uri: %s", err)
+	}
+	if err = checkSourceSize(int64(len(data))); err != nil {
+		return "", 0, err
+	}
+	return mediaType, int64(len(data)), ioutil.WriteFile(inFile, data, 0644)
+}
+
+// decodeBase64 accepts standard and url safe base64, padded or not. A +
+// sent unescaped in a query string arrives as a space so is put back
+func decodeBase64(encoded string) ([]byte, error) {
+	encoded = strings.Replace(encoded, " ", "+", -1)
+	var err error
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		var data []byte
+		if data, err = encoding.DecodeString(encoded); err == nil {
+			return data, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestDecodeDataUri(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inFile := filepath.Join(dir, "in")
+
+	mediaType, size, err := decodeDataUri("data:image/gif;base64,R0lGODlh", inFile)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "image/gif", mediaType)
+	assert.Equal(t, int64(6), size)
+	data, _ := ioutil.ReadFile(inFile)
+	assert.Equal(t, "GIF89a", string(data))
+
+	// a + sent unescaped in a query string arrives as a space
+	_, _, err = decodeDataUri(DataUriFromBase64("/9j/ w=="), inFile)
+	assert.Equal(t, nil, err)
+	data, _ = ioutil.ReadFile(inFile)
+	assert.Equal(t, []byte{0xff, 0xd8, 0xff, 0xfb}, data)
+
+	_, _, err = decodeDataUri("data:text/plain,%3Csvg%3E", inFile)
+	assert.Equal(t, nil, err)
+	data, _ = ioutil.ReadFile(inFile)
+	assert.Equal(t, "<svg>", string(data))
+
+	_, _, err = decodeDataUri("data:image/gif;base64", inFile)
+	assert.Equal(t, 400, err.(*StatusError).Status)
+	_, _, err = decodeDataUri("data:image/gif;base64,!!!", inFile)
+	assert.Equal(t, 400, err.(*StatusError).Status)
+}
@@ -21,6 +21,8 @@ func InitDb(url string) {
 	Dbm = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
 	Dbm.AddTableWithName(Account{}, "accounts").SetKeys(true, "Id")
 	Dbm.AddTableWithName(ImageRequest{}, "image_requests").SetKeys(true, "Id")
+	Dbm.AddTableWithName(ApiKey{}, "api_keys").SetKeys(false, "Key")
+	Dbm.AddTableWithName(ServiceMode{}, "service_modes").SetKeys(false, "Id")
 	Dbm.TraceOn("[gorp]", log.New(os.Stdout, "sql:", log.Lmicroseconds))
 }
 
@@ -0,0 +1,380 @@
+package models
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// delegate is an external program firesize shells out to
+type delegate struct {
+	Name        string
+	VersionArgs []string
+	VersionRgx  *regexp.Regexp
+	Minimum     string
+	Required    bool
+
+	// set by ConfigureDelegate
+	configuredPath string
+	prefix         []string
+
+	path    string
+	version string
+}
+
+var delegates = map[string]*delegate{
+	"convert": {
+		Name:        "convert",
+		VersionArgs: []string{"-version"},
+		VersionRgx:  regexp.MustCompile(`ImageMagick (\d+\.\d+\.\d+)`),
+		Minimum:     "6.7.0",
+		Required:    true,
+	},
+	"identify": {
+		Name:        "identify",
+		VersionArgs: []string{"-version"},
+		VersionRgx:  regexp.MustCompile(`ImageMagick (\d+\.\d+\.\d+)`),
+		Minimum:     "6.7.0",
+		Required:    true,
+	},
+	"ffmpeg": {
+		Name:        "ffmpeg",
+		VersionArgs: []string{"-version"},
+		VersionRgx:  regexp.MustCompile(`ffmpeg version n?(\d+\.\d+(?:\.\d+)?)`),
+		Minimum:     "2.0",
+	},
+	"gifsicle": {
+		Name:        "gifsicle",
+		VersionArgs: []string{"--version"},
+		VersionRgx:  regexp.MustCompile(`Gifsicle (\d+\.\d+)`),
+		Minimum:     "1.80",
+	},
+	"rsvg-convert": {
+		Name:        "rsvg-convert",
+		VersionArgs: []string{"--version"},
+		VersionRgx:  regexp.MustCompile(`rsvg-convert version (\d+\.\d+(?:\.\d+)?)`),
+		Minimum:     "2.40",
+	},
+	"gs": {
+		Name:        "gs",
+		VersionArgs: []string{"--version"},
+		VersionRgx:  regexp.MustCompile(`^(\d+\.\d+(?:\.\d+)?)`),
+		Minimum:     "9.0",
+	},
+	"curl": {
+		Name:        "curl",
+		VersionArgs: []string{"--version"},
+		VersionRgx:  regexp.MustCompile(`curl (\d+\.\d+\.\d+)`),
+		Minimum:     "7.80.0",
+	},
+	"realesrgan": {
+		Name:        "realesrgan-ncnn-vulkan",
+		VersionArgs: []string{"-h"},
+		VersionRgx:  regexp.MustCompile(`realesrgan-ncnn-vulkan v?(\d+\.\d+\.\d+)`),
+		Minimum:     "0.2.0",
+	},
+	"wasmtime": {
+		Name:        "wasmtime",
+		VersionArgs: []string{"--version"},
+		VersionRgx:  regexp.MustCompile(`wasmtime(?:-cli)? (\d+\.\d+\.\d+)`),
+		Minimum:     "14.0.0",
+	},
+}
+
+// DelegateSearchPaths are checked after PATH, covering where the common
+// Heroku and Cloud Native buildpacks install binaries
+var DelegateSearchPaths = []string{
+	"/app/vendor/imagemagick/bin",
+	"/app/vendor/ffmpeg/bin",
+	"/app/vendor/ffmpeg",
+	"/app/.apt/usr/bin",
+	"/app/bin",
+	"/layers/*/*/bin",
+	"/usr/local/bin",
+}
+
+// FfmpegDownloadUrl is a pinned static ffmpeg build, either the binary or
+// a .tar.gz containing it, fetched at boot if ffmpeg can't be found.
+// FfmpegDownloadSha256 verifies the download when set
+var FfmpegDownloadUrl string
+var FfmpegDownloadSha256 string
+var FfmpegInstallDir = filepath.Join(os.TempDir(), "firesize-bin")
+
+// DelegateNames lists the delegates that can be configured
+func DelegateNames() []string {
+	names := make([]string, 0, len(delegates))
+	for name := range delegates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ConfigureDelegate runs the named delegate from path instead of searching
+// for it, and prefixes its command line with a wrapper such as
+// "nice -n 10" or "timeout 20". Either may be empty
+func ConfigureDelegate(name string, path string, prefix string) {
+	d, ok := delegates[name]
+	if !ok {
+		return
+	}
+	d.configuredPath = path
+	d.prefix = strings.Fields(prefix)
+}
+
+// DelegateNice is the niceness delegates run at, 0 to leave it alone.
+// DelegateIoniceClass and DelegateIoniceLevel set their IO scheduling
+// class (1 realtime, 2 best effort, 3 idle) and level, 0 to leave it alone.
+// Running heavy transforms at a lower priority keeps the server itself
+// responsive for cached and proxied requests
+var DelegateNice int
+var DelegateIoniceClass int
+var DelegateIoniceLevel int
+
+// priorityPrefix is prepended to every delegate command line, built by
+// LocateDelegates from the settings above
+var priorityPrefix []string
+
+func buildPriorityPrefix() []string {
+	prefix := []string{}
+	if DelegateNice != 0 {
+		if path := findExecutable("nice"); path != "" {
+			prefix = append(prefix, path, "-n", strconv.Itoa(DelegateNice))
+		} else {
+			grohl.Log(grohl.Data{"delegate": "nice", "status": "missing"})
+		}
+	}
+	if DelegateIoniceClass != 0 {
+		if path := findExecutable("ionice"); path != "" {
+			prefix = append(prefix, path, "-c", strconv.Itoa(DelegateIoniceClass))
+			if DelegateIoniceClass != 3 {
+				prefix = append(prefix, "-n", strconv.Itoa(DelegateIoniceLevel))
+			}
+		} else {
+			grohl.Log(grohl.Data{"delegate": "ionice", "status": "missing"})
+		}
+	}
+	return prefix
+}
+
+// LocateDelegates finds each delegate and checks its version, downloading
+// ffmpeg if it's missing and a download url is configured. Missing or out
+// of date required delegates are an error so misconfigured dynos fail at
+// boot rather than on the first request
+func LocateDelegates() error {
+	priorityPrefix = buildPriorityPrefix()
+
+	problems := []string{}
+	for _, d := range delegates {
+		if d.configuredPath != "" {
+			d.path = findExecutable(d.configuredPath)
+		} else {
+			d.path = findExecutable(d.Name)
+		}
+		if d.path == "" && d.Name == "ffmpeg" && FfmpegDownloadUrl != "" {
+			path, err := downloadFfmpeg()
+			if err != nil {
+				grohl.Log(grohl.Data{"delegate": d.Name, "download": FfmpegDownloadUrl, "failure": err})
+			}
+			d.path = path
+		}
+
+		if d.path == "" {
+			grohl.Log(grohl.Data{"delegate": d.Name, "status": "missing", "required": d.Required})
+			if d.Required {
+				problems = append(problems, d.Name+" not found")
+			}
+			continue
+		}
+
+		d.version = delegateVersion(d)
+		status := "ok"
+		if d.version == "" {
+			status = "unknown-version"
+		} else if compareVersions(d.version, d.Minimum) < 0 {
+			status = "outdated"
+			if d.Required {
+				problems = append(problems, fmt.Sprintf("%s %s is older than %s", d.Name, d.version, d.Minimum))
+			}
+		}
+		grohl.Log(grohl.Data{"delegate": d.Name, "path": d.path, "version": d.version, "status": status})
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("delegates: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// delegateCommand runs the named delegate from wherever LocateDelegates
+// found it, falling back to a PATH lookup, behind the priority and any
+// configured prefix. It's killed when ctx is done
+func delegateCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	d, ok := delegates[name]
+	if !ok {
+		return commandContext(ctx, name, args...)
+	}
+
+	path := d.path
+	if path == "" {
+		path = d.configuredPath
+	}
+	if path == "" {
+		path = name
+	}
+	prefix := append(append([]string{}, priorityPrefix...), d.prefix...)
+	if len(prefix) == 0 {
+		return commandContext(ctx, path, args...)
+	}
+	cmdArgs := append(prefix[1:], path)
+	cmdArgs = append(cmdArgs, args...)
+	return commandContext(ctx, prefix[0], cmdArgs...)
+}
+
+func findExecutable(name string) string {
+	// configured paths are used as is
+	if strings.Contains(name, "/") {
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			return name
+		}
+		return ""
+	}
+	if path, err := exec.LookPath(name); err == nil {
+		return path
+	}
+	for _, dir := range DelegateSearchPaths {
+		matches, _ := filepath.Glob(filepath.Join(dir, name))
+		for _, path := range matches {
+			if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+				return path
+			}
+		}
+	}
+	return ""
+}
+
+func delegateVersion(d *delegate) string {
+	output, _ := exec.Command(d.path, d.VersionArgs...).CombinedOutput()
+	match := d.VersionRgx.FindSubmatch(output)
+	if match == nil {
+		return ""
+	}
+	return string(match[1])
+}
+
+// compareVersions compares dotted version numbers numerically, returning
+// -1, 0 or 1
+func compareVersions(a string, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func downloadFfmpeg() (string, error) {
+	err := os.MkdirAll(FfmpegInstallDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(FfmpegInstallDir, "ffmpeg")
+
+	resp, err := http.Get(FfmpegDownloadUrl)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading ffmpeg: %s", resp.Status)
+	}
+
+	tmp, err := ioutil.TempFile(FfmpegInstallDir, "download")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), resp.Body)
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if FfmpegDownloadSha256 != "" && hex.EncodeToString(hash.Sum(nil)) != strings.ToLower(FfmpegDownloadSha256) {
+		return "", fmt.Errorf("ffmpeg download doesn't match FFMPEG_DOWNLOAD_SHA256")
+	}
+
+	if strings.HasSuffix(FfmpegDownloadUrl, ".tar.gz") || strings.HasSuffix(FfmpegDownloadUrl, ".tgz") {
+		err = extractFromTarGz(tmp.Name(), "ffmpeg", path)
+	} else {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return path, os.Chmod(path, 0755)
+}
+
+// extractFromTarGz copies the first member of archive called name to path
+func extractFromTarGz(archive string, name string, path string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	r := tar.NewReader(gz)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s not found in archive", name)
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || filepath.Base(header.Name) != name {
+			continue
+		}
+
+		out, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, r)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+}
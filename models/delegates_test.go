@@ -0,0 +1,45 @@
+package models
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("6.9.10", "6.9.10"))
+	assert.Equal(t, 1, compareVersions("6.10.0", "6.9.10"))
+	assert.Equal(t, -1, compareVersions("4.2", "4.2.1"))
+	assert.Equal(t, 1, compareVersions("1.92", "1.80"))
+}
+
+func TestDelegateVersionRegexps(t *testing.T) {
+	assert.Equal(t, "6.9.10", delegates["convert"].VersionRgx.FindStringSubmatch(
+		"Version: ImageMagick 6.9.10-23 Q16 x86_64 20190101 https://imagemagick.org")[1])
+	assert.Equal(t, "4.4", delegates["ffmpeg"].VersionRgx.FindStringSubmatch(
+		"ffmpeg version n4.4 Copyright (c) 2000-2021 the FFmpeg developers")[1])
+	assert.Equal(t, "1.92", delegates["gifsicle"].VersionRgx.FindStringSubmatch("LCDF Gifsicle 1.92")[1])
+}
+
+func TestDelegateCommandPrefix(t *testing.T) {
+	defer ConfigureDelegate("convert", "", "")
+
+	ConfigureDelegate("convert", "/opt/im/bin/convert", "nice -n 10")
+	cmd := delegateCommand(context.Background(), "convert", "in.png", "out.png")
+	assert.Equal(t, []string{"nice", "-n", "10", "/opt/im/bin/convert", "in.png", "out.png"}, cmd.Args)
+
+	ConfigureDelegate("convert", "", "")
+	cmd = delegateCommand(context.Background(), "convert", "in.png", "out.png")
+	assert.Equal(t, []string{"convert", "in.png", "out.png"}, cmd.Args)
+}
+
+func TestDelegateCommandPriority(t *testing.T) {
+	defer func() { priorityPrefix = nil }()
+	defer ConfigureDelegate("ffmpeg", "", "")
+
+	priorityPrefix = []string{"/usr/bin/nice", "-n", "10", "/usr/bin/ionice", "-c", "3"}
+	ConfigureDelegate("ffmpeg", "", "timeout 20")
+	cmd := delegateCommand(context.Background(), "ffmpeg", "-i", "in.gif")
+	assert.Equal(t, []string{"/usr/bin/nice", "-n", "10", "/usr/bin/ionice", "-c", "3", "timeout", "20", "ffmpeg", "-i", "in.gif"}, cmd.Args)
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DoctorCheck is the outcome of one capability check
+type DoctorCheck struct {
+	Name   string
+	Ok     bool
+	Detail string
+}
+
+// doctorTransform is an end to end transform of a fixture. prepare, if
+// set, converts the fixture to the format under test first
+type doctorTransform struct {
+	name    string
+	fixture string
+	prepare []string
+	ext     string
+	args    []string
+	verify  func(outFile string) error
+}
+
+var doctorTransforms = []doctorTransform{
+	{
+		name:    "static jpeg",
+		fixture: "static.jpg",
+		args:    []string{"100x100", "g_center"},
+		verify:  expectDimensions(100, 100),
+	},
+	{
+		name:    "animated gif",
+		fixture: "animated.gif",
+		args:    []string{"32x"},
+		verify: func(outFile string) error {
+			if frames := frameCount(context.Background(), outFile); frames < 2 {
+				return fmt.Errorf("expected an animation, got %d frames", frames)
+			}
+			return nil
+		},
+	},
+	{
+		name:    "gif to mp4",
+		fixture: "animated.gif",
+		args:    []string{"32x", "mp4"},
+		verify:  expectExtension(".mp4"),
+	},
+	{
+		name:    "cmyk to srgb",
+		fixture: "static.jpg",
+		prepare: []string{"-colorspace", "CMYK"},
+		ext:     "jpg",
+		args:    []string{"100x"},
+		verify: func(outFile string) error {
+			output, err := identify(context.Background(), "-format", "%[colorspace]", outFile+"[0]")
+			if err != nil {
+				return err
+			}
+			if colorspace := strings.TrimSpace(output); colorspace != "sRGB" {
+				return fmt.Errorf("expected sRGB, got %s", colorspace)
+			}
+			return nil
+		},
+	},
+	{
+		name:    "heic",
+		fixture: "static.jpg",
+		ext:     "heic",
+		args:    []string{"100x", "jpg"},
+		verify:  expectDimensions(100, 75),
+	},
+}
+
+// RunDoctor checks each delegate and runs a battery of transforms over
+// the fixtures in fixturesDir, reporting what works in this environment
+func RunDoctor(fixturesDir string) []DoctorCheck {
+	checks := []DoctorCheck{}
+	for _, name := range DelegateNames() {
+		d := delegates[name]
+		check := DoctorCheck{Name: name, Ok: d.path != "" || !d.Required}
+		switch {
+		case d.path == "" && d.Required:
+			check.Detail = "not found"
+		case d.path == "":
+			check.Detail = "not found (optional)"
+		case d.version == "":
+			check.Detail = d.path + " (unknown version)"
+		default:
+			check.Detail = d.path + " " + d.version
+			if compareVersions(d.version, d.Minimum) < 0 {
+				check.Ok = false
+				check.Detail += ", older than " + d.Minimum
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	for _, transform := range doctorTransforms {
+		check := DoctorCheck{Name: transform.name, Ok: true, Detail: "ok"}
+		if err := transform.run(fixturesDir); err != nil {
+			check.Ok, check.Detail = false, err.Error()
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+func (t doctorTransform) run(fixturesDir string) error {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := filepath.Join(fixturesDir, t.fixture)
+	if t.ext != "" {
+		prepared := filepath.Join(tempDir, "fixture."+t.ext)
+		cmdArgs := append(append([]string{source}, t.prepare...), prepared)
+		cmd := delegateCommand(context.Background(), "convert", cmdArgs...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if len(output) > 0 {
+				err = fmt.Errorf("%s", strings.TrimSpace(string(output)))
+			}
+			return fmt.Errorf("preparing %s fixture: %v", t.ext, err)
+		}
+		source = prepared
+	}
+
+	variantDir := filepath.Join(tempDir, "out")
+	err = os.Mkdir(variantDir, 0755)
+	if err != nil {
+		return err
+	}
+	outFile, err := processVariant(variantDir, source, source, t.args)
+	if err != nil {
+		return err
+	}
+	return t.verify(outFile)
+}
+
+func expectDimensions(width int, height int) func(string) error {
+	return func(outFile string) error {
+		w, h, err := identifyDimensions(context.Background(), outFile)
+		if err != nil {
+			return err
+		}
+		if w != width || h != height {
+			return fmt.Errorf("expected %dx%d, got %dx%d", width, height, w, h)
+		}
+		return nil
+	}
+}
+
+func expectExtension(ext string) func(string) error {
+	return func(outFile string) error {
+		if filepath.Ext(outFile) != ext {
+			return fmt.Errorf("expected a %s, got %s", ext, filepath.Base(outFile))
+		}
+		info, err := os.Stat(outFile)
+		if err != nil {
+			return err
+		}
+		if info.Size() == 0 {
+			return fmt.Errorf("%s is empty", filepath.Base(outFile))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,252 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+// flakyOrigin serves source, cutting the first response off half way
+func flakyOrigin(source []byte, etag string) (*httptest.Server, *[]string) {
+	ranges := []string{}
+	first := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", etag)
+
+		var start int
+		if r.Header.Get("Range") != "" && r.Header.Get("If-Range") == etag {
+			fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(source)-1, len(source)))
+			w.Header().Set("Content-Length", fmt.Sprint(len(source)-start))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set("Content-Length", fmt.Sprint(len(source)))
+		}
+
+		if first {
+			first = false
+			w.Write(source[:len(source)/2])
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.Write(source[start:])
+	}))
+	return server, &ranges
+}
+
+func downloadFrom(t *testing.T, url string) ([]byte, error) {
+	allowed := SourceAllowedNetworks
+	defer func() { SourceAllowedNetworks = allowed }()
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+
+	dir, _ := ioutil.TempDir("", "download")
+	defer os.RemoveAll(dir)
+	inFile, err := downloadRemote(dir, "", &ProcessArgs{Url: url})
+	data, _ := ioutil.ReadFile(inFile)
+	return data, err
+}
+
+func TestDownloadResumesWithIfRange(t *testing.T) {
+	source := bytes.Repeat([]byte("firesize"), 4096)
+	server, ranges := flakyOrigin(source, `"v1"`)
+	defer server.Close()
+
+	data, err := downloadFrom(t, server.URL+"/cat.jpg")
+	assert.Equal(t, nil, err)
+	assert.T(t, bytes.Equal(source, data))
+	assert.Equal(t, []string{"", fmt.Sprintf("bytes=%d-", len(source)/2)}, *ranges)
+}
+
+func TestDownloadRestartsWithoutStrongValidator(t *testing.T) {
+	source := bytes.Repeat([]byte("firesize"), 4096)
+	server, ranges := flakyOrigin(source, `W/"v1"`)
+	defer server.Close()
+
+	defer func(retries int) { SourceRetries = retries }(SourceRetries)
+	SourceRetries = 0
+	_, err := downloadFrom(t, server.URL+"/cat.jpg")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, []string{""}, *ranges)
+
+	// a retry downloads it again from the start
+	server, ranges = flakyOrigin(source, `W/"v1"`)
+	defer server.Close()
+	SourceRetries = 1
+	data, err := downloadFrom(t, server.URL+"/cat.jpg")
+	assert.Equal(t, nil, err)
+	assert.T(t, bytes.Equal(source, data))
+	assert.Equal(t, []string{"", ""}, *ranges)
+}
+
+func TestDownloadRetriesUnavailableOrigins(t *testing.T) {
+	defer func(backoff time.Duration) { SourceRetryBackoff = backoff }(SourceRetryBackoff)
+	SourceRetryBackoff = time.Millisecond
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests <= len(statuses) {
+			w.WriteHeader(statuses[requests-1])
+			return
+		}
+		w.Write([]byte("not really a jpeg"))
+	}))
+	defer server.Close()
+
+	data, err := downloadFrom(t, server.URL+"/cat.jpg")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "not really a jpeg", string(data))
+	assert.Equal(t, 3, requests)
+
+	// out of retries
+	requests = 0
+	statuses = []int{502, 502, 502}
+	_, err = downloadFrom(t, server.URL+"/cat.jpg")
+	statusErr, ok := err.(*StatusError)
+	assert.T(t, ok)
+	assert.Equal(t, "origin_unavailable", statusErr.Code)
+	assert.Equal(t, 502, statusErr.Details["origin_status"])
+	assert.Equal(t, 3, requests)
+
+	// other statuses aren't retried
+	requests = 0
+	statuses = []int{http.StatusNotFound}
+	_, err = downloadFrom(t, server.URL+"/cat.jpg")
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, 1, requests)
+}
+
+func TestDownloadTimesOutSlowOrigins(t *testing.T) {
+	defer func(timeout time.Duration, retries int) {
+		DownloadTimeout, SourceRetries = timeout, retries
+	}(DownloadTimeout, SourceRetries)
+	DownloadTimeout, SourceRetries = 50*time.Millisecond, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not really"))
+		w.(http.Flusher).Flush()
+		time.Sleep(time.Second)
+	}))
+	defer server.Close()
+
+	_, err := downloadFrom(t, server.URL+"/cat.jpg")
+	statusErr, ok := err.(*StatusError)
+	assert.T(t, ok)
+	assert.Equal(t, http.StatusGatewayTimeout, statusErr.Status)
+	assert.Equal(t, "origin_timeout", statusErr.Code)
+	SourceRetries = 1
+	_, ok = sourceRetryWait(context.Background(), statusErr, 0)
+	assert.T(t, ok)
+}
+
+func TestDelegateTimeout(t *testing.T) {
+	assert.Equal(t, IdentifyTimeout, delegateTimeout("identify"))
+	assert.Equal(t, FfmpegTimeout, delegateTimeout("ffmpeg"))
+	assert.Equal(t, ConvertTimeout, delegateTimeout("convert"))
+	assert.Equal(t, ConvertTimeout, delegateTimeout("vips"))
+}
+
+func TestSourceRetryWait(t *testing.T) {
+	ctx := context.Background()
+	unavailable := &StatusError{Status: 502, Code: "origin_unavailable", Details: map[string]interface{}{}}
+	wait, ok := sourceRetryWait(ctx, unavailable, 1)
+	assert.T(t, ok)
+	assert.Equal(t, 2*SourceRetryBackoff, wait)
+
+	unavailable.Details["retry_after"] = 3
+	wait, ok = sourceRetryWait(ctx, unavailable, 0)
+	assert.T(t, ok)
+	assert.Equal(t, 3*time.Second, wait)
+
+	// not worth waiting for past the deadline
+	deadline, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	_, ok = sourceRetryWait(deadline, unavailable, 0)
+	assert.T(t, !ok)
+
+	_, ok = sourceRetryWait(ctx, sourceTooLarge("too large"), 0)
+	assert.T(t, !ok)
+	_, ok = sourceRetryWait(ctx, unavailable, SourceRetries)
+	assert.T(t, !ok)
+
+	codes, err := ParseStatusCodes("429, 503")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[int]bool{429: true, 503: true}, codes)
+	_, err = ParseStatusCodes("5xx")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestDownloadVerifiesSourceChecksum(t *testing.T) {
+	source := []byte("not really a jpeg")
+	sum := sha256.Sum256(source)
+	header := hex.EncodeToString(sum[:])
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/unsigned.jpg" {
+			w.Header().Set("X-Amz-Meta-Sha256", header)
+		}
+		if r.URL.Path == "/tampered.jpg" {
+			w.Write([]byte("tampered"))
+			return
+		}
+		w.Write(source)
+	}))
+	defer server.Close()
+	defer func() { SourceChecksums = nil }()
+	SourceChecksums = ParseSourceChecksums("127.0.0.1=x-amz-meta-sha256")
+
+	data, err := downloadFrom(t, server.URL+"/cat.jpg")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, source, data)
+
+	for _, path := range []string{"/tampered.jpg", "/unsigned.jpg"} {
+		_, err = downloadFrom(t, server.URL+path)
+		statusErr, ok := err.(*StatusError)
+		assert.T(t, ok)
+		assert.Equal(t, http.StatusBadGateway, statusErr.Status)
+	}
+
+	header = base64.StdEncoding.EncodeToString(sum[:])
+	_, err = downloadFrom(t, server.URL+"/cat.jpg")
+	assert.Equal(t, nil, err)
+}
+
+func TestDownloadRefusesSoft404s(t *testing.T) {
+	for _, c := range []struct {
+		contentType string
+		body        string
+		code        string
+	}{
+		{"image/jpeg", "", "empty_source"},
+		{"text/html; charset=utf-8", "<!DOCTYPE html><html><body>Not found</body></html>", "html_source"},
+		{"image/png", "\n  <html><head><title>404</title></head></html>", "html_source"},
+		{"application/json", `{"error": "not found"}`, "json_source"},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", c.contentType)
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, c.body)
+		}))
+		_, err := downloadFrom(t, server.URL+"/cat.jpg")
+		server.Close()
+
+		statusErr, ok := err.(*StatusError)
+		assert.T(t, ok)
+		assert.Equal(t, http.StatusUnprocessableEntity, statusErr.Status)
+		assert.Equal(t, c.code, statusErr.Code)
+		assert.Equal(t, http.StatusNotFound, statusErr.Details["origin_status"])
+		assert.Equal(t, c.contentType, statusErr.Details["origin_content_type"])
+	}
+}
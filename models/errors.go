@@ -0,0 +1,23 @@
+package models
+
+import "fmt"
+
+// StatusError is a processing failure that should be reported to the
+// client with a specific HTTP status rather than a generic 500
+type StatusError struct {
+	Status  int
+	Message string
+
+	// Code and Details, when set, are reported as a JSON error body so
+	// clients can tell failures apart without parsing the message
+	Code    string
+	Details map[string]interface{}
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+func statusErrorf(status int, format string, a ...interface{}) *StatusError {
+	return &StatusError{Status: status, Message: fmt.Sprintf(format, a...)}
+}
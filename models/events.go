@@ -0,0 +1,180 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// TransformEvent describes a single completed image request
+type TransformEvent struct {
+	Account     string    `json:"account"`
+	Source      string    `json:"source"`
+	Ops         []string  `json:"ops"`
+	Bytes       int64     `json:"bytes"`
+	DurationMs  int64     `json:"duration_ms"`
+	CacheStatus string    `json:"cache_status"`
+	Status      int       `json:"status"`
+	CompletedAt time.Time `json:"completed_at"`
+}
+
+// EventSink delivers transform events to a downstream analytics pipeline
+type EventSink interface {
+	Publish(e *TransformEvent) error
+}
+
+var eventSink EventSink
+var events chan *TransformEvent
+
+var eventClient = &http.Client{Timeout: 5 * time.Second}
+
+// InitEvents starts publishing transform events to sinkUrl. The scheme
+// picks the sink:
+//
+//	https://example.com/hook                        POST each event as JSON
+//	sns://us-east-1/arn:aws:sns:us-east-1:123:topic publish to an SNS topic
+//	kafka+http://rest-proxy:8082/topic              produce through a Kafka REST proxy
+func InitEvents(sinkUrl string) {
+	if sinkUrl == "" {
+		return
+	}
+
+	u, err := url.Parse(sinkUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		eventSink = &httpEventSink{url: sinkUrl}
+	case "sns":
+		eventSink = &snsEventSink{
+			region:   u.Host,
+			topicArn: strings.TrimPrefix(u.Path, "/"),
+			creds:    awsCredentialsFromEnv(),
+		}
+	case "kafka+http", "kafka+https":
+		topic := strings.TrimPrefix(u.Path, "/")
+		u.Scheme = strings.TrimPrefix(u.Scheme, "kafka+")
+		u.Path = "/topics/" + topic
+		eventSink = &kafkaRestEventSink{url: u.String()}
+	default:
+		panic("unknown event sink " + sinkUrl)
+	}
+
+	events = make(chan *TransformEvent, 1000)
+	go publishEvents()
+}
+
+// PublishTransformEvent queues e for delivery without blocking the request.
+// Events are dropped when no sink is configured or the queue is full
+func PublishTransformEvent(e *TransformEvent) {
+	if events == nil {
+		return
+	}
+
+	select {
+	case events <- e:
+	default:
+		grohl.Log(grohl.Data{
+			"events":  "dropped",
+			"source":  e.Source,
+			"message": "event queue full",
+		})
+	}
+}
+
+func publishEvents() {
+	for e := range events {
+		err := eventSink.Publish(e)
+		if err != nil {
+			grohl.Log(grohl.Data{
+				"events":  "publish",
+				"failure": err,
+				"source":  e.Source,
+			})
+		}
+	}
+}
+
+type httpEventSink struct {
+	url string
+}
+
+func (s *httpEventSink) Publish(e *TransformEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := eventClient.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return checkEventResponse(resp)
+}
+
+type snsEventSink struct {
+	region   string
+	topicArn string
+	creds    awsCredentials
+}
+
+// http://docs.aws.amazon.com/sns/latest/api/API_Publish.html
+func (s *snsEventSink) Publish(e *TransformEvent) error {
+	message, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	body := []byte(url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {s.topicArn},
+		"Message":  {string(message)},
+	}.Encode())
+
+	req, err := http.NewRequest("POST", "https://sns."+s.region+".amazonaws.com/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	signAwsRequest(req, body, "sns", s.region, s.creds, time.Now())
+
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return err
+	}
+	return checkEventResponse(resp)
+}
+
+type kafkaRestEventSink struct {
+	url string
+}
+
+// http://docs.confluent.io/current/kafka-rest/docs/api.html#post--topics-(string-topic_name)
+func (s *kafkaRestEventSink) Publish(e *TransformEvent) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": e.Source, "value": e}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := eventClient.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return checkEventResponse(resp)
+}
+
+func checkEventResponse(resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("event sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// commandWaitDelay is how long Wait waits for output after the process is
+// killed, in case something it started still holds its pipes open
+var commandWaitDelay = time.Second
+
+// maxCommandOutput caps the output kept from each delegate for logging,
+// ImageMagick can warn once per frame or scanline of a broken image
+const maxCommandOutput = 64 * 1024
+
+// commandContext is exec.CommandContext with the process in its own group,
+// so when ctx is done it's killed along with anything it started, like the
+// ghostscript or ufraw delegates convert runs
+func commandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
+
+// runCommand runs cmd, returning ctx's error instead of the kill's when
+// it was cut short by a timeout or the client going away
+func runCommand(ctx context.Context, cmd *exec.Cmd) error {
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// outputBuffer keeps the first maxCommandOutput bytes written to it and
+// counts the rest
+type outputBuffer struct {
+	buf     bytes.Buffer
+	dropped int
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	if room := maxCommandOutput - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.dropped += len(p) - max(room, 0)
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (b *outputBuffer) String() string {
+	if b.dropped > 0 {
+		return fmt.Sprintf("%s... (%d bytes dropped)", b.buf.String(), b.dropped)
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package models
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
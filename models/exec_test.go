@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRunCommandKillsProcessGroupOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+
+	// the backgrounded sleep holds stdout open, it must be killed too
+	var output outputBuffer
+	cmd := commandContext(ctx, "sh", "-c", "sleep 5 & sleep 5; wait")
+	cmd.Stdout = &output
+	err := runCommand(ctx, cmd)
+	assert.Equal(t, context.Canceled, err)
+	assert.T(t, time.Since(start) < 2*time.Second)
+}
+
+func TestRunCommandTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := runCommand(ctx, commandContext(ctx, "sleep", "5"))
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestOutputBufferIsLimited(t *testing.T) {
+	var output outputBuffer
+	output.Write([]byte(strings.Repeat("a", maxCommandOutput-1)))
+	n, err := output.Write([]byte("bcd"))
+	assert.Equal(t, 3, n)
+	assert.Equal(t, nil, err)
+	output.Write([]byte("efg"))
+
+	assert.T(t, strings.HasSuffix(output.String(), "ab... (5 bytes dropped)"))
+}
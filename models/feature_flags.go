@@ -0,0 +1,171 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// FeatureFlag gates an operation, as named in bearer token ops claims, or
+// video for mp4 output. The operation is enabled if Enabled is set, in
+// any of Environments, for any of Tenants, or for Percent of tenants
+type FeatureFlag struct {
+	Enabled      bool     `json:"enabled"`
+	Environments []string `json:"environments"`
+	Tenants      []string `json:"tenants"`
+	Percent      int      `json:"percent"`
+}
+
+// Environment names the deployment, like staging or production, for
+// flags enabled per environment
+var Environment string
+
+// FeatureFlagsUrl is a remote provider serving the flags as JSON, polled
+// every featureFlagsRefreshEvery. It replaces FEATURE_FLAGS when set
+var FeatureFlagsUrl string
+
+var featureFlagsRefreshEvery = time.Minute
+
+var featureFlagsClient = &http.Client{Timeout: 5 * time.Second}
+
+var featureFlags = struct {
+	sync.RWMutex
+	byOperation map[string]FeatureFlag
+}{byOperation: map[string]FeatureFlag{}}
+
+// LoadFeatureFlags reads a JSON object of flags by operation, either
+// inline or from the file at path when inline is empty. Operations
+// without a flag are enabled
+func LoadFeatureFlags(inline string, path string) error {
+	data := []byte(inline)
+	if inline == "" && path != "" {
+		var err error
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		setFeatureFlags(map[string]FeatureFlag{})
+		return nil
+	}
+	return parseFeatureFlags(data)
+}
+
+func parseFeatureFlags(data []byte) error {
+	flags := map[string]FeatureFlag{}
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return err
+	}
+	setFeatureFlags(flags)
+	return nil
+}
+
+func setFeatureFlags(flags map[string]FeatureFlag) {
+	featureFlags.Lock()
+	featureFlags.byOperation = flags
+	featureFlags.Unlock()
+}
+
+// StartFeatureFlagsRefresh polls FeatureFlagsUrl, once at boot and then
+// periodically in the background. The last flags fetched are kept while
+// the provider is unreachable
+func StartFeatureFlagsRefresh() {
+	if FeatureFlagsUrl == "" {
+		return
+	}
+	refreshFeatureFlags()
+	go func() {
+		for range time.Tick(featureFlagsRefreshEvery) {
+			refreshFeatureFlags()
+		}
+	}()
+}
+
+func refreshFeatureFlags() {
+	err := fetchFeatureFlags()
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "refresh-feature-flags",
+			"failure": err,
+		})
+	}
+}
+
+func fetchFeatureFlags() error {
+	resp, err := featureFlagsClient.Get(FeatureFlagsUrl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("feature flags provider returned %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return parseFeatureFlags(data)
+}
+
+// OperationEnabled is true if op may be used by a request for tenants,
+// the account subdomain and API key name it's made with
+func OperationEnabled(op string, tenants ...string) bool {
+	featureFlags.RLock()
+	flag, ok := featureFlags.byOperation[op]
+	featureFlags.RUnlock()
+	if !ok || flag.Enabled {
+		return true
+	}
+
+	for _, env := range flag.Environments {
+		if env == Environment && Environment != "" {
+			return true
+		}
+	}
+	for _, tenant := range tenants {
+		if tenant == "" {
+			continue
+		}
+		for _, allowed := range flag.Tenants {
+			if allowed == tenant {
+				return true
+			}
+		}
+		if flag.Percent > 0 && rolloutBucket(op, tenant) < flag.Percent {
+			return true
+		}
+	}
+	return false
+}
+
+// DisabledOperation returns the first operation in urlArgs that isn't
+// enabled for tenants, or ""
+func DisabledOperation(urlArgs []string, tenants ...string) string {
+	for _, arg := range urlArgs {
+		ops := []string{Operation(arg)}
+		if arg == "mp4" {
+			ops = append(ops, "video")
+		}
+		for _, op := range ops {
+			if op != "" && !OperationEnabled(op, tenants...) {
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+// rolloutBucket places a tenant in one of 100 buckets, differently for
+// each operation so the same tenants aren't always first
+func rolloutBucket(op string, tenant string) int {
+	h := fnv.New32a()
+	h.Write([]byte(op + "/" + tenant))
+	return int(h.Sum32() % 100)
+}
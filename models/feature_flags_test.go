@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestOperationEnabled(t *testing.T) {
+	defer LoadFeatureFlags("", "")
+	defer func() { Environment = "" }()
+	err := LoadFeatureFlags(`{
+		"video": {"environments": ["staging"], "tenants": ["acme"]},
+		"pixelate": {"enabled": false},
+		"trim": {"enabled": true}
+	}`, "")
+	assert.Equal(t, nil, err)
+
+	assert.T(t, OperationEnabled("resize", "anyone"))
+	assert.T(t, OperationEnabled("trim", "anyone"))
+	assert.T(t, !OperationEnabled("pixelate", "acme"))
+	assert.T(t, !OperationEnabled("video", "other"))
+	assert.T(t, OperationEnabled("video", "other", "acme"))
+
+	Environment = "staging"
+	assert.T(t, OperationEnabled("video", "other"))
+}
+
+func TestOperationEnabledRollsOutByPercent(t *testing.T) {
+	defer LoadFeatureFlags("", "")
+	LoadFeatureFlags(`{"video": {"percent": 25}}`, "")
+
+	enabled := 0
+	for i := 0; i < 1000; i++ {
+		tenant := fmt.Sprintf("tenant%d", i)
+		if OperationEnabled("video", tenant) {
+			enabled++
+		}
+		assert.Equal(t, OperationEnabled("video", tenant), OperationEnabled("video", tenant))
+	}
+	assert.T(t, enabled > 150 && enabled < 350)
+}
+
+func TestDisabledOperation(t *testing.T) {
+	defer LoadFeatureFlags("", "")
+	LoadFeatureFlags(`{"video": {}, "pixelate": {"tenants": ["acme"]}}`, "")
+
+	assert.Equal(t, "", DisabledOperation([]string{"128x", "jpg"}, "other"))
+	assert.Equal(t, "video", DisabledOperation([]string{"128x", "mp4"}, "other"))
+	assert.Equal(t, "pixelate", DisabledOperation([]string{"128x", "pixelate_8,0,0,10,10"}, "other"))
+	assert.Equal(t, "", DisabledOperation([]string{"128x", "pixelate_8,0,0,10,10"}, "other", "acme"))
+}
+
+func TestFetchFeatureFlags(t *testing.T) {
+	defer LoadFeatureFlags("", "")
+	defer func() { FeatureFlagsUrl = "" }()
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, `{"video": {"enabled": false}}`)
+	}))
+	defer server.Close()
+	FeatureFlagsUrl = server.URL
+
+	assert.Equal(t, nil, fetchFeatureFlags())
+	assert.T(t, !OperationEnabled("video", "acme"))
+
+	status = http.StatusInternalServerError
+	assert.NotEqual(t, nil, fetchFeatureFlags())
+	assert.T(t, !OperationEnabled("video", "acme"))
+}
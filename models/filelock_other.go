@@ -0,0 +1,11 @@
+//go:build !unix
+
+package models
+
+import (
+	"os"
+)
+
+func lockFile(f *os.File, exclusive bool, wait bool) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package models
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an flock on f, exclusive or shared. Unless wait is set it
+// fails rather than waiting out another process's lock
+func lockFile(f *os.File, exclusive bool, wait bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
@@ -0,0 +1,83 @@
+package models
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// FuzzNewProcessArgs parses untrusted url paths and checks the convert
+// command line never carries anything an attacker could use to make
+// ImageMagick read other files or take extra options
+func FuzzNewProcessArgs(f *testing.F) {
+	f.Add("128x128!/g_center/frame_0/")
+	f.Add("500x300/fit_cover/bg_ff00ff/q_80/strip/")
+	f.Add("pixelate_10,10,100,100,8/trim_20/flip/flop/filter_sepia/")
+	f.Add("bri_-100/con_100/sat_0/radius_20/mask_circle/lqip/")
+	f.Add("w_auto/encoding_base64/keepmeta/noorient/mp4/")
+
+	f.Fuzz(func(t *testing.T, path string) {
+		args := NewProcessArgs(strings.Split(path, "/"), imgUrl)
+		args.HasOperations()
+		args.CacheKey()
+
+		cmdArgs, outFile := args.CommandArgs("in", "out")
+		if !strings.HasPrefix(outFile, "out.") {
+			t.Fatalf("output %q escaped the workspace", outFile)
+		}
+		n := len(cmdArgs)
+		if n < 2 || cmdArgs[n-1] != outFile || !strings.HasPrefix(cmdArgs[n-2], "in") {
+			t.Fatalf("input and output must come last, got %q", cmdArgs)
+		}
+		for _, arg := range cmdArgs[:n-2] {
+			if strings.HasPrefix(arg, "@") || strings.ContainsAny(arg, "/\\") ||
+				strings.IndexFunc(arg, unicode.IsControl) >= 0 {
+				t.Fatalf("unsafe argument %q from %q", arg, path)
+			}
+		}
+		if frame := cmdArgs[n-2]; frame != "in" && !regexp.MustCompile(`^in\[\d+\]$`).MatchString(frame) {
+			t.Fatalf("unsafe input %q from %q", frame, path)
+		}
+	})
+}
+
+// FuzzVerifySignedArgs makes sure malformed signatures are rejected
+// rather than panicking or slipping through
+func FuzzVerifySignedArgs(f *testing.F) {
+	f.Add("s_0000000000000000000000000000000000000000000000000000000000000000/128x/", imgUrl)
+	f.Add("s_k1_0000000000000000000000000000000000000000000000000000000000000000/e_1/", imgUrl)
+	f.Add("s_/", "")
+
+	f.Fuzz(func(t *testing.T, args string, url string) {
+		SigningKey = "secret"
+		defer func() { SigningKey = "" }()
+
+		if _, err := VerifySignedArgs(args, url); err == nil {
+			if !strings.HasPrefix(args, "s_"+SignPath("/"+strings.SplitN(args, "/", 2)[1]+url)) {
+				t.Fatalf("accepted %q for %q without a valid signature", args, url)
+			}
+		}
+	})
+}
+
+// FuzzApplyClientHints feeds arbitrary hint headers through the width
+// selection
+func FuzzApplyClientHints(f *testing.F) {
+	f.Add("400", "1200", "2.625", "on")
+	f.Add("-1", "NaN", "1e308", "")
+
+	f.Fuzz(func(t *testing.T, width string, viewport string, dpr string, saveData string) {
+		args := NewProcessArgs([]string{"w_auto", "x300"}, imgUrl)
+		args.ApplyClientHints(http.Header{
+			"Width":          {width},
+			"Viewport-Width": {viewport},
+			"Dpr":            {dpr},
+		})
+		args.ApplySaveData(http.Header{"Save-Data": {saveData}})
+		if args.Width < 0 || args.Width > MaxDimension {
+			t.Fatalf("width %d from hints %q %q %q", args.Width, width, viewport, dpr)
+		}
+	})
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// GcsSourceEndpoint serves gs:// sources, Google Cloud Storage's XML API
+// unless pointed at an emulator
+var GcsSourceEndpoint = "https://storage.googleapis.com"
+
+// GcsSourceBuckets are the buckets gs:// sources may come from
+var GcsSourceBuckets BucketAllowlist
+
+// gcsScope only lets the service account's tokens read objects
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// gcsServiceAccount is the part of a service account key file needed to
+// get access tokens
+type gcsServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyId string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenUri     string `json:"token_uri"`
+
+	key *rsa.PrivateKey
+
+	mu          sync.Mutex
+	accessToken string
+	expires     time.Time
+}
+
+// gcsAccount authorizes requests for gs:// sources. Without one only
+// public objects can be fetched
+var gcsAccount *gcsServiceAccount
+
+var gcsTokenClient = &http.Client{Timeout: 10 * time.Second}
+
+// InitGcsSources reads the service account key file gs:// sources are
+// fetched with, as downloaded from the Cloud console
+func InitGcsSources(credentialsFile string) error {
+	gcsAccount = nil
+	if credentialsFile == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return err
+	}
+	account := &gcsServiceAccount{}
+	if err = json.Unmarshal(data, account); err != nil {
+		return err
+	}
+	if account.key, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(account.PrivateKey)); err != nil {
+		return err
+	}
+	if account.TokenUri == "" {
+		account.TokenUri = "https://oauth2.googleapis.com/token"
+	}
+	gcsAccount = account
+	return nil
+}
+
+// token returns an access token, exchanging a signed JWT for a new one
+// when the last is about to expire
+// https://developers.google.com/identity/protocols/oauth2/service-account#httprest
+func (a *gcsServiceAccount) token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.accessToken != "" && now.Add(time.Minute).Before(a.expires) {
+		return a.accessToken, nil
+	}
+
+	assertion := jwt.New(jwt.GetSigningMethod("RS256"))
+	assertion.Header["kid"] = a.PrivateKeyId
+	assertion.Claims["iss"] = a.ClientEmail
+	assertion.Claims["scope"] = gcsScope
+	assertion.Claims["aud"] = a.TokenUri
+	assertion.Claims["iat"] = now.Unix()
+	assertion.Claims["exp"] = now.Add(time.Hour).Unix()
+	signed, err := assertion.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {signed},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", a.TokenUri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := gcsTokenClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gcs token endpoint responded with status %d", resp.StatusCode)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	a.accessToken = body.AccessToken
+	a.expires = now.Add(time.Duration(body.ExpiresIn) * time.Second)
+	return a.accessToken, nil
+}
+
+// gcsSourceFetcher fetches gs://bucket/object sources, authorized as the
+// configured service account
+type gcsSourceFetcher struct{}
+
+// https://cloud.google.com/storage/docs/xml-api/get-object-download
+func (gcsSourceFetcher) Fetch(ctx context.Context, source string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid gs source")
+	}
+	if err = GcsSourceBuckets.check("gs bucket", u.Host); err != nil {
+		return nil, err
+	}
+	object := &url.URL{Path: "/" + u.Host + u.Path}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(GcsSourceEndpoint, "/")+object.EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, header)
+	if gcsAccount != nil {
+		token, err := gcsAccount.token(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return storageClient.Do(req)
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestGcsSources(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := 0
+	paths, auths := []string{}, []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokens++
+			assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.FormValue("grant_type"))
+			w.Write([]byte(`{"access_token":"ya29.token","expires_in":3600}`))
+			return
+		}
+		paths = append(paths, r.URL.EscapedPath())
+		auths = append(auths, r.Header.Get("Authorization"))
+		w.Write([]byte("GIF89a"))
+	}))
+	defer server.Close()
+
+	dir, _ := ioutil.TempDir("", "_firesize_test")
+	defer os.RemoveAll(dir)
+	credentials, _ := json.Marshal(map[string]string{
+		"client_email": "firesize@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		"token_uri":    server.URL + "/token",
+	})
+	credentialsFile := filepath.Join(dir, "credentials.json")
+	ioutil.WriteFile(credentialsFile, credentials, 0600)
+
+	endpoint, buckets := GcsSourceEndpoint, GcsSourceBuckets
+	defer func() { GcsSourceEndpoint, GcsSourceBuckets = endpoint, buckets }()
+	defer InitGcsSources("")
+	GcsSourceEndpoint = server.URL
+	GcsSourceBuckets = BucketAllowlist(ParseHostPatterns("originals"))
+	assert.Equal(t, nil, InitGcsSources(credentialsFile))
+
+	for i := 0; i < 2; i++ {
+		resp, err := fetchSource(context.Background(), "gs://originals/products/cat 1.jpg", nil)
+		assert.Equal(t, nil, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, 1, tokens)
+	assert.Equal(t, []string{"/originals/products/cat%201.jpg", "/originals/products/cat%201.jpg"}, paths)
+	assert.Equal(t, "Bearer ya29.token", auths[0])
+
+	// other buckets the service account can read are refused
+	_, err = fetchSource(context.Background(), "gs://results/cat.jpg", nil)
+	assert.Equal(t, 403, err.(*StatusError).Status)
+	GcsSourceBuckets = nil
+	_, err = fetchSource(context.Background(), "gs://originals/products/cat 1.jpg", nil)
+	assert.Equal(t, 403, err.(*StatusError).Status)
+	assert.Equal(t, 2, len(paths))
+
+	_, err = fetchSource(context.Background(), "gopher://example.com/cat.jpg", nil)
+	assert.Equal(t, 400, err.(*StatusError).Status)
+}
@@ -0,0 +1,62 @@
+package models
+
+import "strconv"
+
+// ResizeMode is how a resize treats the requested box. The url syntax
+// borrows ImageMagick's geometry modifiers, but args hold the mode so
+// engines that don't speak geometry can act on it too
+type ResizeMode string
+
+const (
+	ResizeDefault      ResizeMode = ""
+	ResizeShrinkOnly   ResizeMode = "shrink"
+	ResizeEnlargeOnly  ResizeMode = "enlarge"
+	ResizeIgnoreAspect ResizeMode = "exact"
+	ResizeFillArea     ResizeMode = "fill"
+)
+
+var resizeModeModifiers = map[string]ResizeMode{
+	">": ResizeShrinkOnly,
+	"<": ResizeEnlargeOnly,
+	"!": ResizeIgnoreAspect,
+	"^": ResizeFillArea,
+}
+
+// MaxDimension caps requested widths and heights, larger ones are
+// clamped to it
+var MaxDimension = 8192
+
+// parseDimension reads a requested width or height, 0 if there isn't one
+func parseDimension(s string) int {
+	d, err := strconv.Atoi(s)
+	if err != nil || d <= 0 {
+		return 0
+	}
+	if MaxDimension > 0 && d > MaxDimension {
+		return MaxDimension
+	}
+	return d
+}
+
+// modifier is the ImageMagick geometry modifier for the mode
+func (m ResizeMode) modifier() string {
+	for modifier, mode := range resizeModeModifiers {
+		if mode == m {
+			return modifier
+		}
+	}
+	return ""
+}
+
+// geometry renders width and height as an ImageMagick geometry, leaving
+// out whichever is unset
+func geometry(width int, height int) string {
+	g := "x"
+	if width > 0 {
+		g = strconv.Itoa(width) + g
+	}
+	if height > 0 {
+		g += strconv.Itoa(height)
+	}
+	return g
+}
@@ -0,0 +1,171 @@
+package models
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// webIcon is one file of the web app icon set
+type webIcon struct {
+	Name string
+	Size int
+	Rel  string // link rel for the html snippet, empty for manifest icons
+}
+
+var webIcons = []webIcon{
+	{Name: "apple-touch-icon.png", Size: 180, Rel: "apple-touch-icon"},
+	{Name: "apple-touch-icon-152x152.png", Size: 152},
+	{Name: "apple-touch-icon-120x120.png", Size: 120},
+	{Name: "icon-32x32.png", Size: 32, Rel: "icon"},
+	{Name: "icon-16x16.png", Size: 16, Rel: "icon"},
+	{Name: "icon-192x192.png", Size: 192},
+	{Name: "icon-512x512.png", Size: 512},
+}
+
+// faviconSizes are packed into favicon.ico
+var faviconSizes = []int{16, 32, 48}
+
+// WriteIconBundle downloads url and writes a zip of favicon.ico, the apple
+// touch icons, the manifest icons, a manifest.json and icons.html with the
+// tags to paste into a page's head
+func WriteIconBundle(w io.Writer, url string) error {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile, err := downloadChecked(tempDir, url)
+	if err != nil {
+		return err
+	}
+
+	files := []string{}
+	for _, icon := range webIcons {
+		outFile := filepath.Join(tempDir, icon.Name)
+		err = convertIcon(iconArgs(inFile, outFile, icon.Size))
+		if err != nil {
+			return err
+		}
+		files = append(files, outFile)
+	}
+
+	favicon := filepath.Join(tempDir, "favicon.ico")
+	err = convertIcon(faviconArgs(inFile, favicon))
+	if err != nil {
+		return err
+	}
+	files = append(files, favicon)
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		err = addZipFile(archive, filepath.Base(file), file)
+		if err != nil {
+			return err
+		}
+	}
+	for _, generated := range [][2]string{
+		{"manifest.json", iconManifest()},
+		{"icons.html", iconHtml()},
+	} {
+		f, err := archive.Create(generated[0])
+		if err != nil {
+			return err
+		}
+		io.WriteString(f, generated[1])
+	}
+	return archive.Close()
+}
+
+// iconArgs squares the source up on a transparent background so logos of
+// any aspect ratio fill the icon
+func iconArgs(inFile string, outFile string, size int) []string {
+	dimensions := fmt.Sprintf("%dx%d", size, size)
+	return []string{
+		inFile + "[0]",
+		"-thumbnail", dimensions,
+		"-background", "none",
+		"-gravity", "center",
+		"-extent", dimensions,
+		"png:" + outFile,
+	}
+}
+
+func faviconArgs(inFile string, outFile string) []string {
+	sizes := make([]string, len(faviconSizes))
+	for i, size := range faviconSizes {
+		sizes[i] = strconv.Itoa(size)
+	}
+	return []string{
+		inFile + "[0]",
+		"-background", "none",
+		"-define", "icon:auto-resize=" + strings.Join(sizes, ","),
+		outFile,
+	}
+}
+
+func iconManifest() string {
+	icons := []string{}
+	for _, icon := range webIcons {
+		if strings.HasPrefix(icon.Name, "icon-") && icon.Size >= 192 {
+			icons = append(icons, fmt.Sprintf(
+				`    {"src": "/%s", "sizes": "%dx%d", "type": "image/png"}`, icon.Name, icon.Size, icon.Size))
+		}
+	}
+	return "{\n  \"icons\": [\n" + strings.Join(icons, ",\n") + "\n  ]\n}\n"
+}
+
+func iconHtml() string {
+	lines := []string{`<link rel="icon" href="/favicon.ico" sizes="any">`}
+	for _, icon := range webIcons {
+		if icon.Rel == "" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf(`<link rel="%s" type="image/png" sizes="%dx%d" href="/%s">`,
+			icon.Rel, icon.Size, icon.Size, icon.Name))
+	}
+	lines = append(lines, `<link rel="manifest" href="/manifest.json">`)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func convertIcon(cmdArgs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "icons",
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+	}
+	return err
+}
+
+func addZipFile(archive *zip.Writer, name string, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	member, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(member, f)
+	return err
+}
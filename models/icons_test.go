@@ -0,0 +1,23 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestIconArgs(t *testing.T) {
+	assert.Equal(t,
+		[]string{"in[0]", "-thumbnail", "180x180", "-background", "none", "-gravity", "center", "-extent", "180x180", "png:out.png"},
+		iconArgs("in", "out.png", 180))
+}
+
+func TestIconHtml(t *testing.T) {
+	expected := `<link rel="icon" href="/favicon.ico" sizes="any">
+<link rel="apple-touch-icon" type="image/png" sizes="180x180" href="/apple-touch-icon.png">
+<link rel="icon" type="image/png" sizes="32x32" href="/icon-32x32.png">
+<link rel="icon" type="image/png" sizes="16x16" href="/icon-16x16.png">
+<link rel="manifest" href="/manifest.json">
+`
+	assert.Equal(t, expected, iconHtml())
+}
@@ -1,13 +1,14 @@
 package models
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -16,60 +17,212 @@ import (
 	"github.com/technoweenie/grohl"
 )
 
-// Low timeout as we can potentially run 3 convert steps and in all
-// cases in a Heroku environment there is a hard limit of 30secs before
-// your request is simply killed
-var normalTimeout = 10 * time.Second
+// MaxSourceBytes caps the size of source images downloaded, 0 for no limit
+var MaxSourceBytes int64 = 50 * 1024 * 1024
 
-type IMagick struct{}
+// MaxSourcePixels and MaxSourceFrames cap the pixels in each frame and the
+// number of frames of source images, 0 for no limit
+var MaxSourcePixels int64 = 100 * 1000 * 1000
+var MaxSourceFrames = 1000
+
+// MaxDownloadResumes is how many times an interrupted source download is
+// resumed from where it stopped before the download step fails
+var MaxDownloadResumes = 3
 
-type processPipelineStep func(workingDirectoryPath string, inputFilePath string, args *ProcessArgs) (outputFilePath string, err error)
+type IMagick struct{}
 
-var defaultPipeline = []processPipelineStep{
-	downloadRemote,
-	preProcessImage,
-	processImage,
-	postProcessImage,
+var defaultPipeline = []pipelineStep{
+	{Name: "download", Run: sharedDownload},
+	{Name: "route", Run: routeSource, Retries: 1},
+	{Name: "check-limits", Run: checkSourceLimits},
+	{Name: "pre-process", Run: preProcessImage},
+	{Name: "super-resolve", Run: superResolve},
+	{Name: "extract-profile", Run: extractColorProfile},
+	{Name: "inspect-color", Run: inspectColor},
+	{Name: "convert", Run: processImage, Retries: 1},
+	{Name: "wasm-filter", Run: filterWasm},
+	{Name: "mask", Run: maskImage, Retries: 1},
+	{Name: "watermark", Run: watermarkImage, Retries: 1},
+	{Name: "post-process", Run: postProcessImage, Retries: 1},
+	{Name: "verify", Run: verifyOutput},
 }
 
 // Process a remote asset url using graphicsmagick with the args supplied
 // and write the response to w
 func (p *IMagick) Process(w http.ResponseWriter, r *http.Request, args *ProcessArgs) (err error) {
+	key := args.CacheKey()
+	cacheInMemory := memoryCacheable(args)
+	// pushes need the result's file, which memory entries may not have
+	if cacheInMemory && !args.Push {
+		if entry, ok := Memory.Get(key); ok {
+			serveMemoryResult(w, r, entry)
+			return nil
+		}
+	}
+
 	tempDir, err := createTemporaryWorkspace()
 	if err != nil {
 		return
 	}
-	// defer os.RemoveAll(tempDir)
+	defer os.RemoveAll(tempDir)
 
 	var filePath string
 
-	// No operations? Just proxy the request
-	if !args.HasOperations() {
-		return proxyRequest(w, args)
+	// No operations? Just proxy the request, unless it has to be verified
+	// before it's sent on. In proxy-only mode everything is, so misbehaving
+	// delegates can be taken out of the path
+	proxyOnly := CurrentServiceMode().ProxyOnly()
+	if op := args.unproxyable(); proxyOnly && op != "" {
+		// the original can't be passed through in place of an image with
+		// something covered up or stripped from it
+		return statusErrorf(http.StatusServiceUnavailable, "%s is unavailable", op)
 	}
-
-	for _, step := range defaultPipeline {
-		filePath, err = step(tempDir, filePath, args)
+	if !args.HasOperations() || proxyOnly {
+		w.Header().Set("X-Firesize-Cache", "pass")
+		if proxyOnly && args.HasOperations() {
+			setDegradedHeaders(w, []string{"proxy-only"})
+		}
+		if args.Encoding == "" && sourceChecksumHeader(args.Url) == "" && isRemoteSource(args.Url) {
+			return proxyRequest(w, args, true)
+		}
+		filePath, err = downloadRemote(tempDir, filePath, args)
 		if err != nil {
 			return
 		}
+		return serveResult(w, r, filePath, time.Time{}, args)
+	}
+
+	if Contents != nil {
+		if name, ok := Contents.Lookup(key); ok {
+			w.Header().Set("X-Firesize-Cache", "hit")
+			setContentHeaders(w, name)
+			modified := Contents.Modified(key)
+			if cacheInMemory {
+				Memory.PutFile(key, args.Url, Contents.ObjectPath(name), name, modified)
+			}
+			if err = pushResult(w, args, Contents.ObjectPath(name)); err != nil {
+				return
+			}
+			return serveResult(w, r, Contents.ObjectPath(name), modified, args)
+		}
+	}
+	if RemoteCache != nil {
+		if filePath, ok := fetchRemoteResult(args.ctx(), tempDir, key); ok {
+			w.Header().Set("X-Firesize-Cache", "remote")
+			p.storeResult(w, key, filePath, args, cacheInMemory)
+			if err = pushResult(w, args, filePath); err != nil {
+				return
+			}
+			return serveResult(w, r, filePath, time.Time{}, args)
+		}
+	}
+	w.Header().Set("X-Firesize-Cache", "miss")
+
+	// identical requests arriving together share a single run of the
+	// pipeline, and only the one that started it stores the result
+	f, shared, err := joinFlight(args.ctx(), key, func(ctx context.Context) (string, []string, func(), error) {
+		workspace, err := createTemporaryWorkspace()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		flightArgs := *args
+		flightArgs.Context = ctx
+		filePath, fromMipmap, err := runPipelineFromMipmap(workspace, &flightArgs)
+		if !fromMipmap {
+			filePath, err = runPipeline(defaultPipeline, workspace, "", &flightArgs)
+			if err == nil && len(flightArgs.Degraded) == 0 {
+				storeMipmaps(&flightArgs, filePath)
+			}
+		}
+		return filePath, flightArgs.Degraded, func() { os.RemoveAll(workspace) }, err
+	})
+	if err != nil {
+		return
+	}
+	defer f.release()
+	filePath, args.Degraded = f.filePath, f.degraded
+
+	if len(args.Degraded) > 0 {
+		setDegradedHeaders(w, args.Degraded)
+	} else if !shared {
+		p.storeResult(w, key, filePath, args, cacheInMemory)
+		if RemoteCache != nil {
+			storeRemoteResult(key, args.Url, filePath)
+		}
+	}
+
+	if args.KeepMeta {
+		kept := args.KeptMetadata(strings.TrimPrefix(filepath.Ext(filePath), "."))
+		w.Header().Set("X-Firesize-Metadata-Kept", strings.Join(kept, ","))
+	}
+	if err = pushResult(w, args, filePath); err != nil {
+		return
 	}
 
 	// serve response
-	http.ServeFile(w, r, filePath)
-	return
+	return serveResult(w, r, filePath, time.Time{}, args)
+}
+
+// storeResult keeps a result in the content store, and in memory when
+// cacheInMemory is set, so the next request is served locally
+func (p *IMagick) storeResult(w http.ResponseWriter, key string, filePath string, args *ProcessArgs, cacheInMemory bool) {
+	var name string
+	if Contents != nil {
+		var err error
+		name, err = Contents.Put(key, args.Url, filePath, strings.TrimPrefix(filepath.Ext(filePath), "."))
+		if err != nil {
+			grohl.Log(grohl.Data{
+				"processor": "imagick",
+				"step":      "store",
+				"failure":   err,
+			})
+			name = ""
+		} else {
+			setContentHeaders(w, name)
+		}
+	}
+	if cacheInMemory {
+		Memory.PutFile(key, args.Url, filePath, name, time.Time{})
+	}
+}
+
+// setDegradedHeaders describes how the result falls short of what was
+// asked for. Degraded results are only cached briefly, and aren't put in
+// the content store, so a later request can produce the real thing
+func setDegradedHeaders(w http.ResponseWriter, degraded []string) {
+	w.Header().Set("X-Firesize-Degraded", strings.Join(degraded, ", "))
+	for _, reason := range degraded {
+		w.Header().Add("Warning", fmt.Sprintf(`199 firesize "%s"`, reason))
+	}
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	if w.Header().Get("Surrogate-Control") != "" {
+		w.Header().Set("Surrogate-Control", "max-age=300")
+	}
 }
 
-func createTemporaryWorkspace() (string, error) {
-	return ioutil.TempDir("", "_firesize")
+// setContentHeaders points clients at the immutable content addressed url
+// of the stored result
+func setContentHeaders(w http.ResponseWriter, name string) {
+	w.Header().Set("X-Firesize-Content-Hash", strings.SplitN(name, ".", 2)[0])
+	w.Header().Set("Content-Location", "/cas/"+name)
 }
 
-func proxyRequest(w http.ResponseWriter, args *ProcessArgs) error {
-	resp, err := http.Get(args.Url)
+// proxyRequest streams the source to w as is. Unless limited, sources over
+// MaxSourceBytes are passed through too
+func proxyRequest(w http.ResponseWriter, args *ProcessArgs, limited bool) error {
+	if err := checkSource(args.Url); err != nil {
+		return err
+	}
+	resp, err := fetchSource(args.ctx(), args.Url, nil)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if limited {
+		if err = checkSourceSize(resp.ContentLength); err != nil {
+			return err
+		}
+	}
 	_, err = io.Copy(w, resp.Body)
 	return err
 }
@@ -77,6 +230,19 @@ func proxyRequest(w http.ResponseWriter, args *ProcessArgs) error {
 func downloadRemote(tempDir string, _ string, args *ProcessArgs) (string, error) {
 	url := args.Url
 	inFile := filepath.Join(tempDir, "in")
+	if isDataUri(url) {
+		mediaType, size, err := decodeDataUri(url, inFile)
+		if err != nil {
+			return inFile, err
+		}
+		return inFile, checkSourceContent(inFile, size, 0, mediaType)
+	}
+	if isLocalSource(url) {
+		return readLocalSource(url)
+	}
+	if err := checkSource(url); err != nil {
+		return inFile, err
+	}
 
 	grohl.Log(grohl.Data{
 		"processor": "imagick",
@@ -84,32 +250,320 @@ func downloadRemote(tempDir string, _ string, args *ProcessArgs) (string, error)
 		"local":     inFile,
 	})
 
+	for attempt := 0; ; attempt++ {
+		// each attempt gets its own deadline so a stalled origin leaves
+		// time for a retry
+		ctx, cancel := context.WithTimeout(args.ctx(), DownloadTimeout)
+		err := downloadSourceFile(ctx, inFile, url, args)
+		if err != nil && ctx.Err() == context.DeadlineExceeded && args.ctx().Err() == nil {
+			err = &StatusError{
+				Status:  http.StatusGatewayTimeout,
+				Message: fmt.Sprintf("source download took longer than %s", DownloadTimeout),
+				Code:    "origin_timeout",
+			}
+		}
+		cancel()
+		wait, retry := sourceRetryWait(args.ctx(), err, attempt)
+		if !retry {
+			return inFile, err
+		}
+		grohl.Counter(1.0, "source.retried", 1)
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"download":  url,
+			"retry":     attempt + 1,
+			"wait":      wait.Seconds(),
+			"failure":   err,
+		})
+		select {
+		case <-args.ctx().Done():
+			return inFile, err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// downloadSourceFile makes one attempt at downloading url into inFile
+func downloadSourceFile(ctx context.Context, inFile string, url string, args *ProcessArgs) error {
 	out, err := os.Create(inFile)
 	if err != nil {
-		return inFile, err
+		return err
 	}
 	defer out.Close()
 
-	resp, err := http.Get(url)
+	// resume interrupted downloads from the last byte received, as long as
+	// the origin can tell us the source hasn't changed in between
+	var written int64
+	var validator, checksum, contentType string
+	var originStatus int
+	checksumHeader := sourceChecksumHeader(url)
+	for resumes := 0; ; resumes++ {
+		header := http.Header{}
+		if written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			header.Set("If-Range", validator)
+		}
+		resp, err := fetchSource(ctx, url, header)
+		if err != nil {
+			return err
+		}
+		if SourceRetryStatuses[resp.StatusCode] {
+			resp.Body.Close()
+			return originUnavailable(resp)
+		}
+
+		// anything but the rest of the same source means starting over
+		if written > 0 && (resp.StatusCode != http.StatusPartialContent ||
+			!strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", written))) {
+			if err = out.Truncate(0); err == nil {
+				_, err = out.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				resp.Body.Close()
+				return err
+			}
+			written = 0
+		}
+		if written == 0 {
+			originStatus, contentType = resp.StatusCode, resp.Header.Get("Content-Type")
+			validator = resumeValidator(resp)
+			if checksumHeader != "" {
+				checksum = resp.Header.Get(checksumHeader)
+			}
+		}
+		if err = checkSourceSize(written + resp.ContentLength); err != nil {
+			resp.Body.Close()
+			return err
+		}
+
+		// Content-Length can lie or be missing so read at most one byte
+		// more than allowed to tell if the source is too big
+		body := io.Reader(resp.Body)
+		if MaxSourceBytes > 0 {
+			body = io.LimitReader(resp.Body, MaxSourceBytes+1-written)
+		}
+		n, err := io.Copy(out, body)
+		resp.Body.Close()
+		written += n
+		if err == nil {
+			err = checkSourceSize(written)
+			if err == nil {
+				err = checkSourceContent(inFile, written, originStatus, contentType)
+			}
+			if err == nil && checksumHeader != "" {
+				err = checkSourceChecksum(inFile, checksumHeader, checksum)
+			}
+			return err
+		}
+		if validator == "" || resumes >= MaxDownloadResumes || ctx.Err() != nil {
+			return err
+		}
+
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"download":  url,
+			"resume":    written,
+			"failure":   err,
+		})
+	}
+}
+
+// resumeValidator returns the strong ETag, or failing that the
+// Last-Modified date, an interrupted download can be resumed with using
+// If-Range, or "" if the origin doesn't support ranges
+func resumeValidator(resp *http.Response) string {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Accept-Ranges") != "bytes" {
+		return ""
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// checkSourceSize refuses sources larger than MaxSourceBytes
+func checkSourceSize(size int64) error {
+	if MaxSourceBytes > 0 && size > MaxSourceBytes {
+		return sourceTooLarge("source is larger than the %d byte limit", MaxSourceBytes)
+	}
+	return nil
+}
+
+// checkSourceContent refuses empty sources and HTML or JSON documents,
+// usually an origin's soft 404 page, before they reach the delegates.
+// The origin's status and content type are reported to help track down
+// what it actually sent
+func checkSourceContent(inFile string, size int64, originStatus int, contentType string) error {
+	details := map[string]interface{}{
+		"origin_status":       originStatus,
+		"origin_content_type": contentType,
+	}
+	if originStatus == 0 {
+		// uploads and data uris don't come from an origin
+		details = map[string]interface{}{"content_type": contentType}
+	}
+	if size == 0 {
+		return &StatusError{Status: http.StatusUnprocessableEntity, Message: "source is empty",
+			Code: "empty_source", Details: details}
+	}
+
+	f, err := os.Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	detected := http.DetectContentType(head)
+	trimmed := bytes.TrimLeft(head, " \t\r\n\ufeff")
+	switch {
+	case strings.HasPrefix(detected, "text/html"):
+		details["detected_content_type"] = "text/html"
+		return &StatusError{Status: http.StatusUnprocessableEntity, Message: "source is an HTML document, not an image",
+			Code: "html_source", Details: details}
+	case strings.HasPrefix(detected, "text/plain") && len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['):
+		details["detected_content_type"] = "application/json"
+		return &StatusError{Status: http.StatusUnprocessableEntity, Message: "source is a JSON document, not an image",
+			Code: "json_source", Details: details}
+	}
+	return nil
+}
+
+// checkSourceLimits pings the source for its dimensions without decoding
+// it and refuses images that would exhaust memory once decompressed
+func checkSourceLimits(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	output, err := identify(args.ctx(), "-ping", "-format", "%w %h\n", inFile)
 	if err != nil {
 		return inFile, err
 	}
-	defer resp.Body.Close()
 
-	_, err = io.Copy(out, resp.Body)
+	frames := strings.Split(strings.TrimSpace(output), "\n")
+	for _, frame := range frames {
+		var width, height int64
+		fmt.Sscan(frame, &width, &height)
+		if err = checkImageLimits(width, height, len(frames)); err != nil {
+			return inFile, err
+		}
+	}
+	return inFile, nil
+}
+
+// downloadChecked downloads url for the endpoints that read a source
+// without running the pipeline, held to the limits checkSourceLimits sets
+// before anything decodes it
+func downloadChecked(tempDir string, url string) (string, error) {
+	args := &ProcessArgs{Url: url}
+	filePath, err := downloadRemote(tempDir, "", args)
+	if err != nil {
+		return filePath, err
+	}
+	return checkSourceLimits(tempDir, filePath, args)
+}
 
-	return inFile, err
+func checkImageLimits(width int64, height int64, frames int) error {
+	if MaxSourcePixels > 0 && width*height > MaxSourcePixels {
+		return sourceTooLarge("source is %dx%d, larger than the %d pixel limit", width, height, MaxSourcePixels)
+	}
+	if MaxSourceFrames > 0 && frames > MaxSourceFrames {
+		return sourceTooLarge("source has %d frames, more than the %d frame limit", frames, MaxSourceFrames)
+	}
+	return nil
 }
 
 func preProcessImage(tempDir string, inFile string, args *ProcessArgs) (string, error) {
-	if isAnimatedGif(inFile) {
+	animated, err := isAnimatedGif(args.ctx(), inFile)
+	if err != nil {
+		args.degrade("animation-unknown")
+	}
+	if animated {
+		args.Animated = true
 		args.Format = "gif" // Total hack cos format is incorrectly .png on example
-		return coalesceAnimatedGif(tempDir, inFile)
+		return cachedCoalesce(args.ctx(), tempDir, inFile, args.Url)
 	} else {
 		return inFile, nil
 	}
 }
 
+// extractColorProfile saves the embedded ICC profile, if there is one, so it
+// survives stripping metadata
+func extractColorProfile(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if !args.stripping() {
+		return inFile, nil
+	}
+
+	profile := filepath.Join(tempDir, "profile.icc")
+	ctx, cancel := context.WithTimeout(args.ctx(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", inFile+"[0]", profile)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		// most images don't have a profile, which convert reports as an error
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "extract-profile",
+			"profile":   "none",
+			"output":    outErr.String(),
+		})
+		return inFile, nil
+	}
+
+	if info, err := os.Stat(profile); err == nil && info.Size() > 0 {
+		args.ColorProfile = profile
+	}
+	return inFile, nil
+}
+
+// inspectColor records the colorspace and embedded ICC profile of the
+// source so it can be converted to sRGB
+func inspectColor(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	ctx, cancel := context.WithTimeout(args.ctx(), IdentifyTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "identify", "-format", "%[colorspace]|%[profile:icc]", inFile+"[0]")
+	var stdout bytes.Buffer
+	var stderr outputBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "inspect-color",
+			"failure":   err,
+			"output":    stderr.String(),
+		})
+		// carry on without color management rather than fail the request
+		args.degrade("color-unmanaged")
+		return inFile, nil
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(stdout.String()), "|", 2)
+	args.Colorspace = parts[0]
+	if len(parts) == 2 {
+		args.IccProfile = parts[1]
+	}
+
+	// without a CMYK profile the conversion is only approximate
+	if colorArgs := args.colorArgs(); len(colorArgs) > 0 && colorArgs[0] == "-colorspace" {
+		args.degrade("cmyk-approximated")
+	}
+
+	// once converted the original profile no longer describes the pixels
+	if args.ColorProfile != "" && len(args.colorArgs()) > 0 && SrgbProfile != "" {
+		args.ColorProfile = SrgbProfile
+	}
+
+	grohl.Log(grohl.Data{
+		"processor":   "imagick",
+		"step":        "inspect-color",
+		"colorspace":  args.Colorspace,
+		"icc-profile": args.IccProfile,
+	})
+	return inFile, nil
+}
+
 func processImage(tempDir string, inFile string, args *ProcessArgs) (string, error) {
 	outFile := filepath.Join(tempDir, "out")
 	cmdArgs, outFileWithFormat := args.CommandArgs(inFile, outFile)
@@ -120,47 +574,102 @@ func processImage(tempDir string, inFile string, args *ProcessArgs) (string, err
 	})
 
 	executable := "convert"
-	cmd := exec.Command(executable, cmdArgs...)
-	var outErr bytes.Buffer
+	ctx, cancel := context.WithTimeout(args.ctx(), delegateTimeout(executable))
+	defer cancel()
+	cmd := delegateCommand(ctx, executable, cmdArgs...)
+	var outErr outputBuffer
 	cmd.Stdout, cmd.Stderr = &outErr, &outErr
-	err := runWithTimeout(cmd, normalTimeout)
+	err := runLimited(ctx, cmd, args.Priority)
 	if err != nil {
 		grohl.Log(grohl.Data{
 			"processor": "imagick",
 			"step":      "convert",
 			"failure":   err,
 			"args":      cmdArgs,
-			"output":    string(outErr.Bytes()),
+			"output":    outErr.String(),
 		})
 	}
 
 	return outFileWithFormat, err
 }
 
+func maskImage(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if !args.hasMask() || args.Animated {
+		return inFile, nil
+	}
+
+	width, height, err := identifyDimensions(args.ctx(), inFile)
+	if err != nil {
+		return inFile, err
+	}
+
+	outFile := filepath.Join(tempDir, "masked.png")
+	cmdArgs := args.MaskArgs(inFile, outFile, width, height)
+
+	grohl.Log(grohl.Data{
+		"processor": "imagick",
+		"args":      cmdArgs,
+	})
+
+	ctx, cancel := context.WithTimeout(args.ctx(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err = runLimited(ctx, cmd, args.Priority)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "mask",
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+	}
+
+	return outFile, err
+}
+
 func postProcessImage(tempDir string, inFile string, args *ProcessArgs) (string, error) {
 	// If it originally "mp4" was requested even if before processing
 	// changed it to "gif"
 	grohl.Log(grohl.Data{"args": args})
 	if args.RequestFormat == "mp4" && args.Format == "gif" {
 		outFile := filepath.Join(tempDir, "video.mp4")
-		cmdArgs := []string{"-f", "gif", "-i", inFile, outFile}
+		cmdArgs := []string{"-f", "gif", "-i", inFile}
+		if args.Deterministic {
+			cmdArgs = append(cmdArgs, "-fflags", "+bitexact", "-flags:v", "+bitexact", "-map_metadata", "-1")
+		}
+
+		var outErr outputBuffer
+		var stdout io.Writer = &outErr
+		if args.StepProgress != nil {
+			// ffmpeg writes key=value progress lines to stdout, report
+			// frames encoded out of the total
+			cmdArgs = append(cmdArgs, "-progress", "pipe:1", "-nostats")
+			progress := ffmpegProgressWriter(frameCount(args.ctx(), inFile), args.StepProgress)
+			defer progress.Close()
+			stdout = progress
+		}
+		cmdArgs = append(cmdArgs, outFile)
 
 		grohl.Log(grohl.Data{
 			"processor": "ffmpeg",
 			"args":      cmdArgs,
 		})
 
-		cmd := exec.Command("ffmpeg", cmdArgs...)
-		var outErr bytes.Buffer
-		cmd.Stdout, cmd.Stderr = &outErr, &outErr
-		err := runWithTimeout(cmd, normalTimeout)
+		ctx, cancel := context.WithTimeout(args.ctx(), FfmpegTimeout)
+		defer cancel()
+		cmd := delegateCommand(ctx, "ffmpeg", cmdArgs...)
+		cmd.Stdout, cmd.Stderr = stdout, &outErr
+		err := runLimited(ctx, cmd, args.Priority)
 		if err != nil {
 			grohl.Log(grohl.Data{
 				"processor": "ffmpeg",
 				"step":      "post-process-mp4",
 				"failure":   err,
 				"args":      cmdArgs,
-				"output":    string(outErr.Bytes()),
+				"output":    outErr.String(),
 			})
 		}
 
@@ -170,80 +679,122 @@ func postProcessImage(tempDir string, inFile string, args *ProcessArgs) (string,
 	return inFile, nil
 }
 
-func isAnimatedGif(inFile string) bool {
+// ffmpegProgressWriter parses the output of ffmpeg -progress, calling
+// report with the fraction of frames encoded so far
+func ffmpegProgressWriter(totalFrames int, report func(float64)) io.WriteCloser {
+	r, w := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "frame=") || totalFrames <= 0 {
+				continue
+			}
+			frame, err := strconv.Atoi(strings.TrimPrefix(line, "frame="))
+			if err == nil {
+				report(math.Min(1, float64(frame)/float64(totalFrames)))
+			}
+		}
+		r.Close()
+	}()
+	return w
+}
+
+// frameCount returns the number of frames in inFile, or 0 if it can't
+// be identified
+func frameCount(ctx context.Context, inFile string) int {
+	// %n is printed once for every frame, selecting one would count only it
+	output, err := identify(ctx, "-ping", "-format", "%n\n", inFile)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.SplitN(strings.TrimSpace(output), "\n", 2)[0])
+	return n
+}
+
+// isAnimatedGif errors if the frames can't be counted, in which case the
+// image is treated as a still
+func isAnimatedGif(ctx context.Context, inFile string) (bool, error) {
 	// identify -format %n updates-product-click.gif # => 105
-	cmd := exec.Command("identify", "-format", "%n", inFile)
-	var stdout, stderr bytes.Buffer
+	ctx, cancel := context.WithTimeout(ctx, IdentifyTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "identify", "-format", "%n", inFile)
+	var stdout bytes.Buffer
+	var stderr outputBuffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
-	err := runWithTimeout(cmd, 10*time.Second)
+	err := runCommand(ctx, cmd)
 	if err != nil {
-		output := string(stderr.Bytes())
+		output := stderr.String()
 		grohl.Log(grohl.Data{
 			"processor": "imagick",
 			"step":      "identify",
 			"failure":   err,
 			"output":    output,
 		})
-	} else {
-		output := string(stdout.Bytes())
-		output = strings.TrimSpace(output)
-		numFrames, err := strconv.Atoi(output)
-		if err != nil {
-			grohl.Log(grohl.Data{
-				"processor": "imagick",
-				"step":      "identify",
-				"failure":   err,
-				"output":    output,
-				"message":   "non numeric identify output",
-			})
-		} else {
-			grohl.Log(grohl.Data{
-				"processor":  "imagick",
-				"step":       "identify",
-				"num-frames": numFrames,
-			})
-			return numFrames > 1
-		}
+		return false, err
+	}
+
+	output := strings.TrimSpace(string(stdout.Bytes()))
+	numFrames, err := strconv.Atoi(output)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "identify",
+			"failure":   err,
+			"output":    output,
+			"message":   "non numeric identify output",
+		})
+		return false, err
+	}
+	grohl.Log(grohl.Data{
+		"processor":  "imagick",
+		"step":       "identify",
+		"num-frames": numFrames,
+	})
+	return numFrames > 1, nil
+}
+
+func identifyDimensions(ctx context.Context, inFile string) (width int, height int, err error) {
+	ctx, cancel := context.WithTimeout(ctx, IdentifyTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "identify", "-format", "%w %h", inFile+"[0]")
+	var stdout bytes.Buffer
+	var stderr outputBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "identify",
+			"failure":   err,
+			"output":    stderr.String(),
+		})
+		return
 	}
-	// if anything fucks out assume not animated
-	return false
+	_, err = fmt.Sscanf(stdout.String(), "%d %d", &width, &height)
+	return
 }
 
-func coalesceAnimatedGif(tempDir string, inFile string) (string, error) {
+func coalesceAnimatedGif(ctx context.Context, tempDir string, inFile string) (string, error) {
 	outFile := filepath.Join(tempDir, "temp")
 
 	// convert do.gif -coalesce temporary.gif
-	cmd := exec.Command("convert", inFile, "-coalesce", outFile)
-	var outErr bytes.Buffer
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", inFile, "-coalesce", outFile)
+	var outErr outputBuffer
 	cmd.Stdout, cmd.Stderr = &outErr, &outErr
 
-	err := runWithTimeout(cmd, 60*time.Second)
+	err := runCommand(ctx, cmd)
 	if err != nil {
 		grohl.Log(grohl.Data{
 			"processor": "imagick",
 			"step":      "coalesce",
 			"failure":   err,
-			"output":    string(outErr.Bytes()),
+			"output":    outErr.String(),
 		})
 	}
 
 	return outFile, err
 }
-
-func runWithTimeout(cmd *exec.Cmd, timeout time.Duration) error {
-	// Start the process
-	err := cmd.Start()
-	if err != nil {
-		return err
-	}
-
-	// Kill the process if it doesn't exit in time
-	defer time.AfterFunc(timeout, func() {
-		fmt.Println("command timed out")
-		cmd.Process.Kill()
-	}).Stop()
-
-	// Wait for the process to finish
-	return cmd.Wait()
-}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// flight is one run of the pipeline shared by every request for the same
+// derivative that arrives while it's running. Its result file is kept
+// until the last of them has released it
+type flight struct {
+	done     chan struct{}
+	filePath string
+	degraded []string
+	err      error
+	ended    bool
+
+	cancel   context.CancelFunc
+	cleanup  func()
+	waiting  int
+	users    int
+	finished bool
+}
+
+var inflight = struct {
+	sync.Mutex
+	byKey map[string]*flight
+}{byKey: map[string]*flight{}}
+
+// joinFlight runs process for key, unless a run for the same key is
+// already in flight, in which case it waits for and shares that one's
+// result. The run is only canceled once every request waiting on it has
+// gone away, or the deadline of the request that started it passes.
+// Requests still with time left when it runs out start a run of their
+// own rather than sharing its failure. shared is true for requests that didn't start the run. Unless an error is
+// returned, callers must release the flight once they're done with its
+// result
+func joinFlight(ctx context.Context, key string, process func(ctx context.Context) (string, []string, func(), error)) (f *flight, shared bool, err error) {
+	inflight.Lock()
+	f, shared = inflight.byKey[key]
+	if shared {
+		f.waiting++
+		f.users++
+	} else {
+		flightCtx := context.WithoutCancel(ctx)
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			flightCtx, cancel = context.WithDeadline(flightCtx, deadline)
+		} else {
+			flightCtx, cancel = context.WithCancel(flightCtx)
+		}
+		f = &flight{done: make(chan struct{}), cancel: cancel, waiting: 1, users: 1}
+		inflight.byKey[key] = f
+		go f.run(flightCtx, key, process)
+	}
+	inflight.Unlock()
+
+	if shared {
+		grohl.Counter(1.0, "inflight.shared", 1)
+	}
+
+	select {
+	case <-f.done:
+		if f.err != nil {
+			f.release()
+			if f.ended && hasTimeLeft(ctx) {
+				return joinFlight(ctx, key, process)
+			}
+			return nil, shared, f.err
+		}
+		return f, shared, nil
+	case <-ctx.Done():
+		inflight.Lock()
+		f.waiting--
+		if f.waiting == 0 {
+			f.cancel()
+		}
+		inflight.Unlock()
+		f.release()
+		return nil, shared, ctx.Err()
+	}
+}
+
+// hasTimeLeft is whether ctx is still live, checking its deadline as well
+// as its timer, which may not have fired yet for a deadline just passed
+func hasTimeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Now().Before(deadline)
+}
+
+func (f *flight) run(ctx context.Context, key string, process func(ctx context.Context) (string, []string, func(), error)) {
+	filePath, degraded, cleanup, err := process(ctx)
+	ended := ctx.Err() != nil
+	f.cancel()
+
+	inflight.Lock()
+	delete(inflight.byKey, key)
+	f.filePath, f.degraded, f.err, f.cleanup = filePath, degraded, err, cleanup
+	f.ended = ended
+	f.finished = true
+	unused := f.users == 0
+	inflight.Unlock()
+	close(f.done)
+
+	if unused && cleanup != nil {
+		cleanup()
+	}
+}
+
+// release gives up a request's hold on the result, removing it once no
+// request holds it
+func (f *flight) release() {
+	inflight.Lock()
+	f.users--
+	last := f.users == 0 && f.finished
+	inflight.Unlock()
+	if last && f.cleanup != nil {
+		f.cleanup()
+	}
+}
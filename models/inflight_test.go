@@ -0,0 +1,138 @@
+package models
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestJoinFlightSharesOneRun(t *testing.T) {
+	var runs, cleanups int32
+	start := make(chan struct{})
+	process := func(ctx context.Context) (string, []string, func(), error) {
+		atomic.AddInt32(&runs, 1)
+		<-start
+		return "out.png", []string{"color-unmanaged"}, func() { atomic.AddInt32(&cleanups, 1) }, nil
+	}
+
+	var wg sync.WaitGroup
+	var sharedCount int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f, shared, err := joinFlight(context.Background(), "key", process)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, "out.png", f.filePath)
+			assert.Equal(t, []string{"color-unmanaged"}, f.degraded)
+			assert.Equal(t, int32(0), atomic.LoadInt32(&cleanups))
+			if shared {
+				atomic.AddInt32(&sharedCount, 1)
+			}
+			f.release()
+		}()
+	}
+	for atomic.LoadInt32(&runs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(start)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), runs)
+	assert.Equal(t, int32(1), cleanups)
+	assert.T(t, sharedCount >= 1)
+}
+
+func TestJoinFlightCancelsOnceEveryoneLeaves(t *testing.T) {
+	canceled := make(chan struct{})
+	process := func(ctx context.Context) (string, []string, func(), error) {
+		<-ctx.Done()
+		close(canceled)
+		return "", nil, nil, ctx.Err()
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() {
+		_, _, err := joinFlight(first, "cancel", process)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		_, _, err := joinFlight(second, "cancel", process)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	cancelFirst()
+	assert.Equal(t, context.Canceled, <-errs)
+	select {
+	case <-canceled:
+		t.Fatal("Expected the run to continue while a request still waits on it")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	cancelSecond()
+	assert.Equal(t, context.Canceled, <-errs)
+	<-canceled
+}
+
+func TestJoinFlightKeepsTheDeadline(t *testing.T) {
+	deadline := time.Now().Add(time.Minute)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	var flightDeadline time.Time
+	f, _, err := joinFlight(ctx, "deadline", func(ctx context.Context) (string, []string, func(), error) {
+		flightDeadline, _ = ctx.Deadline()
+		return "out.png", nil, nil, nil
+	})
+	assert.Equal(t, nil, err)
+	f.release()
+	assert.T(t, flightDeadline.Equal(deadline))
+
+	var hasDeadline bool
+	f, _, err = joinFlight(context.Background(), "deadline", func(ctx context.Context) (string, []string, func(), error) {
+		_, hasDeadline = ctx.Deadline()
+		return "out.png", nil, nil, nil
+	})
+	assert.Equal(t, nil, err)
+	f.release()
+	assert.T(t, !hasDeadline)
+}
+
+func TestJoinFlightOutlivesTheStartingDeadline(t *testing.T) {
+	var runs int32
+	process := func(ctx context.Context) (string, []string, func(), error) {
+		if atomic.AddInt32(&runs, 1) == 1 {
+			<-ctx.Done()
+			return "", nil, nil, ctx.Err()
+		}
+		return "out.png", nil, nil, nil
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancelShort()
+	long, cancelLong := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLong()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := joinFlight(short, "deadlines", process)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	f, _, err := joinFlight(long, "deadlines", process)
+
+	assert.Equal(t, context.DeadlineExceeded, <-errs)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "out.png", f.filePath)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&runs))
+	f.release()
+}
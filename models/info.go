@@ -0,0 +1,129 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// ImageInfo describes a source image without processing it. Width and
+// Height are as displayed, after EXIF orientation is applied, RawWidth
+// and RawHeight as stored
+type ImageInfo struct {
+	Format       string            `json:"format"`
+	Width        int               `json:"width"`
+	Height       int               `json:"height"`
+	RawWidth     int               `json:"raw_width"`
+	RawHeight    int               `json:"raw_height"`
+	Orientation  string            `json:"orientation,omitempty"`
+	Frames       int               `json:"frames"`
+	Bytes        int64             `json:"bytes"`
+	Colorspace   string            `json:"colorspace"`
+	ColorProfile string            `json:"color_profile,omitempty"`
+	Exif         map[string]string `json:"exif,omitempty"`
+}
+
+// FetchImageInfo downloads url and identifies it
+func FetchImageInfo(url string) (*ImageInfo, error) {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	filePath, err := downloadChecked(tempDir, url)
+	if err != nil {
+		return nil, err
+	}
+	return identifyInfo(filePath)
+}
+
+func identifyInfo(filePath string) (*ImageInfo, error) {
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// -ping reads just enough to get the attributes, one line per frame
+	output, err := identify(context.Background(), "-ping", "-format", "%m|%w|%h|%[orientation]|%[colorspace]|%[profile:icc]\n", filePath)
+	if err != nil {
+		return nil, err
+	}
+	frames := strings.Split(strings.TrimSpace(output), "\n")
+	fields := strings.SplitN(frames[0], "|", 6)
+	for len(fields) < 6 {
+		fields = append(fields, "")
+	}
+
+	info := &ImageInfo{
+		Format:       strings.ToLower(fields[0]),
+		Frames:       len(frames),
+		Bytes:        stat.Size(),
+		Colorspace:   fields[4],
+		ColorProfile: fields[5],
+	}
+	if fields[3] != "Undefined" {
+		info.Orientation = fields[3]
+	}
+	info.RawWidth, _ = strconv.Atoi(fields[1])
+	info.RawHeight, _ = strconv.Atoi(fields[2])
+	info.Width, info.Height = info.RawWidth, info.RawHeight
+	if swapsDimensions(info.Orientation) {
+		info.Width, info.Height = info.RawHeight, info.RawWidth
+	}
+
+	exif, err := identify(context.Background(), "-format", "%[EXIF:*]", filePath+"[0]")
+	if err == nil {
+		info.Exif = parseExif(exif)
+	}
+
+	return info, nil
+}
+
+// swapsDimensions is true for the EXIF orientations, 5 to 8, that rotate
+// the image a quarter turn when displayed
+func swapsDimensions(orientation string) bool {
+	switch orientation {
+	case "LeftTop", "RightTop", "RightBottom", "LeftBottom":
+		return true
+	}
+	return false
+}
+
+// parseExif reads identify's "exif:Make=Apple" lines into a map keyed by
+// tag name
+func parseExif(output string) map[string]string {
+	exif := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		exif[strings.TrimPrefix(parts[0], "exif:")] = parts[1]
+	}
+	return exif
+}
+
+func identify(ctx context.Context, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, IdentifyTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "identify", args...)
+	var stdout bytes.Buffer
+	var stderr outputBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "identify",
+			"failure":   err,
+			"args":      args,
+			"output":    stderr.String(),
+		})
+	}
+	return stdout.String(), err
+}
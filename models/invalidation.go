@@ -0,0 +1,248 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// AssetUpdatedEvent is the message origins publish when a source image
+// changes. Either field may be used
+type AssetUpdatedEvent struct {
+	Url  string   `json:"url"`
+	Urls []string `json:"urls"`
+}
+
+// InvalidateSource drops every cached derivative of url so the next
+// request regenerates it from the updated origin
+func InvalidateSource(url string) error {
+	grohl.Log(grohl.Data{"invalidate": url})
+
+	result, err := PurgeCache(context.Background(), &CachePurge{Urls: []string{url}})
+	if err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return errors.New(strings.Join(result.Errors, "; "))
+	}
+	return nil
+}
+
+// StartInvalidationSubscriber listens for asset updated events in the
+// background. The scheme of subscribeUrl picks the transport:
+//
+//	nats://localhost:4222/assets.updated
+//	kafka+http://rest-proxy:8082/assets-updated?group=firesize
+func StartInvalidationSubscriber(subscribeUrl string) {
+	if subscribeUrl == "" {
+		return
+	}
+
+	u, err := url.Parse(subscribeUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	var subscribe func(handle func([]byte)) error
+	switch u.Scheme {
+	case "nats":
+		subscribe = func(handle func([]byte)) error {
+			return subscribeNats(u, handle)
+		}
+	case "kafka+http", "kafka+https":
+		subscribe = func(handle func([]byte)) error {
+			return subscribeKafkaRest(u, handle)
+		}
+	default:
+		panic("unknown invalidation subscriber " + subscribeUrl)
+	}
+
+	go func() {
+		for {
+			err := subscribe(handleAssetUpdated)
+			grohl.Log(grohl.Data{
+				"subscriber": u.Scheme,
+				"failure":    err,
+				"message":    "reconnecting",
+			})
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func handleAssetUpdated(payload []byte) {
+	var e AssetUpdatedEvent
+	err := json.Unmarshal(payload, &e)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"subscriber": "invalid",
+			"failure":    err,
+			"payload":    string(payload),
+		})
+		return
+	}
+
+	urls := e.Urls
+	if e.Url != "" {
+		urls = append(urls, e.Url)
+	}
+	for _, url := range urls {
+		err = InvalidateSource(url)
+		if err != nil {
+			grohl.Log(grohl.Data{
+				"invalidate": url,
+				"failure":    err,
+			})
+		}
+	}
+}
+
+// subscribeNats speaks just enough of the NATS text protocol to receive
+// messages on a single subject
+// http://nats.io/documentation/internals/nats-protocol/
+func subscribeNats(u *url.URL, handle func([]byte)) error {
+	conn, err := net.DialTimeout("tcp", u.Host, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	subject := strings.TrimPrefix(u.Path, "/")
+	connect := map[string]interface{}{"verbose": false, "pedantic": false, "name": "firesize"}
+	if u.User != nil {
+		connect["user"] = u.User.Username()
+		connect["pass"], _ = u.User.Password()
+	}
+	connectJson, _ := json.Marshal(connect)
+	_, err = fmt.Fprintf(conn, "CONNECT %s\r\nSUB %s 1\r\n", connectJson, subject)
+	if err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch fields[0] {
+		case "PING":
+			_, err = io.WriteString(conn, "PONG\r\n")
+			if err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New(strings.TrimSpace(line))
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return err
+			}
+			payload := make([]byte, size+2)
+			_, err = io.ReadFull(r, payload)
+			if err != nil {
+				return err
+			}
+			handle(payload[:size])
+		}
+	}
+}
+
+// subscribeKafkaRest consumes a topic through a Kafka REST proxy
+// http://docs.confluent.io/current/kafka-rest/docs/api.html#consumers
+func subscribeKafkaRest(u *url.URL, handle func([]byte)) error {
+	topic := strings.TrimPrefix(u.Path, "/")
+	group := u.Query().Get("group")
+	if group == "" {
+		group = "firesize"
+	}
+	base := strings.TrimPrefix(u.Scheme, "kafka+") + "://" + u.Host
+	hostname, _ := os.Hostname()
+
+	var instance struct {
+		BaseUri string `json:"base_uri"`
+	}
+	err := kafkaRestCall("POST", base+"/consumers/"+group, map[string]string{
+		"name":              "firesize-" + hostname,
+		"format":            "json",
+		"auto.offset.reset": "latest",
+	}, &instance)
+	if err != nil {
+		return err
+	}
+	defer kafkaRestCall("DELETE", instance.BaseUri, nil, nil)
+
+	err = kafkaRestCall("POST", instance.BaseUri+"/subscription", map[string][]string{
+		"topics": {topic},
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var records []struct {
+			Value json.RawMessage `json:"value"`
+		}
+		err = kafkaRestCall("GET", instance.BaseUri+"/records", nil, &records)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			handle(record.Value)
+		}
+		if len(records) == 0 {
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func kafkaRestCall(method string, url string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.json.v2+json")
+
+	resp, err := eventClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("kafka rest proxy %s %s responded with status %d", method, url, resp.StatusCode)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSubscribeNatsReceivesMessages(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	payload := `{"url":"http://placekitten.com/g/32/32"}`
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "INFO {}\r\n")
+		r.ReadString('\n') // CONNECT
+		r.ReadString('\n') // SUB
+		fmt.Fprint(conn, "PING\r\n")
+		r.ReadString('\n') // PONG
+		fmt.Fprintf(conn, "MSG assets.updated 1 %d\r\n%s\r\n", len(payload), payload)
+	}()
+
+	u, _ := url.Parse("nats://" + l.Addr().String() + "/assets.updated")
+	var received []string
+	err = subscribeNats(u, func(b []byte) {
+		received = append(received, string(b))
+	})
+
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, []string{payload}, received)
+}
+
+func TestAssetUpdatedPurgesRemoteResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	remote := indexedResultCache{}
+	RemoteCache = remote
+	defer func() { RemoteCache = nil }()
+
+	// stored by another instance, so only the remote cache knows of it
+	data := []byte("not really a cat")
+	cat := &CachedResult{Format: "png", Data: data, Version: resultCacheFormat, Sha256: dataSha256(data), Source: "http://example.com/cat.jpg"}
+	remote.Put(context.Background(), "cat-512", cat)
+	dog := *cat
+	dog.Source = "http://example.com/dog.jpg"
+	remote.Put(context.Background(), "dog-512", &dog)
+
+	handleAssetUpdated([]byte(`{"urls":["http://example.com/cat.jpg"]}`))
+
+	_, ok := fetchRemoteResult(context.Background(), dir, "cat-512")
+	assert.T(t, !ok)
+	_, ok = fetchRemoteResult(context.Background(), dir, "dog-512")
+	assert.T(t, ok)
+}
@@ -0,0 +1,296 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// Job processes an image in the background for clients that would rather
+// not hold a request open, e.g. long gif to mp4 conversions
+type Job struct {
+	Id          string    `json:"id"`
+	AccountId   int64     `json:"-"`
+	Url         string    `json:"url"`
+	Args        []string  `json:"args"`
+	State       string    `json:"state"`
+	Step        string    `json:"step,omitempty"`
+	Progress    float64   `json:"progress"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created"`
+	CompletedAt time.Time `json:"completed,omitempty"`
+
+	ResultPath string `json:"-"`
+	tempDir    string
+
+	mu          sync.Mutex
+	subscribers map[chan JobEvent]bool
+	done        chan struct{}
+}
+
+// JobEvent is sent to subscribers whenever a job's state changes
+type JobEvent struct {
+	State    string  `json:"state"`
+	Step     string  `json:"step,omitempty"`
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// How long finished job results are kept, and how many finished jobs each
+// account may keep at once
+var (
+	JobRetention     = 24 * time.Hour
+	JobMaxPerAccount = 100
+	jobCleanupEvery  = time.Minute
+)
+
+var jobs = struct {
+	sync.Mutex
+	byId map[string]*Job
+}{byId: map[string]*Job{}}
+
+// StartJob queues processing of url with urlArgs and returns immediately
+func StartJob(accountId int64, url string, urlArgs []string) *Job {
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	job := &Job{
+		Id:          hex.EncodeToString(id),
+		AccountId:   accountId,
+		Url:         url,
+		Args:        urlArgs,
+		State:       JobQueued,
+		CreatedAt:   time.Now(),
+		subscribers: map[chan JobEvent]bool{},
+		done:        make(chan struct{}),
+	}
+
+	jobs.Lock()
+	jobs.byId[job.Id] = job
+	jobs.Unlock()
+
+	go job.run()
+	return job
+}
+
+// FindJob returns the job with id, or nil
+func FindJob(id string) *Job {
+	jobs.Lock()
+	defer jobs.Unlock()
+	return jobs.byId[id]
+}
+
+// StartJobCleanup removes expired job results in the background
+func StartJobCleanup() {
+	go func() {
+		for range time.Tick(jobCleanupEvery) {
+			cleanupJobs(time.Now())
+		}
+	}()
+}
+
+// cleanupJobs forgets finished jobs older than JobRetention, then the
+// oldest finished jobs of any account over JobMaxPerAccount, and deletes
+// their results. Returns the bytes reclaimed
+func cleanupJobs(now time.Time) int64 {
+	jobs.Lock()
+	expired := []*Job{}
+	finished := map[int64][]*Job{}
+	for _, job := range jobs.byId {
+		if !job.Finished() {
+			continue
+		}
+		if now.Sub(job.CompletedAt) > JobRetention {
+			expired = append(expired, job)
+		} else {
+			finished[job.AccountId] = append(finished[job.AccountId], job)
+		}
+	}
+	for _, accountJobs := range finished {
+		if len(accountJobs) <= JobMaxPerAccount {
+			continue
+		}
+		sort.Slice(accountJobs, func(i, k int) bool {
+			return accountJobs[i].CompletedAt.Before(accountJobs[k].CompletedAt)
+		})
+		expired = append(expired, accountJobs[:len(accountJobs)-JobMaxPerAccount]...)
+	}
+	for _, job := range expired {
+		delete(jobs.byId, job.Id)
+	}
+	jobs.Unlock()
+
+	var reclaimed int64
+	for _, job := range expired {
+		reclaimed += job.removeResult()
+	}
+	if len(expired) > 0 {
+		grohl.Counter(1.0, "jobs.reclaimed_bytes", int(reclaimed))
+		grohl.Log(grohl.Data{
+			"action":    "cleanup-jobs",
+			"jobs":      len(expired),
+			"reclaimed": reclaimed,
+		})
+	}
+	return reclaimed
+}
+
+func (j *Job) removeResult() int64 {
+	j.mu.Lock()
+	tempDir := j.tempDir
+	j.mu.Unlock()
+	if tempDir == "" {
+		return 0
+	}
+	size := dirSize(tempDir)
+	os.RemoveAll(tempDir)
+	return size
+}
+
+// jobWorkspaces are the workspaces of jobs still running or holding a
+// result
+func jobWorkspaces() map[string]bool {
+	jobs.Lock()
+	defer jobs.Unlock()
+	workspaces := map[string]bool{}
+	for _, job := range jobs.byId {
+		job.mu.Lock()
+		if job.tempDir != "" {
+			workspaces[job.tempDir] = true
+		}
+		job.mu.Unlock()
+	}
+	return workspaces
+}
+
+func (j *Job) run() {
+	args := NewProcessArgs(j.Args, j.Url)
+	args.Priority = PriorityBatch
+
+	var steps []pipelineStep
+	if args.HasOperations() {
+		steps = defaultPipeline
+	} else {
+		steps = defaultPipeline[:1]
+	}
+
+	args.Progress = func(step string, index int, total int, state string) {
+		logProgress(step, index, total, state)
+		if state == StepStarted || state == StepCompleted {
+			fraction := float64(index) / float64(total)
+			if state == StepCompleted {
+				fraction = float64(index+1) / float64(total)
+			}
+			args.StepProgress = func(stepFraction float64) {
+				j.update(JobRunning, step, (float64(index)+stepFraction)/float64(total), "")
+			}
+			j.update(JobRunning, step, fraction, "")
+		}
+	}
+
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		j.finish("", err)
+		return
+	}
+	j.mu.Lock()
+	j.tempDir = tempDir
+	j.mu.Unlock()
+
+	filePath, err := runPipeline(steps, tempDir, "", args)
+	j.finish(filePath, err)
+}
+
+func (j *Job) update(state string, step string, progress float64, errMessage string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.State, j.Step, j.Progress, j.Error = state, step, progress, errMessage
+	event := j.event()
+	for ch := range j.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// slow subscribers miss intermediate progress, not the outcome
+		}
+	}
+}
+
+func (j *Job) finish(filePath string, err error) {
+	j.mu.Lock()
+	j.CompletedAt = time.Now()
+	if err == nil {
+		j.ResultPath = filePath
+	}
+	j.mu.Unlock()
+
+	if err != nil {
+		j.update(JobFailed, j.Step, j.Progress, err.Error())
+	} else {
+		j.update(JobCompleted, "", 1, "")
+	}
+	close(j.done)
+}
+
+func (j *Job) event() JobEvent {
+	return JobEvent{State: j.State, Step: j.Step, Progress: j.Progress, Error: j.Error}
+}
+
+// MarshalJSON locks the job so state isn't read mid-update
+func (j *Job) MarshalJSON() ([]byte, error) {
+	type job Job
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return json.Marshal((*job)(j))
+}
+
+// Snapshot returns the current state of the job
+func (j *Job) Snapshot() JobEvent {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.event()
+}
+
+// Finished is true once the job has completed or failed
+func (j *Job) Finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed when the job completes or fails
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Subscribe returns a channel of state changes and a func to stop
+// receiving them
+func (j *Job) Subscribe() (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, 16)
+	j.mu.Lock()
+	j.subscribers[ch] = true
+	j.mu.Unlock()
+
+	return ch, func() {
+		j.mu.Lock()
+		delete(j.subscribers, ch)
+		j.mu.Unlock()
+	}
+}
@@ -0,0 +1,43 @@
+package models
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func finishedJob(t *testing.T, id string, accountId int64, completed time.Time) *Job {
+	tempDir, err := ioutil.TempDir("", "job")
+	assert.Equal(t, nil, err)
+	ioutil.WriteFile(filepath.Join(tempDir, "out.png"), make([]byte, 10), 0644)
+
+	job := &Job{Id: id, AccountId: accountId, CompletedAt: completed, tempDir: tempDir, done: make(chan struct{})}
+	close(job.done)
+	jobs.byId[id] = job
+	return job
+}
+
+func TestCleanupJobsRemovesExpiredAndExcess(t *testing.T) {
+	defer func(max int) { JobMaxPerAccount = max }(JobMaxPerAccount)
+	JobMaxPerAccount = 1
+	now := time.Now()
+
+	finishedJob(t, "expired", 1, now.Add(-JobRetention-time.Minute))
+	finishedJob(t, "older", 2, now.Add(-2*time.Minute))
+	finishedJob(t, "newer", 2, now.Add(-time.Minute))
+	running := &Job{Id: "running", AccountId: 2, done: make(chan struct{})}
+	jobs.byId["running"] = running
+
+	assert.Equal(t, int64(20), cleanupJobs(now))
+	assert.T(t, FindJob("expired") == nil)
+	assert.T(t, FindJob("older") == nil)
+	assert.T(t, FindJob("newer") != nil)
+	assert.T(t, FindJob("running") != nil)
+
+	FindJob("newer").removeResult()
+	delete(jobs.byId, "newer")
+	delete(jobs.byId, "running")
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// LocalSourceRoot is a directory of originals served as /local/ sources,
+// read straight from disk rather than over HTTP. Empty disables them
+var LocalSourceRoot string
+
+// InitLocalSourceRoot sets LocalSourceRoot to dir, resolved to an absolute
+// path without symlinks so sources can be checked against it
+func InitLocalSourceRoot(dir string) error {
+	if dir == "" {
+		LocalSourceRoot = ""
+		return nil
+	}
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local source root %s isn't a directory", dir)
+	}
+	LocalSourceRoot = root
+	return nil
+}
+
+// isLocalSource is true for sources read from LocalSourceRoot
+func isLocalSource(source string) bool {
+	return strings.HasPrefix(source, "local:")
+}
+
+// isRemoteSource is true for sources fetched from an origin, rather than
+// given inline or read from disk
+func isRemoteSource(source string) bool {
+	return !isDataUri(source) && !isLocalSource(source)
+}
+
+// LocalSourceUrl is the source url of a path under LocalSourceRoot, as
+// given after /local/ in a transform path
+func LocalSourceUrl(path string) string {
+	return "local:/" + strings.TrimPrefix(path, "/")
+}
+
+// localSourcePath resolves a local: source to a file under
+// LocalSourceRoot. Sources escaping it, through .. or a symlink, are
+// treated as missing
+func localSourcePath(source string) (string, os.FileInfo, error) {
+	if LocalSourceRoot == "" {
+		return "", nil, statusErrorf(http.StatusNotFound, "local sources aren't enabled")
+	}
+	notFound := &StatusError{Status: http.StatusNotFound, Message: "source not found", Code: "source_not_found"}
+
+	rel := filepath.Clean("/" + strings.TrimPrefix(source, "local:"))
+	path, err := filepath.EvalSymlinks(filepath.Join(LocalSourceRoot, rel))
+	if os.IsNotExist(err) {
+		return "", nil, notFound
+	} else if err != nil {
+		return "", nil, err
+	}
+	if !strings.HasPrefix(path, LocalSourceRoot+string(filepath.Separator)) {
+		return "", nil, notFound
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return "", nil, notFound
+	}
+	return path, info, nil
+}
+
+// readLocalSource checks a local source like a download and returns its
+// path. The pipeline only ever reads its input, so it isn't copied
+func readLocalSource(source string) (string, error) {
+	path, info, err := localSourcePath(source)
+	if err != nil {
+		return "", err
+	}
+	if err = checkSourceSize(info.Size()); err != nil {
+		return "", err
+	}
+	return path, checkSourceContent(path, info.Size(), 0, "")
+}
+
+// sourceIdentity is the normalized url of a source, with the size and
+// modification time of local ones so derivatives cached from them are
+// replaced along with the file
+func sourceIdentity(source string) string {
+	if !isLocalSource(source) {
+		return normalizeSourceUrl(source)
+	}
+	_, info, err := localSourcePath(source)
+	if err != nil {
+		return source
+	}
+	return source + "@" + strconv.FormatInt(info.Size(), 10) + "-" + strconv.FormatInt(info.ModTime().UnixNano(), 10)
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestLocalSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "originals")
+	os.MkdirAll(filepath.Join(root, "products"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "products", "123.gif"), []byte("GIF89a"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "secret.gif"), []byte("GIF89a"), 0644)
+	os.Symlink(filepath.Join(dir, "secret.gif"), filepath.Join(root, "products", "escape.gif"))
+
+	defer InitLocalSourceRoot("")
+	_, err = readLocalSource(LocalSourceUrl("products/123.gif"))
+	assert.Equal(t, 404, err.(*StatusError).Status)
+
+	assert.Equal(t, nil, InitLocalSourceRoot(root))
+	path, err := readLocalSource(LocalSourceUrl("products/123.gif"))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, filepath.Join(LocalSourceRoot, "products", "123.gif"), path)
+
+	for _, escape := range []string{"../secret.gif", "products/../../secret.gif", "products/escape.gif", "products", "missing.gif"} {
+		_, err = readLocalSource(LocalSourceUrl(escape))
+		assert.Equal(t, 404, err.(*StatusError).Status)
+	}
+
+	// replacing the original changes the cache key of its variants
+	args := &ProcessArgs{Url: LocalSourceUrl("products/123.gif"), Width: 64}
+	key := args.CacheKey()
+	ioutil.WriteFile(filepath.Join(root, "products", "123.gif"), []byte("GIF89a+"), 0644)
+	assert.NotEqual(t, key, args.CacheKey())
+
+	assert.Equal(t, false, isRemoteSource(args.Url))
+	assert.Equal(t, true, isRemoteSource("http://example.com/local/cat.jpg"))
+}
@@ -0,0 +1,128 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BuildManifest lists the assets of a static site build and the presets
+// each should be generated in, as produced by static site generator plugins
+//
+//	{"presets": {"thumb": ["200x200", "g_center", "jpg"]},
+//	 "assets": [{"src": "http://example.com/cat.jpg", "presets": ["thumb"]}]}
+type BuildManifest struct {
+	Presets map[string][]string `json:"presets"`
+	Assets  []BuildAsset        `json:"assets"`
+}
+
+type BuildAsset struct {
+	Src     string   `json:"src"`
+	Presets []string `json:"presets"`
+}
+
+// BuildOutput is one generated image. Url is the firesize path serving
+// it and Hash the sha256 of its contents for cache busting and integrity
+type BuildOutput struct {
+	Src    string `json:"src"`
+	Preset string `json:"preset"`
+	Url    string `json:"url,omitempty"`
+	Hash   string `json:"hash,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ProcessManifest generates every preset of every asset. Failures are
+// reported on their output so one broken asset doesn't fail the build
+func ProcessManifest(manifest *BuildManifest) []BuildOutput {
+	outputs := []BuildOutput{}
+	for _, asset := range manifest.Assets {
+		outputs = append(outputs, processAsset(manifest, asset)...)
+	}
+	return outputs
+}
+
+func processAsset(manifest *BuildManifest, asset BuildAsset) []BuildOutput {
+	outputs := make([]BuildOutput, len(asset.Presets))
+	for i, preset := range asset.Presets {
+		outputs[i] = BuildOutput{Src: asset.Src, Preset: preset}
+	}
+
+	fail := func(err error) []BuildOutput {
+		for i := range outputs {
+			if outputs[i].Error == "" && outputs[i].Hash == "" {
+				outputs[i].Error = err.Error()
+			}
+		}
+		return outputs
+	}
+
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source, err := downloadRemote(tempDir, "", &ProcessArgs{Url: asset.Src})
+	if err != nil {
+		return fail(err)
+	}
+
+	for i, preset := range asset.Presets {
+		urlArgs, ok := manifest.Presets[preset]
+		if !ok {
+			outputs[i].Error = fmt.Sprintf("unknown preset %q", preset)
+			continue
+		}
+
+		variantDir := filepath.Join(tempDir, fmt.Sprintf("%d", i))
+		err = os.Mkdir(variantDir, 0755)
+		if err != nil {
+			return fail(err)
+		}
+		filePath, err := processVariant(variantDir, source, asset.Src, urlArgs)
+		if err != nil {
+			outputs[i].Error = err.Error()
+			continue
+		}
+
+		output := &outputs[i]
+		output.Url = TransformPath(urlArgs, asset.Src)
+		output.Hash, err = fileSha256(filePath)
+		if err != nil {
+			output.Error = err.Error()
+			continue
+		}
+		if info, err := os.Stat(filePath); err == nil {
+			output.Bytes = info.Size()
+		}
+		output.Width, output.Height, _ = identifyDimensions(context.Background(), filePath)
+
+		// prime the content store so the first real request is a hit
+		if Contents != nil {
+			args := NewProcessArgs(urlArgs, asset.Src)
+			Contents.Put(args.CacheKey(), args.Url, filePath, strings.TrimPrefix(filepath.Ext(filePath), "."))
+		}
+	}
+	return outputs
+}
+
+// TransformPath is the path firesize serves url processed with urlArgs
+// from, signed when a signing key is configured
+func TransformPath(urlArgs []string, url string) string {
+	path := "/"
+	for _, arg := range urlArgs {
+		if arg != "" {
+			path += arg + "/"
+		}
+	}
+	path += url
+	if SigningRequired() {
+		path = "/" + signSegment(path) + path
+	}
+	return path
+}
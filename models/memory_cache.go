@@ -0,0 +1,228 @@
+package models
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryCache keeps small results, like thumbnails, in RAM so hot images
+// are served without touching disk or the pipeline. Entries are evicted
+// least recently used first once the cache holds more than maxBytes.
+// With minHits above 1 results are only admitted once they've been asked
+// for that many times, so a crawl of one-off images can't push out the
+// hot ones
+type MemoryCache struct {
+	maxBytes      int64
+	maxEntryBytes int64
+	minHits       int
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List
+	entries map[string]*list.Element
+
+	// misses counts the recent requests for keys not yet admitted,
+	// forgetting the oldest beyond maxTrackedMisses
+	misses      map[string]int
+	missOrder   *list.List
+	missEntries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	source  string
+	name    string
+	ext     string
+	mime    string
+	data    []byte
+	etag    string
+	modTime time.Time
+}
+
+// Memory is nil unless MEMORY_CACHE_MAX_BYTES is set
+var Memory *MemoryCache
+
+// MemoryCacheMaxEntryBytes is the largest result kept in memory
+var MemoryCacheMaxEntryBytes int64 = 200 * 1024
+
+// MemoryCacheMinHits is how many times a result has to be asked for before
+// it's kept in memory
+var MemoryCacheMinHits = 1
+
+// maxTrackedMisses bounds the keys whose misses are counted for admission
+const maxTrackedMisses = 16384
+
+func InitMemoryCache(maxBytes int64) {
+	if maxBytes <= 0 {
+		Memory = nil
+		return
+	}
+	Memory = NewMemoryCache(maxBytes, MemoryCacheMaxEntryBytes)
+	Memory.minHits = MemoryCacheMinHits
+}
+
+func NewMemoryCache(maxBytes int64, maxEntryBytes int64) *MemoryCache {
+	return &MemoryCache{
+		maxBytes:      maxBytes,
+		maxEntryBytes: maxEntryBytes,
+		minHits:       1,
+		order:         list.New(),
+		entries:       map[string]*list.Element{},
+		misses:        map[string]int{},
+		missOrder:     list.New(),
+		missEntries:   map[string]*list.Element{},
+	}
+}
+
+// Get returns the entry for a transform key, marking it recently used.
+// Misses count towards the key's admission
+func (c *MemoryCache) Get(key string) (*memoryEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.countMiss(key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*memoryEntry), true
+}
+
+func (c *MemoryCache) countMiss(key string) {
+	if c.minHits <= 1 {
+		return
+	}
+	if el, ok := c.missEntries[key]; ok {
+		c.missOrder.MoveToFront(el)
+	} else {
+		c.missEntries[key] = c.missOrder.PushFront(key)
+		if c.missOrder.Len() > maxTrackedMisses {
+			c.forgetMisses(c.missOrder.Back().Value.(string))
+		}
+	}
+	c.misses[key]++
+}
+
+func (c *MemoryCache) forgetMisses(key string) {
+	if el, ok := c.missEntries[key]; ok {
+		c.missOrder.Remove(el)
+		delete(c.missEntries, key)
+		delete(c.misses, key)
+	}
+}
+
+// PutFile keeps the result at filePath under key if it's small enough.
+// name is its content store object name, if it has one, and modified when
+// it was produced if that isn't the file's modification time
+func (c *MemoryCache) PutFile(key string, source string, filePath string, name string, modified time.Time) {
+	info, err := os.Stat(filePath)
+	if err != nil || info.Size() > c.maxEntryBytes || info.Size() > c.maxBytes {
+		return
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	if modified.IsZero() {
+		modified = info.ModTime()
+	}
+	sum := sha256.Sum256(data)
+	mime := contentTypeForFormat(strings.TrimPrefix(filepath.Ext(filePath), "."))
+	if mime == "application/octet-stream" {
+		// left to ServeContent to work out from the extension
+		mime = ""
+	}
+	c.put(&memoryEntry{
+		key:     key,
+		source:  normalizeSourceUrl(source),
+		name:    name,
+		ext:     filepath.Ext(filePath),
+		mime:    mime,
+		data:    data,
+		etag:    resultETag(hex.EncodeToString(sum[:]), ""),
+		modTime: modified,
+	})
+}
+
+func (c *MemoryCache) put(entry *memoryEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.minHits > 1 {
+		if c.misses[entry.key] < c.minHits {
+			return
+		}
+		c.forgetMisses(entry.key)
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.size += int64(len(entry.data))
+	for c.size > c.maxBytes {
+		c.remove(c.order.Back())
+	}
+}
+
+// Purge drops the entries for which match is true, given each one's key
+// and normalized source url, returning the source of each dropped key
+func (c *MemoryCache) Purge(match func(key string, source string) bool) map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := map[string]string{}
+	for key, el := range c.entries {
+		entry := el.Value.(*memoryEntry)
+		if match(key, entry.source) {
+			purged[key] = entry.source
+			c.remove(el)
+		}
+	}
+	return purged
+}
+
+func (c *MemoryCache) remove(el *list.Element) {
+	entry := c.order.Remove(el).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+// memoryCacheable is true for requests whose results can be kept in, and
+// served from, the memory cache
+func memoryCacheable(args *ProcessArgs) bool {
+	return Memory != nil && args.Encoding == "" && args.HasOperations() &&
+		!CurrentServiceMode().ProxyOnly()
+}
+
+// serveMemoryResult serves a result straight from the memory cache
+func serveMemoryResult(w http.ResponseWriter, r *http.Request, entry *memoryEntry) {
+	w.Header().Set("X-Firesize-Cache", "memory")
+	if entry.name != "" {
+		setContentHeaders(w, entry.name)
+	}
+	setValidators(w, entry.etag, entry.modTime)
+	if notModified(r, entry.etag, entry.modTime) {
+		writeNotModified(w)
+		return
+	}
+	if r.Header.Get("Range") != "" || entry.mime == "" {
+		http.ServeContent(w, r, "result"+entry.ext, entry.modTime, bytes.NewReader(entry.data))
+		return
+	}
+
+	// the common case of a whole thumbnail is written straight out
+	w.Header().Set("Content-Type", entry.mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(entry.data)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		w.Write(entry.data)
+	}
+}
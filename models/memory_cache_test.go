@@ -0,0 +1,113 @@
+package models
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, size int) string {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, make([]byte, size), 0644)
+		return path
+	}
+	cache := NewMemoryCache(250, 100)
+	cache.PutFile("a", imgUrl, write("a.png", 100), "", time.Time{})
+	cache.PutFile("b", imgUrl, write("b.png", 100), "", time.Time{})
+	cache.PutFile("big", imgUrl, write("big.png", 101), "", time.Time{})
+	_, ok := cache.Get("big")
+	assert.T(t, !ok)
+
+	_, ok = cache.Get("a")
+	assert.T(t, ok)
+	cache.PutFile("c", imgUrl, write("c.png", 100), "", time.Time{})
+	_, ok = cache.Get("b")
+	assert.T(t, !ok)
+	_, ok = cache.Get("a")
+	assert.T(t, ok)
+	assert.Equal(t, int64(200), cache.size)
+}
+
+func TestMemoryCacheAdmitsHotResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	result := filepath.Join(dir, "result.png")
+	ioutil.WriteFile(result, make([]byte, 10), 0644)
+
+	cache := NewMemoryCache(1024, 1024)
+	cache.minHits = 2
+	_, ok := cache.Get("cat")
+	assert.T(t, !ok)
+	cache.PutFile("cat", imgUrl, result, "", time.Time{})
+	_, ok = cache.Get("cat")
+	assert.T(t, !ok)
+
+	// asked for twice now, so it's hot enough to keep
+	cache.PutFile("cat", imgUrl, result, "", time.Time{})
+	_, ok = cache.Get("cat")
+	assert.T(t, ok)
+	assert.Equal(t, 0, len(cache.misses))
+}
+
+func TestMemoryCachePurgesMatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	result := filepath.Join(dir, "out.png")
+	ioutil.WriteFile(result, []byte("not really a png"), 0644)
+	cache := NewMemoryCache(1024, 1024)
+	cache.PutFile("cat", "http://example.com/cat.jpg", result, "", time.Time{})
+	cache.PutFile("dog", "http://example.com/dog.jpg", result, "", time.Time{})
+
+	purged := cache.Purge(func(key string, source string) bool {
+		return source == "http://example.com/cat.jpg"
+	})
+	assert.Equal(t, map[string]string{"cat": "http://example.com/cat.jpg"}, purged)
+	_, ok := cache.Get("cat")
+	assert.T(t, !ok)
+	_, ok = cache.Get("dog")
+	assert.T(t, ok)
+}
+
+func TestServeMemoryResult(t *testing.T) {
+	entry := &memoryEntry{name: "abc.png", ext: ".png", data: []byte("not really a png")}
+	r, _ := http.NewRequest("GET", "http://firesize.dev/128x/"+imgUrl, nil)
+	w := httptest.NewRecorder()
+	serveMemoryResult(w, r, entry)
+	assert.Equal(t, "memory", w.Header().Get("X-Firesize-Cache"))
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "/cas/abc.png", w.Header().Get("Content-Location"))
+	assert.Equal(t, "not really a png", w.Body.String())
+
+	// whole results of a known type are written straight out
+	entry.mime = "image/png"
+	w = httptest.NewRecorder()
+	serveMemoryResult(w, r, entry)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "16", w.Header().Get("Content-Length"))
+	assert.Equal(t, "not really a png", w.Body.String())
+
+	r.Method = "HEAD"
+	w = httptest.NewRecorder()
+	serveMemoryResult(w, r, entry)
+	assert.Equal(t, "", w.Body.String())
+}
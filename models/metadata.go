@@ -0,0 +1,226 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/technoweenie/grohl"
+)
+
+// ImageMetadata describes a processed image for clients that want to lay
+// it out before it arrives
+type ImageMetadata struct {
+	Format   string   `json:"format"`
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	Frames   int      `json:"frames"`
+	Bytes    int64    `json:"bytes"`
+	Palette  []string `json:"palette,omitempty"`
+	BlurHash string   `json:"blurhash,omitempty"`
+}
+
+// readMetadata identifies the image at filePath. The palette and blurhash
+// are best effort and left empty for formats we can't read
+func readMetadata(filePath string) (*ImageMetadata, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// one line per frame
+	ctx, cancel := context.WithTimeout(context.Background(), IdentifyTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "identify", "-format", "%m %w %h\n", filePath)
+	var stdout bytes.Buffer
+	var stderr outputBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err = runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "metadata",
+			"failure":   err,
+			"output":    stderr.String(),
+		})
+		return nil, err
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	fields := strings.Fields(lines[0])
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected identify output %q", lines[0])
+	}
+	metadata := &ImageMetadata{
+		Format: strings.ToLower(fields[0]),
+		Frames: len(lines),
+		Bytes:  info.Size(),
+	}
+	metadata.Width, _ = strconv.Atoi(fields[1])
+	metadata.Height, _ = strconv.Atoi(fields[2])
+
+	metadata.Palette, _ = extractPalette(filePath, 5)
+	metadata.BlurHash, _ = fileBlurHash(filePath)
+
+	return metadata, nil
+}
+
+// ImagePalette is the most common colors of an image as hex values
+type ImagePalette struct {
+	Dominant string   `json:"dominant"`
+	Palette  []string `json:"palette"`
+}
+
+// FetchImagePalette downloads url and extracts up to colors colors
+func FetchImagePalette(url string, colors int) (*ImagePalette, error) {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	filePath, err := downloadChecked(tempDir, url)
+	if err != nil {
+		return nil, err
+	}
+
+	palette, err := extractPalette(filePath, colors)
+	if err != nil {
+		return nil, err
+	}
+	if len(palette) == 0 {
+		return nil, fmt.Errorf("no colors found in %s", url)
+	}
+	return &ImagePalette{Dominant: palette[0], Palette: palette}, nil
+}
+
+var histogramRgx = regexp.MustCompile(`^\s*(\d+):.*#([0-9A-Fa-f]{6})`)
+
+// extractPalette returns up to colors hex values, most common first, by
+// quantizing a small copy of the first frame and reading its histogram
+func extractPalette(filePath string, colors int) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", filePath+"[0]",
+		"-thumbnail", "64x64>",
+		"-alpha", "off",
+		"+dither",
+		"-colors", strconv.Itoa(colors),
+		"-format", "%c",
+		"histogram:info:-")
+	var stdout bytes.Buffer
+	var stderr outputBuffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := runCommand(ctx, cmd)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "palette",
+			"failure":   err,
+			"output":    stderr.String(),
+		})
+		return nil, err
+	}
+	return parseHistogram(stdout.String()), nil
+}
+
+type histogramEntry struct {
+	count int
+	color string
+}
+
+func parseHistogram(output string) []string {
+	entries := []histogramEntry{}
+	for _, line := range strings.Split(output, "\n") {
+		match := histogramRgx.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		count, _ := strconv.Atoi(match[1])
+		entries = append(entries, histogramEntry{count, "#" + strings.ToLower(match[2])})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].count > entries[j].count
+	})
+
+	palette := make([]string, len(entries))
+	for i, e := range entries {
+		palette[i] = e.color
+	}
+	return palette
+}
+
+// blurHashCacheSize bounds the in-memory cache of source blurhashes
+const blurHashCacheSize = 10000
+
+var blurHashes = struct {
+	sync.Mutex
+	byKey map[string]string
+}{byKey: map[string]string{}}
+
+// FetchBlurHash downloads url and encodes it with x by y components.
+// Sources rarely change so results are remembered by url
+func FetchBlurHash(url string, x int, y int) (string, error) {
+	key := fmt.Sprintf("%dx%d %s", x, y, url)
+	blurHashes.Lock()
+	hash, ok := blurHashes.byKey[key]
+	blurHashes.Unlock()
+	if ok {
+		return hash, nil
+	}
+
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tempDir)
+
+	filePath, err := downloadChecked(tempDir, url)
+	if err != nil {
+		return "", err
+	}
+
+	img, err := decodeFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	hash = BlurHash(img, x, y)
+
+	blurHashes.Lock()
+	if len(blurHashes.byKey) >= blurHashCacheSize {
+		blurHashes.byKey = map[string]string{}
+	}
+	blurHashes.byKey[key] = hash
+	blurHashes.Unlock()
+
+	return hash, nil
+}
+
+func fileBlurHash(filePath string) (string, error) {
+	img, err := decodeFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	return BlurHash(img, 4, 3), nil
+}
+
+func decodeFile(filePath string) (image.Image, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseHistogramOrdersByFrequency(t *testing.T) {
+	output := `        12: (255,255,255) #FFFFFF white
+      4084: ( 18, 52, 86) #123456 srgb(18,52,86)
+`
+	assert.Equal(t, []string{"#123456", "#ffffff"}, parseHistogram(output))
+}
+
+func TestBlurHashOfSolidImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.White)
+		}
+	}
+	assert.Equal(t, "L9TSUA~qfQ~q~qoffQoffQfQfQfQ", BlurHash(img, 4, 3))
+}
+
+func TestParseExif(t *testing.T) {
+	output := "exif:Make=Apple\nexif:Orientation=6\nnot a tag\n"
+	assert.Equal(t, map[string]string{"Make": "Apple", "Orientation": "6"}, parseExif(output))
+}
+
+func TestSwapsDimensions(t *testing.T) {
+	for _, orientation := range []string{"", "TopLeft", "TopRight", "BottomRight", "BottomLeft"} {
+		assert.Equal(t, false, swapsDimensions(orientation))
+	}
+	for _, orientation := range []string{"LeftTop", "RightTop", "RightBottom", "LeftBottom"} {
+		assert.Equal(t, true, swapsDimensions(orientation))
+	}
+}
+
+func TestHashImageOfGradient(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x * 4)})
+		}
+	}
+	hashes := HashImage(img)
+	// brightness rises left to right so no pixel beats its right neighbour
+	assert.Equal(t, "0000000000000000", hashes.DHash)
+	// and the right half is above the mean
+	assert.Equal(t, "0f0f0f0f0f0f0f0f", hashes.AHash)
+	assert.Equal(t, 16, len(hashes.PHash))
+}
+
+func TestSourceEndpointsCheckLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a stand in for identify pinging a decompression bomb
+	bomb := filepath.Join(dir, "identify")
+	ioutil.WriteFile(bomb, []byte("#!/bin/sh\necho 100000 100000\n"), 0755)
+	defer ConfigureDelegate("identify", "", "")
+	ConfigureDelegate("identify", bomb, "")
+
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("GIF89a"))
+	}))
+	defer origin.Close()
+	allowed := SourceAllowedNetworks
+	defer func() { SourceAllowedNetworks = allowed }()
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+
+	url := origin.URL + "/bomb.gif"
+	_, infoErr := FetchImageInfo(url)
+	_, paletteErr := FetchImagePalette(url, 5)
+	_, blurHashErr := FetchBlurHash(url, 4, 3)
+	_, hashesErr := FetchImageHashes(url)
+	iconsErr := WriteIconBundle(&bytes.Buffer{}, url)
+	for _, err := range []error{infoErr, paletteErr, blurHashErr, hashesErr, iconsErr} {
+		statusErr, ok := err.(*StatusError)
+		assert.T(t, ok, err)
+		assert.Equal(t, "source_too_large", statusErr.Code)
+	}
+}
@@ -0,0 +1,183 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/technoweenie/grohl"
+)
+
+// MipmapMinWidth enables mipmaps, a chain of halving power of two widths
+// generated alongside larger variants and kept in the content store, down
+// to this width. Smaller requests for the same source are then downscaled
+// from the nearest one rather than downloaded and resized from the
+// original. 0 disables them
+var MipmapMinWidth = 0
+
+// mipmapBase is the prefix of the content store keys of the mipmaps made
+// from a source. Only plain resizes are made from, or make, mipmaps, as
+// anything else would be applied twice or need the original's pixels.
+// Deterministic requests are left out as their output would depend on
+// whether a mipmap happened to exist
+func mipmapBase(args *ProcessArgs) (string, bool) {
+	if MipmapMinWidth <= 0 || Contents == nil {
+		return "", false
+	}
+	switch args.Format {
+	case "", "png", "jpg", "jpeg":
+	default:
+		return "", false
+	}
+	if (args.Mode != ResizeDefault && args.Mode != ResizeShrinkOnly) ||
+		args.Fit != "" || args.Gravity != "" || args.Frame != "" ||
+		args.Pixelate != "" || args.RedEye != "" || args.Enlarge != "" || args.Trim || args.Flip || args.Flop ||
+		args.Filter != "" || args.Daltonize != "" || args.WasmFilter != "" || args.Brightness != "" || args.Contrast != "" ||
+		args.Saturation != "" || len(args.Raw) > 0 || args.hasMask() ||
+		args.Deterministic || args.KeepMeta || args.Lqip || args.Watermark != "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(sourceIdentity(args.Url) + "\n" + args.Version + "\n" + strconv.FormatBool(args.NoAutoOrient)))
+	return "mipmap-" + hex.EncodeToString(sum[:]), true
+}
+
+func mipmapKey(base string, width int) string {
+	return base + "-" + strconv.Itoa(width)
+}
+
+// mipmapLevels are the widths of the mipmaps made from an image width
+// wide, largest first
+func mipmapLevels(width int) []int {
+	levels := []int{}
+	level := MipmapMinWidth
+	for level < width {
+		levels = append([]int{level}, levels...)
+		level *= 2
+	}
+	return levels
+}
+
+// findMipmap returns the path of the smallest stored mipmap at least as
+// wide as the request, which is always a downscale away from it
+func findMipmap(args *ProcessArgs) (string, int, bool) {
+	base, ok := mipmapBase(args)
+	if !ok || args.Width <= 0 {
+		return "", 0, false
+	}
+	for level := MipmapMinWidth; level <= MaxDimension; level *= 2 {
+		if level < args.Width {
+			continue
+		}
+		if name, ok := Contents.Lookup(mipmapKey(base, level)); ok {
+			return Contents.ObjectPath(name), level, true
+		}
+	}
+	return "", 0, false
+}
+
+// runPipelineFromMipmap processes the request from a stored mipmap when
+// there's one large enough, skipping the download. ok is false when there
+// isn't, and the request should be processed from the original
+func runPipelineFromMipmap(workspace string, args *ProcessArgs) (filePath string, ok bool, err error) {
+	mipmap, level, found := findMipmap(args)
+	if !found {
+		return "", false, nil
+	}
+	inFile := filepath.Join(workspace, "in")
+	if err = copyFile(mipmap, inFile); err != nil {
+		return "", false, nil
+	}
+	grohl.Counter(1.0, "mipmap.hit", 1)
+	grohl.Log(grohl.Data{
+		"processor": "imagick",
+		"step":      "mipmap",
+		"level":     level,
+	})
+	filePath, err = runPipeline(defaultPipeline[1:], workspace, inFile, args)
+	return filePath, true, err
+}
+
+// mipmapSeed returns the mipmap base of requests whose results mipmaps can
+// be made from. Those asking for a lower quality, including by Save-Data,
+// are left out as every smaller request would inherit their artifacts,
+// though they can still be made from mipmaps
+func mipmapSeed(args *ProcessArgs) (string, bool) {
+	if args.Quality != "" {
+		return "", false
+	}
+	return mipmapBase(args)
+}
+
+// storeMipmaps makes the mipmaps smaller than the result at filePath in
+// the background, in a single convert halving the width each time
+func storeMipmaps(args *ProcessArgs, filePath string) {
+	base, ok := mipmapSeed(args)
+	if !ok {
+		return
+	}
+	ext := filepath.Ext(filePath)
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" {
+		return
+	}
+	workspace, err := createTemporaryWorkspace()
+	if err != nil {
+		return
+	}
+	inFile := filepath.Join(workspace, "in"+ext)
+	if err = copyFile(filePath, inFile); err != nil {
+		os.RemoveAll(workspace)
+		return
+	}
+
+	source := args.Url
+	go func() {
+		defer os.RemoveAll(workspace)
+		ctx, cancel := context.WithTimeout(context.Background(), ConvertTimeout)
+		defer cancel()
+
+		width, _, err := identifyDimensions(ctx, inFile)
+		if err != nil {
+			return
+		}
+		levels := mipmapLevels(width)
+		if len(levels) == 0 {
+			return
+		}
+		if _, ok := Contents.Lookup(mipmapKey(base, levels[0])); ok {
+			return
+		}
+
+		// convert in.png -resize 512x -write 512.png -resize 256x 256.png
+		cmdArgs := []string{inFile}
+		for i, level := range levels {
+			cmdArgs = append(cmdArgs, "-resize", strconv.Itoa(level)+"x")
+			if i < len(levels)-1 {
+				cmdArgs = append(cmdArgs, "-write")
+			}
+			cmdArgs = append(cmdArgs, filepath.Join(workspace, strconv.Itoa(level)+".png"))
+		}
+		cmd := delegateCommand(ctx, "convert", cmdArgs...)
+		var outErr outputBuffer
+		cmd.Stdout, cmd.Stderr = &outErr, &outErr
+		if err = runLimited(ctx, cmd, PriorityBatch); err != nil {
+			grohl.Log(grohl.Data{
+				"processor": "imagick",
+				"step":      "mipmaps",
+				"failure":   err,
+				"output":    outErr.String(),
+			})
+			return
+		}
+
+		for _, level := range levels {
+			levelFile := filepath.Join(workspace, strconv.Itoa(level)+".png")
+			if _, err := Contents.Put(mipmapKey(base, level), source, levelFile, "png"); err != nil {
+				return
+			}
+		}
+		grohl.Counter(1.0, "mipmap.stored", len(levels))
+	}()
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestMipmapLevels(t *testing.T) {
+	defer func(previous int) { MipmapMinWidth = previous }(MipmapMinWidth)
+	MipmapMinWidth = 128
+	assert.Equal(t, []int{1024, 512, 256, 128}, mipmapLevels(1200))
+	assert.Equal(t, []int{128}, mipmapLevels(256))
+	assert.Equal(t, []int{}, mipmapLevels(128))
+}
+
+func TestFindMipmap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(previous int) { MipmapMinWidth = previous }(MipmapMinWidth)
+	MipmapMinWidth = 128
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+
+	base, ok := mipmapBase(NewProcessArgs([]string{"1200x"}, imgUrl))
+	assert.T(t, ok)
+	for _, level := range []int{256, 512} {
+		levelFile := filepath.Join(dir, "level.png")
+		ioutil.WriteFile(levelFile, []byte{byte(level / 256)}, 0644)
+		Contents.Put(mipmapKey(base, level), imgUrl, levelFile, "png")
+	}
+
+	_, level, ok := findMipmap(NewProcessArgs([]string{"300x200"}, imgUrl))
+	assert.T(t, ok)
+	assert.Equal(t, 512, level)
+	_, level, ok = findMipmap(NewProcessArgs([]string{"100x>"}, imgUrl))
+	assert.T(t, ok)
+	assert.Equal(t, 256, level)
+
+	_, _, ok = findMipmap(NewProcessArgs([]string{"600x"}, imgUrl))
+	assert.T(t, !ok)
+	_, _, ok = findMipmap(NewProcessArgs([]string{"x100"}, imgUrl))
+	assert.T(t, !ok)
+	_, _, ok = findMipmap(NewProcessArgs([]string{"100x", "flip"}, imgUrl))
+	assert.T(t, !ok)
+	_, _, ok = findMipmap(NewProcessArgs([]string{"100x"}, "http://example.com/other.jpg"))
+	assert.T(t, !ok)
+}
+
+func TestMipmapSeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(previous int) { MipmapMinWidth = previous }(MipmapMinWidth)
+	MipmapMinWidth = 128
+	InitContentStore(filepath.Join(dir, "store"))
+	defer InitContentStore("")
+
+	base, ok := mipmapSeed(NewProcessArgs([]string{"1200x"}, imgUrl))
+	assert.T(t, ok)
+
+	// low quality results aren't made into mipmaps, but can use them
+	lowQuality := NewProcessArgs([]string{"1200x", "q_10"}, imgUrl)
+	_, ok = mipmapSeed(lowQuality)
+	assert.T(t, !ok)
+	lowQualityBase, ok := mipmapBase(lowQuality)
+	assert.T(t, ok)
+	assert.Equal(t, base, lowQualityBase)
+
+	saveData := NewProcessArgs([]string{"1200x"}, imgUrl)
+	saveData.ApplySaveData(http.Header{"Save-Data": {"on"}})
+	_, ok = mipmapSeed(saveData)
+	assert.T(t, !ok)
+
+	_, ok = mipmapSeed(NewProcessArgs([]string{"lqip"}, imgUrl))
+	assert.T(t, !ok)
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/technoweenie/grohl"
+)
+
+// Ways to answer requests for sources over the size, pixel or frame limits
+const (
+	OverLimitError    = "error"
+	OverLimitRedirect = "redirect"
+	OverLimitProxy    = "proxy"
+)
+
+// OverLimitAction is what requests for sources too large to process get:
+// a 413, a 302 to the original url, or the original passed through
+var OverLimitAction = OverLimitError
+
+func sourceTooLarge(format string, a ...interface{}) *StatusError {
+	err := statusErrorf(http.StatusRequestEntityTooLarge, format, a...)
+	err.Code = "source_too_large"
+	return err
+}
+
+// ServeOverLimit answers a request that failed with err according to
+// OverLimitAction when err is a source over the limits, so users still
+// see an image. Any other error, the error action, or a source that isn't
+// fetched from an origin or has to be watermarked returns err as is.
+// Either way the response is marked degraded so it isn't cached for long
+func ServeOverLimit(w http.ResponseWriter, r *http.Request, args *ProcessArgs, err error) error {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != "source_too_large" ||
+		!isRemoteSource(args.Url) || args.Watermark != "" {
+		return err
+	}
+
+	grohl.Counter(1.0, "source.over_limit", 1)
+	switch OverLimitAction {
+	case OverLimitRedirect:
+		if !isHttpSource(args.Url) {
+			// objects in private storage have no url to send the client to
+			return err
+		}
+		setDegradedHeaders(w, []string{"source-too-large"})
+		http.Redirect(w, r, args.Url, http.StatusFound)
+		return nil
+	case OverLimitProxy:
+		setDegradedHeaders(w, []string{"source-too-large"})
+		return proxyRequest(w, args, false)
+	}
+	return err
+}
+
+// InitOverLimitAction sets OverLimitAction, erroring on unknown actions
+func InitOverLimitAction(action string) error {
+	switch action {
+	case "":
+		OverLimitAction = OverLimitError
+	case OverLimitError, OverLimitRedirect, OverLimitProxy:
+		OverLimitAction = action
+	default:
+		return fmt.Errorf("unknown over limit action %q", action)
+	}
+	return nil
+}
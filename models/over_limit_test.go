@@ -0,0 +1,33 @@
+package models
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestServeOverLimit(t *testing.T) {
+	defer InitOverLimitAction("")
+	args := &ProcessArgs{Url: imgUrl}
+	tooLarge := sourceTooLarge("source is larger than the %d byte limit", 10)
+
+	w := httptest.NewRecorder()
+	err := ServeOverLimit(w, httptest.NewRequest("GET", "/", nil), args, tooLarge)
+	assert.Equal(t, tooLarge, err)
+
+	assert.Equal(t, nil, InitOverLimitAction(OverLimitRedirect))
+	err = ServeOverLimit(w, httptest.NewRequest("GET", "/", nil), args, tooLarge)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, imgUrl, w.Header().Get("Location"))
+	assert.Equal(t, "source-too-large", w.Header().Get("X-Firesize-Degraded"))
+
+	other := errors.New("convert failed")
+	err = ServeOverLimit(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), args, other)
+	assert.Equal(t, other, err)
+
+	assert.NotEqual(t, nil, InitOverLimitAction("shrug"))
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"os"
+	"sort"
+)
+
+// ImageHashes are 64 bit perceptual hashes of an image as hex. Near
+// identical images have hashes a small hamming distance apart
+type ImageHashes struct {
+	PHash string `json:"phash"`
+	DHash string `json:"dhash"`
+	AHash string `json:"ahash"`
+}
+
+// FetchImageHashes downloads url and hashes its first frame
+func FetchImageHashes(url string) (*ImageHashes, error) {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	filePath, err := downloadChecked(tempDir, url)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := decodeFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return HashImage(img), nil
+}
+
+// HashImage computes the pHash, dHash and aHash of img
+func HashImage(img image.Image) *ImageHashes {
+	return &ImageHashes{
+		PHash: hashHex(pHash(img)),
+		DHash: hashHex(dHash(img)),
+		AHash: hashHex(aHash(img)),
+	}
+}
+
+// aHash sets a bit for each pixel of an 8x8 thumbnail brighter than the
+// mean
+func aHash(img image.Image) uint64 {
+	pixels := grayThumbnail(img, 8, 8)
+	mean := 0.0
+	for _, p := range pixels {
+		mean += p
+	}
+	mean /= float64(len(pixels))
+	return bitsAbove(pixels, mean)
+}
+
+// dHash sets a bit for each pixel of a 9x8 thumbnail brighter than its
+// right hand neighbour
+func dHash(img image.Image) uint64 {
+	pixels := grayThumbnail(img, 9, 8)
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// pHash takes the DCT of a 32x32 thumbnail and sets a bit for each of the
+// lowest 8x8 frequencies above their median
+func pHash(img image.Image) uint64 {
+	const size = 32
+	pixels := grayThumbnail(img, size, size)
+
+	cosines := make([]float64, size*size)
+	for u := 0; u < size; u++ {
+		for x := 0; x < size; x++ {
+			cosines[u*size+x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * size))
+		}
+	}
+
+	coefficients := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for y := 0; y < size; y++ {
+				for x := 0; x < size; x++ {
+					sum += pixels[y*size+x] * cosines[u*size+x] * cosines[v*size+y]
+				}
+			}
+			coefficients = append(coefficients, sum)
+		}
+	}
+
+	// the DC term is just overall brightness so is left out of the median
+	sorted := append([]float64{}, coefficients[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	return bitsAbove(coefficients, median)
+}
+
+func bitsAbove(values []float64, threshold float64) uint64 {
+	var hash uint64
+	for _, v := range values {
+		hash <<= 1
+		if v > threshold {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// grayThumbnail box filters img down to width by height luma values
+func grayThumbnail(img image.Image, width int, height int) []float64 {
+	bounds := img.Bounds()
+	srcWidth, srcHeight := bounds.Dx(), bounds.Dy()
+	pixels := make([]float64, width*height)
+
+	for ty := 0; ty < height; ty++ {
+		y0 := ty * srcHeight / height
+		y1 := int(math.Max(float64(y0+1), float64((ty+1)*srcHeight/height)))
+		for tx := 0; tx < width; tx++ {
+			x0 := tx * srcWidth / width
+			x1 := int(math.Max(float64(x0+1), float64((tx+1)*srcWidth/width)))
+
+			sum, samples := 0.0, 0
+			for y := y0; y < y1 && y < srcHeight; y++ {
+				for x := x0; x < x1 && x < srcWidth; x++ {
+					r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					sum += 0.299*float64(r>>8) + 0.587*float64(g>>8) + 0.114*float64(b>>8)
+					samples++
+				}
+			}
+			if samples > 0 {
+				pixels[ty*width+tx] = sum / float64(samples)
+			}
+		}
+	}
+	return pixels
+}
+
+func hashHex(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
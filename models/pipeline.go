@@ -0,0 +1,109 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+type processPipelineStep func(workingDirectoryPath string, inputFilePath string, args *ProcessArgs) (outputFilePath string, err error)
+
+// pipelineStep is a named step with how many times it may be retried.
+// Only steps that can safely run again over the same input should retry
+type pipelineStep struct {
+	Name    string
+	Run     processPipelineStep
+	Retries int
+}
+
+// StepError reports which step of the pipeline failed and how many times
+// it was attempted
+type StepError struct {
+	Step     string
+	Attempts int
+	Err      error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("%s failed after %d attempt(s): %s", e.Step, e.Attempts, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// Step states reported to a ProgressFunc
+const (
+	StepStarted   = "started"
+	StepRetrying  = "retrying"
+	StepCompleted = "completed"
+	StepFailed    = "failed"
+)
+
+// ProgressFunc is told as each step of the pipeline changes state. index
+// counts from 0 up to total-1
+type ProgressFunc func(step string, index int, total int, state string)
+
+var retryBackoff = 250 * time.Millisecond
+
+// runPipeline runs each step in turn over the output of the previous one,
+// retrying failed steps according to their policy. Errors that should be
+// reported to the client as is are never retried, and no more steps run
+// once the args' context is done
+func runPipeline(steps []pipelineStep, tempDir string, filePath string, args *ProcessArgs) (string, error) {
+	progress := args.Progress
+	if progress == nil {
+		progress = logProgress
+	}
+
+	for i, step := range steps {
+		progress(step.Name, i, len(steps), StepStarted)
+		start := time.Now()
+
+		var err error
+		var output string
+		attempts := 0
+		for {
+			attempts++
+			if err = args.ctx().Err(); err != nil {
+				break
+			}
+			output, err = step.Run(tempDir, filePath, args)
+			if err == nil || attempts > step.Retries || args.ctx().Err() != nil {
+				break
+			}
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				break
+			}
+			progress(step.Name, i, len(steps), StepRetrying)
+			time.Sleep(retryBackoff * time.Duration(attempts))
+		}
+
+		if err != nil {
+			progress(step.Name, i, len(steps), StepFailed)
+			return output, &StepError{Step: step.Name, Attempts: attempts, Err: err}
+		}
+
+		elapsed := time.Since(start)
+		args.Timings.Record(step.Name, elapsed)
+		grohl.Log(grohl.Data{
+			"pipeline": step.Name,
+			"attempts": attempts,
+			"elapsed":  elapsed.Seconds(),
+		})
+		progress(step.Name, i, len(steps), StepCompleted)
+		filePath = output
+	}
+	return filePath, nil
+}
+
+func logProgress(step string, index int, total int, state string) {
+	grohl.Log(grohl.Data{
+		"pipeline": step,
+		"progress": fmt.Sprintf("%d/%d", index+1, total),
+		"state":    state,
+	})
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRunPipelineRetriesAndReportsProgress(t *testing.T) {
+	retryBackoff = 0
+	var states []string
+	args := &ProcessArgs{Progress: func(step string, index int, total int, state string) {
+		states = append(states, step+":"+state)
+	}}
+
+	flaky := 0
+	steps := []pipelineStep{
+		{Name: "first", Run: func(_ string, in string, _ *ProcessArgs) (string, error) {
+			return in + "1", nil
+		}},
+		{Name: "flaky", Retries: 1, Run: func(_ string, in string, _ *ProcessArgs) (string, error) {
+			flaky++
+			if flaky == 1 {
+				return in, errors.New("blip")
+			}
+			return in + "2", nil
+		}},
+	}
+
+	out, err := runPipeline(steps, "", "in", args)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "in12", out)
+	assert.Equal(t, []string{
+		"first:started", "first:completed",
+		"flaky:started", "flaky:retrying", "flaky:completed",
+	}, states)
+}
+
+func TestRunPipelineReturnsStepErrors(t *testing.T) {
+	retryBackoff = 0
+	attempts := 0
+	steps := []pipelineStep{
+		{Name: "broken", Retries: 2, Run: func(_ string, in string, _ *ProcessArgs) (string, error) {
+			attempts++
+			return in, errors.New("nope")
+		}},
+	}
+
+	_, err := runPipeline(steps, "", "in", &ProcessArgs{})
+	assert.Equal(t, &StepError{Step: "broken", Attempts: 3, Err: errors.New("nope")}, err)
+	assert.Equal(t, 3, attempts)
+}
+
+func TestRunPipelineDoesNotRetryStatusErrors(t *testing.T) {
+	retryBackoff = 0
+	attempts := 0
+	steps := []pipelineStep{
+		{Name: "download", Retries: 2, Run: func(_ string, in string, _ *ProcessArgs) (string, error) {
+			attempts++
+			return in, statusErrorf(403, "forbidden")
+		}},
+	}
+
+	_, err := runPipeline(steps, "", "in", &ProcessArgs{})
+	assert.Equal(t, 1, attempts)
+	assert.Equal(t, 1, err.(*StepError).Attempts)
+}
+
+func TestCheckImageLimits(t *testing.T) {
+	assert.Equal(t, nil, checkImageLimits(10000, 10000, 1))
+
+	err, ok := checkImageLimits(50000, 50000, 1).(*StatusError)
+	assert.T(t, ok)
+	assert.Equal(t, 413, err.Status)
+
+	err, ok = checkImageLimits(100, 100, MaxSourceFrames+1).(*StatusError)
+	assert.T(t, ok)
+	assert.Equal(t, 413, err.Status)
+
+	defer func(max int64) { MaxSourcePixels = max }(MaxSourcePixels)
+	MaxSourcePixels = 0
+	assert.Equal(t, nil, checkImageLimits(50000, 50000, 1))
+}
+
+func TestDegradedHeaders(t *testing.T) {
+	args := &ProcessArgs{}
+	args.degrade("color-unmanaged")
+	args.degrade("animation-unknown")
+	args.degrade("color-unmanaged")
+	assert.Equal(t, []string{"color-unmanaged", "animation-unknown"}, args.Degraded)
+
+	w := httptest.NewRecorder()
+	setDegradedHeaders(w, args.Degraded)
+	assert.Equal(t, "color-unmanaged, animation-unknown", w.Header().Get("X-Firesize-Degraded"))
+	assert.Equal(t, []string{`199 firesize "color-unmanaged"`, `199 firesize "animation-unknown"`}, w.Header()["Warning"])
+	assert.Equal(t, "public, max-age=300", w.Header().Get("Cache-Control"))
+}
+
+func TestRunPipelineStopsWhenContextIsDone(t *testing.T) {
+	retryBackoff = 0
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	steps := []pipelineStep{
+		{Name: "first", Retries: 3, Run: func(tempDir string, in string, args *ProcessArgs) (string, error) {
+			runs++
+			cancel()
+			return in, errors.New("interrupted")
+		}},
+		{Name: "second", Run: func(tempDir string, in string, args *ProcessArgs) (string, error) {
+			runs++
+			return in, nil
+		}},
+	}
+	_, err := runPipeline(steps, "", "in", &ProcessArgs{Context: ctx})
+	assert.Equal(t, 1, runs)
+	assert.Equal(t, "first", err.(*StepError).Step)
+
+	_, err = runPipeline(steps[1:], "", "in", &ProcessArgs{Context: ctx})
+	assert.Equal(t, 1, runs)
+	assert.T(t, errors.Is(err, context.Canceled))
+}
+
+func TestFrameCountCountsEveryFrame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	animation := &gif.GIF{}
+	palette := color.Palette{color.Black, color.White}
+	for i := 0; i < 3; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	inFile := filepath.Join(dir, "animated.gif")
+	f, _ := os.Create(inFile)
+	assert.Equal(t, nil, gif.EncodeAll(f, animation))
+	f.Close()
+
+	if _, err := exec.LookPath("identify"); err != nil {
+		// a stand in printing %n for every frame read, as identify does
+		fake := filepath.Join(dir, "identify")
+		ioutil.WriteFile(fake, []byte("#!/bin/sh\nfor last; do :; done\ncase \"$last\" in *\\[0\\]) echo 1 ;; *) printf '3\\n3\\n3\\n' ;; esac\n"), 0755)
+		defer ConfigureDelegate("identify", "", "")
+		ConfigureDelegate("identify", fake, "")
+	}
+	assert.Equal(t, 3, frameCount(context.Background(), inFile))
+}
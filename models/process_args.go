@@ -1,47 +1,268 @@
 package models
 
-import "regexp"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
 
 type ProcessArgs struct {
-	ResizeMod     string
-	Height        string
-	Width         string
+	Mode          ResizeMode
+	Height        int
+	Width         int
+	AutoWidth     bool
 	RequestFormat string
 	Format        string
 	Gravity       string
+	Fit           string
+	Background    string
 	Frame         string
+	NoAutoOrient  bool
+	Pixelate      string
+	Trim          bool
+	TrimFuzz      string
+	Flip          bool
+	Flop          bool
+	Filter        string
+	Quality       string
+	Brightness    string
+	Contrast      string
+	Saturation    string
+	Radius        string
+	Mask          string
+	Deterministic bool
+	Strip         bool
+	KeepMeta      bool
+	Lqip          bool
+	Version       string          `json:",omitempty"`
+	RedEye        string          `json:",omitempty"`
+	Enlarge       string          `json:",omitempty"`
+	Daltonize     string          `json:",omitempty"`
+	Watermark     string          `json:",omitempty"`
+	WasmFilter    string          `json:",omitempty"`
+	WasmFilterId  string          `json:",omitempty"`
+	Raw           []string        `json:",omitempty"`
+	ColorProfile  string          `json:"-"`
+	Colorspace    string          `json:"-"`
+	IccProfile    string          `json:"-"`
+	Encoding      string          `json:"-"`
+	Push          bool            `json:"-"`
+	PushName      string          `json:"-"`
+	Account       string          `json:"-"`
+	Animated      bool            `json:"-"`
+	Progress      ProgressFunc    `json:"-"`
+	StepProgress  func(float64)   `json:"-"`
+	Priority      string          `json:"-"`
+	Degraded      []string        `json:"-"`
+	Timings       *Timings        `json:"-"`
+	Context       context.Context `json:"-"`
 	Url           string
 }
 
+// DeterministicOutput pins encoder settings for every request so the same
+// input and args always produce byte identical output
+var DeterministicOutput bool
+
+// StripMetadata strips metadata from every request, not just those asking
+// for it with strip
+var StripMetadata bool
+
+// SrgbProfile is the ICC profile images are converted to before encoding.
+// CmykProfile is assumed for CMYK images without an embedded profile.
+// Without an sRGB profile only CMYK images are converted, using
+// ImageMagick's built in colorspace conversion
+var SrgbProfile string
+var CmykProfile string
+
 func NewProcessArgs(urlArgs []string, url string) *ProcessArgs {
-	args := &ProcessArgs{}
+	args := &ProcessArgs{Deterministic: DeterministicOutput, Strip: StripMetadata}
 	for _, arg := range urlArgs {
 		args.setUrlArg(arg)
 	}
 	args.Url = url
+	if args.Lqip {
+		args.applyLqip()
+	}
 	return args
 }
 
+// lqipWidth is the width of lqip placeholders, small enough to inline
+const lqipWidth = 20
+
+// applyLqip turns the request into a tiny, heavily compressed still
+// returned inline as a data uri. It replaces any dimensions requested
+func (p *ProcessArgs) applyLqip() {
+	p.Width, p.Height, p.Mode = lqipWidth, 0, ResizeDefault
+	p.Fit = ""
+	if p.Frame == "" {
+		p.Frame = "0"
+	}
+	if !p.hasMask() {
+		p.RequestFormat, p.Format = "jpg", "jpg"
+	}
+	p.Quality = "20"
+	p.Strip, p.KeepMeta = true, false
+	p.Encoding = "base64"
+}
+
 var dimensionsRgx = regexp.MustCompile(`^(\d+)?x(\d+)?([<>!^])?$`)
 var gravityRgx = regexp.MustCompile(`^g_([a-z]+)$`)
 var frameRgx = regexp.MustCompile(`^frame_(\d+)$`)
 var formatRgx = regexp.MustCompile(`^(png|jpg|jpeg|gif|mp4)$`)
+var noAutoOrientRgx = regexp.MustCompile(`^noorient$`)
+var autoWidthRgx = regexp.MustCompile(`^w_auto$`)
+var widthRgx = regexp.MustCompile(`^w_(\d+)$`)
+var heightRgx = regexp.MustCompile(`^h_(\d+)$`)
+var pixelateRgx = regexp.MustCompile(`^pixelate_(\d+),(\d+),(\d+),(\d+),(\d+)$`)
+var redEyeRgx = regexp.MustCompile(`^redeye_(\d+),(\d+),(\d+),(\d+)$`)
+var trimRgx = regexp.MustCompile(`^trim(?:_(\d{1,2}|100))?$`)
+var flipRgx = regexp.MustCompile(`^flip$`)
+var flopRgx = regexp.MustCompile(`^flop$`)
+var filterRgx = regexp.MustCompile(`^filter_(grayscale|sepia)$`)
+var fitRgx = regexp.MustCompile(`^fit_(cover|contain|fill|inside|outside|pad)$`)
+var backgroundRgx = regexp.MustCompile(`^bg_([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+var qualityRgx = regexp.MustCompile(`^q_(100|[1-9]\d?)$`)
+var stripRgx = regexp.MustCompile(`^strip$`)
+var keepMetaRgx = regexp.MustCompile(`^keepmeta$`)
+var radiusRgx = regexp.MustCompile(`^radius_(\d+)$`)
+var maskRgx = regexp.MustCompile(`^mask_(circle)$`)
+var encodingRgx = regexp.MustCompile(`^encoding_(base64|multipart)$`)
+var lqipRgx = regexp.MustCompile(`^lqip$`)
+var adjustmentRgx = regexp.MustCompile(`^(bri|con|sat)_(-?\d{1,3})$`)
+var versionRgx = regexp.MustCompile(`^[vt]_([A-Za-z0-9._-]{1,64})$`)
+var pushRgx = regexp.MustCompile(`^push(?:_([A-Za-z0-9_-]{1,256}))?$`)
 
 func (p *ProcessArgs) HasOperations() bool {
-	return p.Height != "" ||
-		p.Width != "" ||
+	return p.Height > 0 ||
+		p.Width > 0 ||
+		p.Watermark != "" ||
 		p.Format != "" ||
 		p.Gravity != "" ||
-		p.Frame != ""
+		p.Fit != "" ||
+		p.Frame != "" ||
+		p.Pixelate != "" ||
+		p.RedEye != "" ||
+		p.Enlarge != "" ||
+		p.Trim ||
+		p.Flip ||
+		p.Flop ||
+		p.Filter != "" ||
+		p.Daltonize != "" ||
+		p.WasmFilter != "" ||
+		p.Quality != "" ||
+		p.Strip ||
+		p.Brightness != "" ||
+		p.Contrast != "" ||
+		p.Saturation != "" ||
+		len(p.Raw) > 0 ||
+		p.hasMask()
+}
+
+// ctx is the context of the request the args are processed for, so work
+// stops when the client goes away
+func (p *ProcessArgs) ctx() context.Context {
+	if p.Context == nil {
+		return context.Background()
+	}
+	return p.Context
+}
+
+// degrade records a way the result falls short of what was asked for
+func (p *ProcessArgs) degrade(reason string) {
+	for _, r := range p.Degraded {
+		if r == reason {
+			return
+		}
+	}
+	p.Degraded = append(p.Degraded, reason)
+}
+
+// stripping is true unless keepmeta opted out of a strip requested by the
+// url or the server wide default
+func (p *ProcessArgs) stripping() bool {
+	return p.Strip && !p.KeepMeta
+}
+
+func (p *ProcessArgs) hasMask() bool {
+	return p.Radius != "" || p.Mask != ""
+}
+
+// unproxyable names the first operation whose result the original can't
+// stand in for, as it hides or removes part of it, like a redacted face
+// or GPS metadata
+func (p *ProcessArgs) unproxyable() string {
+	switch {
+	case p.Watermark != "":
+		return "watermarking"
+	case p.Pixelate != "":
+		return "pixelate"
+	case p.RedEye != "":
+		return "redeye"
+	case p.hasMask():
+		return "mask"
+	case p.Strip:
+		return "strip"
+	}
+	return ""
+}
+
+// CacheKey identifies the derivative these args produce. It must be taken
+// before processing as the pipeline fills in defaults as it goes
+func (p *ProcessArgs) CacheKey() string {
+	normalized := *p
+	normalized.Url = sourceIdentity(p.Url)
+	b, _ := json.Marshal(&normalized)
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeSourceUrl rewrites the parts of a source url that don't change
+// what's fetched, the case of the scheme and host, a default port and a
+// fragment, so spellings of the same url share cache entries
+func normalizeSourceUrl(source string) string {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" {
+		return source
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
 }
 
 func (p *ProcessArgs) setUrlArg(arg string) bool {
 	switch {
 	case dimensionsRgx.MatchString(arg):
 		dimensions := dimensionsRgx.FindStringSubmatch(arg)
-		p.Width = dimensions[1]
-		p.Height = dimensions[2]
-		p.ResizeMod = dimensions[3]
+		p.Width = parseDimension(dimensions[1])
+		p.Height = parseDimension(dimensions[2])
+		p.Mode = resizeModeModifiers[dimensions[3]]
+		return true
+
+	case widthRgx.MatchString(arg):
+		p.Width = parseDimension(widthRgx.FindStringSubmatch(arg)[1])
+		return true
+
+	case heightRgx.MatchString(arg):
+		p.Height = parseDimension(heightRgx.FindStringSubmatch(arg)[1])
 		return true
 
 	case gravityRgx.MatchString(arg):
@@ -49,6 +270,56 @@ func (p *ProcessArgs) setUrlArg(arg string) bool {
 		p.Gravity = gravity[1]
 		return true
 
+	case fitRgx.MatchString(arg):
+		fit := fitRgx.FindStringSubmatch(arg)
+		p.Fit = fit[1]
+		return true
+
+	case backgroundRgx.MatchString(arg):
+		background := backgroundRgx.FindStringSubmatch(arg)
+		p.Background = background[1]
+		return true
+
+	case qualityRgx.MatchString(arg):
+		quality := qualityRgx.FindStringSubmatch(arg)
+		p.Quality = quality[1]
+		return true
+
+	case stripRgx.MatchString(arg):
+		p.Strip = true
+		return true
+
+	case keepMetaRgx.MatchString(arg):
+		p.KeepMeta = true
+		return true
+
+	case radiusRgx.MatchString(arg):
+		radius := radiusRgx.FindStringSubmatch(arg)
+		p.Radius = radius[1]
+		return true
+
+	case maskRgx.MatchString(arg):
+		mask := maskRgx.FindStringSubmatch(arg)
+		p.Mask = mask[1]
+		return true
+
+	case rawRgx.MatchString(arg):
+		raw := rawRgx.FindStringSubmatch(arg)
+		if raw[2] != "" && !rawValueRgx.MatchString(raw[2]) {
+			return false
+		}
+		p.Raw = append(p.Raw, strings.TrimPrefix(arg, "raw_"))
+		return true
+
+	case lqipRgx.MatchString(arg):
+		p.Lqip = true
+		return true
+
+	case encodingRgx.MatchString(arg):
+		encoding := encodingRgx.FindStringSubmatch(arg)
+		p.Encoding = encoding[1]
+		return true
+
 	case frameRgx.MatchString(arg):
 		frame := frameRgx.FindStringSubmatch(arg)
 		p.Frame = frame[1]
@@ -59,6 +330,100 @@ func (p *ProcessArgs) setUrlArg(arg string) bool {
 		p.RequestFormat = format[1]
 		p.Format = format[1]
 		return true
+
+	case noAutoOrientRgx.MatchString(arg):
+		p.NoAutoOrient = true
+		return true
+
+	case autoWidthRgx.MatchString(arg):
+		p.AutoWidth = true
+		return true
+
+	case enlargeRgx.MatchString(arg):
+		p.Enlarge = enlargeRgx.FindStringSubmatch(arg)[1]
+		return true
+
+	case redEyeRgx.MatchString(arg):
+		p.RedEye = strings.TrimPrefix(arg, "redeye_")
+		return true
+
+	case pixelateRgx.MatchString(arg):
+		// blocks no bigger than the region, which is no bigger than an
+		// image can be, keep the scaled up region bounded
+		pixelate := pixelateRgx.FindStringSubmatch(arg)
+		width, _ := strconv.Atoi(pixelate[3])
+		height, _ := strconv.Atoi(pixelate[4])
+		size, _ := strconv.Atoi(pixelate[5])
+		if size < 2 || size > width || size > height || width > MaxDimension || height > MaxDimension {
+			return false
+		}
+		p.Pixelate = strings.TrimPrefix(arg, "pixelate_")
+		return true
+
+	case trimRgx.MatchString(arg):
+		trim := trimRgx.FindStringSubmatch(arg)
+		p.Trim = true
+		p.TrimFuzz = trim[1]
+		return true
+
+	case flipRgx.MatchString(arg):
+		p.Flip = true
+		return true
+
+	case flopRgx.MatchString(arg):
+		p.Flop = true
+		return true
+
+	case filterRgx.MatchString(arg):
+		filter := filterRgx.FindStringSubmatch(arg)
+		p.Filter = filter[1]
+		return true
+
+	case daltonizeRgx.MatchString(arg):
+		p.Daltonize = arg
+		return true
+
+	case wasmFilterRgx.MatchString(arg):
+		p.WasmFilter = wasmFilterRgx.FindStringSubmatch(arg)[1]
+		p.WasmFilterId = wasmFilters[p.WasmFilter]
+		return true
+
+	// the version only busts caches, it's in the path so it's signed and
+	// in the cache key but changes nothing about the result
+	case versionRgx.MatchString(arg):
+		version := versionRgx.FindStringSubmatch(arg)
+		p.Version = version[1]
+		return true
+
+	// pushing doesn't change the result, so shares its cache key. The
+	// name template is base64url encoded, as it can contain slashes
+	case pushRgx.MatchString(arg):
+		push := pushRgx.FindStringSubmatch(arg)
+		if push[1] != "" {
+			name, err := base64.RawURLEncoding.DecodeString(push[1])
+			if err != nil {
+				return false
+			}
+			p.PushName = string(name)
+		}
+		p.Push = true
+		return true
+
+	case adjustmentRgx.MatchString(arg):
+		adjustment := adjustmentRgx.FindStringSubmatch(arg)
+		amount, _ := strconv.Atoi(adjustment[2])
+		if amount < -100 || amount > 100 {
+			return false
+		}
+		switch adjustment[1] {
+		case "bri":
+			p.Brightness = adjustment[2]
+		case "con":
+			p.Contrast = adjustment[2]
+		case "sat":
+			p.Saturation = adjustment[2]
+		}
+		return true
 	}
 	return false
 }
@@ -66,37 +431,93 @@ func (p *ProcessArgs) setUrlArg(arg string) bool {
 func (p *ProcessArgs) CommandArgs(inFile, outFile string) (args []string, outFileWithFormat string) {
 	args = make([]string, 0)
 
-	if p.Gravity != "" {
-		args = append(args, "-gravity", p.Gravity)
-		if p.ResizeMod == "" {
-			p.ResizeMod = "^"
+	// read exif metadata for original orientation before any resizing so
+	// the requested dimensions apply to the image as it is displayed
+	// http://www.imagemagick.org/script/command-line-options.php#auto-orient
+	if !p.NoAutoOrient {
+		args = append(args, "-auto-orient")
+	}
+
+	args = append(args, p.colorArgs()...)
+
+	// the region is in source pixels so redact before anything moves them
+	if p.Pixelate != "" {
+		args = append(args, p.pixelateArgs()...)
+	}
+	if p.RedEye != "" {
+		args = append(args, p.redEyeArgs()...)
+	}
+
+	// tighten borders before resizing so the margins don't count towards
+	// the requested dimensions
+	if p.Trim {
+		if p.TrimFuzz != "" {
+			args = append(args, "-fuzz", p.TrimFuzz+"%")
 		}
+		args = append(args, "-trim", "+repage")
 	}
 
-	if p.ResizeMod == "" {
-		p.ResizeMod = ">"
+	if p.Fit != "" {
+		args = append(args, p.fitArgs()...)
+	} else {
+		args = append(args, p.legacyResizeArgs()...)
+	}
+
+	// animated gifs have already been coalesced so these mirror every
+	// full frame rather than just the deltas
+	if p.Flip {
+		args = append(args, "-flip")
+	}
+	if p.Flop {
+		args = append(args, "-flop")
+	}
+
+	// -modulate takes percentages where 100 leaves the channel untouched
+	if p.Brightness != "" || p.Saturation != "" {
+		args = append(args, "-modulate", modulatePercent(p.Brightness)+","+modulatePercent(p.Saturation))
 	}
-	if p.Width != "" && p.Height != "" {
-		args = append(args, "-thumbnail", p.Width+"x"+p.Height+p.ResizeMod)
-		args = append(args, "-crop", p.Width+"x"+p.Height+"+0+0")
-	} else if p.Width != "" {
-		args = append(args, "-thumbnail", p.Width+"x")
-	} else if p.Height != "" {
-		args = append(args, "-thumbnail", "x"+p.Height)
+	if p.Contrast != "" {
+		args = append(args, "-brightness-contrast", "0x"+p.Contrast)
 	}
 
+	switch p.Filter {
+	case "grayscale":
+		args = append(args, "-colorspace", "Gray")
+	case "sepia":
+		args = append(args, "-sepia-tone", "80%")
+	}
+	args = append(args, p.daltonizeArgs()...)
+
+	args = append(args, p.rawArgs()...)
+
+	// masked corners need an alpha channel
+	if p.hasMask() && !p.Animated {
+		p.Format = "png"
+	}
 	if p.Format == "" {
 		p.Format = "png"
 		if p.Frame != "" {
 			p.Format = "gif"
 		}
 	}
+	// -strip drops the ICC profile along with everything else, so put the
+	// one extracted before processing back to keep colors from shifting
+	if p.stripping() {
+		args = append(args, "-strip")
+		if p.ColorProfile != "" {
+			args = append(args, "-profile", p.ColorProfile)
+		}
+	}
+
+	if p.Quality != "" {
+		args = append(args, "-quality", p.Quality)
+	}
 	args = append(args, "-format", p.Format)
 	args = append(args, "+repage")
 
-	// read exif metadata for original orientation
-	// http://www.imagemagick.org/script/command-line-options.php#auto-orient
-	args = append(args, "-auto-orient")
+	if p.Deterministic {
+		args = append(args, deterministicArgs...)
+	}
 
 	outFileWithFormat = outFile + "." + p.Format
 
@@ -107,3 +528,212 @@ func (p *ProcessArgs) CommandArgs(inFile, outFile string) (args []string, outFil
 	}
 	return args, outFileWithFormat
 }
+
+// deterministicArgs drop the timestamps ImageMagick writes into png text
+// and tIME chunks and pin the encoder settings that otherwise vary between
+// ImageMagick versions and builds
+var deterministicArgs = []string{
+	"+set", "date:create",
+	"+set", "date:modify",
+	"+set", "date:timestamp",
+	"-define", "png:exclude-chunk=date,time",
+	"-define", "png:compression-level=9",
+	"-define", "png:compression-filter=5",
+	"-define", "png:compression-strategy=1",
+	"-sampling-factor", "4:2:0",
+	"-interlace", "None",
+}
+
+// MaskArgs cuts the corners off an already resized width x height image
+// by compositing it with an alpha mask, either a circle or a rounded
+// rectangle
+func (p *ProcessArgs) MaskArgs(inFile string, outFile string, width int, height int) []string {
+	var shape string
+	if p.Mask == "circle" {
+		rx, ry := float64(width)/2, float64(height)/2
+		shape = fmt.Sprintf("ellipse %g,%g %g,%g 0,360", rx-0.5, ry-0.5, rx, ry)
+	} else {
+		shape = fmt.Sprintf("roundrectangle 0,0 %d,%d %s,%s", width-1, height-1, p.Radius, p.Radius)
+	}
+
+	return []string{
+		inFile,
+		"-alpha", "set",
+		"(", "+clone", "-alpha", "transparent", "-fill", "white", "-draw", shape, ")",
+		"-compose", "DstIn", "-composite",
+		outFile,
+	}
+}
+
+// pixelateArgs mosaics a region of the image by scaling it down to a
+// pixel per block and back up again. Both scales are to exact sizes, as
+// percentages round and could leave a row or column of the region as it was
+func (p *ProcessArgs) pixelateArgs() []string {
+	var x, y, width, height, size int
+	fmt.Sscanf(p.Pixelate, "%d,%d,%d,%d,%d", &x, &y, &width, &height, &size)
+	return []string{
+		"-region", fmt.Sprintf("%dx%d+%d+%d", width, height, x, y),
+		"-scale", fmt.Sprintf("%dx%d!", (width+size-1)/size, (height+size-1)/size),
+		"-scale", fmt.Sprintf("%dx%d!", width, height),
+		"+region",
+	}
+}
+
+// redEyeThreshold is how much redder than the other channels a pixel has
+// to be to count as red eye, well above skin tones
+const redEyeThreshold = 1.5
+
+// redEyeArgs replace the red of pupils in a region around the eyes with
+// the average of green and blue, darkening them to their natural color.
+// Only strongly red pixels change so skin and irises are left alone
+func (p *ProcessArgs) redEyeArgs() []string {
+	var x, y, width, height int
+	fmt.Sscanf(p.RedEye, "%d,%d,%d,%d", &x, &y, &width, &height)
+	return []string{
+		"-region", fmt.Sprintf("%dx%d+%d+%d", width, height, x, y),
+		"-channel", "R",
+		"-fx", fmt.Sprintf("r > 0.25 && r > %g*(g+b)/2 ? (g+b)/2 : r", redEyeThreshold),
+		"+channel",
+		"+region",
+	}
+}
+
+// colorArgs convert the image to sRGB, which is what browsers assume for
+// untagged images, based on the colorspace and profile found when the
+// source was inspected
+func (p *ProcessArgs) colorArgs() []string {
+	cmyk := p.Colorspace == "CMYK"
+	if SrgbProfile == "" {
+		if cmyk {
+			return []string{"-colorspace", "sRGB"}
+		}
+		return nil
+	}
+
+	switch {
+	case p.IccProfile != "":
+		if strings.Contains(strings.ToLower(p.IccProfile), "srgb") {
+			return nil
+		}
+		return []string{"-profile", SrgbProfile}
+	case cmyk && CmykProfile != "":
+		// the first -profile assigns the assumed profile, the second converts
+		return []string{"-profile", CmykProfile, "-profile", SrgbProfile}
+	case cmyk:
+		return []string{"-colorspace", "sRGB"}
+	}
+	return nil
+}
+
+// resizeOperator prefers -thumbnail, which also drops profiles other than
+// ICC to keep thumbnails small, unless metadata has to be kept
+func (p *ProcessArgs) resizeOperator() string {
+	if p.KeepMeta {
+		return "-resize"
+	}
+	return "-thumbnail"
+}
+
+// keptMetadata lists the kinds of metadata that survive conversion to
+// format when keepmeta is set. ImageMagick carries exif and xmp into png
+// as raw profile text chunks, gif only has room for a comment and we don't
+// map anything into mp4 containers
+var keptMetadata = map[string][]string{
+	"jpg":  {"exif", "iptc", "xmp", "icc", "comment"},
+	"jpeg": {"exif", "iptc", "xmp", "icc", "comment"},
+	"png":  {"exif", "xmp", "icc", "comment"},
+	"gif":  {"comment"},
+	"mp4":  {},
+}
+
+// KeptMetadata returns the kinds of metadata preserved in an output of
+// the given format
+func (p *ProcessArgs) KeptMetadata(format string) []string {
+	if !p.KeepMeta {
+		return nil
+	}
+	return keptMetadata[format]
+}
+
+// legacyResizeArgs keeps the behavior of urls that don't specify a fit:
+// shrink only to fit inside the box, or cover it when a gravity is given
+func (p *ProcessArgs) legacyResizeArgs() (args []string) {
+	if p.Gravity != "" {
+		args = append(args, "-gravity", p.Gravity)
+		if p.Mode == ResizeDefault {
+			p.Mode = ResizeFillArea
+		}
+	}
+
+	if p.Mode == ResizeDefault {
+		p.Mode = ResizeShrinkOnly
+	}
+	if p.Width > 0 && p.Height > 0 {
+		box := geometry(p.Width, p.Height)
+		args = append(args, p.resizeOperator(), box+p.Mode.modifier())
+		args = append(args, "-crop", box+"+0+0")
+	} else if p.Width > 0 || p.Height > 0 {
+		args = append(args, p.resizeOperator(), geometry(p.Width, p.Height))
+	}
+	return args
+}
+
+// fitArgs resizes to the box according to an explicit fit mode:
+//
+//	cover    preserve aspect ratio, fill the box and crop the overflow
+//	contain  preserve aspect ratio, fit inside the box and pad to fill it
+//	fill     ignore aspect ratio and stretch to exactly the box
+//	inside   preserve aspect ratio, fit inside the box
+//	outside  preserve aspect ratio, cover the box without cropping
+//
+// pad is an alias for contain. A > or < modifier on the dimensions still
+// limits the resize to only shrinking or only enlarging
+func (p *ProcessArgs) fitArgs() (args []string) {
+	if p.Width == 0 || p.Height == 0 {
+		if p.Width > 0 || p.Height > 0 {
+			args = append(args, p.resizeOperator(), geometry(p.Width, p.Height)+p.enlargeFlag())
+		}
+		return args
+	}
+
+	box := geometry(p.Width, p.Height)
+	gravity := p.Gravity
+	if gravity == "" {
+		gravity = "center"
+	}
+
+	switch p.Fit {
+	case "cover":
+		args = append(args, p.resizeOperator(), box+"^"+p.enlargeFlag())
+		args = append(args, "-gravity", gravity, "-extent", box)
+	case "contain", "pad":
+		args = append(args, p.resizeOperator(), box+p.enlargeFlag())
+		args = append(args, "-gravity", gravity, "-background", p.backgroundColor(), "-extent", box)
+	case "fill":
+		args = append(args, p.resizeOperator(), box+"!"+p.enlargeFlag())
+	case "inside":
+		args = append(args, p.resizeOperator(), box+p.enlargeFlag())
+	case "outside":
+		args = append(args, p.resizeOperator(), box+"^"+p.enlargeFlag())
+	}
+	return args
+}
+
+func (p *ProcessArgs) enlargeFlag() string {
+	if p.Mode == ResizeShrinkOnly || p.Mode == ResizeEnlargeOnly {
+		return p.Mode.modifier()
+	}
+	return ""
+}
+
+func (p *ProcessArgs) backgroundColor() string {
+	if p.Background == "" {
+		return "white"
+	}
+	return "#" + p.Background
+}
+
+func modulatePercent(adjustment string) string {
+	amount, _ := strconv.Atoi(adjustment)
+	return strconv.Itoa(100 + amount)
+}
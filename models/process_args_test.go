@@ -11,7 +11,7 @@ var imgUrl = "http://placekitten.com/g/32/32"
 func Test_ProcessArgsGetsWidth(t *testing.T) {
 	args := NewProcessArgs([]string{"128x"}, imgUrl)
 	assert.Equal(t, &ProcessArgs{
-		Width: "128",
+		Width: 128,
 		Url:   "http://placekitten.com/g/32/32",
 	}, args)
 }
@@ -19,7 +19,7 @@ func Test_ProcessArgsGetsWidth(t *testing.T) {
 func Test_ProcessArgsGetsHeight(t *testing.T) {
 	args := NewProcessArgs([]string{"x64"}, imgUrl)
 	assert.Equal(t, &ProcessArgs{
-		Height: "64",
+		Height: 64,
 		Url:    "http://placekitten.com/g/32/32",
 	}, args)
 }
@@ -27,18 +27,18 @@ func Test_ProcessArgsGetsHeight(t *testing.T) {
 func Test_ProcessArgsGetsWidthAndHeight(t *testing.T) {
 	args := NewProcessArgs([]string{"128x64!"}, imgUrl)
 	assert.Equal(t, &ProcessArgs{
-		Width:     "128",
-		Height:    "64",
-		ResizeMod: "!",
-		Url:       "http://placekitten.com/g/32/32",
+		Width:  128,
+		Height: 64,
+		Mode:   ResizeIgnoreAspect,
+		Url:    "http://placekitten.com/g/32/32",
 	}, args)
 }
 
 func Test_ProcessArgsGetsTheRest(t *testing.T) {
 	args := NewProcessArgs([]string{"128x64", "g_center", "frame_0", "png"}, imgUrl)
 	assert.Equal(t, &ProcessArgs{
-		Width:         "128",
-		Height:        "64",
+		Width:         128,
+		Height:        64,
 		Gravity:       "center",
 		Frame:         "0",
 		RequestFormat: "png",
@@ -49,8 +49,8 @@ func Test_ProcessArgsGetsTheRest(t *testing.T) {
 
 func TestConvertsStructIntoCommandLineArgs(t *testing.T) {
 	args := &ProcessArgs{
-		Width:   "128",
-		Height:  "64",
+		Width:   128,
+		Height:  64,
 		Gravity: "north",
 		Frame:   "0",
 		Format:  "png",
@@ -59,12 +59,12 @@ func TestConvertsStructIntoCommandLineArgs(t *testing.T) {
 	cmdArgs, _ := args.CommandArgs("in.psd", "out")
 
 	assert.Equal(t, []string{
+		"-auto-orient",
 		"-gravity", "north",
 		"-thumbnail", "128x64^",
 		"-crop", "128x64+0+0",
 		"-format", "png",
 		"+repage",
-		"-auto-orient",
 		"in.psd[0]",
 		"out.png",
 	}, cmdArgs)
@@ -72,18 +72,18 @@ func TestConvertsStructIntoCommandLineArgs(t *testing.T) {
 
 func TestOnlyShrinksIfGravityOmitted(t *testing.T) {
 	args := &ProcessArgs{
-		Width:  "128",
-		Height: "64",
+		Width:  128,
+		Height: 64,
 	}
 
 	cmdArgs, _ := args.CommandArgs("in.gif", "out")
 
 	assert.Equal(t, []string{
+		"-auto-orient",
 		"-thumbnail", "128x64>",
 		"-crop", "128x64+0+0",
 		"-format", "png",
 		"+repage",
-		"-auto-orient",
 		"in.gif",
 		"out.png",
 	}, cmdArgs)
@@ -91,14 +91,14 @@ func TestOnlyShrinksIfGravityOmitted(t *testing.T) {
 
 func TestSpecifyJustHeight(t *testing.T) {
 	args := &ProcessArgs{
-		Height: "64",
+		Height: 64,
 	}
 	cmdArgs, _ := args.CommandArgs("in.gif", "out")
 	assert.Equal(t, []string{
+		"-auto-orient",
 		"-thumbnail", "x64",
 		"-format", "png",
 		"+repage",
-		"-auto-orient",
 		"in.gif",
 		"out.png",
 	}, cmdArgs)
@@ -106,19 +106,397 @@ func TestSpecifyJustHeight(t *testing.T) {
 
 func TestSpecifyJustWidth(t *testing.T) {
 	args := &ProcessArgs{
-		Width: "128",
+		Width: 128,
 	}
 	cmdArgs, _ := args.CommandArgs("in.psd", "out")
 	assert.Equal(t, []string{
+		"-auto-orient",
 		"-thumbnail", "128x",
 		"-format", "png",
 		"+repage",
-		"-auto-orient",
 		"in.psd",
 		"out.png",
 	}, cmdArgs)
 }
 
+func TestAutoOrientCanBeDisabled(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "noorient"}, imgUrl)
+	assert.T(t, args.NoAutoOrient)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-thumbnail", "128x",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+}
+
+func TestFlipAndFlop(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "flip", "flop"}, imgUrl)
+	assert.T(t, args.Flip)
+	assert.T(t, args.Flop)
+
+	cmdArgs, _ := args.CommandArgs("in.gif", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-thumbnail", "128x",
+		"-flip",
+		"-flop",
+		"-format", "png",
+		"+repage",
+		"in.gif",
+		"out.png",
+	}, cmdArgs)
+}
+
+func TestFilters(t *testing.T) {
+	args := NewProcessArgs([]string{"128x64", "g_center", "filter_grayscale"}, imgUrl)
+	assert.Equal(t, "grayscale", args.Filter)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-gravity", "center",
+		"-thumbnail", "128x64^",
+		"-crop", "128x64+0+0",
+		"-colorspace", "Gray",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	args = NewProcessArgs([]string{"filter_sepia"}, imgUrl)
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-sepia-tone", "80%",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	args = NewProcessArgs([]string{"filter_blur"}, imgUrl)
+	assert.Equal(t, "", args.Filter)
+}
+
+func TestDaltonize(t *testing.T) {
+	args := NewProcessArgs([]string{"simulate_deuteranopia"}, imgUrl)
+	assert.Equal(t, "simulate_deuteranopia", args.Daltonize)
+	assert.T(t, args.HasOperations())
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-colorspace", "RGB",
+		"-color-matrix", "0.367322 0.860646 -0.227968 0.280085 0.672501 0.047413 -0.011820 0.042940 0.968881",
+		"-colorspace", "sRGB",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	// correction leaves what protanopes see of the original alone and
+	// shifts what they lose into green and blue
+	args = NewProcessArgs([]string{"daltonize_protanopia"}, imgUrl)
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, "1.000000 0.000000 0.000000 0.478897 0.476911 0.044192 0.597282 -0.688692 1.091410", cmdArgs[4])
+	assert.NotEqual(t, NewProcessArgs([]string{"simulate_protanopia"}, imgUrl).CacheKey(), args.CacheKey())
+
+	args = NewProcessArgs([]string{"daltonize_achromatopsia"}, imgUrl)
+	assert.Equal(t, "", args.Daltonize)
+}
+
+func TestBrightnessContrastAndSaturation(t *testing.T) {
+	args := NewProcessArgs([]string{"bri_20", "con_-15", "sat_100"}, imgUrl)
+	assert.Equal(t, "20", args.Brightness)
+	assert.Equal(t, "-15", args.Contrast)
+	assert.Equal(t, "100", args.Saturation)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-modulate", "120,200",
+		"-brightness-contrast", "0x-15",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	args = NewProcessArgs([]string{"sat_-50"}, imgUrl)
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{"-auto-orient", "-modulate", "100,50"}, cmdArgs[:3])
+}
+
+func TestAdjustmentsOutOfRangeAreIgnored(t *testing.T) {
+	args := NewProcessArgs([]string{"bri_101", "con_-200"}, imgUrl)
+	assert.Equal(t, "", args.Brightness)
+	assert.Equal(t, "", args.Contrast)
+}
+
+func TestDeterministicOutputPinsEncoderSettings(t *testing.T) {
+	DeterministicOutput = true
+	defer func() { DeterministicOutput = false }()
+
+	args := NewProcessArgs([]string{"128x"}, imgUrl)
+	assert.T(t, args.Deterministic)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-thumbnail", "128x",
+		"-format", "png",
+		"+repage",
+		"+set", "date:create",
+		"+set", "date:modify",
+		"+set", "date:timestamp",
+		"-define", "png:exclude-chunk=date,time",
+		"-define", "png:compression-level=9",
+		"-define", "png:compression-filter=5",
+		"-define", "png:compression-strategy=1",
+		"-sampling-factor", "4:2:0",
+		"-interlace", "None",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+}
+
+func fitCommandArgs(urlArgs ...string) []string {
+	args := NewProcessArgs(urlArgs, imgUrl)
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	// trim the orientation, format and file args common to every command
+	return cmdArgs[1 : len(cmdArgs)-5]
+}
+
+func TestFitCover(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200^",
+		"-gravity", "center",
+		"-extent", "300x200",
+	}, fitCommandArgs("300x200", "fit_cover"))
+
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200^",
+		"-gravity", "north",
+		"-extent", "300x200",
+	}, fitCommandArgs("300x200", "fit_cover", "g_north"))
+}
+
+func TestFitContain(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200",
+		"-gravity", "center",
+		"-background", "#ff0000",
+		"-extent", "300x200",
+	}, fitCommandArgs("300x200", "fit_contain", "bg_ff0000"))
+}
+
+func TestFitPadIsContainWithWhiteBackground(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200",
+		"-gravity", "north",
+		"-background", "white",
+		"-extent", "300x200",
+	}, fitCommandArgs("300x200", "fit_pad", "g_north"))
+}
+
+func TestFitFill(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200!",
+	}, fitCommandArgs("300x200", "fit_fill"))
+}
+
+func TestFitInside(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200",
+	}, fitCommandArgs("300x200", "fit_inside"))
+
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200>",
+	}, fitCommandArgs("300x200>", "fit_inside"))
+}
+
+func TestFitOutside(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x200^",
+	}, fitCommandArgs("300x200", "fit_outside"))
+}
+
+func TestFitWithOneDimension(t *testing.T) {
+	assert.Equal(t, []string{
+		"-thumbnail", "300x",
+	}, fitCommandArgs("300x", "fit_cover"))
+}
+
+func TestTrimBeforeResizing(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "trim"}, imgUrl)
+	assert.T(t, args.Trim)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-trim", "+repage",
+		"-thumbnail", "128x",
+	}, cmdArgs[:5])
+
+	args = NewProcessArgs([]string{"128x", "trim_15"}, imgUrl)
+	assert.Equal(t, "15", args.TrimFuzz)
+
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-fuzz", "15%",
+		"-trim", "+repage",
+		"-thumbnail", "128x",
+	}, cmdArgs[:7])
+}
+
+func TestMasksForcePng(t *testing.T) {
+	args := NewProcessArgs([]string{"64x64", "jpg", "radius_8"}, imgUrl)
+	assert.Equal(t, "8", args.Radius)
+
+	_, outFile := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, "out.png", outFile)
+
+	args = NewProcessArgs([]string{"64x64", "mask_circle"}, imgUrl)
+	args.Animated = true
+	args.Format = "gif"
+	_, outFile = args.CommandArgs("in.gif", "out")
+	assert.Equal(t, "out.gif", outFile)
+}
+
+func TestMaskArgs(t *testing.T) {
+	args := NewProcessArgs([]string{"mask_circle"}, imgUrl)
+	assert.Equal(t, []string{
+		"in.png",
+		"-alpha", "set",
+		"(", "+clone", "-alpha", "transparent", "-fill", "white", "-draw", "ellipse 31.5,23.5 32,24 0,360", ")",
+		"-compose", "DstIn", "-composite",
+		"out.png",
+	}, args.MaskArgs("in.png", "out.png", 64, 48))
+
+	args = NewProcessArgs([]string{"radius_8"}, imgUrl)
+	assert.Equal(t, "roundrectangle 0,0 63,47 8,8", args.MaskArgs("in.png", "out.png", 64, 48)[10])
+}
+
+func TestPixelateRegion(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "pixelate_10,20,100,50,8"}, imgUrl)
+	assert.Equal(t, "10,20,100,50,8", args.Pixelate)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-region", "100x50+10+20",
+		"-scale", "13x7!",
+		"-scale", "100x50!",
+		"+region",
+		"-thumbnail", "128x",
+	}, cmdArgs[:10])
+
+	args = NewProcessArgs([]string{"pixelate_10,20,100,50,1"}, imgUrl)
+	assert.Equal(t, "", args.Pixelate)
+
+	// blocks that don't divide the region still cover all of it
+	args = NewProcessArgs([]string{"pixelate_0,0,10,10,3"}, imgUrl)
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{"-scale", "4x4!", "-scale", "10x10!"}, cmdArgs[3:7])
+
+	// blocks bigger than the region, or regions bigger than an image can
+	// be, would be scaled up without bound
+	args = NewProcessArgs([]string{"pixelate_0,0,10,10,100000"}, imgUrl)
+	assert.Equal(t, "", args.Pixelate)
+	args = NewProcessArgs([]string{"pixelate_0,0,99999999,99999999,2"}, imgUrl)
+	assert.Equal(t, "", args.Pixelate)
+}
+
+func TestRedEyeRegion(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "redeye_40,60,120,30"}, imgUrl)
+	assert.Equal(t, "40,60,120,30", args.RedEye)
+	assert.T(t, args.HasOperations())
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-region", "120x30+40+60",
+		"-channel", "R",
+		"-fx", "r > 0.25 && r > 1.5*(g+b)/2 ? (g+b)/2 : r",
+		"+channel",
+		"+region",
+		"-thumbnail", "128x",
+	}, cmdArgs[:11])
+
+	args = NewProcessArgs([]string{"redeye_40,60,120"}, imgUrl)
+	assert.Equal(t, "", args.RedEye)
+}
+
+func TestStripKeepsColorProfile(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "strip"}, imgUrl)
+	assert.T(t, args.Strip)
+	args.ColorProfile = "/tmp/profile.icc"
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-thumbnail", "128x",
+		"-strip",
+		"-profile", "/tmp/profile.icc",
+		"-format", "png",
+	}, cmdArgs[:8])
+}
+
+func TestStripMetadataByDefault(t *testing.T) {
+	StripMetadata = true
+	defer func() { StripMetadata = false }()
+
+	args := NewProcessArgs([]string{}, imgUrl)
+	assert.T(t, args.Strip)
+	assert.T(t, args.HasOperations())
+}
+
+func TestKeepMetaOverridesStrip(t *testing.T) {
+	StripMetadata = true
+	defer func() { StripMetadata = false }()
+
+	args := NewProcessArgs([]string{"128x", "keepmeta"}, imgUrl)
+	assert.T(t, args.KeepMeta)
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-resize", "128x",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	assert.Equal(t, []string{"exif", "xmp", "icc", "comment"}, args.KeptMetadata("png"))
+	assert.Equal(t, []string{"comment"}, args.KeptMetadata("gif"))
+}
+
+func TestColorArgsConvertToSrgb(t *testing.T) {
+	args := &ProcessArgs{Colorspace: "CMYK"}
+	assert.Equal(t, []string{"-colorspace", "sRGB"}, args.colorArgs())
+
+	SrgbProfile, CmykProfile = "sRGB.icc", "USWebCoatedSWOP.icc"
+	defer func() { SrgbProfile, CmykProfile = "", "" }()
+
+	assert.Equal(t, []string{"-profile", "USWebCoatedSWOP.icc", "-profile", "sRGB.icc"}, args.colorArgs())
+
+	args = &ProcessArgs{Colorspace: "sRGB", IccProfile: "Display P3"}
+	assert.Equal(t, []string{"-profile", "sRGB.icc"}, args.colorArgs())
+
+	args = &ProcessArgs{Colorspace: "sRGB", IccProfile: "sRGB IEC61966-2.1"}
+	assert.Equal(t, 0, len(args.colorArgs()))
+
+	args = &ProcessArgs{Colorspace: "sRGB"}
+	assert.Equal(t, 0, len(args.colorArgs()))
+}
+
 func TestHasNoOperationsWithJustUrl(t *testing.T) {
 	args := &ProcessArgs{
 		Url: "http://someth.ing",
@@ -127,10 +505,10 @@ func TestHasNoOperationsWithJustUrl(t *testing.T) {
 }
 
 func TestHasOperationsWithAnythingThatIsNotUrl(t *testing.T) {
-	args := &ProcessArgs{Height: "1"}
+	args := &ProcessArgs{Height: 1}
 	assert.T(t, args.HasOperations())
 
-	args = &ProcessArgs{Width: "1"}
+	args = &ProcessArgs{Width: 1}
 	assert.T(t, args.HasOperations())
 
 	args = &ProcessArgs{Format: "1"}
@@ -141,4 +519,111 @@ func TestHasOperationsWithAnythingThatIsNotUrl(t *testing.T) {
 
 	args = &ProcessArgs{Frame: "1"}
 	assert.T(t, args.HasOperations())
+
+	args = &ProcessArgs{Flip: true}
+	assert.T(t, args.HasOperations())
+
+	args = &ProcessArgs{Flop: true}
+	assert.T(t, args.HasOperations())
+
+	args = &ProcessArgs{Filter: "sepia"}
+	assert.T(t, args.HasOperations())
+}
+
+func TestLqip(t *testing.T) {
+	args := NewProcessArgs([]string{"500x300", "png", "lqip"}, imgUrl)
+	assert.Equal(t, "base64", args.Encoding)
+
+	cmdArgs, outFile := args.CommandArgs("in.gif", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-thumbnail", "20x",
+		"-strip",
+		"-quality", "20",
+		"-format", "jpg",
+		"+repage",
+		"in.gif[0]", "out.jpg",
+	}, cmdArgs)
+	assert.Equal(t, "out.jpg", outFile)
+}
+
+func TestVersionOnlyChangesCacheKey(t *testing.T) {
+	args := NewProcessArgs([]string{"128x", "v_2024-05-01"}, imgUrl)
+	assert.Equal(t, "2024-05-01", args.Version)
+	assert.Equal(t, "1714521600", NewProcessArgs([]string{"t_1714521600"}, imgUrl).Version)
+
+	unversioned := NewProcessArgs([]string{"128x"}, imgUrl)
+	assert.NotEqual(t, unversioned.CacheKey(), args.CacheKey())
+	assert.NotEqual(t, NewProcessArgs([]string{"128x", "v_3"}, imgUrl).CacheKey(), args.CacheKey())
+
+	args.Version = ""
+	assert.Equal(t, unversioned, args)
+	assert.Equal(t, false, NewProcessArgs([]string{"v_2"}, imgUrl).HasOperations())
+}
+
+func TestProcessArgsGetsTypedGeometry(t *testing.T) {
+	args := NewProcessArgs([]string{"w_128", "h_64"}, imgUrl)
+	assert.Equal(t, 128, args.Width)
+	assert.Equal(t, 64, args.Height)
+	assert.Equal(t, ResizeDefault, args.Mode)
+
+	for modifier, mode := range map[string]ResizeMode{">": ResizeShrinkOnly, "<": ResizeEnlargeOnly, "!": ResizeIgnoreAspect, "^": ResizeFillArea} {
+		args = NewProcessArgs([]string{"128x64" + modifier}, imgUrl)
+		assert.Equal(t, mode, args.Mode)
+		assert.Equal(t, modifier, args.Mode.modifier())
+	}
+}
+
+func TestProcessArgsClampsDimensions(t *testing.T) {
+	args := NewProcessArgs([]string{"100000x0"}, imgUrl)
+	assert.Equal(t, MaxDimension, args.Width)
+	assert.Equal(t, 0, args.Height)
+
+	args = NewProcessArgs([]string{"h_99999"}, imgUrl)
+	assert.Equal(t, MaxDimension, args.Height)
+}
+
+func TestRawConvertFlags(t *testing.T) {
+	defer func() { RawConvertFlags = map[string]int{} }()
+	RawConvertFlags = ParseRawConvertFlags("-sharpen:1, +dither")
+	assert.Equal(t, map[string]int{"-sharpen": 1, "+dither": 0}, RawConvertFlags)
+
+	args := NewProcessArgs([]string{"128x", "raw_-sharpen:0x1.5", "raw_+dither", "raw_-write:@etc", "raw_-level:-write"}, imgUrl)
+	assert.Equal(t, []string{"-sharpen:0x1.5", "+dither"}, args.Raw)
+	assert.Equal(t, nil, args.CheckRaw())
+
+	cmdArgs, _ := args.CommandArgs("in.jpg", "out")
+	assert.Equal(t, []string{
+		"-auto-orient",
+		"-thumbnail", "128x",
+		"-sharpen", "0x1.5",
+		"+dither",
+		"-format", "png",
+		"+repage",
+		"in.jpg",
+		"out.png",
+	}, cmdArgs)
+
+	args = NewProcessArgs([]string{"raw_-fx:u"}, imgUrl)
+	assert.T(t, args.HasOperations())
+	assert.Equal(t, "convert flag -fx is not allowed", args.CheckRaw().Error())
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	for _, arg := range cmdArgs {
+		assert.NotEqual(t, "-fx", arg)
+	}
+
+	// values past a flag's arity would be read as the input file
+	args = NewProcessArgs([]string{"raw_+dither:etc"}, imgUrl)
+	assert.Equal(t, "convert flag +dither takes no value", args.CheckRaw().Error())
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	for _, arg := range cmdArgs {
+		assert.NotEqual(t, "etc", arg)
+	}
+
+	args = NewProcessArgs([]string{"raw_-sharpen"}, imgUrl)
+	assert.Equal(t, "convert flag -sharpen needs a value", args.CheckRaw().Error())
+	cmdArgs, _ = args.CommandArgs("in.jpg", "out")
+	for _, arg := range cmdArgs {
+		assert.NotEqual(t, "-sharpen", arg)
+	}
 }
@@ -0,0 +1,152 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// ResultPusher stores results for callers to keep under names of their
+// choosing, unlike a ResultCache whose names are transform keys
+type ResultPusher interface {
+	Push(ctx context.Context, name string, format string, data []byte) error
+}
+
+// PushStore is nil unless PUSH_URL is set. Only requests asking with push
+// are pushed to it
+var PushStore ResultPusher
+
+// PushNameTemplate names pushed objects, unless a request brings its own
+var PushNameTemplate = "{hash}.{format}"
+
+// pushVars are the variables a name template can use
+var pushVars = map[string]bool{"hash": true, "width": true, "format": true, "account": true}
+
+var pushVarRgx = regexp.MustCompile(`\{([a-z]*)\}`)
+
+// pushNameRgx limits pushed object names to slash separated words, so
+// they can't escape the store's prefix
+var pushNameRgx = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+// pushAccountRgx matches accounts that make a single segment of a name
+var pushAccountRgx = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// InitPushStore configures where results are pushed. Like CACHE_URL the
+// scheme picks the backend, though only S3 is supported
+func InitPushStore(pushUrl string) {
+	if pushUrl == "" {
+		PushStore = nil
+		return
+	}
+
+	u, err := url.Parse(pushUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		PushStore = newS3Cache(u, awsCredentialsFromEnv())
+	default:
+		panic("unknown push store " + pushUrl)
+	}
+}
+
+// CheckPushNameTemplate returns an error when template uses unknown
+// variables or wouldn't make a valid object name
+func CheckPushNameTemplate(template string) error {
+	for _, match := range pushVarRgx.FindAllStringSubmatch(template, -1) {
+		if !pushVars[match[1]] {
+			return fmt.Errorf("unknown push name variable %s", match[0])
+		}
+	}
+	_, err := pushName(template, map[string]string{"hash": "0", "width": "0", "format": "png", "account": "a"})
+	return err
+}
+
+// CheckPush returns an error when the request asks for a push that can't
+// be made
+func (p *ProcessArgs) CheckPush() error {
+	if !p.Push {
+		return nil
+	}
+	if !p.HasOperations() {
+		return fmt.Errorf("push needs at least one operation")
+	}
+	if p.PushName != "" {
+		return CheckPushNameTemplate(p.PushName)
+	}
+	return nil
+}
+
+// pushName fills in template's variables. Empty values leave an invalid
+// name, as an empty account would
+func pushName(template string, vars map[string]string) (string, error) {
+	name := pushVarRgx.ReplaceAllStringFunc(template, func(v string) string {
+		return vars[strings.Trim(v, "{}")]
+	})
+	if !pushNameRgx.MatchString(name) {
+		return "", fmt.Errorf("push name %q isn't a valid object name", name)
+	}
+	return name, nil
+}
+
+// pushResult pushes the result at filePath when the request asked for it,
+// named by PushNameTemplate or by the request's own template under its
+// account's prefix, so callers can't name each other's objects. The name
+// is reported in X-Firesize-Pushed. Degraded results aren't pushed, as
+// they'd be kept
+func pushResult(w http.ResponseWriter, args *ProcessArgs, filePath string) error {
+	if !args.Push || PushStore == nil || len(args.Degraded) > 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	format := strings.TrimPrefix(filepath.Ext(filePath), ".")
+	if args.Account != "" && !pushAccountRgx.MatchString(args.Account) {
+		return statusErrorf(http.StatusBadRequest, "account %q can't be part of a push name", args.Account)
+	}
+	template := PushNameTemplate
+	if args.PushName != "" {
+		if args.Account == "" {
+			return statusErrorf(http.StatusForbidden, "push names need an account")
+		}
+		template = args.Account + "/" + args.PushName
+	}
+	vars := map[string]string{"hash": dataSha256(data), "format": format, "account": args.Account}
+	if strings.Contains(template, "{width}") {
+		width, _, err := identifyDimensions(args.ctx(), filePath)
+		if err != nil {
+			return err
+		}
+		vars["width"] = strconv.Itoa(width)
+	}
+	name, err := pushName(template, vars)
+	if err != nil {
+		return statusErrorf(http.StatusBadRequest, "%s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(args.ctx(), remoteCacheTimeout)
+	defer cancel()
+	if err = PushStore.Push(ctx, name, format, data); err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "push",
+			"name":    name,
+			"failure": err,
+		})
+		return statusErrorf(http.StatusBadGateway, "could not push result")
+	}
+	w.Header().Set("X-Firesize-Pushed", name)
+	return nil
+}
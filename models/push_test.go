@@ -0,0 +1,115 @@
+package models
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestPushArgs(t *testing.T) {
+	template := "{account}/thumbs/{hash}.{format}"
+	args := NewProcessArgs([]string{"128x", "push_" + base64.RawURLEncoding.EncodeToString([]byte(template))}, imgUrl)
+	assert.T(t, args.Push)
+	assert.Equal(t, template, args.PushName)
+	assert.Equal(t, nil, args.CheckPush())
+	assert.Equal(t, NewProcessArgs([]string{"128x"}, imgUrl).CacheKey(), args.CacheKey())
+
+	args = NewProcessArgs([]string{"128x", "push"}, imgUrl)
+	assert.T(t, args.Push)
+	assert.Equal(t, "", args.PushName)
+
+	args = NewProcessArgs([]string{"push"}, imgUrl)
+	assert.NotEqual(t, nil, args.CheckPush())
+}
+
+func TestCheckPushNameTemplate(t *testing.T) {
+	assert.Equal(t, nil, CheckPushNameTemplate("{hash}.{format}"))
+	assert.Equal(t, nil, CheckPushNameTemplate("{account}/{width}w/{hash}.{format}"))
+	assert.Equal(t, "unknown push name variable {size}", CheckPushNameTemplate("{size}.{format}").Error())
+	assert.NotEqual(t, nil, CheckPushNameTemplate("../{hash}.{format}"))
+	assert.NotEqual(t, nil, CheckPushNameTemplate("/{hash}.{format}"))
+	assert.NotEqual(t, nil, CheckPushNameTemplate("{account}//{hash}"))
+}
+
+func TestPushResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	objects := map[string][]byte{}
+	contentTypes := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		contentTypes[r.URL.Path] = r.Header.Get("Content-Type")
+	}))
+	defer server.Close()
+	u, _ := url.Parse("s3://pushed/images?endpoint=" + url.QueryEscape(server.URL))
+	PushStore = newS3Cache(u, awsCredentials{AccessKeyId: "AKID", SecretAccessKey: "secret"})
+	defer func() { PushStore = nil }()
+
+	data := []byte("not really a png")
+	filePath := filepath.Join(dir, "out.png")
+	ioutil.WriteFile(filePath, data, 0644)
+
+	// without push nothing is stored
+	w := httptest.NewRecorder()
+	assert.Equal(t, nil, pushResult(w, &ProcessArgs{Width: 128}, filePath))
+	assert.Equal(t, 0, len(objects))
+
+	w = httptest.NewRecorder()
+	assert.Equal(t, nil, pushResult(w, &ProcessArgs{Width: 128, Push: true}, filePath))
+	name := dataSha256(data) + ".png"
+	assert.Equal(t, name, w.Header().Get("X-Firesize-Pushed"))
+	assert.Equal(t, data, objects["/pushed/images/"+name])
+	assert.Equal(t, "image/png", contentTypes["/pushed/images/"+name])
+
+	defer func(previous string) { PushNameTemplate = previous }(PushNameTemplate)
+	PushNameTemplate = "{account}/{hash}.{format}"
+	w = httptest.NewRecorder()
+	assert.Equal(t, nil, pushResult(w, &ProcessArgs{Width: 128, Push: true, Account: "acme"}, filePath))
+	assert.Equal(t, "acme/"+name, w.Header().Get("X-Firesize-Pushed"))
+
+	// a deployment template naming the account can't be filled in without one
+	err = pushResult(httptest.NewRecorder(), &ProcessArgs{Width: 128, Push: true}, filePath)
+	assert.Equal(t, http.StatusBadRequest, err.(*StatusError).Status)
+
+	// the request's own names always go under its account
+	w = httptest.NewRecorder()
+	args := &ProcessArgs{Width: 128, Push: true, PushName: "thumbs/{hash}.{format}", Account: "acme"}
+	assert.Equal(t, nil, pushResult(w, args, filePath))
+	assert.Equal(t, "acme/thumbs/"+name, w.Header().Get("X-Firesize-Pushed"))
+	assert.Equal(t, data, objects["/pushed/images/acme/thumbs/"+name])
+
+	args.PushName = "other/logo.png"
+	w = httptest.NewRecorder()
+	assert.Equal(t, nil, pushResult(w, args, filePath))
+	assert.Equal(t, "acme/other/logo.png", w.Header().Get("X-Firesize-Pushed"))
+
+	args.Account = ""
+	err = pushResult(httptest.NewRecorder(), args, filePath)
+	assert.Equal(t, http.StatusForbidden, err.(*StatusError).Status)
+	args.Account = "acme/../other"
+	err = pushResult(httptest.NewRecorder(), args, filePath)
+	assert.Equal(t, http.StatusBadRequest, err.(*StatusError).Status)
+
+	// degraded results would be kept, so aren't pushed
+	objects = map[string][]byte{}
+	args = &ProcessArgs{Width: 128, Push: true, Degraded: []string{"proxy-only"}}
+	w = httptest.NewRecorder()
+	assert.Equal(t, nil, pushResult(w, args, filePath))
+	assert.Equal(t, "", w.Header().Get("X-Firesize-Pushed"))
+	assert.Equal(t, 0, len(objects))
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// RawConvertFlags are the convert flags requests may pass straight
+// through with raw_ segments, an escape hatch for options that haven't
+// been modeled yet, mapped to the number of values each takes (0 or 1).
+// None are allowed unless configured
+var RawConvertFlags = map[string]int{}
+
+// rawRgx matches raw_{flag} and raw_{flag}:{value}, like
+// raw_-sharpen:0x1.5 or raw_+dither
+var rawRgx = regexp.MustCompile(`^raw_([-+][a-z][a-z-]*)(?::(.+))?$`)
+
+// rawValueRgx limits values to numbers, geometries and plain words, so
+// they can't name files (@file) or be read as another flag
+var rawValueRgx = regexp.MustCompile(`^(-?[0-9.][0-9A-Za-z.,%+!<>^x-]*|[A-Za-z][A-Za-z0-9-]*)$`)
+
+// ParseRawConvertFlags reads a comma separated list of flags, each with
+// the number of values it takes, like "-sharpen:1,-unsharp:1,+dither".
+// Flags without a count take no value
+func ParseRawConvertFlags(value string) map[string]int {
+	flags := map[string]int{}
+	for _, flag := range strings.Split(value, ",") {
+		if flag = strings.TrimSpace(flag); flag == "" {
+			continue
+		}
+		flag, arity := splitRaw(flag)
+		switch arity {
+		case "", "0":
+			flags[flag] = 0
+		case "1":
+			flags[flag] = 1
+		default:
+			panic(fmt.Sprintf("convert flag %s can't take %s values", flag, arity))
+		}
+	}
+	return flags
+}
+
+// CheckRaw returns an error naming the first raw flag that isn't allowed
+func (p *ProcessArgs) CheckRaw() error {
+	for _, raw := range p.Raw {
+		flag, value := splitRaw(raw)
+		arity, ok := RawConvertFlags[flag]
+		switch {
+		case !ok:
+			return fmt.Errorf("convert flag %s is not allowed", flag)
+		case arity == 0 && value != "":
+			return fmt.Errorf("convert flag %s takes no value", flag)
+		case arity == 1 && value == "":
+			return fmt.Errorf("convert flag %s needs a value", flag)
+		}
+	}
+	return nil
+}
+
+// rawArgs are the convert args for the allowed raw flags
+func (p *ProcessArgs) rawArgs() (args []string) {
+	for _, raw := range p.Raw {
+		flag, value := splitRaw(raw)
+		arity, ok := RawConvertFlags[flag]
+		if !ok || (arity == 1) != (value != "") {
+			continue
+		}
+		args = append(args, flag)
+		if arity == 1 {
+			args = append(args, value)
+		}
+	}
+	return args
+}
+
+func splitRaw(raw string) (flag string, value string) {
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], ""
+}
@@ -0,0 +1,325 @@
+package models
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisCache keeps results in Redis, a shared hot cache without S3's
+// latency on every hit. Each value is a header line of the cache format,
+// the image format and its checksum, then the image, and expires after
+// ttl. Values from before the cache format was kept have only the image
+// format on their first line. The keys made from each source are kept in
+// a set under source:<url>, expiring with them, and the sources in the
+// sorted set sources so they can be looked up by prefix
+type redisCache struct {
+	addr     string
+	useTls   bool
+	password string
+	db       int
+	prefix   string
+	ttl      time.Duration
+
+	conns chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisPoolSize is how many idle connections are kept for reuse
+var redisPoolSize = 8
+
+var defaultRedisCacheTtl = 24 * time.Hour
+
+func newRedisCache(u *url.URL) *redisCache {
+	c := &redisCache{
+		addr:   u.Host,
+		useTls: u.Scheme == "rediss",
+		prefix: "firesize:",
+		ttl:    defaultRedisCacheTtl,
+		conns:  make(chan *redisConn, redisPoolSize),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	c.db, _ = strconv.Atoi(strings.TrimPrefix(u.Path, "/"))
+	query := u.Query()
+	if prefix, ok := query["prefix"]; ok {
+		c.prefix = prefix[0]
+	}
+	if ttl, err := time.ParseDuration(query.Get("ttl")); err == nil {
+		c.ttl = ttl
+	}
+	return c
+}
+
+func (c *redisCache) Get(ctx context.Context, key string) (*CachedResult, error) {
+	reply, err := c.do(ctx, "GET", c.prefix+key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(reply, '\n')
+	if i < 0 {
+		return nil, errors.New("redis: malformed cached result")
+	}
+	result := &CachedResult{Data: reply[i+1:], Version: 1}
+	fields := strings.Fields(string(reply[:i]))
+	switch len(fields) {
+	case 1:
+		result.Format = fields[0]
+	case 3:
+		if result.Version, err = strconv.Atoi(fields[0]); err != nil {
+			return nil, errors.New("redis: malformed cached result")
+		}
+		result.Format, result.Sha256 = fields[1], fields[2]
+	default:
+		return nil, errors.New("redis: malformed cached result")
+	}
+	return result, nil
+}
+
+func (c *redisCache) Put(ctx context.Context, key string, result *CachedResult) error {
+	header := strconv.Itoa(result.Version) + " " + result.Format + " " + result.Sha256 + "\n"
+	value := append([]byte(header), result.Data...)
+	ttl := strconv.FormatInt(int64(c.ttl/time.Millisecond), 10)
+	_, err := c.do(ctx, "SET", c.prefix+key, string(value), "PX", ttl)
+	if err != nil || result.Source == "" {
+		return err
+	}
+	if _, err = c.do(ctx, "SADD", c.prefix+"source:"+result.Source, key); err != nil {
+		return err
+	}
+	if _, err = c.do(ctx, "PEXPIRE", c.prefix+"source:"+result.Source, ttl); err != nil {
+		return err
+	}
+	_, err = c.do(ctx, "ZADD", c.prefix+"sources", "0", result.Source)
+	return err
+}
+
+func (c *redisCache) Delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, "DEL", c.prefix+key)
+	return err
+}
+
+// PurgeSources walks the sources sorted set from prefix, dropping the sets
+// of those matching along with any whose set has already expired
+func (c *redisCache) PurgeSources(ctx context.Context, prefix string, match func(source string) bool) (map[string]string, error) {
+	min, max := "-", "+"
+	if prefix != "" {
+		// no utf-8 byte sorts after \xff
+		min, max = "["+prefix, "("+prefix+"\xff"
+	}
+	sources, err := c.doArray(ctx, "ZRANGEBYLEX", c.prefix+"sources", min, max)
+	if err != nil {
+		return nil, err
+	}
+	purged := map[string]string{}
+	for _, source := range sources {
+		set := c.prefix + "source:" + source
+		keys, err := c.doArray(ctx, "SMEMBERS", set)
+		if err != nil {
+			return purged, err
+		}
+		if len(keys) > 0 && !match(source) {
+			continue
+		}
+		for _, key := range keys {
+			purged[key] = source
+		}
+		if _, err = c.do(ctx, "DEL", set); err != nil {
+			return purged, err
+		}
+		if _, err = c.do(ctx, "ZREM", c.prefix+"sources", source); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+// do sends a command and reads its reply, nil for a missing key
+func (c *redisCache) do(ctx context.Context, args ...string) ([]byte, error) {
+	var reply []byte
+	err := c.exchange(ctx, func(conn *redisConn) (err error) {
+		reply, err = conn.do(args...)
+		return err
+	})
+	return reply, err
+}
+
+// doArray sends a command replying with an array of strings
+func (c *redisCache) doArray(ctx context.Context, args ...string) ([]string, error) {
+	var reply []string
+	err := c.exchange(ctx, func(conn *redisConn) (err error) {
+		reply, err = conn.doArray(args...)
+		return err
+	})
+	return reply, err
+}
+
+// exchange runs f on a pooled connection. Connections are only returned
+// to the pool after a clean exchange
+func (c *redisCache) exchange(ctx context.Context, f func(conn *redisConn) error) error {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(remoteCacheTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	err = f(conn)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return err
+	}
+	select {
+	case c.conns <- conn:
+	default:
+		conn.Close()
+	}
+	return err
+}
+
+func (c *redisCache) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: remoteCacheTimeout}
+	var netConn net.Conn
+	var err error
+	if c.useTls {
+		netConn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if c.password != "" {
+		if _, err = conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err = conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// do writes a command as an array of bulk strings and reads the reply
+// https://redis.io/docs/reference/protocol-spec/
+func (conn *redisConn) do(args ...string) ([]byte, error) {
+	if err := conn.send(args); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+// doArray writes a command and reads an array of strings in reply
+func (conn *redisConn) doArray(args ...string) ([]string, error) {
+	if err := conn.send(args); err != nil {
+		return nil, err
+	}
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if strings.HasPrefix(line, "-") {
+		return nil, redisError(line[1:])
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	values := []string{}
+	for i := 0; i < n; i++ {
+		value, err := conn.reply()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(value))
+	}
+	return values, nil
+}
+
+func (conn *redisConn) send(args []string) error {
+	var cmd bytes.Buffer
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := conn.Write(cmd.Bytes())
+	return err
+}
+
+// reply reads a single string reply
+func (conn *redisConn) reply() ([]byte, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, redisError(line[1:])
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(conn.r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
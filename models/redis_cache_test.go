@@ -0,0 +1,198 @@
+package models
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+// fakeRedis speaks just enough of the protocol for redisCache
+func fakeRedis(t *testing.T, password string) (string, map[string]string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var mu sync.Mutex
+	values := map[string]string{}
+	sets := map[string]map[string]bool{}
+	members := func(key string) []string {
+		list := []string{}
+		for member := range sets[key] {
+			list = append(list, member)
+		}
+		sort.Strings(list)
+		return list
+	}
+	writeArray := func(w io.Writer, list []string) {
+		fmt.Fprintf(w, "*%d\r\n", len(list))
+		for _, member := range list {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(member), member)
+		}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				authed := password == ""
+				for {
+					args, err := readFakeRedisCommand(r)
+					if err != nil {
+						return
+					}
+					mu.Lock()
+					switch {
+					case args[0] == "AUTH":
+						authed = args[1] == password
+						if authed {
+							io.WriteString(conn, "+OK\r\n")
+						} else {
+							io.WriteString(conn, "-WRONGPASS invalid password\r\n")
+						}
+					case !authed:
+						io.WriteString(conn, "-NOAUTH Authentication required\r\n")
+					case args[0] == "SET":
+						values[args[1]] = args[2]
+						io.WriteString(conn, "+OK\r\n")
+					case args[0] == "GET":
+						if value, ok := values[args[1]]; ok {
+							fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(value), value)
+						} else {
+							io.WriteString(conn, "$-1\r\n")
+						}
+					case args[0] == "SADD" || args[0] == "ZADD":
+						if sets[args[1]] == nil {
+							sets[args[1]] = map[string]bool{}
+						}
+						sets[args[1]][args[len(args)-1]] = true
+						io.WriteString(conn, ":1\r\n")
+					case args[0] == "ZREM":
+						delete(sets[args[1]], args[2])
+						io.WriteString(conn, ":1\r\n")
+					case args[0] == "SMEMBERS":
+						writeArray(conn, members(args[1]))
+					case args[0] == "ZRANGEBYLEX":
+						// only the [min (max ranges redisCache asks for
+						list := []string{}
+						for _, member := range members(args[1]) {
+							if args[2] == "-" || (member >= args[2][1:] && member < args[3][1:]) {
+								list = append(list, member)
+							}
+						}
+						writeArray(conn, list)
+					case args[0] == "DEL":
+						_, ok := values[args[1]]
+						if sets[args[1]] != nil {
+							ok = true
+						}
+						delete(values, args[1])
+						delete(sets, args[1])
+						if ok {
+							io.WriteString(conn, ":1\r\n")
+						} else {
+							io.WriteString(conn, ":0\r\n")
+						}
+					default:
+						io.WriteString(conn, "+OK\r\n")
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), values
+}
+
+func readFakeRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+func TestRedisCache(t *testing.T) {
+	addr, values := fakeRedis(t, "s3cret")
+	u, _ := url.Parse("redis://:s3cret@" + addr + "/2?ttl=1h")
+	cache := newRedisCache(u)
+	ctx := context.Background()
+
+	result, err := cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.T(t, result == nil)
+
+	data := []byte("not\r\nreally\na png")
+	err = cache.Put(ctx, "abc", &CachedResult{Format: "png", Data: data, Version: 2, Sha256: dataSha256(data)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "2 png "+dataSha256(data)+"\n"+string(data), values["firesize:abc"])
+
+	result, err = cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "png", result.Format)
+	assert.Equal(t, string(data), string(result.Data))
+	assert.Equal(t, 2, result.Version)
+	assert.Equal(t, dataSha256(data), result.Sha256)
+
+	// values written before the cache format was kept
+	values["firesize:old"] = "gif\nGIF89a"
+	result, err = cache.Get(ctx, "old")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "gif", result.Format)
+	assert.Equal(t, 1, result.Version)
+	assert.Equal(t, "GIF89a", string(result.Data))
+
+	err = cache.Delete(ctx, "abc")
+	assert.Equal(t, nil, err)
+	result, err = cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.T(t, result == nil)
+
+	// results are indexed by source for purges
+	cat, dog := "http://example.com/pets/cat.jpg", "http://example.com/pets/dog.jpg"
+	cache.Put(ctx, "cat-128", &CachedResult{Format: "png", Data: data, Source: cat})
+	cache.Put(ctx, "cat-256", &CachedResult{Format: "png", Data: data, Source: cat})
+	cache.Put(ctx, "dog-128", &CachedResult{Format: "png", Data: data, Source: dog})
+	purged, err := cache.PurgeSources(ctx, "http://example.com/pets/", func(source string) bool { return source == cat })
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{"cat-128": cat, "cat-256": cat}, purged)
+	purged, err = cache.PurgeSources(ctx, "", func(string) bool { return true })
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{"dog-128": dog}, purged)
+}
+
+func TestRedisCacheReportsErrors(t *testing.T) {
+	addr, _ := fakeRedis(t, "s3cret")
+	u, _ := url.Parse("redis://:wrong@" + addr)
+	_, err := newRedisCache(u).Get(context.Background(), "abc")
+	assert.Equal(t, "redis: WRONGPASS invalid password", fmt.Sprint(err))
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"net/http"
+	"strings"
+)
+
+// RegionHeader is the edge header carrying the client's country
+var RegionHeader = "CF-IPCountry"
+
+// RegionPresets maps a country code to url args applied on top of the
+// request's own, e.g. a lower quality for regions with slow networks
+var RegionPresets = map[string][]string{}
+
+// ParseRegionPresets reads presets in the form "IN=q_60;NG=q_50/filter_grayscale"
+func ParseRegionPresets(s string) map[string][]string {
+	presets := map[string][]string{}
+	for _, preset := range strings.Split(s, ";") {
+		parts := strings.SplitN(strings.TrimSpace(preset), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		presets[strings.ToUpper(parts[0])] = strings.Split(parts[1], "/")
+	}
+	return presets
+}
+
+// ApplyRegionPreset overrides args with the preset for the client's region.
+// The overrides become part of the args so they are reflected in the cache
+// key like any other arg
+func (p *ProcessArgs) ApplyRegionPreset(h http.Header) {
+	preset, ok := RegionPresets[strings.ToUpper(h.Get(RegionHeader))]
+	if !ok {
+		return
+	}
+	for _, arg := range preset {
+		p.setUrlArg(arg)
+	}
+}
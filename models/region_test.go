@@ -0,0 +1,28 @@
+package models
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRegionPresetsOverrideArgs(t *testing.T) {
+	RegionPresets = ParseRegionPresets("in=q_60; NG=q_40/filter_grayscale")
+	defer func() { RegionPresets = map[string][]string{} }()
+
+	args := NewProcessArgs([]string{"128x", "q_90"}, imgUrl)
+	key := args.CacheKey()
+	args.ApplyRegionPreset(http.Header{"Cf-Ipcountry": {"IN"}})
+	assert.Equal(t, "60", args.Quality)
+	assert.NotEqual(t, key, args.CacheKey())
+
+	args = NewProcessArgs([]string{"128x"}, imgUrl)
+	args.ApplyRegionPreset(http.Header{"Cf-Ipcountry": {"NG"}})
+	assert.Equal(t, "40", args.Quality)
+	assert.Equal(t, "grayscale", args.Filter)
+
+	args = NewProcessArgs([]string{"128x", "q_90"}, imgUrl)
+	args.ApplyRegionPreset(http.Header{"Cf-Ipcountry": {"US"}})
+	assert.Equal(t, "90", args.Quality)
+}
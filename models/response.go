@@ -0,0 +1,194 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// InlineMaxBytes caps the size of results returned inline as base64
+var InlineMaxBytes int64 = 32 * 1024
+
+type inlineResponse struct {
+	DataUri     string `json:"data_uri"`
+	ContentType string `json:"content_type"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// CacheControl is sent with every processed image
+var CacheControl = "public, max-age=864000"
+
+// serveResult writes the file at filePath to w in the encoding the args
+// asked for. The ETag is the hash of the result, and Last-Modified when it
+// was produced, modified or failing that the file's modification time,
+// so conditional requests for an unchanged result get a 304
+func serveResult(w http.ResponseWriter, r *http.Request, filePath string, modified time.Time, args *ProcessArgs) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if modified.IsZero() {
+		modified = info.ModTime()
+	}
+	hash, err := fileSha256(filePath)
+	if err != nil {
+		return err
+	}
+	setValidators(w, resultETag(hash, args.Encoding), modified)
+	if notModified(r, w.Header().Get("ETag"), modified) {
+		writeNotModified(w)
+		return nil
+	}
+
+	switch args.Encoding {
+	case "base64":
+		return serveBase64(w, filePath)
+	case "multipart":
+		return serveMultipart(w, filePath)
+	}
+
+	http.ServeContent(w, r, filepath.Base(filePath), modified, f)
+	return nil
+}
+
+// resultETag is a strong ETag for a result with the given content hash,
+// distinct for each encoding as they're different representations
+func resultETag(hash string, encoding string) string {
+	if len(hash) > 32 {
+		hash = hash[:32]
+	}
+	if encoding != "" {
+		hash += "-" + encoding
+	}
+	return `"` + hash + `"`
+}
+
+func setValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since when there
+// isn't one, against the result's validators
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || modified.IsZero() {
+		return false
+	}
+	return !modified.Truncate(time.Second).After(since)
+}
+
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// serveBase64 returns small results as a data uri inside a JSON document,
+// saving server side renderers a second round trip
+func serveBase64(w http.ResponseWriter, filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > InlineMaxBytes {
+		return statusErrorf(http.StatusRequestEntityTooLarge,
+			"result is %d bytes, inline responses are limited to %d", info.Size(), InlineMaxBytes)
+	}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	contentType := http.DetectContentType(data)
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(inlineResponse{
+		DataUri:     "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(data),
+		ContentType: contentType,
+		Bytes:       info.Size(),
+	})
+}
+
+// serveMultipart returns a multipart/mixed response with the image as the
+// first part followed by a JSON part describing it
+func serveMultipart(w http.ResponseWriter, filePath string) error {
+	metadata, err := readMetadata(filePath)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	imagePart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":        {contentTypeForFormat(metadata.Format)},
+		"Content-Disposition": {`inline; filename="` + filepath.Base(filePath) + `"`},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(imagePart, f)
+	if err != nil {
+		return err
+	}
+
+	metadataPart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"application/json"},
+	})
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(metadataPart).Encode(metadata)
+	if err != nil {
+		return err
+	}
+
+	return mw.Close()
+}
+
+func contentTypeForFormat(format string) string {
+	switch format {
+	case "jpeg", "jpg":
+		return "image/jpeg"
+	case "png", "gif", "webp":
+		return "image/" + format
+	case "mp4":
+		return "video/mp4"
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,84 @@
+package models
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func writeTempResult(t *testing.T, data []byte) (string, func()) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(dir, "out.gif")
+	ioutil.WriteFile(filePath, data, 0644)
+	return filePath, func() { os.RemoveAll(dir) }
+}
+
+func TestServeBase64ReturnsDataUri(t *testing.T) {
+	filePath, cleanup := writeTempResult(t, []byte("GIF89a"))
+	defer cleanup()
+
+	w := httptest.NewRecorder()
+	err := serveResult(w, httptest.NewRequest("GET", "/", nil), filePath, time.Time{}, &ProcessArgs{Encoding: "base64"})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var body inlineResponse
+	json.Unmarshal(w.Body.Bytes(), &body)
+	assert.Equal(t, inlineResponse{
+		DataUri:     "data:image/gif;base64,R0lGODlh",
+		ContentType: "image/gif",
+		Bytes:       6,
+	}, body)
+}
+
+func TestServeBase64RejectsLargeResults(t *testing.T) {
+	filePath, cleanup := writeTempResult(t, make([]byte, InlineMaxBytes+1))
+	defer cleanup()
+
+	err := serveResult(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), filePath, time.Time{}, &ProcessArgs{Encoding: "base64"})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, err.(*StatusError).Status)
+}
+
+func TestServeResultConditionalRequests(t *testing.T) {
+	filePath, cleanup := writeTempResult(t, []byte("not really a png"))
+	defer cleanup()
+	modified := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	w := httptest.NewRecorder()
+	err := serveResult(w, httptest.NewRequest("GET", "/", nil), filePath, modified, &ProcessArgs{})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, `"`+"e90137d39de304eefbbe788bc535c7e8"+`"`, etag)
+	assert.Equal(t, "Thu, 01 Oct 2026 12:00:00 GMT", w.Header().Get("Last-Modified"))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", `"other", `+etag)
+	w = httptest.NewRecorder()
+	serveResult(w, r, filePath, modified, &ProcessArgs{})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-Modified-Since", "Thu, 01 Oct 2026 12:00:00 GMT")
+	w = httptest.NewRecorder()
+	serveResult(w, r, filePath, modified, &ProcessArgs{})
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	serveResult(w, r, filePath, modified, &ProcessArgs{Encoding: "base64"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `"e90137d39de304eefbbe788bc535c7e8-base64"`, w.Header().Get("ETag"))
+}
@@ -0,0 +1,142 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// CachedResult is a processed image as kept by a ResultCache. Version is
+// the resultCacheFormat it was written with and Sha256 the checksum of
+// Data, both stored alongside it by every backend. Source is the
+// normalized url it was made from, indexed on Put so it can be purged
+type CachedResult struct {
+	Format  string
+	Data    []byte
+	Version int
+	Sha256  string
+	Source  string
+}
+
+// ResultCache keeps processed results by transform key somewhere shared,
+// so they outlive restarts and are reused by every instance. Get returns
+// nil without an error for keys it doesn't have, and Delete succeeds for
+// them. PurgeSources drops the index of sources starting with prefix that
+// match picks, returning the keys made from them with their source, so
+// purges by source reach results stored by any instance
+type ResultCache interface {
+	Get(ctx context.Context, key string) (*CachedResult, error)
+	Put(ctx context.Context, key string, result *CachedResult) error
+	Delete(ctx context.Context, key string) error
+	PurgeSources(ctx context.Context, prefix string, match func(source string) bool) (map[string]string, error)
+}
+
+// RemoteCache is nil unless CACHE_URL is set
+var RemoteCache ResultCache
+
+// resultFormatRgx keeps formats read back from a cache to plain file
+// extensions
+var resultFormatRgx = regexp.MustCompile(`^[a-z0-9]{1,8}$`)
+
+// remoteCacheTimeout bounds each call to the remote cache, a slow cache
+// shouldn't be slower than processing
+var remoteCacheTimeout = 5 * time.Second
+
+// InitResultCache configures the remote cache at cacheUrl. The scheme
+// picks the backend:
+//
+//	s3://bucket/prefix?region=us-east-1             an S3 bucket
+//	s3://bucket/prefix?endpoint=http://minio:9000   an S3 compatible store
+//	redis://:password@host:6379/0?ttl=24h           Redis, rediss:// for TLS
+func InitResultCache(cacheUrl string) {
+	if cacheUrl == "" {
+		RemoteCache = nil
+		return
+	}
+
+	u, err := url.Parse(cacheUrl)
+	if err != nil {
+		panic(err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		RemoteCache = newS3Cache(u, awsCredentialsFromEnv())
+	case "redis", "rediss":
+		RemoteCache = newRedisCache(u)
+	default:
+		panic("unknown result cache " + cacheUrl)
+	}
+}
+
+// fetchRemoteResult writes the result cached under key into tempDir,
+// returning its path. Failures are logged and treated as misses
+func fetchRemoteResult(ctx context.Context, tempDir string, key string) (string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, remoteCacheTimeout)
+	defer cancel()
+	result, err := RemoteCache.Get(ctx, key)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "remote-cache-get",
+			"failure": err,
+		})
+		return "", false
+	}
+	if result == nil {
+		return "", false
+	}
+	if err = checkCachedResult(result); err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "remote-cache-get",
+			"key":     key,
+			"failure": err,
+		})
+		if err == errCorruptResult {
+			RemoteCache.Delete(ctx, key)
+		}
+		return "", false
+	}
+
+	filePath := filepath.Join(tempDir, "cached."+result.Format)
+	if err = ioutil.WriteFile(filePath, result.Data, 0644); err != nil {
+		return "", false
+	}
+	return filePath, true
+}
+
+// storeRemoteResult puts the result at filePath, made from source, in the
+// remote cache in the background, so the response isn't held up waiting
+// for it
+func storeRemoteResult(key string, source string, filePath string) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return
+	}
+	result := &CachedResult{
+		Format:  strings.TrimPrefix(filepath.Ext(filePath), "."),
+		Data:    data,
+		Version: resultCacheFormat,
+		Sha256:  dataSha256(data),
+	}
+	// inline sources are never purged by url, so aren't worth indexing
+	if !strings.HasPrefix(source, "data:") {
+		result.Source = normalizeSourceUrl(source)
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), remoteCacheTimeout)
+		defer cancel()
+		if err := RemoteCache.Put(ctx, key, result); err != nil {
+			grohl.Log(grohl.Data{
+				"action":  "remote-cache-put",
+				"failure": err,
+			})
+		}
+	}()
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestS3Cache(t *testing.T) {
+	objects := map[string][]byte{}
+	metadata := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+			metadata[r.URL.Path] = http.Header{}
+			for name, values := range r.Header {
+				if strings.HasPrefix(name, "X-Amz-Meta-") {
+					metadata[r.URL.Path][name] = values
+				}
+			}
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case "GET":
+			if r.URL.Query().Get("list-type") == "2" {
+				prefix := r.URL.Path + "/" + r.URL.Query().Get("prefix")
+				w.Write([]byte("<ListBucketResult><IsTruncated>false</IsTruncated>"))
+				for path := range objects {
+					if strings.HasPrefix(path, prefix) {
+						w.Write([]byte("<Contents><Key>" + strings.TrimPrefix(path, r.URL.Path+"/") + "</Key></Contents>"))
+					}
+				}
+				w.Write([]byte("</ListBucketResult>"))
+				return
+			}
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			copyHeader(w.Header(), metadata[r.URL.Path])
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse("s3://results/firesize/?endpoint=" + url.QueryEscape(server.URL))
+	cache := newS3Cache(u, awsCredentials{AccessKeyId: "AKID", SecretAccessKey: "secret"})
+	ctx := context.Background()
+
+	result, err := cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.T(t, result == nil)
+
+	data := []byte("not really a png")
+	err = cache.Put(ctx, "abc", &CachedResult{Format: "png", Data: data, Version: 2, Sha256: dataSha256(data)})
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "png", metadata["/results/firesize/abc"].Get("X-Amz-Meta-Format"))
+	assert.Equal(t, "2", metadata["/results/firesize/abc"].Get("X-Amz-Meta-Firesize-Format"))
+
+	result, err = cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "png", result.Format)
+	assert.Equal(t, "not really a png", string(result.Data))
+	assert.Equal(t, 2, result.Version)
+	assert.Equal(t, dataSha256(data), result.Sha256)
+
+	// objects written before the cache format was kept
+	metadata["/results/firesize/abc"].Del("X-Amz-Meta-Firesize-Format")
+	result, err = cache.Get(ctx, "abc")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, result.Version)
+
+	// results are indexed by source for purges
+	cat, dog := "http://example.com/pets/cat.jpg", "http://example.com/pets/dog.jpg"
+	cache.Put(ctx, "cat-128", &CachedResult{Format: "png", Data: data, Source: cat})
+	cache.Put(ctx, "dog-128", &CachedResult{Format: "png", Data: data, Source: dog})
+	purged, err := cache.PurgeSources(ctx, "http://example.com/pets/", func(source string) bool { return source == cat })
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{"cat-128": cat}, purged)
+	purged, err = cache.PurgeSources(ctx, "http://example.com/", func(string) bool { return true })
+	assert.Equal(t, nil, err)
+	assert.Equal(t, map[string]string{"dog-128": dog}, purged)
+}
+
+type staticResultCache struct {
+	result  *CachedResult
+	deleted []string
+}
+
+func (c *staticResultCache) Get(ctx context.Context, key string) (*CachedResult, error) {
+	return c.result, nil
+}
+
+func (c *staticResultCache) Put(ctx context.Context, key string, result *CachedResult) error {
+	return nil
+}
+
+func (c *staticResultCache) Delete(ctx context.Context, key string) error {
+	c.deleted = append(c.deleted, key)
+	return nil
+}
+
+func (c *staticResultCache) PurgeSources(ctx context.Context, prefix string, match func(source string) bool) (map[string]string, error) {
+	return nil, nil
+}
+
+// indexedResultCache keeps results in memory, standing in for a remote
+// cache shared with other instances
+type indexedResultCache map[string]*CachedResult
+
+func (c indexedResultCache) Get(ctx context.Context, key string) (*CachedResult, error) {
+	return c[key], nil
+}
+
+func (c indexedResultCache) Put(ctx context.Context, key string, result *CachedResult) error {
+	c[key] = result
+	return nil
+}
+
+func (c indexedResultCache) Delete(ctx context.Context, key string) error {
+	delete(c, key)
+	return nil
+}
+
+func (c indexedResultCache) PurgeSources(ctx context.Context, prefix string, match func(source string) bool) (map[string]string, error) {
+	purged := map[string]string{}
+	for key, result := range c {
+		if result.Source != "" && strings.HasPrefix(result.Source, prefix) && match(result.Source) {
+			purged[key] = result.Source
+		}
+	}
+	return purged, nil
+}
+
+func TestFetchRemoteResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { RemoteCache = nil }()
+
+	RemoteCache = &staticResultCache{result: &CachedResult{Format: "png", Data: []byte("not really a png")}}
+	filePath, ok := fetchRemoteResult(context.Background(), dir, "abc")
+	assert.T(t, ok)
+	assert.T(t, strings.HasSuffix(filePath, ".png"))
+	data, _ := ioutil.ReadFile(filePath)
+	assert.Equal(t, "not really a png", string(data))
+
+	RemoteCache = &staticResultCache{result: &CachedResult{Format: "../../etc", Data: []byte("x")}}
+	_, ok = fetchRemoteResult(context.Background(), dir, "abc")
+	assert.T(t, !ok)
+}
+
+func TestFetchRemoteResultChecksFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func() { RemoteCache = nil }()
+
+	data := []byte("not really a png")
+	cache := &staticResultCache{result: &CachedResult{Format: "png", Data: data, Version: 2, Sha256: dataSha256(data)}}
+	RemoteCache = cache
+	_, ok := fetchRemoteResult(context.Background(), dir, "abc")
+	assert.T(t, ok)
+
+	// written by a newer version, left for it
+	cache.result.Version = resultCacheFormat + 1
+	_, ok = fetchRemoteResult(context.Background(), dir, "abc")
+	assert.T(t, !ok)
+	assert.Equal(t, 0, len(cache.deleted))
+
+	// corrupted, removed so it's processed and stored again
+	cache.result = &CachedResult{Format: "png", Data: []byte("truncated"), Version: 2, Sha256: dataSha256(data)}
+	_, ok = fetchRemoteResult(context.Background(), dir, "abc")
+	assert.T(t, !ok)
+	assert.Equal(t, []string{"abc"}, cache.deleted)
+}
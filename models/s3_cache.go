@@ -0,0 +1,219 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Cache keeps results as objects in an S3 bucket, or any store speaking
+// the S3 API. Objects are addressed path style so buckets with dots in
+// their names, and stores without virtual hosts, work too. Each result is
+// indexed by an empty sources/<hex source>/<key> object, which can be
+// listed by source prefix as hex keeps the order of the bytes it encodes
+type s3Cache struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	region   string
+	creds    awsCredentials
+}
+
+var s3Client = &http.Client{Timeout: 30 * time.Second}
+
+func newS3Cache(u *url.URL, creds awsCredentials) *s3Cache {
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := query.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Cache{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		bucket:   u.Host,
+		prefix:   prefix,
+		region:   region,
+		creds:    creds,
+	}
+}
+
+func (c *s3Cache) objectUrl(key string) string {
+	return c.endpoint + "/" + c.bucket + "/" + c.prefix + key
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html
+func (c *s3Cache) Get(ctx context.Context, key string) (*CachedResult, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.objectUrl(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	signAwsRequest(req, nil, "s3", c.region, c.creds, time.Now())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("s3 responded with status %d", resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	version, err := strconv.Atoi(resp.Header.Get("X-Amz-Meta-Firesize-Format"))
+	if err != nil {
+		version = 1
+	}
+	return &CachedResult{
+		Format:  resp.Header.Get("X-Amz-Meta-Format"),
+		Data:    data,
+		Version: version,
+		Sha256:  resp.Header.Get("X-Amz-Meta-Sha256"),
+	}, nil
+}
+
+func (c *s3Cache) Put(ctx context.Context, key string, result *CachedResult) error {
+	err := c.putObject(ctx, key, result.Data, http.Header{
+		"Content-Type":               {contentTypeForFormat(result.Format)},
+		"X-Amz-Meta-Format":          {result.Format},
+		"X-Amz-Meta-Firesize-Format": {strconv.Itoa(result.Version)},
+		"X-Amz-Meta-Sha256":          {result.Sha256},
+	})
+	if err != nil || result.Source == "" {
+		return err
+	}
+	indexKey := s3SourceIndexPrefix(result.Source) + "/" + key
+	if len(c.prefix+indexKey) > s3MaxKeyLength {
+		return nil
+	}
+	return c.putObject(ctx, indexKey, nil, http.Header{})
+}
+
+// Push stores a result under name with just its content type, so the
+// bucket can serve it as is
+func (c *s3Cache) Push(ctx context.Context, name string, format string, data []byte) error {
+	return c.putObject(ctx, name, data, http.Header{"Content-Type": {contentTypeForFormat(format)}})
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObject.html
+func (c *s3Cache) putObject(ctx context.Context, key string, data []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.objectUrl(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	signAwsRequest(req, data, "s3", c.region, c.creds, time.Now())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// s3MaxKeyLength is the longest object key S3 accepts, results of sources
+// too long to index under it can only be purged by key
+const s3MaxKeyLength = 1024
+
+func s3SourceIndexPrefix(source string) string {
+	return "sources/" + hex.EncodeToString([]byte(source))
+}
+
+// PurgeSources lists the index objects of sources starting with prefix,
+// deleting those matching
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+func (c *s3Cache) PurgeSources(ctx context.Context, prefix string, match func(source string) bool) (map[string]string, error) {
+	purged := map[string]string{}
+	query := url.Values{"list-type": {"2"}, "prefix": {c.prefix + s3SourceIndexPrefix(prefix)}}
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", c.endpoint+"/"+c.bucket+"?"+query.Encode(), nil)
+		if err != nil {
+			return purged, err
+		}
+		signAwsRequest(req, nil, "s3", c.region, c.creds, time.Now())
+		resp, err := s3Client.Do(req)
+		if err != nil {
+			return purged, err
+		}
+		var list struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return purged, fmt.Errorf("s3 responded with status %d", resp.StatusCode)
+		}
+		if err != nil {
+			return purged, err
+		}
+
+		for _, object := range list.Contents {
+			indexKey := strings.TrimPrefix(object.Key, c.prefix)
+			parts := strings.Split(strings.TrimPrefix(indexKey, "sources/"), "/")
+			if len(parts) != 2 {
+				continue
+			}
+			source, err := hex.DecodeString(parts[0])
+			if err != nil || !match(string(source)) {
+				continue
+			}
+			purged[parts[1]] = string(source)
+			if err = c.Delete(ctx, indexKey); err != nil {
+				return purged, err
+			}
+		}
+		if !list.IsTruncated {
+			return purged, nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObject.html
+func (c *s3Cache) Delete(ctx context.Context, key string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", c.objectUrl(key), nil)
+	if err != nil {
+		return err
+	}
+	signAwsRequest(req, nil, "s3", c.region, c.creds, time.Now())
+
+	resp, err := s3Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3SourceRegion is the region s3:// sources are fetched from, and
+// S3SourceEndpoint the S3 compatible store serving them, if not AWS
+var (
+	S3SourceRegion   = "us-east-1"
+	S3SourceEndpoint string
+)
+
+// S3SourceBuckets are the buckets s3:// sources may come from
+var S3SourceBuckets BucketAllowlist
+
+// s3SourceCreds sign requests for s3:// sources, so private buckets can be
+// resized from without being exposed
+var s3SourceCreds = awsCredentialsFromEnv()
+
+// s3SourceFetcher fetches s3://bucket/key sources path style with signed
+// requests
+type s3SourceFetcher struct{}
+
+func (s3SourceFetcher) Fetch(ctx context.Context, source string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Host == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid s3 source")
+	}
+	if err = S3SourceBuckets.check("s3 bucket", u.Host); err != nil {
+		return nil, err
+	}
+	endpoint := S3SourceEndpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + S3SourceRegion + ".amazonaws.com"
+	}
+	object := &url.URL{Path: "/" + u.Host + u.Path}
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(endpoint, "/")+object.EscapedPath(), nil)
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, header)
+	signAwsRequest(req, nil, "s3", S3SourceRegion, s3SourceCreds, time.Now())
+	return storageClient.Do(req)
+}
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestS3SourcesAreSigned(t *testing.T) {
+	source := bytes.Repeat([]byte("firesize"), 4096)
+	origin, ranges := flakyOrigin(source, `"v1"`)
+	defer origin.Close()
+
+	paths, signedHeaders := []string{}, []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.EscapedPath())
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		signedHeaders = append(signedHeaders, strings.SplitN(strings.SplitN(auth, "SignedHeaders=", 2)[1], ",", 2)[0])
+		origin.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	endpoint, creds, buckets := S3SourceEndpoint, s3SourceCreds, S3SourceBuckets
+	defer func() { S3SourceEndpoint, s3SourceCreds, S3SourceBuckets = endpoint, creds, buckets }()
+	S3SourceEndpoint = server.URL
+	S3SourceBuckets = BucketAllowlist(ParseHostPatterns("originals"))
+	s3SourceCreds = awsCredentials{AccessKeyId: "AKID", SecretAccessKey: "secret"}
+
+	data, err := downloadFrom(t, "s3://originals/products/cat 1.jpg")
+	assert.Equal(t, nil, err)
+	assert.T(t, bytes.Equal(source, data))
+	assert.Equal(t, []string{"/originals/products/cat%201.jpg", "/originals/products/cat%201.jpg"}, paths)
+	assert.Equal(t, 2, len(*ranges))
+	// resumed requests are signed along with their range
+	assert.T(t, strings.Contains(signedHeaders[1], "range"))
+
+	_, err = downloadFrom(t, "s3://originals")
+	assert.Equal(t, 400, err.(*StatusError).Status)
+
+	// other buckets the credentials can read are never signed for
+	_, err = downloadFrom(t, "s3://results/cat.jpg")
+	assert.Equal(t, 403, err.(*StatusError).Status)
+	assert.Equal(t, 2, len(paths))
+	S3SourceBuckets = nil
+	_, err = downloadFrom(t, "s3://originals/products/cat 1.jpg")
+	assert.Equal(t, 403, err.(*StatusError).Status)
+}
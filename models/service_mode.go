@@ -0,0 +1,142 @@
+package models
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// Service modes for incident response. proxy-only passes sources through
+// untouched instead of running delegates, maintenance answers image
+// requests with a static 503
+const (
+	ModeNormal      = "normal"
+	ModeProxyOnly   = "proxy-only"
+	ModeMaintenance = "maintenance"
+)
+
+// ServiceMode is the mode every instance runs in. It's kept in the
+// service_modes table when ServiceModeFromDb is set, so toggling it
+// reaches every instance without a deploy
+type ServiceMode struct {
+	Id        int64     `db:"id" json:"-"`
+	Mode      string    `db:"mode" json:"mode"`
+	Message   string    `db:"message" json:"message,omitempty"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// AdminToken authenticates the admin endpoints, which are disabled when
+// it's empty
+var AdminToken string
+
+// ServiceModeFromDb shares the mode between instances through the
+// database, otherwise it only applies to the instance it was set on
+var ServiceModeFromDb bool
+
+var serviceModeRefreshEvery = 10 * time.Second
+
+var serviceMode = struct {
+	sync.RWMutex
+	current ServiceMode
+}{current: ServiceMode{Mode: ModeNormal}}
+
+// AdminAuthorized is true if header is an Authorization: Bearer header
+// holding AdminToken
+func AdminAuthorized(header string) bool {
+	if AdminToken == "" || !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	return subtle.ConstantTimeCompare([]byte(token), []byte(AdminToken)) == 1
+}
+
+// CurrentServiceMode returns the mode this instance is running in
+func CurrentServiceMode() ServiceMode {
+	serviceMode.RLock()
+	defer serviceMode.RUnlock()
+	return serviceMode.current
+}
+
+// SetServiceMode switches the service into mode, persisting it when
+// ServiceModeFromDb is set. An empty mode means normal
+func SetServiceMode(mode string, message string) (ServiceMode, error) {
+	if mode == "" {
+		mode = ModeNormal
+	}
+	switch mode {
+	case ModeNormal, ModeProxyOnly, ModeMaintenance:
+	default:
+		return CurrentServiceMode(), fmt.Errorf("unknown service mode %q", mode)
+	}
+
+	current := ServiceMode{Id: 1, Mode: mode, Message: message, UpdatedAt: time.Now().UTC()}
+	if ServiceModeFromDb && Dbm != nil {
+		_, err := Dbm.Exec(`insert into service_modes (id, mode, message, updated_at) values ($1, $2, $3, $4)
+			on conflict (id) do update set mode = $2, message = $3, updated_at = $4`,
+			current.Id, current.Mode, current.Message, current.UpdatedAt)
+		if err != nil {
+			return CurrentServiceMode(), err
+		}
+	}
+
+	serviceMode.Lock()
+	serviceMode.current = current
+	serviceMode.Unlock()
+
+	grohl.Log(grohl.Data{
+		"action":  "service-mode",
+		"mode":    mode,
+		"message": message,
+	})
+	return current, nil
+}
+
+// StartServiceModeRefresh picks up modes set on other instances, once at
+// boot and then periodically in the background
+func StartServiceModeRefresh() {
+	if !ServiceModeFromDb || Dbm == nil {
+		return
+	}
+	refreshServiceMode()
+	go func() {
+		for range time.Tick(serviceModeRefreshEvery) {
+			refreshServiceMode()
+		}
+	}()
+}
+
+// refreshServiceMode keeps the last known mode if the database can't be
+// read, so an outage doesn't flip an instance back to normal
+func refreshServiceMode() {
+	modes, err := Dbm.Select(ServiceMode{}, `select * from service_modes where id = 1 limit 1`)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "refresh-service-mode",
+			"failure": err,
+		})
+		return
+	}
+
+	current := ServiceMode{Mode: ModeNormal}
+	if len(modes) > 0 {
+		current = *modes[0].(*ServiceMode)
+	}
+	serviceMode.Lock()
+	serviceMode.current = current
+	serviceMode.Unlock()
+}
+
+// ProxyOnly is true when sources should be passed through unprocessed
+func (m ServiceMode) ProxyOnly() bool {
+	return m.Mode == ModeProxyOnly
+}
+
+// Maintenance is true when image requests get the static maintenance
+// response
+func (m ServiceMode) Maintenance() bool {
+	return m.Mode == ModeMaintenance
+}
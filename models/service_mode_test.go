@@ -0,0 +1,36 @@
+package models
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestProxyOnlyRefusesRedactions(t *testing.T) {
+	SetServiceMode(ModeProxyOnly, "")
+	defer SetServiceMode(ModeNormal, "")
+
+	for arg, op := range map[string]string{
+		"pixelate_0,0,10,10,4": "pixelate",
+		"redeye_0,0,10,10":     "redeye",
+		"mask_circle":          "mask",
+		"strip":                "strip",
+	} {
+		args := NewProcessArgs([]string{"128x", arg}, imgUrl)
+		r, _ := http.NewRequest("GET", "/128x/"+arg+"/"+imgUrl, nil)
+		err := new(IMagick).Process(httptest.NewRecorder(), r, args)
+		statusErr, ok := err.(*StatusError)
+		assert.T(t, ok)
+		assert.Equal(t, http.StatusServiceUnavailable, statusErr.Status)
+		assert.Equal(t, op+" is unavailable", statusErr.Message)
+	}
+
+	defer func(previous bool) { StripMetadata = previous }(StripMetadata)
+	StripMetadata = true
+	args := NewProcessArgs([]string{"128x"}, imgUrl)
+	r, _ := http.NewRequest("GET", "/128x/"+imgUrl, nil)
+	err := new(IMagick).Process(httptest.NewRecorder(), r, args)
+	assert.Equal(t, "strip is unavailable", err.(*StatusError).Message)
+}
@@ -0,0 +1,223 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// SftpSourceLogin logs in to the servers matching Host when fetching
+// Scheme sources, sftp or ftp, as User with Password or the private key at
+// KeyFile. HostKey pins SFTP servers to the base64 sha256 of their host
+// key, as ssh-keygen -l prints it
+type SftpSourceLogin struct {
+	Scheme   string
+	Host     HostPattern
+	User     string
+	Password string
+	KeyFile  string
+	HostKey  string
+}
+
+// SftpSourceLogins are the only servers credentials are sent to. Servers
+// without one are fetched from anonymously, so a caller can't have the
+// credentials sent to a host of their choosing
+var SftpSourceLogins []SftpSourceLogin
+
+// ParseSftpSourceLogins reads one login per line, the scheme, a host glob
+// or /regexp/ as in ParseHostPatterns, user:password and any key= or
+// hostkey= options. SFTP logins must pin the host key, and FTP ones send
+// the password in the clear so have to be listed on purpose
+//
+//	sftp files.example.com firesize:secret hostkey=AAAA...
+//	sftp *.internal.example.com firesize key=/etc/firesize/id_ed25519 hostkey=AAAA...
+//	ftp legacy.example.com firesize:secret
+func ParseSftpSourceLogins(config string) ([]SftpSourceLogin, error) {
+	logins := []SftpSourceLogin{}
+	for _, line := range strings.Split(config, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || (fields[0] != "sftp" && fields[0] != "ftp") {
+			return nil, fmt.Errorf("sftp source login %q isn't scheme host user:password", line)
+		}
+		hosts := ParseHostPatterns(fields[1])
+		if len(hosts) != 1 {
+			return nil, fmt.Errorf("sftp source login %q has an invalid host", line)
+		}
+		login := SftpSourceLogin{Scheme: fields[0], Host: hosts[0]}
+		credentials := strings.SplitN(fields[2], ":", 2)
+		login.User = credentials[0]
+		if len(credentials) > 1 {
+			login.Password = credentials[1]
+		}
+		for _, option := range fields[3:] {
+			switch {
+			case strings.HasPrefix(option, "key=") && login.Scheme == "sftp":
+				login.KeyFile = strings.TrimPrefix(option, "key=")
+			case strings.HasPrefix(option, "hostkey=") && login.Scheme == "sftp":
+				login.HostKey = strings.TrimPrefix(option, "hostkey=")
+			default:
+				return nil, fmt.Errorf("sftp source login %q has unknown option %q", line, option)
+			}
+		}
+		if login.Scheme == "sftp" && login.HostKey == "" {
+			return nil, fmt.Errorf("sftp source login %q doesn't pin a hostkey", line)
+		}
+		logins = append(logins, login)
+	}
+	return logins, nil
+}
+
+// sftpSourceLogin returns the login for u's scheme and host, nil if it
+// has none
+func sftpSourceLogin(u *url.URL) *SftpSourceLogin {
+	host := strings.ToLower(u.Hostname())
+	for i, login := range SftpSourceLogins {
+		if login.Scheme == u.Scheme && login.Host.Match(host) {
+			return &SftpSourceLogins[i]
+		}
+	}
+	return nil
+}
+
+// curlSourceFetcher fetches sftp:// and ftp:// sources with curl, held to
+// the source network restrictions like http ones
+type curlSourceFetcher struct{}
+
+func (curlSourceFetcher) Fetch(ctx context.Context, source string, header http.Header) (*http.Response, error) {
+	u, err := url.Parse(source)
+	if err != nil || u.Hostname() == "" || strings.Trim(u.Path, "/") == "" {
+		return nil, statusErrorf(http.StatusBadRequest, "invalid source url")
+	}
+	ip, err := resolveSourceIP(ctx, u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := delegateCommand(ctx, "curl", "--config", "-")
+	cmd.Stdin = strings.NewReader(strings.Join(curlSourceConfig(u, ip), "\n") + "\n")
+	var outErr outputBuffer
+	cmd.Stderr = &outErr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		ContentLength: -1,
+		Body:          &curlBody{ReadCloser: stdout, cmd: cmd, outErr: &outErr},
+	}, nil
+}
+
+// curlSourceConfig is the curl config fetching u, given on stdin so the
+// password isn't on the command line. The host is pinned to ip, which has
+// been checked, so it can't resolve somewhere else by the time curl runs
+func curlSourceConfig(u *url.URL, ip net.IP) []string {
+	port := u.Port()
+	if port == "" {
+		port = "21"
+		if u.Scheme == "sftp" {
+			port = "22"
+		}
+	}
+	address := ip.String()
+	if ip.To4() == nil {
+		address = "[" + address + "]"
+	}
+	clean := *u
+	clean.User = nil
+
+	config := []string{
+		"url = " + curlQuote(clean.String()),
+		"resolve = " + curlQuote(u.Hostname()+":"+port+":"+address),
+		"fail",
+		"silent",
+		"show-error",
+		"connect-timeout = 10",
+		// brackets and braces in paths are names, not ranges to fetch
+		"globoff",
+		// passive FTP data connections go to the address already checked
+		"ftp-skip-pasv-ip",
+	}
+	if MaxSourceBytes > 0 {
+		config = append(config, "max-filesize = "+strconv.FormatInt(MaxSourceBytes, 10))
+	}
+	login := sftpSourceLogin(u)
+	if login == nil {
+		return config
+	}
+	config = append(config, "user = "+curlQuote(login.User+":"+login.Password))
+	if login.KeyFile != "" {
+		config = append(config, "key = "+curlQuote(login.KeyFile))
+	}
+	if login.HostKey != "" {
+		config = append(config, "hostpubsha256 = "+curlQuote(login.HostKey))
+	}
+	return config
+}
+
+func curlQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// curlBody is curl's output, ending in an error if curl fails
+type curlBody struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	outErr *outputBuffer
+	waited bool
+}
+
+func (b *curlBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF && !b.waited {
+		b.waited = true
+		if waitErr := b.cmd.Wait(); waitErr != nil {
+			return n, curlError(waitErr, b.outErr.String())
+		}
+	}
+	return n, err
+}
+
+func (b *curlBody) Close() error {
+	err := b.ReadCloser.Close()
+	if !b.waited {
+		b.waited = true
+		b.cmd.Process.Kill()
+		b.cmd.Wait()
+	}
+	return err
+}
+
+// curlError turns curl's exit codes into the errors a download from an
+// http origin would have failed with
+// https://curl.se/libcurl/c/libcurl-errors.html
+func curlError(err error, output string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	message := strings.TrimSpace(output)
+	switch exitErr.ExitCode() {
+	case 78: // CURLE_REMOTE_FILE_NOT_FOUND
+		return &StatusError{Status: http.StatusNotFound, Message: "source not found", Code: "source_not_found"}
+	case 63: // CURLE_FILESIZE_EXCEEDED
+		return sourceTooLarge("source is larger than the %d byte limit", MaxSourceBytes)
+	case 9, 67: // CURLE_REMOTE_ACCESS_DENIED, CURLE_LOGIN_DENIED
+		return statusErrorf(http.StatusBadGateway, "source server refused access: %s", message)
+	}
+	return errors.New("curl: " + message)
+}
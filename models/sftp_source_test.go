@@ -0,0 +1,95 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSftpSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a stand in for curl that sends back the config it was given
+	echo := filepath.Join(dir, "curl")
+	ioutil.WriteFile(echo, []byte("#!/bin/sh\ncat\n"), 0755)
+	missing := filepath.Join(dir, "curl-missing")
+	ioutil.WriteFile(missing, []byte("#!/bin/sh\necho 'curl: (78) No such file' >&2\nexit 78\n"), 0755)
+
+	allowed, logins := SourceAllowedNetworks, SftpSourceLogins
+	defer func() { SourceAllowedNetworks, SftpSourceLogins = allowed, logins }()
+	defer ConfigureDelegate("curl", "", "")
+	SftpSourceLogins, err = ParseSftpSourceLogins("sftp localhost firesize:pa\"ss hostkey=abc123\n")
+	assert.Equal(t, nil, err)
+
+	ConfigureDelegate("curl", echo, "")
+	_, err = fetchSource(context.Background(), "sftp://127.0.0.1/originals/cat.jpg", nil)
+	assert.Equal(t, 403, err.(*StatusError).Status)
+
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+	resp, err := fetchSource(context.Background(), "sftp://someone@localhost:2222/originals/cat.jpg", nil)
+	assert.Equal(t, nil, err)
+	config, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, nil, err)
+	for _, line := range []string{
+		`url = "sftp://localhost:2222/originals/cat.jpg"`,
+		`resolve = "localhost:2222:127.0.0.1"`,
+		`user = "firesize:pa\"ss"`,
+		`hostpubsha256 = "abc123"`,
+	} {
+		assert.T(t, strings.Contains(string(config), line+"\n"), line)
+	}
+
+	// a range in the path isn't expanded into many fetches
+	resp, err = fetchSource(context.Background(), "sftp://localhost/img[1-500].jpg", nil)
+	assert.Equal(t, nil, err)
+	config, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.T(t, strings.Contains(string(config), "\ngloboff\n"))
+	assert.T(t, strings.Contains(string(config), `url = "sftp://localhost/img[1-500].jpg"`), string(config))
+
+	// other hosts, and plain ftp to the same host, get no credentials
+	for _, source := range []string{"sftp://127.0.0.1/originals/cat.jpg", "ftp://localhost/originals/cat.jpg"} {
+		resp, err = fetchSource(context.Background(), source, nil)
+		assert.Equal(t, nil, err)
+		config, _ = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		assert.T(t, !strings.Contains(string(config), "user ="), source)
+	}
+
+	ConfigureDelegate("curl", missing, "")
+	resp, err = fetchSource(context.Background(), "ftp://127.0.0.1/originals/cat.jpg", nil)
+	assert.Equal(t, nil, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 404, err.(*StatusError).Status)
+}
+
+func TestParseSftpSourceLogins(t *testing.T) {
+	logins, err := ParseSftpSourceLogins(`
+sftp *.example.com firesize key=/etc/firesize/id_ed25519 hostkey=abc123
+ftp legacy.example.com firesize:secret
+`)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(logins))
+	assert.Equal(t, "/etc/firesize/id_ed25519", logins[0].KeyFile)
+	assert.Equal(t, "secret", logins[1].Password)
+
+	for _, config := range []string{
+		"sftp files.example.com firesize:secret",
+		"ftp legacy.example.com firesize:secret hostkey=abc123",
+		"http files.example.com firesize:secret",
+		"sftp files.example.com",
+	} {
+		_, err = ParseSftpSourceLogins(config)
+		assert.NotEqual(t, nil, err, config)
+	}
+}
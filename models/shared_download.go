@@ -0,0 +1,99 @@
+package models
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// DownloadShareWindow is how long a finished download of a source is kept
+// for transforms of it arriving just after, as the variants of a page
+// often do. Concurrent downloads of the same source are always shared
+var DownloadShareWindow = 2 * time.Second
+
+// recentDownloads are the finished downloads still in their share window,
+// each held until the window is over
+var recentDownloads = struct {
+	sync.Mutex
+	byKey map[string]*flight
+}{byKey: map[string]*flight{}}
+
+// sharedDownload downloads the source like downloadRemote, sharing one
+// download between every transform of the same source requested together
+// rather than only identical ones
+func sharedDownload(tempDir string, _ string, args *ProcessArgs) (string, error) {
+	if !isRemoteSource(args.Url) {
+		return downloadRemote(tempDir, "", args)
+	}
+	key := "download-" + sourceIdentity(args.Url)
+	inFile := filepath.Join(tempDir, "in")
+
+	recentDownloads.Lock()
+	f, recent := recentDownloads.byKey[key]
+	if recent {
+		inflight.Lock()
+		f.users++
+		inflight.Unlock()
+	}
+	recentDownloads.Unlock()
+
+	if recent {
+		grohl.Counter(1.0, "download.shared", 1)
+	} else {
+		var shared bool
+		var err error
+		f, shared, err = joinFlight(args.ctx(), key, func(ctx context.Context) (string, []string, func(), error) {
+			workspace, err := createTemporaryWorkspace()
+			if err != nil {
+				return "", nil, nil, err
+			}
+			downloadArgs := *args
+			downloadArgs.Context = ctx
+			filePath, err := downloadRemote(workspace, "", &downloadArgs)
+			return filePath, nil, func() { os.RemoveAll(workspace) }, err
+		})
+		if err != nil {
+			return inFile, err
+		}
+		if shared {
+			grohl.Counter(1.0, "download.shared", 1)
+		}
+		keepRecentDownload(key, f)
+	}
+	defer f.release()
+
+	// the pipeline never writes to its input so a link is as good as a copy
+	if err := os.Link(f.filePath, inFile); err != nil {
+		return inFile, copyFile(f.filePath, inFile)
+	}
+	return inFile, nil
+}
+
+// keepRecentDownload holds a finished download for DownloadShareWindow
+func keepRecentDownload(key string, f *flight) {
+	if DownloadShareWindow <= 0 {
+		return
+	}
+	recentDownloads.Lock()
+	defer recentDownloads.Unlock()
+	if _, ok := recentDownloads.byKey[key]; ok {
+		return
+	}
+	inflight.Lock()
+	f.users++
+	inflight.Unlock()
+	recentDownloads.byKey[key] = f
+
+	time.AfterFunc(DownloadShareWindow, func() {
+		recentDownloads.Lock()
+		if recentDownloads.byKey[key] == f {
+			delete(recentDownloads.byKey, key)
+		}
+		recentDownloads.Unlock()
+		f.release()
+	})
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSharedDownloads(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Write([]byte("GIF89a"))
+	}))
+	defer server.Close()
+
+	allowed, window := SourceAllowedNetworks, DownloadShareWindow
+	defer func() { SourceAllowedNetworks, DownloadShareWindow = allowed, window }()
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+	DownloadShareWindow = 100 * time.Millisecond
+
+	download := func() {
+		dir, _ := ioutil.TempDir("", "download")
+		defer os.RemoveAll(dir)
+		inFile, err := sharedDownload(dir, "", &ProcessArgs{Url: server.URL + "/cat.gif"})
+		assert.Equal(t, nil, err)
+		data, _ := ioutil.ReadFile(inFile)
+		assert.Equal(t, "GIF89a", string(data))
+	}
+
+	// variants requested together download the source once
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			download()
+		}()
+	}
+	for atomic.LoadInt32(&hits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	// and so do ones arriving just after
+	download()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	time.Sleep(150 * time.Millisecond)
+	download()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
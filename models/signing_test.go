@@ -0,0 +1,116 @@
+package models
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestVerifySignedArgs(t *testing.T) {
+	SigningKey = "secret"
+	defer func() { SigningKey = "" }()
+
+	url := "http://example.com/cat.jpg"
+	signature := SignPath("/500x300/g_center/" + url)
+
+	rest, err := VerifySignedArgs("s_"+signature+"/500x300/g_center/", url)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "500x300/g_center/", rest)
+
+	_, err = VerifySignedArgs("s_"+signature+"/500x301/g_center/", url)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = VerifySignedArgs("500x300/g_center/", url)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	rest, err = VerifySignedArgs("s_"+SignPath("/"+url)+"/", url)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "", rest)
+}
+
+func TestVerifySignedArgsWithKeyIds(t *testing.T) {
+	SigningKeys = ParseSigningKeys("old:secret1, new:secret2")
+	defer func() { SigningKeys = map[string]string{} }()
+
+	url := "http://example.com/cat.jpg"
+	for _, id := range []string{"old", "new"} {
+		signature := signPathWithKey(SigningKeys[id], "/128x/"+url)
+		rest, err := VerifySignedArgs("s_"+id+"_"+signature+"/128x/", url)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "128x/", rest)
+	}
+
+	signature := signPathWithKey("secret1", "/128x/"+url)
+	_, err := VerifySignedArgs("s_new_"+signature+"/128x/", url)
+	assert.Equal(t, ErrInvalidSignature, err)
+	_, err = VerifySignedArgs("s_gone_"+signature+"/128x/", url)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifySignedArgsExpiry(t *testing.T) {
+	SigningKey = "secret"
+	defer func() { SigningKey = "" }()
+
+	url := "http://example.com/cat.jpg"
+	future := "e_" + strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	rest, err := VerifySignedArgs("s_"+SignPath("/128x/"+future+"/"+url)+"/128x/"+future+"/", url)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "128x/", rest)
+
+	past := "e_" + strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	_, err = VerifySignedArgs("s_"+SignPath("/128x/"+past+"/"+url)+"/128x/"+past+"/", url)
+	assert.Equal(t, ErrSignatureExpired, err)
+}
+
+func TestTransformPath(t *testing.T) {
+	url := "http://example.com/cat.jpg"
+	assert.Equal(t, "/200x200/g_center/"+url, TransformPath([]string{"200x200", "g_center"}, url))
+
+	SigningKeys = map[string]string{"k2": "secret"}
+	SigningKeyId = "k2"
+	defer func() { SigningKeys, SigningKeyId = map[string]string{}, "" }()
+
+	path := TransformPath([]string{"200x200", "g_center"}, url)
+	assert.Equal(t, "/s_k2_", path[:6])
+	rest, err := VerifySignedArgs(path[1:len(path)-len(url)], url)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "200x200/g_center/", rest)
+}
+
+func TestVersionIsSigned(t *testing.T) {
+	SigningKey = "secret"
+	defer func() { SigningKey = "" }()
+
+	url := "http://example.com/cat.jpg"
+	signature := SignPath("/128x/v_2/" + url)
+	rest, err := VerifySignedArgs("s_"+signature+"/128x/v_2/", url)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "128x/v_2/", rest)
+
+	_, err = VerifySignedArgs("s_"+signature+"/128x/v_3/", url)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifySignedQuery(t *testing.T) {
+	SigningKey = "secret"
+	defer func() { SigningKey = "" }()
+
+	path := "/info/http://example.com/cat.jpg"
+	assert.Equal(t, nil, VerifySignedQuery(path, url.Values{"s": {SignPath(path)}}))
+	assert.Equal(t, ErrInvalidSignature, VerifySignedQuery(path, url.Values{}))
+	assert.Equal(t, ErrInvalidSignature, VerifySignedQuery("/palette/http://example.com/cat.jpg", url.Values{"s": {SignPath(path)}}))
+
+	// the rest of the query is signed too
+	query := url.Values{"url": {"http://example.com/cat.jpg"}, "e": {strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)}}
+	query.Set("s", SignPath("/hash?"+query.Encode()))
+	assert.Equal(t, nil, VerifySignedQuery("/hash", query))
+	query.Set("url", "http://example.com/dog.jpg")
+	assert.Equal(t, ErrInvalidSignature, VerifySignedQuery("/hash", query))
+
+	expired := url.Values{"url": {"http://example.com/cat.jpg"}, "e": {"1"}}
+	expired.Set("s", SignPath("/hash?"+expired.Encode()))
+	assert.Equal(t, ErrSignatureExpired, VerifySignedQuery("/hash", expired))
+}
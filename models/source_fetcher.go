@@ -0,0 +1,71 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SourceFetcher fetches sources with one url scheme. header carries any
+// Range and If-Range of a resumed download, which the fetcher must send
+// on. Supporting a new kind of storage takes a fetcher here
+type SourceFetcher interface {
+	Fetch(ctx context.Context, source string, header http.Header) (*http.Response, error)
+}
+
+// sourceFetchers are the fetchers of each source url scheme
+var sourceFetchers = map[string]SourceFetcher{
+	"http":   httpSourceFetcher{},
+	"https":  httpSourceFetcher{},
+	"s3":     s3SourceFetcher{},
+	"gs":     gcsSourceFetcher{},
+	"azblob": azblobSourceFetcher{},
+	"sftp":   curlSourceFetcher{},
+	"ftp":    curlSourceFetcher{},
+}
+
+// fetchSource GETs source with the fetcher for its scheme
+func fetchSource(ctx context.Context, source string, header http.Header) (*http.Response, error) {
+	fetcher, ok := sourceFetchers[strings.ToLower(strings.SplitN(source, ":", 2)[0])]
+	if !ok {
+		return nil, statusErrorf(http.StatusBadRequest, "unsupported source %s", source)
+	}
+	return fetcher.Fetch(ctx, source, header)
+}
+
+// isHttpSource is true for sources with a url clients can fetch themselves
+func isHttpSource(source string) bool {
+	scheme := strings.ToLower(strings.SplitN(source, ":", 2)[0])
+	return scheme == "http" || scheme == "https"
+}
+
+// httpSourceFetcher fetches sources from origins over http, held to the
+// source network restrictions and sending the configured SourceHeaders
+type httpSourceFetcher struct{}
+
+func (httpSourceFetcher) Fetch(ctx context.Context, source string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	setSourceHeaders(req)
+	copyHeader(req.Header, header)
+	return sourceClient.Do(req)
+}
+
+// storageClient fetches sources from object storage. It's only pointed at
+// endpoints the server was configured with rather than ones a caller
+// picked, so isn't held to the source network restrictions
+var storageClient = &http.Client{
+	Transport: &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+	},
+}
+
+func copyHeader(dst http.Header, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
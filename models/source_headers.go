@@ -0,0 +1,74 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// SourceHeader is a header sent when fetching sources from hosts matching
+// Host, or from every origin when Host is nil
+type SourceHeader struct {
+	Host  *HostPattern
+	Name  string
+	Value string
+}
+
+// SourceHeaders are sent with requests to http origins, so sources can
+// be fetched from origins that want credentials or block unknown agents
+var SourceHeaders []SourceHeader
+
+// ParseSourceHeaders reads one header per line, each "Name: value" for
+// every origin or "host Name: value" for hosts matching a glob or /regexp/
+// as in ParseHostPatterns. Later lines override earlier ones
+//
+//	User-Agent: firesize (+https://example.com)
+//	*.example.com Authorization: Bearer abc123
+func ParseSourceHeaders(config string) ([]SourceHeader, error) {
+	headers := []SourceHeader{}
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		header := SourceHeader{}
+		fields := strings.Fields(line)
+		if !strings.Contains(fields[0], ":") {
+			hosts := ParseHostPatterns(fields[0])
+			header.Host = &hosts[0]
+			line = strings.TrimSpace(line[len(fields[0]):])
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("source header %q isn't Name: value", line)
+		}
+		header.Name = http.CanonicalHeaderKey(strings.TrimSpace(line[:i]))
+		header.Value = strings.TrimSpace(line[i+1:])
+		if strings.ContainsAny(header.Name, " \t") {
+			return nil, fmt.Errorf("source header name %q is invalid", header.Name)
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+// setSourceHeaders adds the headers configured for req's host
+func setSourceHeaders(req *http.Request) {
+	for _, header := range SourceHeaders {
+		if header.Host == nil || matchSourceHost(req.URL.String(), []HostPattern{*header.Host}) {
+			req.Header.Set(header.Name, header.Value)
+		}
+	}
+}
+
+// redirectSourceHeaders carries the source headers over a redirect,
+// dropping those only meant for the host redirected from so credentials
+// for one origin are never sent to another
+func redirectSourceHeaders(req *http.Request) {
+	for _, header := range SourceHeaders {
+		if header.Host != nil {
+			req.Header.Del(header.Name)
+		}
+	}
+	setSourceHeaders(req)
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseSourceHeaders(t *testing.T) {
+	headers, err := ParseSourceHeaders("user-agent: firesize (+https://example.com)\n\n  *.example.com Authorization: Bearer abc:123\n")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(headers))
+	assert.T(t, headers[0].Host == nil)
+	assert.Equal(t, "User-Agent", headers[0].Name)
+	assert.Equal(t, "firesize (+https://example.com)", headers[0].Value)
+	assert.T(t, headers[1].Host.Match("img.example.com"))
+	assert.Equal(t, "Authorization", headers[1].Name)
+	assert.Equal(t, "Bearer abc:123", headers[1].Value)
+
+	_, err = ParseSourceHeaders("example.com Authorization")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSourceHeadersStayWithTheirHost(t *testing.T) {
+	var redirected http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = r.Header
+	}))
+	defer other.Close()
+	var origin http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin = r.Header
+		http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+	}))
+	defer server.Close()
+
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8,::1/128")
+	defer func() { SourceAllowedNetworks, SourceHeaders = nil, nil }()
+	SourceHeaders, _ = ParseSourceHeaders("User-Agent: firesize\n127.0.0.1 X-Origin-Token: s3cret")
+
+	resp, err := fetchSource(context.Background(), server.URL+"/cat.jpg", http.Header{"Range": {"bytes=10-"}})
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+	assert.Equal(t, "firesize", origin.Get("User-Agent"))
+	assert.Equal(t, "s3cret", origin.Get("X-Origin-Token"))
+	assert.Equal(t, "bytes=10-", origin.Get("Range"))
+	assert.Equal(t, "firesize", redirected.Get("User-Agent"))
+	assert.Equal(t, "", redirected.Get("X-Origin-Token"))
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SourceMaxRedirects is how many redirects are followed fetching a
+// source, 0 to refuse any. SourceSameHostRedirects only follows redirects
+// to the host the source was requested from, such as http to https
+var (
+	SourceMaxRedirects      = 10
+	SourceSameHostRedirects bool
+)
+
+// redirectSource decides whether to follow each redirect fetching a source.
+// Every hop is held to the source host rules like the first request, the
+// network rules already apply to every connection in dialSource
+func redirectSource(req *http.Request, via []*http.Request) error {
+	if len(via) > SourceMaxRedirects {
+		return &StatusError{
+			Status:  http.StatusBadGateway,
+			Message: "source redirected too many times",
+			Code:    "source_redirect",
+			Details: map[string]interface{}{"max_redirects": SourceMaxRedirects},
+		}
+	}
+	from, to := strings.ToLower(via[0].URL.Hostname()), strings.ToLower(req.URL.Hostname())
+	if SourceSameHostRedirects && from != to {
+		return &StatusError{
+			Status:  http.StatusBadGateway,
+			Message: "source redirected from " + from + " to another host " + to,
+			Code:    "source_redirect",
+		}
+	}
+	if err := checkSource(req.URL.String()); err != nil {
+		return err
+	}
+	redirectSourceHeaders(req)
+	return nil
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSourceRedirectPolicy(t *testing.T) {
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("moved"))
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hop":
+			http.Redirect(w, r, "/cat.jpg", http.StatusFound)
+		case "/moved":
+			http.Redirect(w, r, strings.Replace(other.URL, "127.0.0.1", "localhost", 1), http.StatusFound)
+		default:
+			w.Write([]byte("cat"))
+		}
+	}))
+	defer server.Close()
+
+	defer func(max int) {
+		SourceAllowedNetworks, SourceDenylist = nil, nil
+		SourceMaxRedirects, SourceSameHostRedirects = max, false
+	}(SourceMaxRedirects)
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8,::1/128")
+	fetch := func(path string) error {
+		resp, err := fetchSource(context.Background(), server.URL+path, nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	statusCode := func(err error) string {
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) {
+			return ""
+		}
+		return statusErr.Code
+	}
+
+	assert.Equal(t, nil, fetch("/hop"))
+	assert.Equal(t, nil, fetch("/moved"))
+
+	SourceMaxRedirects = 0
+	assert.Equal(t, "source_redirect", statusCode(fetch("/hop")))
+
+	SourceMaxRedirects, SourceSameHostRedirects = 10, true
+	assert.Equal(t, nil, fetch("/hop"))
+	assert.Equal(t, "source_redirect", statusCode(fetch("/moved")))
+
+	// every hop is held to the host rules
+	SourceSameHostRedirects = false
+	SourceDenylist = ParseHostPatterns("localhost")
+	var statusErr *StatusError
+	assert.T(t, errors.As(fetch("/moved"), &statusErr))
+	assert.Equal(t, http.StatusForbidden, statusErr.Status)
+}
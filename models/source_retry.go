@@ -0,0 +1,85 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SourceRetries is how many more times a source download is attempted
+// after a failure that's likely to pass, a dropped connection, a timeout
+// or one of SourceRetryStatuses, waiting SourceRetryBackoff before the
+// first retry and twice as long before each after that
+var (
+	SourceRetries       = 2
+	SourceRetryBackoff  = 250 * time.Millisecond
+	SourceRetryStatuses = map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	}
+)
+
+// ParseStatusCodes reads a comma separated list of status codes
+func ParseStatusCodes(config string) (map[int]bool, error) {
+	codes := map[int]bool{}
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		code, err := strconv.Atoi(entry)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("%q isn't a status code", entry)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// originUnavailable is the error for a response with one of
+// SourceRetryStatuses, keeping any Retry-After the origin asked for
+func originUnavailable(resp *http.Response) error {
+	details := map[string]interface{}{"origin_status": resp.StatusCode}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		details["retry_after"] = seconds
+	}
+	return &StatusError{
+		Status:  http.StatusBadGateway,
+		Message: fmt.Sprintf("origin responded with status %d", resp.StatusCode),
+		Code:    "origin_unavailable",
+		Details: details,
+	}
+}
+
+// sourceRetryWait is how long to wait before retrying a download that
+// failed with err on attempt, counting from 0, and whether to retry at all.
+// Errors for the client, like a refused host or a source that's too large,
+// won't change by trying again. A Retry-After longer than the backoff is
+// honored unless it would run past the request's deadline
+func sourceRetryWait(ctx context.Context, err error, attempt int) (time.Duration, bool) {
+	if err == nil || attempt >= SourceRetries || ctx.Err() != nil {
+		return 0, false
+	}
+	wait := SourceRetryBackoff << uint(attempt)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.Code != "origin_unavailable" && statusErr.Code != "origin_timeout" {
+			return 0, false
+		}
+		if seconds, ok := statusErr.Details["retry_after"].(int); ok {
+			if after := time.Duration(seconds) * time.Second; after > wait {
+				wait = after
+			}
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+		return 0, false
+	}
+	return wait, true
+}
@@ -0,0 +1,301 @@
+package models
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/technoweenie/grohl"
+)
+
+// SourceRoute sends sources whose detected MIME type matches Pattern, like
+// image/svg+xml or video/*, to Engine
+type SourceRoute struct {
+	Pattern string
+	Engine  string
+}
+
+// SourceRoutes pick the engine that decodes each source, the first whose
+// pattern matches wins. Sources matching none are left to ImageMagick
+var SourceRoutes []SourceRoute
+
+// sourceEngines turn a source into an image the rest of the pipeline can
+// process. Supporting a new media type takes an engine here and a route
+// to it
+var sourceEngines = map[string]processPipelineStep{
+	"imagick":     func(tempDir string, inFile string, args *ProcessArgs) (string, error) { return inFile, nil },
+	"rsvg":        rasterizeSvg,
+	"ghostscript": rasterizePdf,
+	"ffmpeg":      extractVideoFrame,
+}
+
+// ParseSourceRoutes reads comma separated type=engine pairs, e.g.
+// "image/svg+xml=rsvg,application/pdf=ghostscript,video/*=ffmpeg"
+func ParseSourceRoutes(s string) ([]SourceRoute, error) {
+	routes := []SourceRoute{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("source route %q isn't type=engine", pair)
+		}
+		route := SourceRoute{Pattern: strings.ToLower(strings.TrimSpace(parts[0])), Engine: strings.TrimSpace(parts[1])}
+		if _, ok := sourceEngines[route.Engine]; !ok {
+			return nil, fmt.Errorf("unknown source engine %q", route.Engine)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// sourceEngine is the name of the engine for a MIME type
+func sourceEngine(mimeType string) string {
+	for _, route := range SourceRoutes {
+		if route.Pattern == "*" || route.Pattern == "*/*" || route.Pattern == mimeType ||
+			(strings.HasSuffix(route.Pattern, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(route.Pattern, "*"))) {
+			return route.Engine
+		}
+	}
+	return "imagick"
+}
+
+// routeSource hands the source to the engine routed its detected type
+func routeSource(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if len(SourceRoutes) == 0 {
+		return inFile, nil
+	}
+	mimeType, err := detectSourceType(inFile)
+	if err != nil {
+		return inFile, err
+	}
+	engine := sourceEngine(mimeType)
+	if engine != "imagick" {
+		grohl.Log(grohl.Data{
+			"processor": engine,
+			"step":      "route",
+			"type":      mimeType,
+		})
+	}
+	return sourceEngines[engine](tempDir, inFile, args)
+}
+
+// detectSourceType sniffs the MIME type of a source from its first bytes,
+// recognizing SVGs, which are plain XML to http.DetectContentType
+func detectSourceType(inFile string) (string, error) {
+	f, err := os.Open(inFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+
+	mimeType := strings.SplitN(http.DetectContentType(head), ";", 2)[0]
+	if (mimeType == "text/xml" || mimeType == "text/plain") && strings.Contains(string(head), "<svg") {
+		return "image/svg+xml", nil
+	}
+	return mimeType, nil
+}
+
+// pdfDensity is the resolution PDFs are rendered at, pdfProbeDensity the
+// one their page size is measured at before that
+const pdfDensity = 150
+const pdfProbeDensity = 9
+
+// rasterizeSvg renders an SVG at the requested width when there is one,
+// so it's drawn sharp rather than scaled up from its nominal size. The
+// size it would render at is held to the source limits first
+func rasterizeSvg(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if width, height, ok := svgSize(inFile); ok {
+		if args.Width > 0 {
+			width, height = float64(args.Width), height*float64(args.Width)/width
+		}
+		if err := checkRenderLimits(width, height); err != nil {
+			return inFile, err
+		}
+	}
+
+	outFile := filepath.Join(tempDir, "rasterized.png")
+	cmdArgs := []string{"-f", "png"}
+	if args.Width > 0 {
+		cmdArgs = append(cmdArgs, "-w", strconv.Itoa(args.Width), "--keep-aspect-ratio")
+	}
+	cmdArgs = append(cmdArgs, "-o", outFile, inFile)
+	return outFile, runSourceEngine(args, "rsvg-convert", cmdArgs)
+}
+
+// rasterizePdf renders the first page of a PDF. When there's a pixel
+// limit the page is rendered small first to measure it, so oversized
+// pages are refused before they're rendered in full
+func rasterizePdf(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if MaxSourcePixels > 0 {
+		probeFile := filepath.Join(tempDir, "probe.png")
+		if err := runSourceEngine(args, "gs", pdfArgs(probeFile, inFile, pdfProbeDensity)); err != nil {
+			return inFile, err
+		}
+		output, err := identify(args.ctx(), "-ping", "-format", "%w %h", probeFile)
+		if err != nil {
+			return inFile, err
+		}
+		var width, height float64
+		fmt.Sscan(output, &width, &height)
+		scale := float64(pdfDensity) / pdfProbeDensity
+		if err = checkRenderLimits(width*scale, height*scale); err != nil {
+			return inFile, err
+		}
+	}
+
+	outFile := filepath.Join(tempDir, "rasterized.png")
+	return outFile, runSourceEngine(args, "gs", pdfArgs(outFile, inFile, pdfDensity))
+}
+
+func pdfArgs(outFile string, inFile string, density int) []string {
+	return []string{
+		"-q", "-dSAFER", "-dBATCH", "-dNOPAUSE",
+		"-sDEVICE=png16m", "-r" + strconv.Itoa(density), "-dFirstPage=1", "-dLastPage=1",
+		"-sOutputFile=" + outFile, inFile,
+	}
+}
+
+// checkRenderLimits holds the size a vector source would be rendered at to
+// the limits checkSourceLimits holds rendered sources to
+func checkRenderLimits(width float64, height float64) error {
+	return checkImageLimits(int64(math.Ceil(width)), int64(math.Ceil(height)), 1)
+}
+
+// svgLengthUnits are the CSS pixels in each unit an SVG's size can be
+// given in
+var svgLengthUnits = map[string]float64{
+	"": 1, "px": 1, "pt": 96.0 / 72, "pc": 16, "in": 96, "cm": 96 / 2.54, "mm": 96 / 25.4, "em": 16, "ex": 8,
+}
+
+// svgSize reads the nominal size of an SVG from the width, height and
+// viewBox of its root element. ok is false when it has none usable, as
+// with percentages
+func svgSize(inFile string) (width float64, height float64, ok bool) {
+	f, err := os.Open(inFile)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	decoder := xml.NewDecoder(f)
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		root, isElement := token.(xml.StartElement)
+		if !isElement {
+			continue
+		}
+		if root.Name.Local != "svg" {
+			return 0, 0, false
+		}
+
+		var viewWidth, viewHeight float64
+		for _, attr := range root.Attr {
+			switch attr.Name.Local {
+			case "width":
+				width = svgLength(attr.Value)
+			case "height":
+				height = svgLength(attr.Value)
+			case "viewBox":
+				var x, y float64
+				fields := strings.FieldsFunc(attr.Value, func(r rune) bool { return r == ',' || r == ' ' })
+				if len(fields) == 4 {
+					fmt.Sscan(strings.Join(fields, " "), &x, &y, &viewWidth, &viewHeight)
+				}
+			}
+		}
+		if viewWidth > 0 && viewHeight > 0 {
+			switch {
+			case width == 0 && height == 0:
+				width, height = viewWidth, viewHeight
+			case width == 0:
+				width = height * viewWidth / viewHeight
+			case height == 0:
+				height = width * viewHeight / viewWidth
+			}
+		}
+		return width, height, width > 0 && height > 0
+	}
+}
+
+// svgLength is an SVG length in pixels, 0 for ones that can't be known
+// without rendering
+func svgLength(value string) float64 {
+	value = strings.TrimSpace(value)
+	end := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if end < 0 {
+		end = len(value)
+	}
+	n, err := strconv.ParseFloat(value[:end], 64)
+	unit, known := svgLengthUnits[value[end:]]
+	if err != nil || !known {
+		return 0
+	}
+	return n * unit
+}
+
+// videoDemuxers are the ffmpeg demuxers for the video types sources can
+// be detected as
+var videoDemuxers = map[string]string{
+	"video/mp4":       "mov",
+	"video/webm":      "matroska",
+	"video/avi":       "avi",
+	"video/mpeg":      "mpeg",
+	"application/ogg": "ogg",
+}
+
+// extractVideoFrame takes the first frame of a video as a still. ffmpeg
+// is held to the demuxer for the detected type and to reading the file
+// itself, as playlists like HLS and concat could otherwise have it read
+// other local files or fetch urls
+func extractVideoFrame(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	mimeType, err := detectSourceType(inFile)
+	if err != nil {
+		return inFile, err
+	}
+	demuxer, ok := videoDemuxers[mimeType]
+	if !ok {
+		return inFile, statusErrorf(http.StatusUnsupportedMediaType, "%s isn't a supported video type", mimeType)
+	}
+
+	outFile := filepath.Join(tempDir, "frame.png")
+	return outFile, runSourceEngine(args, "ffmpeg", []string{
+		"-y", "-protocol_whitelist", "file", "-f", demuxer, "-i", inFile,
+		"-frames:v", "1", "-f", "image2", outFile,
+	})
+}
+
+func runSourceEngine(args *ProcessArgs, name string, cmdArgs []string) error {
+	ctx, cancel := context.WithTimeout(args.ctx(), delegateTimeout(name))
+	defer cancel()
+	cmd := delegateCommand(ctx, name, cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err := runLimited(ctx, cmd, args.Priority)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": name,
+			"step":      "route",
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+	}
+	return err
+}
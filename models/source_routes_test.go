@@ -0,0 +1,150 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseSourceRoutes(t *testing.T) {
+	routes, err := ParseSourceRoutes("image/svg+xml=rsvg, video/*=ffmpeg")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []SourceRoute{{"image/svg+xml", "rsvg"}, {"video/*", "ffmpeg"}}, routes)
+
+	_, err = ParseSourceRoutes("application/pdf=acrobat")
+	assert.NotEqual(t, nil, err)
+	_, err = ParseSourceRoutes("application/pdf")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestSourceEngine(t *testing.T) {
+	defer func() { SourceRoutes = nil }()
+	SourceRoutes, _ = ParseSourceRoutes("image/svg+xml=rsvg,video/*=ffmpeg,application/pdf=ghostscript")
+	assert.Equal(t, "rsvg", sourceEngine("image/svg+xml"))
+	assert.Equal(t, "ffmpeg", sourceEngine("video/webm"))
+	assert.Equal(t, "ghostscript", sourceEngine("application/pdf"))
+	assert.Equal(t, "imagick", sourceEngine("image/jpeg"))
+}
+
+func TestDetectSourceType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for contents, expected := range map[string]string{
+		`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`: "image/svg+xml",
+		"%PDF-1.7\n": "application/pdf",
+		"GIF89a":     "image/gif",
+	} {
+		inFile := filepath.Join(dir, "in")
+		ioutil.WriteFile(inFile, []byte(contents), 0644)
+		mimeType, err := detectSourceType(inFile)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, expected, mimeType)
+	}
+}
+
+func TestSvgSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type size struct {
+		width, height float64
+		ok            bool
+	}
+	for contents, expected := range map[string]size{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="200" height="100"/>`: {200, 100, true},
+		`<?xml version="1.0"?><svg width="1in" height="72pt"/>`:              {96, 96, true},
+		`<svg viewBox="0 0 400 300"/>`:                                       {400, 300, true},
+		`<svg width="800" viewBox="0,0,400,300"/>`:                           {800, 600, true},
+		`<svg width="100%" height="100%"/>`:                                  {0, 0, false},
+		`<html><svg width="200" height="100"/></html>`:                       {0, 0, false},
+	} {
+		inFile := filepath.Join(dir, "in.svg")
+		ioutil.WriteFile(inFile, []byte(contents), 0644)
+		width, height, ok := svgSize(inFile)
+		assert.Equal(t, expected, size{width, height, ok})
+	}
+}
+
+func TestVectorSourcesCheckLimitsBeforeRendering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the renderers record that they ran, the probe page measures 1500
+	// inches square
+	rendered := filepath.Join(dir, "rendered")
+	renderer := filepath.Join(dir, "render")
+	ioutil.WriteFile(renderer, []byte("#!/bin/sh\necho \"$@\" >> "+rendered+"\n"), 0755)
+	identify := filepath.Join(dir, "identify")
+	ioutil.WriteFile(identify, []byte("#!/bin/sh\necho 13500 13500\n"), 0755)
+	for name, path := range map[string]string{"rsvg-convert": renderer, "gs": renderer, "identify": identify} {
+		defer ConfigureDelegate(name, "", "")
+		ConfigureDelegate(name, path, "")
+	}
+
+	svgFile := filepath.Join(dir, "in.svg")
+	ioutil.WriteFile(svgFile, []byte(`<svg width="100000" height="100000"/>`), 0644)
+	args := &ProcessArgs{}
+	_, err = rasterizeSvg(dir, svgFile, args)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "source_too_large", err.(*StatusError).Code)
+	_, err = os.Stat(rendered)
+	assert.T(t, os.IsNotExist(err))
+
+	// a small width keeps the render within the limit
+	args.Width = 640
+	_, err = rasterizeSvg(dir, svgFile, args)
+	assert.Equal(t, nil, err)
+
+	os.Remove(rendered)
+	pdfFile := filepath.Join(dir, "in.pdf")
+	ioutil.WriteFile(pdfFile, []byte("%PDF-1.7\n"), 0644)
+	_, err = rasterizePdf(dir, pdfFile, args)
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "source_too_large", err.(*StatusError).Code)
+	runs, _ := ioutil.ReadFile(rendered)
+	assert.Equal(t, 1, strings.Count(string(runs), "\n"))
+	assert.T(t, strings.Contains(string(runs), "-r9 "))
+}
+
+func TestExtractVideoFramePinsTheDemuxer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ran := filepath.Join(dir, "ran")
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	ioutil.WriteFile(ffmpeg, []byte("#!/bin/sh\necho \"$@\" > "+ran+"\n"), 0755)
+	defer ConfigureDelegate("ffmpeg", "", "")
+	ConfigureDelegate("ffmpeg", ffmpeg, "")
+
+	inFile := filepath.Join(dir, "in")
+	ioutil.WriteFile(inFile, []byte("\x1a\x45\xdf\xa3 webm"), 0644)
+	_, err = extractVideoFrame(dir, inFile, &ProcessArgs{})
+	assert.Equal(t, nil, err)
+	cmdArgs, _ := ioutil.ReadFile(ran)
+	assert.T(t, strings.HasPrefix(string(cmdArgs), "-y -protocol_whitelist file -f matroska -i "+inFile+" "))
+
+	// an HLS playlist isn't a video ffmpeg may open
+	os.Remove(ran)
+	ioutil.WriteFile(inFile, []byte("#EXTM3U\n#EXTINF:1,\nfile:///etc/passwd\n"), 0644)
+	_, err = extractVideoFrame(dir, inFile, &ProcessArgs{})
+	assert.Equal(t, 415, err.(*StatusError).Status)
+	_, err = os.Stat(ran)
+	assert.T(t, os.IsNotExist(err))
+}
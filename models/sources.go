@@ -0,0 +1,275 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HostPattern matches source hostnames by glob, e.g. *.example.com, or by
+// regular expression when written between slashes, e.g. /^img\d+\./
+type HostPattern struct {
+	glob string
+	rgx  *regexp.Regexp
+}
+
+func (p HostPattern) Match(host string) bool {
+	if p.rgx != nil {
+		return p.rgx.MatchString(host)
+	}
+	ok, _ := path.Match(p.glob, host)
+	return ok
+}
+
+// SourceAllowlist, when not empty, limits the hosts images are fetched
+// from. SourceDenylist hosts are never fetched from
+var SourceAllowlist []HostPattern
+var SourceDenylist []HostPattern
+
+// ParseHostPatterns reads a comma separated list of globs and /regexps/
+func ParseHostPatterns(config string) []HostPattern {
+	patterns := []HostPattern{}
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+			patterns = append(patterns, HostPattern{rgx: regexp.MustCompile(entry[1 : len(entry)-1])})
+		} else {
+			patterns = append(patterns, HostPattern{glob: strings.ToLower(entry)})
+		}
+	}
+	return patterns
+}
+
+// matchSourceHost is true if the host of source matches any of patterns
+func matchSourceHost(source string, patterns []HostPattern) bool {
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, p := range patterns {
+		if p.Match(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSource refuses urls whose host isn't allowed so firesize can't be
+// used as an open proxy
+func checkSource(source string) error {
+	if len(SourceAllowlist) == 0 && len(SourceDenylist) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil || u.Hostname() == "" {
+		return statusErrorf(http.StatusBadRequest, "invalid source url")
+	}
+	host := strings.ToLower(u.Hostname())
+
+	if matchSourceHost(source, SourceDenylist) ||
+		(len(SourceAllowlist) > 0 && !matchSourceHost(source, SourceAllowlist)) {
+		return statusErrorf(http.StatusForbidden, "source host %s is not allowed", host)
+	}
+	return nil
+}
+
+// BucketAllowlist names the buckets or containers a storage source may be
+// fetched from, as globs or /regexps/ as in ParseHostPatterns. An empty
+// list allows none, so the server's credentials can't be used to read
+// buckets that were never meant to be served, like the result cache's
+type BucketAllowlist []HostPattern
+
+// check refuses bucket, named kind in the error, unless it's allowed
+func (l BucketAllowlist) check(kind string, bucket string) error {
+	bucket = strings.ToLower(bucket)
+	for _, p := range l {
+		if p.Match(bucket) {
+			return nil
+		}
+	}
+	return statusErrorf(http.StatusForbidden, "%s %s is not allowed", kind, bucket)
+}
+
+// SourceChecksum has sources from hosts matching Host verified against
+// the sha256 the origin sends in Header, e.g. x-amz-meta-sha256, hex or
+// base64 encoded
+type SourceChecksum struct {
+	Host   HostPattern
+	Header string
+}
+
+// SourceChecksums are the hosts whose sources must match their checksum
+// before they're processed
+var SourceChecksums []SourceChecksum
+
+// ParseSourceChecksums reads a comma separated list of host=header pairs,
+// where host is a glob or /regexp/ as in ParseHostPatterns
+func ParseSourceChecksums(config string) []SourceChecksum {
+	checksums := []SourceChecksum{}
+	for _, entry := range strings.Split(config, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			continue
+		}
+		hosts := ParseHostPatterns(entry[:i])
+		header := strings.TrimSpace(entry[i+1:])
+		if len(hosts) == 0 || header == "" {
+			continue
+		}
+		checksums = append(checksums, SourceChecksum{Host: hosts[0], Header: header})
+	}
+	return checksums
+}
+
+// sourceChecksumHeader returns the header holding the checksum of source,
+// or "" if its host isn't verified
+func sourceChecksumHeader(source string) string {
+	for _, checksum := range SourceChecksums {
+		if matchSourceHost(source, []HostPattern{checksum.Host}) {
+			return checksum.Header
+		}
+	}
+	return ""
+}
+
+// checkSourceChecksum refuses downloads that don't hash to expected, the
+// value of header in the origin's response. A missing checksum is refused
+// too, as the source can't be trusted without one
+func checkSourceChecksum(filePath string, header string, expected string) error {
+	expected = strings.Trim(strings.TrimSpace(expected), `"`)
+	if expected == "" {
+		return statusErrorf(http.StatusBadGateway, "source has no %s checksum", header)
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, f); err != nil {
+		return err
+	}
+	sum := hash.Sum(nil)
+
+	if strings.EqualFold(expected, hex.EncodeToString(sum)) ||
+		expected == base64.StdEncoding.EncodeToString(sum) {
+		return nil
+	}
+	return statusErrorf(http.StatusBadGateway, "source doesn't match its %s checksum", header)
+}
+
+// SourceAllowedNetworks are CIDRs sources may be fetched from even though
+// they are private, e.g. an origin on the internal network
+var SourceAllowedNetworks []*net.IPNet
+
+// ParseNetworks reads a comma separated list of CIDRs
+func ParseNetworks(config string) []*net.IPNet {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// carrier grade NAT and "this network" aren't covered by net.IP's helpers
+var reservedNetworks = ParseNetworks("0.0.0.0/8,100.64.0.0/10")
+
+// checkSourceIP refuses addresses on private, loopback and link-local
+// networks, such as the 169.254.169.254 metadata service, unless allowed
+func checkSourceIP(ip net.IP) error {
+	for _, network := range SourceAllowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	internal := ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+	for _, network := range reservedNetworks {
+		internal = internal || network.Contains(ip)
+	}
+	if internal {
+		return statusErrorf(http.StatusForbidden, "source address %s is not allowed", ip)
+	}
+	return nil
+}
+
+// resolveSourceIP resolves host to its first allowed address
+func resolveSourceIP(ctx context.Context, host string) (net.IP, error) {
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	err = statusErrorf(http.StatusForbidden, "source host %s is not allowed", host)
+	for _, ip := range ips {
+		if err = checkSourceIP(ip); err == nil {
+			return ip, nil
+		}
+	}
+	return nil, err
+}
+
+var sourceDialer = &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+
+// dialSource resolves the host itself and connects to the first allowed
+// address, so a name can't resolve differently between check and connect
+func dialSource(ctx context.Context, network string, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	err = statusErrorf(http.StatusForbidden, "source host %s is not allowed", host)
+	for _, ip := range ips {
+		if checkErr := checkSourceIP(ip); checkErr != nil {
+			err = checkErr
+			continue
+		}
+		var conn net.Conn
+		conn, err = sourceDialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// sourceClient fetches source images. Every connection, including those
+// for redirects, goes through dialSource
+var sourceClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         dialSource,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+	},
+	CheckRedirect: redirectSource,
+}
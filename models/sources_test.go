@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCheckSource(t *testing.T) {
+	SourceAllowlist = ParseHostPatterns("*.example.com, /^img\\d+\\.cdn\\.net$/")
+	SourceDenylist = ParseHostPatterns("private.example.com")
+	defer func() { SourceAllowlist, SourceDenylist = nil, nil }()
+
+	assert.Equal(t, nil, checkSource("http://www.example.com/cat.jpg"))
+	assert.Equal(t, nil, checkSource("https://IMG12.cdn.net/cat.jpg"))
+
+	for _, source := range []string{
+		"http://example.org/cat.jpg",
+		"http://private.example.com/cat.jpg",
+		"http://img.cdn.net/cat.jpg",
+	} {
+		err, ok := checkSource(source).(*StatusError)
+		assert.T(t, ok)
+		assert.Equal(t, 403, err.Status)
+	}
+}
+
+func TestCheckSourceWithoutLists(t *testing.T) {
+	assert.Equal(t, nil, checkSource("http://anywhere.test/cat.jpg"))
+}
+
+func TestCheckSourceIP(t *testing.T) {
+	for _, blocked := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.169.254", "100.64.0.1", "::1", "fe80::1", "fd00::1", "0.0.0.0"} {
+		assert.NotEqual(t, nil, checkSourceIP(net.ParseIP(blocked)), blocked)
+	}
+	assert.Equal(t, nil, checkSourceIP(net.ParseIP("93.184.216.34")))
+
+	SourceAllowedNetworks = ParseNetworks("10.1.0.0/16")
+	defer func() { SourceAllowedNetworks = nil }()
+	assert.Equal(t, nil, checkSourceIP(net.ParseIP("10.1.2.3")))
+}
+
+func TestSourceClientRefusesLoopback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer server.Close()
+
+	_, err := sourceClient.Get(server.URL)
+	var statusErr *StatusError
+	assert.T(t, errors.As(err, &statusErr))
+	assert.Equal(t, 403, statusErr.Status)
+
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+	defer func() { SourceAllowedNetworks = nil }()
+	resp, err := sourceClient.Get(server.URL)
+	assert.Equal(t, nil, err)
+	resp.Body.Close()
+}
+
+func TestDownloadRemoteEnforcesMaxSourceBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// no Content-Length so the limit is only found while copying
+		w.(http.Flusher).Flush()
+		w.Write(make([]byte, 20))
+	}))
+	defer server.Close()
+
+	SourceAllowedNetworks = ParseNetworks("127.0.0.0/8")
+	defer func(max int64) { SourceAllowedNetworks, MaxSourceBytes = nil, max }(MaxSourceBytes)
+	tempDir, _ := ioutil.TempDir("", "download")
+	defer os.RemoveAll(tempDir)
+
+	MaxSourceBytes = 20
+	_, err := downloadRemote(tempDir, "", &ProcessArgs{Url: server.URL})
+	assert.Equal(t, nil, err)
+
+	MaxSourceBytes = 10
+	_, err = downloadRemote(tempDir, "", &ProcessArgs{Url: server.URL})
+	statusErr, ok := err.(*StatusError)
+	assert.T(t, ok)
+	assert.Equal(t, 413, statusErr.Status)
+}
+
+func TestParseSourceChecksums(t *testing.T) {
+	checksums := ParseSourceChecksums("*.s3.amazonaws.com=x-amz-meta-sha256, /^cdn\\d+\\./=X-Checksum,broken")
+	assert.Equal(t, 2, len(checksums))
+	SourceChecksums = checksums
+	defer func() { SourceChecksums = nil }()
+
+	assert.Equal(t, "x-amz-meta-sha256", sourceChecksumHeader("https://bucket.s3.amazonaws.com/cat.jpg"))
+	assert.Equal(t, "X-Checksum", sourceChecksumHeader("http://cdn2.example.com/cat.jpg"))
+	assert.Equal(t, "", sourceChecksumHeader("http://example.com/cat.jpg"))
+}
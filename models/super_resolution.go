@@ -0,0 +1,180 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// SuperResolutionBackend upscales small sources for enlarge_sr before
+// they're resized: an http(s) url the source is POSTed to, answering with
+// the upscaled image, or "realesrgan" to run realesrgan-ncnn-vulkan. Empty
+// turns enlarge_sr off
+var SuperResolutionBackend string
+
+// SuperResolutionMaxPixels is the largest source sent to the backend, and
+// SuperResolutionRateLimit how many are sent a minute across every request,
+// 0 for no limit. Sources over either are resized as usual, marked degraded
+var (
+	SuperResolutionMaxPixels = 512 * 512
+	SuperResolutionRateLimit = 60
+)
+
+// superResolutionScale is how many times larger the backend makes sources
+const superResolutionScale = 4
+
+var superResolutionTimeout = 30 * time.Second
+
+var superResolutionClient = &http.Client{Timeout: superResolutionTimeout}
+
+var enlargeRgx = regexp.MustCompile(`^enlarge_(sr)$`)
+
+// superResolutionWindow counts the sources sent to the backend in the
+// current minute
+var superResolutionWindow = struct {
+	sync.Mutex
+	rateWindow
+}{}
+
+// CheckEnlarge returns an error if enlarge_sr is asked for without a
+// backend to do it
+func (p *ProcessArgs) CheckEnlarge() error {
+	if p.Enlarge == "sr" && SuperResolutionBackend == "" {
+		return errors.New("super resolution isn't enabled")
+	}
+	return nil
+}
+
+// allowSuperResolution counts a source against SuperResolutionRateLimit,
+// returning false once this minute's are used up
+func allowSuperResolution(now time.Time) bool {
+	if SuperResolutionRateLimit <= 0 {
+		return true
+	}
+	superResolutionWindow.Lock()
+	defer superResolutionWindow.Unlock()
+	if now.Sub(superResolutionWindow.start) >= time.Minute {
+		superResolutionWindow.rateWindow = rateWindow{start: now}
+	}
+	if superResolutionWindow.count >= SuperResolutionRateLimit {
+		return false
+	}
+	superResolutionWindow.count++
+	return true
+}
+
+// superResolve upscales a still source smaller than the requested size
+// with the backend, so enlarging it invents detail rather than blurring.
+// It never fails the request: a source that can't be upscaled is resized
+// as usual and the response marked degraded
+func superResolve(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if args.Enlarge != "sr" || SuperResolutionBackend == "" {
+		return inFile, nil
+	}
+	if args.Animated {
+		args.degrade("super-resolution-animated")
+		return inFile, nil
+	}
+	width, height, err := identifyDimensions(args.ctx(), inFile)
+	if err != nil {
+		return inFile, err
+	}
+	if args.Width <= width && args.Height <= height {
+		return inFile, nil
+	}
+	if width*height > SuperResolutionMaxPixels {
+		args.degrade("super-resolution-too-large")
+		return inFile, nil
+	}
+	if !allowSuperResolution(time.Now()) {
+		grohl.Counter(1.0, "super_resolution.rate_limited", 1)
+		args.degrade("super-resolution-rate-limited")
+		return inFile, nil
+	}
+
+	ctx, cancel := context.WithTimeout(args.ctx(), superResolutionTimeout)
+	defer cancel()
+	outFile := filepath.Join(tempDir, "sr.png")
+	start := time.Now()
+	if SuperResolutionBackend == "realesrgan" {
+		err = runRealesrgan(ctx, inFile, outFile, args)
+	} else {
+		err = postSuperResolution(ctx, inFile, outFile)
+	}
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"step":    "super-resolve",
+			"backend": SuperResolutionBackend,
+			"failure": err,
+		})
+		args.degrade("super-resolution-failed")
+		return inFile, nil
+	}
+	grohl.Counter(1.0, "super_resolution.ms", int(time.Since(start)/time.Millisecond))
+	return outFile, nil
+}
+
+func runRealesrgan(ctx context.Context, inFile string, outFile string, args *ProcessArgs) error {
+	cmdArgs := []string{"-i", inFile, "-o", outFile, "-s", strconv.Itoa(superResolutionScale), "-f", "png"}
+	cmd := delegateCommand(ctx, "realesrgan", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	if err := runLimited(ctx, cmd, args.Priority); err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(outErr.String()))
+	}
+	return nil
+}
+
+// postSuperResolution sends inFile to the backend url and saves the
+// upscaled image it answers with, no larger than MaxSourceBytes
+func postSuperResolution(ctx context.Context, inFile string, outFile string) error {
+	data, err := ioutil.ReadFile(inFile)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", SuperResolutionBackend, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+	req.Header.Set("X-Firesize-Scale", strconv.Itoa(superResolutionScale))
+	resp, err := superResolutionClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("super resolution backend responded with status %d", resp.StatusCode)
+	}
+
+	out, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	body := io.Reader(resp.Body)
+	if MaxSourceBytes > 0 {
+		body = io.LimitReader(resp.Body, MaxSourceBytes+1)
+	}
+	n, err := io.Copy(out, body)
+	if err != nil {
+		return err
+	}
+	if n == 0 || (MaxSourceBytes > 0 && n > MaxSourceBytes) {
+		return fmt.Errorf("super resolution backend sent %d bytes", n)
+	}
+	return nil
+}
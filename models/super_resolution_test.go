@@ -0,0 +1,80 @@
+package models
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestEnlargeArgs(t *testing.T) {
+	args := NewProcessArgs([]string{"1024x", "enlarge_sr"}, imgUrl)
+	assert.Equal(t, "sr", args.Enlarge)
+	assert.NotEqual(t, NewProcessArgs([]string{"1024x"}, imgUrl).CacheKey(), args.CacheKey())
+	_, ok := mipmapBase(args)
+	assert.T(t, !ok)
+
+	defer func() { SuperResolutionBackend = "" }()
+	assert.Equal(t, "super resolution isn't enabled", args.CheckEnlarge().Error())
+	SuperResolutionBackend = "realesrgan"
+	assert.Equal(t, nil, args.CheckEnlarge())
+}
+
+func TestSuperResolutionRateLimit(t *testing.T) {
+	defer func(limit int) { SuperResolutionRateLimit = limit }(SuperResolutionRateLimit)
+	SuperResolutionRateLimit = 2
+	now := time.Now()
+	assert.T(t, allowSuperResolution(now))
+	assert.T(t, allowSuperResolution(now))
+	assert.T(t, !allowSuperResolution(now.Add(30*time.Second)))
+	assert.T(t, allowSuperResolution(now.Add(time.Minute)))
+}
+
+func TestSuperResolutionBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inFile := filepath.Join(dir, "in")
+	ioutil.WriteFile(inFile, []byte("\x89PNG\r\n\x1a\nsmall"), 0644)
+	outFile := filepath.Join(dir, "sr.png")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path == "/overloaded" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Content-Type") != "image/png" || r.Header.Get("X-Firesize-Scale") != "4" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write(append(body, " but larger"...))
+	}))
+	defer backend.Close()
+	defer func() { SuperResolutionBackend = "" }()
+	SuperResolutionBackend = backend.URL
+	assert.Equal(t, nil, postSuperResolution(context.Background(), inFile, outFile))
+	data, _ := ioutil.ReadFile(outFile)
+	assert.Equal(t, "\x89PNG\r\n\x1a\nsmall but larger", string(data))
+
+	SuperResolutionBackend = backend.URL + "/overloaded"
+	assert.NotEqual(t, nil, postSuperResolution(context.Background(), inFile, outFile))
+
+	// a stand in for realesrgan-ncnn-vulkan that copies -i to -o
+	fake := filepath.Join(dir, "realesrgan")
+	ioutil.WriteFile(fake, []byte("#!/bin/sh\ncp \"$2\" \"$4\"\n"), 0755)
+	ConfigureDelegate("realesrgan", fake, "")
+	defer ConfigureDelegate("realesrgan", "", "")
+	os.Remove(outFile)
+	assert.Equal(t, nil, runRealesrgan(context.Background(), inFile, outFile, &ProcessArgs{}))
+	data, _ = ioutil.ReadFile(outFile)
+	assert.Equal(t, "\x89PNG\r\n\x1a\nsmall", string(data))
+}
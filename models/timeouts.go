@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// DownloadTimeout bounds each attempt at fetching a source from its
+// origin, and IdentifyTimeout, ConvertTimeout and FfmpegTimeout each run of
+// those delegates. The defaults are low as a request can run several of
+// them, and in a Heroku environment there is a hard limit of 30secs before
+// it's simply killed
+var (
+	DownloadTimeout = 15 * time.Second
+	IdentifyTimeout = 10 * time.Second
+	ConvertTimeout  = 10 * time.Second
+	FfmpegTimeout   = 10 * time.Second
+)
+
+// delegateTimeout is how long a run of the named delegate may take. Other
+// renderers, like rsvg and ghostscript, get as long as convert
+func delegateTimeout(name string) time.Duration {
+	switch name {
+	case "identify":
+		return IdentifyTimeout
+	case "ffmpeg":
+		return FfmpegTimeout
+	}
+	return ConvertTimeout
+}
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StepTiming is how long a pipeline step took
+type StepTiming struct {
+	Step     string
+	Duration time.Duration
+}
+
+// Timings collects the step timings of a request as the pipeline runs,
+// to be reported in a Server-Timing header or trailer
+type Timings struct {
+	mu    sync.Mutex
+	steps []StepTiming
+}
+
+// Record adds how long a step took
+func (t *Timings) Record(step string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.steps = append(t.steps, StepTiming{Step: step, Duration: d})
+}
+
+// Steps returns the steps recorded so far
+func (t *Timings) Steps() []StepTiming {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]StepTiming{}, t.steps...)
+}
+
+// ServerTiming formats the recorded steps, the total and the cache status
+// as a Server-Timing value, e.g.
+// "download;dur=12.5, convert;dur=40.1, total;dur=55.0, cache;desc=miss"
+// https://www.w3.org/TR/server-timing/
+func (t *Timings) ServerTiming(total time.Duration, cache string) string {
+	metrics := []string{}
+	for _, step := range t.Steps() {
+		metrics = append(metrics, serverTimingMetric(step.Step, step.Duration))
+	}
+	metrics = append(metrics, serverTimingMetric("total", total))
+	if cache != "" {
+		metrics = append(metrics, "cache;desc="+cache)
+	}
+	return strings.Join(metrics, ", ")
+}
+
+func serverTimingMetric(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.1f", name, float64(d)/float64(time.Millisecond))
+}
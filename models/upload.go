@@ -0,0 +1,64 @@
+package models
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// ProcessUpload processes an image sent in the request body rather than
+// fetched from a url, for sources that aren't publicly reachable. Uploads
+// are held to the same limits as downloaded sources but aren't cached, as
+// nothing addresses them
+func (p *IMagick) ProcessUpload(w http.ResponseWriter, r *http.Request, body io.Reader, contentType string, args *ProcessArgs) error {
+	tempDir, err := createTemporaryWorkspace()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	inFile := filepath.Join(tempDir, "in")
+	out, err := os.Create(inFile)
+	if err != nil {
+		return err
+	}
+	if MaxSourceBytes > 0 {
+		body = io.LimitReader(body, MaxSourceBytes+1)
+	}
+	written, err := io.Copy(out, body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = checkSourceSize(written); err != nil {
+		return err
+	}
+	if err = checkSourceContent(inFile, written, 0, contentType); err != nil {
+		return err
+	}
+
+	grohl.Log(grohl.Data{
+		"processor": "imagick",
+		"upload":    written,
+	})
+
+	// the download step is all that's left out
+	filePath, err := runPipeline(defaultPipeline[1:], tempDir, inFile, args)
+	if err != nil {
+		return err
+	}
+	if len(args.Degraded) > 0 {
+		setDegradedHeaders(w, args.Degraded)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if err = pushResult(w, args, filePath); err != nil {
+		return err
+	}
+	return serveResult(w, r, filePath, time.Time{}, args)
+}
@@ -0,0 +1,126 @@
+package models
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// VerifyOutput decodes every result before it is served, to catch
+// convert silently writing truncated or corrupt files
+var VerifyOutput bool
+
+// verifyDecodePixels caps the size of results fully decoded by verify,
+// larger ones only have their header and trailer checked
+var verifyDecodePixels = 4 * 1000 * 1000
+
+// trailers end every complete file of each format
+var trailers = map[string][]byte{
+	"jpeg": {0xff, 0xd9},
+	"png":  {0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82},
+	"gif":  {0x3b},
+}
+
+// verifyOutput checks the result is a complete image in the requested
+// format with dimensions the args could have produced. Formats Go can't
+// decode, and videos, are only checked for being non empty
+func verifyOutput(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if !VerifyOutput {
+		return inFile, nil
+	}
+
+	f, err := os.Open(inFile)
+	if err != nil {
+		return inFile, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return inFile, err
+	}
+	if stat.Size() == 0 {
+		return inFile, fmt.Errorf("verify: %s is empty", inFile)
+	}
+	if args.RequestFormat == "mp4" {
+		return inFile, nil
+	}
+
+	config, format, err := image.DecodeConfig(f)
+	if err == image.ErrFormat {
+		return inFile, nil
+	}
+	if err != nil {
+		return inFile, fmt.Errorf("verify: %s", err)
+	}
+	if expected := verifyFormat(args.Format); expected != "" && format != expected {
+		return inFile, fmt.Errorf("verify: expected %s output, got %s", expected, format)
+	}
+	if err = verifyDimensions(config.Width, config.Height, args); err != nil {
+		return inFile, err
+	}
+
+	trailer := trailers[format]
+	tail := make([]byte, len(trailer))
+	if _, err = f.ReadAt(tail, stat.Size()-int64(len(trailer))); err != nil || !bytes.Equal(tail, trailer) {
+		return inFile, fmt.Errorf("verify: %s output is truncated", format)
+	}
+
+	if config.Width*config.Height <= verifyDecodePixels {
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return inFile, err
+		}
+		if _, _, err = image.Decode(f); err != nil {
+			return inFile, fmt.Errorf("verify: %s", err)
+		}
+	}
+	return inFile, nil
+}
+
+func verifyFormat(format string) string {
+	switch format {
+	case "jpg", "jpeg":
+		return "jpeg"
+	case "png", "gif":
+		return format
+	}
+	return ""
+}
+
+// verifyDimensions checks width and height against the cases where the
+// args pin them down: the box of a cover, contain or fill, the one
+// dimension given to a plain resize, or at most the crop when both are.
+// Animated results keep their original canvas so aren't checked
+func verifyDimensions(width int, height int, args *ProcessArgs) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("verify: output is %dx%d", width, height)
+	}
+	if args.Animated {
+		return nil
+	}
+
+	w, h := args.Width, args.Height
+	exact, bounded := false, false
+	switch {
+	case w == 0 && h == 0:
+		return nil
+	case args.Fit == "cover" || args.Fit == "contain" || args.Fit == "pad":
+		exact = w > 0 && h > 0
+	case args.Fit == "fill":
+		exact = w > 0 && h > 0 && args.enlargeFlag() == ""
+	case args.Fit == "inside":
+		bounded = w > 0 && h > 0
+	case args.Fit == "":
+		bounded = w > 0 && h > 0
+		exact = !bounded
+	}
+
+	switch {
+	case exact && ((w > 0 && width != w) || (h > 0 && height != h)):
+		return fmt.Errorf("verify: expected %s output, got %dx%d", geometry(w, h), width, height)
+	case bounded && (width > w || height > h):
+		return fmt.Errorf("verify: expected output within %dx%d, got %dx%d", w, h, width, height)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package models
+
+import (
+	"image"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func writePng(t *testing.T, dir string, width int, height int) string {
+	path := filepath.Join(dir, "out.png")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = png.Encode(f, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyOutput(t *testing.T) {
+	VerifyOutput = true
+	defer func() { VerifyOutput = false }()
+	dir, _ := ioutil.TempDir("", "verify")
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		urlArgs       []string
+		width, height int
+		ok            bool
+	}{
+		{[]string{"64x", "png"}, 64, 40, true},
+		{[]string{"64x", "png"}, 63, 40, false},
+		{[]string{"64x64", "png"}, 64, 30, true},
+		{[]string{"64x64", "png"}, 80, 64, false},
+		{[]string{"64x64", "fit_cover", "png"}, 64, 64, true},
+		{[]string{"64x64", "fit_contain", "png"}, 64, 60, false},
+		{[]string{"64x64", "fit_outside", "png"}, 90, 64, true},
+		{[]string{"64x", "jpg"}, 64, 40, false},
+	}
+	for _, c := range cases {
+		out := writePng(t, dir, c.width, c.height)
+		_, err := verifyOutput(dir, out, NewProcessArgs(c.urlArgs, imgUrl))
+		assert.Equal(t, c.ok, err == nil)
+	}
+}
+
+func TestVerifyOutputTruncated(t *testing.T) {
+	VerifyOutput = true
+	defer func() { VerifyOutput = false }()
+	dir, _ := ioutil.TempDir("", "verify")
+	defer os.RemoveAll(dir)
+
+	out := writePng(t, dir, 32, 32)
+	data, _ := ioutil.ReadFile(out)
+	ioutil.WriteFile(out, data[:len(data)-4], 0644)
+	_, err := verifyOutput(dir, out, NewProcessArgs([]string{"32x", "png"}, imgUrl))
+	assert.NotEqual(t, nil, err)
+
+	ioutil.WriteFile(out, nil, 0644)
+	_, err = verifyOutput(dir, out, NewProcessArgs([]string{"32x", "png"}, imgUrl))
+	assert.NotEqual(t, nil, err)
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// WasmFilterDir holds the operator's WebAssembly filters, each
+// <name>.wasm applied with wasm_<name>. Filters are WASI commands run with
+// wasmtime, reading the decoded frames as 8 bit RGBA on stdin and writing
+// the same number of bytes to stdout. Their arguments are the width,
+// height and frame count. They get no files, network or environment
+var WasmFilterDir string
+
+// WasmFilterTimeout and WasmFilterMaxMemory bound each run of a filter
+var (
+	WasmFilterTimeout   = 10 * time.Second
+	WasmFilterMaxMemory = int64(256 << 20)
+)
+
+var wasmFilterRgx = regexp.MustCompile(`^wasm_([a-z0-9][a-z0-9_-]{0,31})$`)
+
+// wasmFilters are the ids of the filters in WasmFilterDir by name, the
+// sha prefix of each module so results are cached apart when it changes
+var wasmFilters = map[string]string{}
+
+// InitWasmFilters loads the filters in dir, or turns them off when dir is
+// empty
+func InitWasmFilters(dir string) error {
+	WasmFilterDir, wasmFilters = dir, map[string]string{}
+	if dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.wasm"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+		if !wasmFilterRgx.MatchString("wasm_" + name) {
+			return fmt.Errorf("wasm filter %s isn't named with lowercase letters, digits, _ and -", path)
+		}
+		hash, err := fileSha256(path)
+		if err != nil {
+			return err
+		}
+		wasmFilters[name] = hash[:16]
+	}
+	grohl.Log(grohl.Data{"action": "load-wasm-filters", "dir": dir, "filters": len(wasmFilters)})
+	return nil
+}
+
+// CheckWasmFilter returns an error if the requested filter isn't loaded
+func (p *ProcessArgs) CheckWasmFilter() error {
+	if p.WasmFilter != "" && p.WasmFilterId == "" {
+		return fmt.Errorf("wasm filter %s doesn't exist", p.WasmFilter)
+	}
+	return nil
+}
+
+// WasmFilterArgs run the filter over frames, the raw RGBA of every frame
+func WasmFilterArgs(name string, width int, height int, frames int) []string {
+	return []string{
+		"run",
+		"-W", "max-memory-size=" + strconv.FormatInt(WasmFilterMaxMemory, 10),
+		"-W", "timeout=" + strconv.Itoa(int(WasmFilterTimeout/time.Millisecond)) + "ms",
+		filepath.Join(WasmFilterDir, name+".wasm"),
+		strconv.Itoa(width), strconv.Itoa(height), strconv.Itoa(frames),
+	}
+}
+
+// filterWasm decodes every frame of inFile to RGBA, passes them through
+// the requested filter and puts the filtered pixels back in place of the
+// originals, keeping each frame's timing
+func filterWasm(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if args.WasmFilter == "" {
+		return inFile, nil
+	}
+	if err := args.CheckWasmFilter(); err != nil {
+		return inFile, &StatusError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	width, height, err := identifyDimensions(args.ctx(), inFile)
+	if err != nil {
+		return inFile, err
+	}
+
+	rawFile := filepath.Join(tempDir, "frames.rgba")
+	err = runWasmConvert(args, "decode", inFile, "-coalesce", "+repage", "-depth", "8", "rgba:"+rawFile)
+	if err != nil {
+		return inFile, err
+	}
+	info, err := os.Stat(rawFile)
+	if err != nil {
+		return inFile, err
+	}
+	frameBytes := int64(width) * int64(height) * 4
+	if frameBytes == 0 || info.Size()%frameBytes != 0 {
+		return inFile, fmt.Errorf("decoded %d bytes of %dx%d frames", info.Size(), width, height)
+	}
+
+	filteredFile := filepath.Join(tempDir, "filtered.rgba")
+	err = runWasmFilter(args, rawFile, filteredFile, width, height, int(info.Size()/frameBytes))
+	if err != nil {
+		return inFile, err
+	}
+
+	outFile := filepath.Join(tempDir, "wasm"+filepath.Ext(inFile))
+	err = runWasmConvert(args, "encode",
+		inFile, "-coalesce", "+repage",
+		"null:",
+		"(", "-size", fmt.Sprintf("%dx%d", width, height), "-depth", "8", "rgba:"+filteredFile, ")",
+		"-compose", "Src", "-layers", "composite",
+		outFile)
+	return outFile, err
+}
+
+// runWasmFilter runs the filter named in args over inFile into outFile,
+// which must come out the same size
+func runWasmFilter(args *ProcessArgs, inFile string, outFile string, width int, height int, frames int) error {
+	in, err := os.Open(inFile)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(outFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	// wasmtime enforces the timeout itself, this only catches a stuck runtime
+	ctx, cancel := context.WithTimeout(args.ctx(), 2*WasmFilterTimeout)
+	defer cancel()
+	cmdArgs := WasmFilterArgs(args.WasmFilter, width, height, frames)
+	cmd := delegateCommand(ctx, "wasmtime", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, out, &outErr
+	start := time.Now()
+	err = runLimited(ctx, cmd, args.Priority)
+	grohl.Counter(1.0, "wasm_filter.ms", int(time.Since(start)/time.Millisecond))
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "wasm",
+			"step":      "filter",
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+		return statusErrorf(http.StatusUnprocessableEntity, "wasm filter %s failed: %s", args.WasmFilter, strings.TrimSpace(outErr.String()))
+	}
+
+	inInfo, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	outInfo, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	if outInfo.Size() != inInfo.Size() {
+		return statusErrorf(http.StatusUnprocessableEntity, "wasm filter %s wrote %d bytes for %d", args.WasmFilter, outInfo.Size(), inInfo.Size())
+	}
+	return nil
+}
+
+func runWasmConvert(args *ProcessArgs, step string, cmdArgs ...string) error {
+	ctx, cancel := context.WithTimeout(args.ctx(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err := runLimited(ctx, cmd, args.Priority)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "wasm-" + step,
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+	}
+	return err
+}
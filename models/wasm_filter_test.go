@@ -0,0 +1,75 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestWasmFilterArgs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "duotone.wasm"), []byte("\x00asm"), 0644)
+	assert.Equal(t, nil, InitWasmFilters(dir))
+	defer InitWasmFilters("")
+
+	args := NewProcessArgs([]string{"128x", "wasm_duotone"}, imgUrl)
+	assert.Equal(t, "duotone", args.WasmFilter)
+	assert.Equal(t, nil, args.CheckWasmFilter())
+	assert.T(t, args.HasOperations())
+	assert.NotEqual(t, NewProcessArgs([]string{"128x"}, imgUrl).CacheKey(), args.CacheKey())
+	_, ok := mipmapBase(args)
+	assert.T(t, !ok)
+
+	missing := NewProcessArgs([]string{"wasm_glitch"}, imgUrl)
+	assert.Equal(t, "wasm filter glitch doesn't exist", missing.CheckWasmFilter().Error())
+
+	// a changed module is cached apart
+	key := args.CacheKey()
+	ioutil.WriteFile(filepath.Join(dir, "duotone.wasm"), []byte("\x00asm\x01"), 0644)
+	InitWasmFilters(dir)
+	assert.NotEqual(t, key, NewProcessArgs([]string{"128x", "wasm_duotone"}, imgUrl).CacheKey())
+
+	ioutil.WriteFile(filepath.Join(dir, "Bad Name.wasm"), []byte("\x00asm"), 0644)
+	assert.NotEqual(t, nil, InitWasmFilters(dir))
+}
+
+func TestRunWasmFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// stand ins for wasmtime, one passing the pixels through and one
+	// dropping the last of them
+	identity := filepath.Join(dir, "wasmtime")
+	ioutil.WriteFile(identity, []byte("#!/bin/sh\ncat\n"), 0755)
+	short := filepath.Join(dir, "wasmtime-short")
+	ioutil.WriteFile(short, []byte("#!/bin/sh\nhead -c 4\n"), 0755)
+	failing := filepath.Join(dir, "wasmtime-failing")
+	ioutil.WriteFile(failing, []byte("#!/bin/sh\necho 'wasm trap: out of bounds memory access' >&2\nexit 134\n"), 0755)
+	defer ConfigureDelegate("wasmtime", "", "")
+
+	in := filepath.Join(dir, "frames.rgba")
+	ioutil.WriteFile(in, make([]byte, 2*2*4), 0644)
+	out := filepath.Join(dir, "filtered.rgba")
+	args := &ProcessArgs{WasmFilter: "duotone", WasmFilterId: "abc"}
+
+	ConfigureDelegate("wasmtime", identity, "")
+	assert.Equal(t, nil, runWasmFilter(args, in, out, 2, 2, 1))
+
+	ConfigureDelegate("wasmtime", short, "")
+	err = runWasmFilter(args, in, out, 2, 2, 1)
+	assert.Equal(t, 422, err.(*StatusError).Status)
+
+	ConfigureDelegate("wasmtime", failing, "")
+	err = runWasmFilter(args, in, out, 2, 2, 1)
+	assert.Equal(t, 422, err.(*StatusError).Status)
+	assert.Equal(t, "wasm filter duotone failed: wasm trap: out of bounds memory access", err.(*StatusError).Message)
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/technoweenie/grohl"
+)
+
+// WatermarkFile is composited onto every image served to requests that
+// aren't signed or authenticated when set, so a public deployment can't be
+// used as a free CDN of clean images
+var WatermarkFile string
+
+// WatermarkGravity is where on the image the watermark goes
+var WatermarkGravity = "southeast"
+
+// watermarkGravities are the gravities ImageMagick places images by
+var watermarkGravities = map[string]bool{
+	"northwest": true, "north": true, "northeast": true,
+	"west": true, "center": true, "east": true,
+	"southwest": true, "south": true, "southeast": true,
+}
+
+// watermarkId identifies the contents of WatermarkFile, so results are
+// cached apart from clean ones and replaced along with the watermark
+var watermarkId string
+
+// InitWatermark sets the watermark forced on unauthenticated requests, or
+// turns the policy off when file is empty
+func InitWatermark(file string, gravity string) error {
+	WatermarkFile, watermarkId = "", ""
+	if gravity != "" {
+		if !watermarkGravities[gravity] {
+			return fmt.Errorf("unknown watermark gravity %q", gravity)
+		}
+		WatermarkGravity = gravity
+	}
+	if file == "" {
+		return nil
+	}
+	hash, err := fileSha256(file)
+	if err != nil {
+		return err
+	}
+	WatermarkFile, watermarkId = file, hash[:16]
+	return nil
+}
+
+// ApplyWatermarkPolicy marks the args of requests that aren't signed or
+// authenticated for watermarking, when a watermark is configured
+func (p *ProcessArgs) ApplyWatermarkPolicy(authenticated bool) {
+	if WatermarkFile != "" && !authenticated {
+		p.Watermark = watermarkId
+	}
+}
+
+// WatermarkArgs composite the watermark onto every frame of inFile, scaled
+// down to at most a quarter of its width
+func (p *ProcessArgs) WatermarkArgs(inFile string, outFile string, width int) []string {
+	return []string{
+		inFile, "-coalesce",
+		"null:",
+		"(", WatermarkFile, "-resize", fmt.Sprintf("%dx>", max(width/4, 1)), ")",
+		"-gravity", WatermarkGravity, "-geometry", "+8+8",
+		"-layers", "composite",
+		outFile,
+	}
+}
+
+func watermarkImage(tempDir string, inFile string, args *ProcessArgs) (string, error) {
+	if args.Watermark == "" {
+		return inFile, nil
+	}
+
+	width, _, err := identifyDimensions(args.ctx(), inFile)
+	if err != nil {
+		return inFile, err
+	}
+	outFile := filepath.Join(tempDir, "watermarked"+filepath.Ext(inFile))
+	cmdArgs := args.WatermarkArgs(inFile, outFile, width)
+
+	ctx, cancel := context.WithTimeout(args.ctx(), ConvertTimeout)
+	defer cancel()
+	cmd := delegateCommand(ctx, "convert", cmdArgs...)
+	var outErr outputBuffer
+	cmd.Stdout, cmd.Stderr = &outErr, &outErr
+	err = runLimited(ctx, cmd, args.Priority)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"processor": "imagick",
+			"step":      "watermark",
+			"failure":   err,
+			"args":      cmdArgs,
+			"output":    outErr.String(),
+		})
+	}
+	return outFile, err
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestWatermarkPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "_firesize_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "watermark.png")
+	ioutil.WriteFile(file, []byte("watermark"), 0644)
+	defer InitWatermark("", "southeast")
+
+	assert.NotEqual(t, nil, InitWatermark(file, "middle"))
+	assert.Equal(t, nil, InitWatermark(file, "northwest"))
+
+	clean := NewProcessArgs([]string{}, "http://example.com/cat.jpg")
+	clean.ApplyWatermarkPolicy(true)
+	assert.Equal(t, "", clean.Watermark)
+	assert.Equal(t, false, clean.HasOperations())
+
+	// the original can't be proxied to unauthenticated requests
+	args := NewProcessArgs([]string{}, "http://example.com/cat.jpg")
+	args.ApplyWatermarkPolicy(false)
+	assert.NotEqual(t, "", args.Watermark)
+	assert.Equal(t, true, args.HasOperations())
+	assert.NotEqual(t, clean.CacheKey(), args.CacheKey())
+
+	assert.Equal(t, []string{
+		"in.png", "-coalesce", "null:",
+		"(", file, "-resize", "160x>", ")",
+		"-gravity", "northwest", "-geometry", "+8+8",
+		"-layers", "composite", "out.png",
+	}, args.WatermarkArgs("in.png", "out.png", 640))
+
+	// a new watermark replaces cached results
+	key := args.CacheKey()
+	ioutil.WriteFile(file, []byte("new watermark"), 0644)
+	InitWatermark(file, "")
+	args.ApplyWatermarkPolicy(false)
+	assert.NotEqual(t, key, args.CacheKey())
+}
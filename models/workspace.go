@@ -0,0 +1,87 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/technoweenie/grohl"
+)
+
+// workspacePrefix names the temporary directories sources are processed in
+const workspacePrefix = "_firesize"
+
+// WorkspaceMaxAge is how long a workspace can go unmodified before the
+// janitor assumes whatever was using it died and removes it
+var WorkspaceMaxAge = time.Hour
+
+var workspaceJanitorEvery = 10 * time.Minute
+
+func createTemporaryWorkspace() (string, error) {
+	return ioutil.TempDir("", workspacePrefix)
+}
+
+// StartWorkspaceJanitor removes workspaces left behind by crashed or
+// killed processes, once at boot and then periodically in the background
+func StartWorkspaceJanitor() {
+	sweepWorkspaces(os.TempDir(), time.Now())
+	go func() {
+		for range time.Tick(workspaceJanitorEvery) {
+			sweepWorkspaces(os.TempDir(), time.Now())
+		}
+	}()
+}
+
+// sweepWorkspaces removes workspaces in dir older than WorkspaceMaxAge,
+// other than those holding job results. Returns the bytes reclaimed
+func sweepWorkspaces(dir string, now time.Time) int64 {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		grohl.Log(grohl.Data{
+			"action":  "sweep-workspaces",
+			"failure": err,
+		})
+		return 0
+	}
+
+	inUse := jobWorkspaces()
+	removed := 0
+	var reclaimed int64
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), workspacePrefix) ||
+			now.Sub(entry.ModTime()) < WorkspaceMaxAge || inUse[path] {
+			continue
+		}
+		size := dirSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			continue
+		}
+		removed++
+		reclaimed += size
+	}
+
+	if removed > 0 {
+		grohl.Counter(1.0, "workspaces.reclaimed_bytes", int(reclaimed))
+		grohl.Log(grohl.Data{
+			"action":     "sweep-workspaces",
+			"workspaces": removed,
+			"reclaimed":  reclaimed,
+		})
+	}
+	return reclaimed
+}
+
+// dirSize totals the size of the files under dir
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestSweepWorkspaces(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sweep")
+	defer os.RemoveAll(dir)
+
+	workspace := func(name string, age time.Duration) string {
+		path := filepath.Join(dir, name)
+		os.Mkdir(path, 0755)
+		ioutil.WriteFile(filepath.Join(path, "in"), make([]byte, 100), 0644)
+		modified := time.Now().Add(-age)
+		os.Chtimes(path, modified, modified)
+		return path
+	}
+	stale := workspace("_firesize123", 2*time.Hour)
+	fresh := workspace("_firesize456", time.Minute)
+	other := workspace("somebody-else", 2*time.Hour)
+	held := workspace("_firesize789", 2*time.Hour)
+
+	job := &Job{Id: "sweep-test", tempDir: held}
+	jobs.Lock()
+	jobs.byId[job.Id] = job
+	jobs.Unlock()
+	defer func() {
+		jobs.Lock()
+		delete(jobs.byId, job.Id)
+		jobs.Unlock()
+	}()
+
+	assert.Equal(t, int64(100), sweepWorkspaces(dir, time.Now()))
+	for path, exists := range map[string]bool{stale: false, fresh: true, other: true, held: true} {
+		_, err := os.Stat(path)
+		assert.Equal(t, exists, err == nil)
+	}
+}
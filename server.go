@@ -1,13 +1,19 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/asm-products/firesize/addon"
 	"github.com/asm-products/firesize/controllers"
+	"github.com/asm-products/firesize/loadgen"
 	"github.com/asm-products/firesize/models"
 	"github.com/asm-products/firesize/templates"
 	"github.com/codegangsta/negroni"
@@ -15,6 +21,24 @@ import (
 )
 
 func main() {
+	configureProcessing()
+	delegatesErr := models.LocateDelegates()
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		doctor()
+		return
+	}
+	if delegatesErr != nil {
+		panic(delegatesErr)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "manifest" {
+		processManifest()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		runLoadgen(os.Args[2:])
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "3000"
@@ -24,6 +48,28 @@ func main() {
 	templates.Init("templates")
 	models.InitDb(os.Getenv("DATABASE_URL"))
 	addon.Init(os.Getenv("HEROKU_ID"), os.Getenv("HEROKU_API_PASSWORD"), os.Getenv("HEROKU_SSO_SALT"))
+	models.InitCdn(os.Getenv("CDN_PROVIDER"), os.Getenv("CDN_API_TOKEN"), os.Getenv("CDN_SERVICE_ID"))
+	models.InitEvents(os.Getenv("EVENT_SINK_URL"))
+	models.StartInvalidationSubscriber(os.Getenv("INVALIDATION_SUBSCRIBE_URL"))
+	models.StartJobCleanup()
+	models.StartWorkspaceJanitor()
+	if err := models.LoadApiKeys(os.Getenv("API_KEYS"), os.Getenv("API_KEYS_FILE")); err != nil {
+		panic(err)
+	}
+	models.ApiKeysFromDb = os.Getenv("API_KEYS_FROM_DB") == "true"
+	models.AdminToken = os.Getenv("ADMIN_TOKEN")
+	models.ServiceModeFromDb = os.Getenv("SERVICE_MODE_FROM_DB") == "true"
+	models.StartServiceModeRefresh()
+	models.Environment = os.Getenv("FIRESIZE_ENV")
+	if err := models.LoadFeatureFlags(os.Getenv("FEATURE_FLAGS"), os.Getenv("FEATURE_FLAGS_FILE")); err != nil {
+		panic(err)
+	}
+	models.FeatureFlagsUrl = os.Getenv("FEATURE_FLAGS_URL")
+	models.StartFeatureFlagsRefresh()
+	models.BearerSecret = []byte(os.Getenv("BEARER_SECRET"))
+	if err := models.LoadBearerPublicKey(os.Getenv("BEARER_PUBLIC_KEY"), os.Getenv("BEARER_PUBLIC_KEY_FILE")); err != nil {
+		panic(err)
+	}
 
 	rand.Seed(time.Now().UTC().UnixNano())
 
@@ -31,16 +77,328 @@ func main() {
 	r.SkipClean(true) // have to use whatupdave/mux until Gorilla supports this
 
 	new(controllers.AccountsController).Init(r)
+	new(controllers.BatchesController).Init(r)
+	new(controllers.CachePurgesController).Init(r)
 	new(controllers.HerokuResourcesController).Init(r)
 	new(controllers.HomeController).Init(r)
 	new(controllers.ImagesController).Init(r)
+	new(controllers.JobsController).Init(r)
+	new(controllers.ManifestsController).Init(r)
+	new(controllers.PurgesController).Init(r)
 	new(controllers.RegistrationsController).Init(r)
+	new(controllers.ServiceModeController).Init(r)
 	new(controllers.SessionsController).Init(r)
 	new(controllers.SsoSessionsController).Init(r)
 
 	r.PathPrefix("/").Handler(http.FileServer(http.Dir("static")))
 
 	n := negroni.Classic()
+	corsMaxAge, _ := strconv.Atoi(os.Getenv("CORS_MAX_AGE"))
+	n.Use(controllers.NewCors(os.Getenv("CORS_ALLOWED_ORIGINS"), os.Getenv("CORS_ALLOWED_METHODS"),
+		os.Getenv("CORS_ALLOWED_HEADERS"), corsMaxAge))
+	maxRequestTimeout, err := time.ParseDuration(os.Getenv("MAX_REQUEST_TIMEOUT"))
+	if err != nil {
+		maxRequestTimeout = 30 * time.Second
+	}
+	n.Use(controllers.NewRequestDeadline(maxRequestTimeout))
+	n.Use(controllers.NewServiceModeGuard())
+	n.Use(controllers.NewApiKeyAuth())
+	n.Use(controllers.NewIdempotency(24 * time.Hour))
 	n.UseHandler(r)
 	n.Run(host + ":" + port)
 }
+
+// configureProcessing reads the image processing settings from the
+// environment
+func configureProcessing() {
+	for _, name := range models.DelegateNames() {
+		env := strings.ToUpper(name)
+		models.ConfigureDelegate(name, os.Getenv(env+"_PATH"), os.Getenv(env+"_PREFIX"))
+	}
+	models.DelegateNice, _ = strconv.Atoi(os.Getenv("DELEGATE_NICE"))
+	models.DelegateIoniceClass, _ = strconv.Atoi(os.Getenv("DELEGATE_IONICE_CLASS"))
+	models.DelegateIoniceLevel, _ = strconv.Atoi(os.Getenv("DELEGATE_IONICE_LEVEL"))
+	models.CgroupRoot = os.Getenv("CGROUP_ROOT")
+	for _, priority := range []string{models.PriorityInteractive, models.PriorityBatch} {
+		env := "CGROUP_" + strings.ToUpper(priority)
+		models.CgroupLimits[priority] = models.CgroupLimit{
+			MemoryMax: os.Getenv(env + "_MEMORY_MAX"),
+			CpuMax:    os.Getenv(env + "_CPU_MAX"),
+		}
+	}
+	if err := models.InitCgroups(); err != nil {
+		panic(err)
+	}
+	models.FfmpegDownloadUrl = os.Getenv("FFMPEG_DOWNLOAD_URL")
+	models.FfmpegDownloadSha256 = os.Getenv("FFMPEG_DOWNLOAD_SHA256")
+	models.SigningKey = os.Getenv("SIGNING_KEY")
+	models.SigningKeys = models.ParseSigningKeys(os.Getenv("SIGNING_KEYS"))
+	models.SigningKeyId = os.Getenv("SIGNING_KEY_ID")
+	models.SourceAllowlist = models.ParseHostPatterns(os.Getenv("SOURCE_ALLOWLIST"))
+	models.SourceDenylist = models.ParseHostPatterns(os.Getenv("SOURCE_DENYLIST"))
+	models.SourceAllowedNetworks = models.ParseNetworks(os.Getenv("SOURCE_ALLOWED_NETWORKS"))
+	models.SourceChecksums = models.ParseSourceChecksums(os.Getenv("SOURCE_CHECKSUM_HEADERS"))
+	models.RawConvertFlags = models.ParseRawConvertFlags(os.Getenv("RAW_CONVERT_FLAGS"))
+	if err := models.InitOverLimitAction(os.Getenv("OVER_LIMIT_ACTION")); err != nil {
+		panic(err)
+	}
+	routes, err := models.ParseSourceRoutes(os.Getenv("SOURCE_ROUTES"))
+	if err != nil {
+		panic(err)
+	}
+	models.SourceRoutes = routes
+	sourceHeaders, err := models.ParseSourceHeaders(os.Getenv("SOURCE_HEADERS"))
+	if err != nil {
+		panic(err)
+	}
+	models.SourceHeaders = sourceHeaders
+	if max, err := strconv.Atoi(os.Getenv("SOURCE_MAX_REDIRECTS")); err == nil {
+		models.SourceMaxRedirects = max
+	}
+	models.SourceSameHostRedirects = os.Getenv("SOURCE_SAME_HOST_REDIRECTS") == "true"
+	for env, timeout := range map[string]*time.Duration{
+		"DOWNLOAD_TIMEOUT": &models.DownloadTimeout,
+		"IDENTIFY_TIMEOUT": &models.IdentifyTimeout,
+		"CONVERT_TIMEOUT":  &models.ConvertTimeout,
+		"FFMPEG_TIMEOUT":   &models.FfmpegTimeout,
+	} {
+		if d, err := time.ParseDuration(os.Getenv(env)); err == nil {
+			*timeout = d
+		}
+	}
+	if retries, err := strconv.Atoi(os.Getenv("SOURCE_RETRIES")); err == nil {
+		models.SourceRetries = retries
+	}
+	if backoff, err := time.ParseDuration(os.Getenv("SOURCE_RETRY_BACKOFF")); err == nil {
+		models.SourceRetryBackoff = backoff
+	}
+	if statuses := os.Getenv("SOURCE_RETRY_STATUSES"); statuses != "" {
+		codes, err := models.ParseStatusCodes(statuses)
+		if err != nil {
+			panic(err)
+		}
+		models.SourceRetryStatuses = codes
+	}
+	if region := os.Getenv("S3_SOURCE_REGION"); region != "" {
+		models.S3SourceRegion = region
+	}
+	if window, err := time.ParseDuration(os.Getenv("DOWNLOAD_SHARE_WINDOW")); err == nil {
+		models.DownloadShareWindow = window
+	}
+	models.S3SourceEndpoint = os.Getenv("S3_SOURCE_ENDPOINT")
+	models.S3SourceBuckets = models.BucketAllowlist(models.ParseHostPatterns(os.Getenv("S3_SOURCE_BUCKETS")))
+	if endpoint := os.Getenv("GCS_SOURCE_ENDPOINT"); endpoint != "" {
+		models.GcsSourceEndpoint = endpoint
+	}
+	sftpLogins, err := models.ParseSftpSourceLogins(os.Getenv("SFTP_SOURCE_LOGINS"))
+	if err != nil {
+		panic(err)
+	}
+	models.SftpSourceLogins = sftpLogins
+	models.AzblobSourceEndpoint = os.Getenv("AZBLOB_SOURCE_ENDPOINT")
+	models.AzblobSourceContainers = models.BucketAllowlist(models.ParseHostPatterns(os.Getenv("AZBLOB_SOURCE_CONTAINERS")))
+	if err := models.InitAzblobSources(os.Getenv("AZURE_STORAGE_ACCOUNT"), os.Getenv("AZURE_STORAGE_KEY"), os.Getenv("AZURE_STORAGE_SAS_TOKEN")); err != nil {
+		panic(err)
+	}
+	models.GcsSourceBuckets = models.BucketAllowlist(models.ParseHostPatterns(os.Getenv("GCS_SOURCE_BUCKETS")))
+	if err := models.InitGcsSources(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")); err != nil {
+		panic(err)
+	}
+	if err := models.InitLocalSourceRoot(os.Getenv("LOCAL_SOURCE_ROOT")); err != nil {
+		panic(err)
+	}
+	if timeout, err := time.ParseDuration(os.Getenv("WASM_FILTER_TIMEOUT")); err == nil {
+		models.WasmFilterTimeout = timeout
+	}
+	if max, err := strconv.ParseInt(os.Getenv("WASM_FILTER_MAX_MEMORY"), 10, 64); err == nil {
+		models.WasmFilterMaxMemory = max
+	}
+	models.SuperResolutionBackend = os.Getenv("SUPER_RESOLUTION_BACKEND")
+	if max, err := strconv.Atoi(os.Getenv("SUPER_RESOLUTION_MAX_PIXELS")); err == nil {
+		models.SuperResolutionMaxPixels = max
+	}
+	if limit, err := strconv.Atoi(os.Getenv("SUPER_RESOLUTION_RATE_LIMIT")); err == nil {
+		models.SuperResolutionRateLimit = limit
+	}
+	if err := models.InitWasmFilters(os.Getenv("WASM_FILTER_DIR")); err != nil {
+		panic(err)
+	}
+	if err := models.InitWatermark(os.Getenv("WATERMARK_FILE"), os.Getenv("WATERMARK_GRAVITY")); err != nil {
+		panic(err)
+	}
+	models.DeterministicOutput = os.Getenv("DETERMINISTIC_OUTPUT") == "true"
+	models.StripMetadata = os.Getenv("STRIP_METADATA") == "true"
+	models.VerifyOutput = os.Getenv("VERIFY_OUTPUT") == "true"
+	models.SrgbProfile = os.Getenv("SRGB_PROFILE")
+	models.CmykProfile = os.Getenv("CMYK_PROFILE")
+	if max, err := strconv.ParseInt(os.Getenv("CONTENT_STORE_MAX_BYTES"), 10, 64); err == nil {
+		models.ContentStoreMaxBytes = max
+	}
+	if cacheControl := os.Getenv("CACHE_CONTROL"); cacheControl != "" {
+		models.CacheControl = cacheControl
+	}
+	if surrogateControl, ok := os.LookupEnv("SURROGATE_CONTROL"); ok {
+		models.SurrogateControl = surrogateControl
+	}
+	models.InitContentStore(os.Getenv("CONTENT_STORE_DIR"))
+	models.InitResultCache(os.Getenv("CACHE_URL"))
+	models.InitPushStore(os.Getenv("PUSH_URL"))
+	if template := os.Getenv("PUSH_NAME_TEMPLATE"); template != "" {
+		if err := models.CheckPushNameTemplate(template); err != nil {
+			panic(err)
+		}
+		models.PushNameTemplate = template
+	}
+	if max, err := strconv.ParseInt(os.Getenv("MEMORY_CACHE_MAX_ENTRY_BYTES"), 10, 64); err == nil {
+		models.MemoryCacheMaxEntryBytes = max
+	}
+	if hits, err := strconv.Atoi(os.Getenv("MEMORY_CACHE_MIN_HITS")); err == nil {
+		models.MemoryCacheMinHits = hits
+	}
+	memoryCacheMax, _ := strconv.ParseInt(os.Getenv("MEMORY_CACHE_MAX_BYTES"), 10, 64)
+	models.InitMemoryCache(memoryCacheMax)
+	if max, err := strconv.ParseInt(os.Getenv("MAX_SOURCE_BYTES"), 10, 64); err == nil {
+		models.MaxSourceBytes = max
+	}
+	if max, err := strconv.ParseInt(os.Getenv("MAX_SOURCE_PIXELS"), 10, 64); err == nil {
+		models.MaxSourcePixels = max
+	}
+	if max, err := strconv.Atoi(os.Getenv("MAX_SOURCE_FRAMES")); err == nil {
+		models.MaxSourceFrames = max
+	}
+	if max, err := strconv.Atoi(os.Getenv("MAX_DIMENSION")); err == nil {
+		models.MaxDimension = max
+	}
+	if min, err := strconv.Atoi(os.Getenv("MIPMAP_MIN_WIDTH")); err == nil {
+		models.MipmapMinWidth = min
+	}
+	if max, err := strconv.Atoi(os.Getenv("MAX_DOWNLOAD_RESUMES")); err == nil {
+		models.MaxDownloadResumes = max
+	}
+	if maxAge, err := time.ParseDuration(os.Getenv("WORKSPACE_MAX_AGE")); err == nil {
+		models.WorkspaceMaxAge = maxAge
+	}
+	if max, err := strconv.ParseInt(os.Getenv("INLINE_MAX_BYTES"), 10, 64); err == nil {
+		models.InlineMaxBytes = max
+	}
+	if quality, err := strconv.Atoi(os.Getenv("SAVE_DATA_QUALITY")); err == nil {
+		models.SaveDataQuality = quality
+	}
+	if scale, err := strconv.ParseFloat(os.Getenv("SAVE_DATA_SCALE"), 64); err == nil {
+		models.SaveDataScale = scale
+	}
+	if header := os.Getenv("REGION_HEADER"); header != "" {
+		models.RegionHeader = header
+	}
+	models.RegionPresets = models.ParseRegionPresets(os.Getenv("REGION_PRESETS"))
+	if buckets := os.Getenv("CLIENT_HINT_BUCKETS"); buckets != "" {
+		models.ClientHintBuckets = parseInts(buckets)
+	}
+	if ttl, err := time.ParseDuration(os.Getenv("JOB_RETENTION")); err == nil {
+		models.JobRetention = ttl
+	}
+	if max, err := strconv.Atoi(os.Getenv("JOB_MAX_PER_ACCOUNT")); err == nil {
+		models.JobMaxPerAccount = max
+	}
+}
+
+// processManifest reads a static site build manifest from stdin and writes
+// the generated outputs to stdout, for running as a build step:
+//
+//	firesize manifest < images.json > generated.json
+func processManifest() {
+	var manifest models.BuildManifest
+	err := json.NewDecoder(os.Stdin).Decode(&manifest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	outputs := models.ProcessManifest(&manifest)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(map[string]interface{}{"outputs": outputs})
+
+	for _, output := range outputs {
+		if output.Error != "" {
+			os.Exit(1)
+		}
+	}
+}
+
+// doctor runs the self test and exits non-zero if anything is broken:
+//
+//	firesize doctor
+func doctor() {
+	failed := false
+	for _, check := range models.RunDoctor("fixtures") {
+		status := "ok"
+		if !check.Ok {
+			status, failed = "FAIL", true
+		}
+		fmt.Printf("%-4s  %-14s %s\n", status, check.Name, check.Detail)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runLoadgen generates mixed traffic against a running instance and
+// reports latency percentiles:
+//
+//	firesize loadgen -target http://localhost:3000 -duration 1m -concurrency 20 \
+//	  -static http://example.com/a.jpg,http://example.com/b.png -animated http://example.com/c.gif
+func runLoadgen(args []string) {
+	flags := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	target := flags.String("target", "http://localhost:3000", "firesize instance to load")
+	duration := flags.Duration("duration", time.Minute, "how long to generate traffic for")
+	concurrency := flags.Int("concurrency", 10, "concurrent requests")
+	static := flags.String("static", "", "comma separated static source urls")
+	animated := flags.String("animated", "", "comma separated animated source urls")
+	animatedRatio := flags.Float64("animated-ratio", 0.1, "share of requests for animated sources")
+	apiKey := flags.String("key", os.Getenv("LOADGEN_API_KEY"), "API key to send")
+	flags.Parse(args)
+
+	config := &loadgen.Config{
+		Target:          *target,
+		Duration:        *duration,
+		Concurrency:     *concurrency,
+		StaticSources:   splitList(*static),
+		AnimatedSources: splitList(*animated),
+		AnimatedRatio:   *animatedRatio,
+		ApiKey:          *apiKey,
+	}
+	if models.SigningRequired() {
+		config.Sign = models.TransformPath
+	}
+	if len(config.StaticSources) == 0 && len(config.AnimatedSources) == 0 {
+		fmt.Fprintln(os.Stderr, "loadgen needs -static or -animated sources")
+		os.Exit(2)
+	}
+
+	start := time.Now()
+	results := loadgen.Run(config)
+	loadgen.Report(os.Stdout, results, time.Since(start))
+}
+
+func splitList(list string) []string {
+	items := []string{}
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseInts(list string) []int {
+	ints := []int{}
+	for _, s := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			panic(err)
+		}
+		ints = append(ints, i)
+	}
+	return ints
+}